@@ -3,33 +3,47 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/vladimirruppel/messengor/internal/protocol"
 )
 
 var (
 	addr         = flag.String("addr", "localhost:8088", "http service address")
+	encoding     = flag.String("encoding", "json", "wire encoding to request from the server: json or binary")
 	conn         *websocket.Conn
+	codec        protocol.Codec = protocol.JSONCodec{} // Кодировка, согласованная с сервером
 	mu           sync.Mutex
 	loggedInUser struct {
 		ID          string
 		DisplayName string
 		Token       string
+		Role        string
+		Permissions []string // Права от сервера; по ним /help показывает доступные команды
 	}
 	isAuthenticated = false
 	currentChatID   = "global_broadcast"
-	knownUsers      = make(map[string]protocol.UserInfo) // UserID -> UserInfo
+	knownUsers      = make(map[string]protocol.UserInfo)    // UserID -> UserInfo
+	sentMessages    = make(map[string]string)               // MessageID -> текст наших личных сообщений, ожидающих прочтения
+	lastSeqs        = make(map[string]uint64)               // ChatID -> seq последнего полученного сообщения, для SYNC_REQUEST
+	knownGroups     = make(map[string]protocol.GroupInfo)   // ChatID -> группа, в которой состоит пользователь
+	showGroupList   = false                                 // Напечатать ответ LIST_GROUPS_RESPONSE (запрошен командой /group list)
+	knownChannels   = make(map[string]protocol.ChannelInfo) // Название -> канал, в котором состоит пользователь
+	showChannelList = false                                 // Напечатать ответ LIST_CHANNELS_RESPONSE (запрошен командой /channel list)
 	inputPrompt     = "> "
 )
 
@@ -47,6 +61,317 @@ func generatePrivateChatIDClient(userID1, userID2 string) (string, error) {
 	return fmt.Sprintf("private:%s:%s", ids[0], ids[1]), nil
 }
 
+// resetSession забывает данные вошедшего пользователя и возвращает клиент
+// к набору команд для неаутентифицированного пользователя.
+func resetSession() {
+	loggedInUser.ID = ""
+	loggedInUser.DisplayName = ""
+	loggedInUser.Token = ""
+	loggedInUser.Role = ""
+	loggedInUser.Permissions = nil
+	isAuthenticated = false
+	currentChatID = "global_broadcast"
+	knownUsers = make(map[string]protocol.UserInfo)
+	sentMessages = make(map[string]string)
+	lastSeqs = make(map[string]uint64)
+	knownGroups = make(map[string]protocol.GroupInfo)
+	knownChannels = make(map[string]protocol.ChannelInfo)
+	pendingSendsMu.Lock()
+	pendingSends = nil
+	pendingSendsMu.Unlock()
+	updatePrompt()
+}
+
+// noteSeq запоминает seq полученного сообщения чата.
+func noteSeq(chatID string, seq uint64) {
+	if seq > lastSeqs[chatID] {
+		lastSeqs[chatID] = seq
+	}
+}
+
+// requestSync просит сервер дослать сообщения, пришедшие в известные клиенту чаты после последних
+// полученных seq, например пока соединение восстанавливалось. chatIDs - только эти чаты (nil - все).
+func requestSync(chatIDs []string) {
+	if chatIDs == nil {
+		for chatID := range lastSeqs {
+			chatIDs = append(chatIDs, chatID)
+		}
+	}
+	var req protocol.SyncRequestPayload
+	for _, chatID := range chatIDs {
+		req.Chats = append(req.Chats, protocol.ChatSyncState{ChatID: chatID, LastSeq: lastSeqs[chatID]})
+		if len(req.Chats) == protocol.MaxSyncChats {
+			break // Остальные чаты обновятся при открытии их истории
+		}
+	}
+	if len(req.Chats) == 0 {
+		return
+	}
+	if err := sendRequest(protocol.MsgTypeSyncRequest, req); err != nil {
+		log.Printf("Error sending sync request: %v", err)
+	}
+}
+
+// pendingSend - отправленное сообщение, которое сервер еще не подтвердил своей рассылкой или уведомлением.
+type pendingSend struct {
+	clientMsgID string
+	requestID   string // request_id последней отправки; по нему сопоставляется ERROR_NOTIFY
+	msgType     string
+	payload     interface{}
+}
+
+var (
+	pendingSendsMu sync.Mutex
+	pendingSends   []*pendingSend // В порядке отправки
+)
+
+// sendChatMessage отправляет сообщение с ключом client_msg_id и помнит его до подтверждения сервером.
+// Если связь оборвалась, сообщение отправляется повторно после возобновления сессии; сервер
+// по тому же ключу вернет уже сохраненное сообщение, а не сохранит его второй раз.
+// awaitEcho - ждать ответа на запрос (его нет у TEXT_MESSAGE: сервер подтверждает его рассылкой).
+func sendChatMessage(clientMsgID, msgType string, payload interface{}, awaitEcho bool) error {
+	requestID := newRequestID()
+	pendingSendsMu.Lock()
+	pendingSends = append(pendingSends, &pendingSend{clientMsgID: clientMsgID, requestID: requestID, msgType: msgType, payload: payload})
+	pendingSendsMu.Unlock()
+	var err error
+	if awaitEcho {
+		_, err = awaitReplyTo(requestID, msgType, payload, replyTimeout)
+	} else {
+		err = writeRequest(requestID, msgType, payload)
+	}
+	if err != nil {
+		return fmt.Errorf("%w (the message will be resent after reconnecting)", err)
+	}
+	return nil
+}
+
+// removePendingSend забывает сообщение, для которого match вернул true.
+func removePendingSend(match func(*pendingSend) bool) {
+	pendingSendsMu.Lock()
+	defer pendingSendsMu.Unlock()
+	for i, pending := range pendingSends {
+		if match(pending) {
+			pendingSends = append(pendingSends[:i], pendingSends[i+1:]...)
+			return
+		}
+	}
+}
+
+// resendPendingSends повторяет неподтвержденные сообщения после возобновления сессии.
+func resendPendingSends() {
+	pendingSendsMu.Lock()
+	resend := make([]pendingSend, 0, len(pendingSends))
+	for _, pending := range pendingSends {
+		pending.requestID = newRequestID()
+		resend = append(resend, *pending)
+	}
+	pendingSendsMu.Unlock()
+	for _, pending := range resend {
+		if err := writeRequest(pending.requestID, pending.msgType, pending.payload); err != nil {
+			log.Printf("Error resending message %s: %v", pending.clientMsgID, err)
+			return
+		}
+	}
+	if len(resend) > 0 {
+		log.Printf("Resent %d unconfirmed message(s).", len(resend))
+	}
+}
+
+// sendReceipt подтверждает серверу получение или прочтение личных сообщений.
+// Ответа на подтверждение нет, поэтому ждать его не нужно.
+func sendReceipt(msgType, chatID string, messageIDs []string) {
+	if len(messageIDs) == 0 {
+		return
+	}
+	req := protocol.MessageReceiptPayload{ChatID: chatID, MessageIDs: messageIDs}
+	if err := sendRequest(msgType, req); err != nil {
+		log.Printf("Error sending %s: %v", msgType, err)
+	}
+}
+
+// receiptMarker - отметка нашего личного сообщения в истории.
+func receiptMarker(msg protocol.StoredMessage) string {
+	switch {
+	case msg.ReadAt != 0:
+		return " [read]"
+	case msg.DeliveredAt != 0:
+		return " [delivered]"
+	default:
+		return " [sent]"
+	}
+}
+
+// hasPermission сообщает, выдал ли сервер текущему пользователю право perm.
+func hasPermission(perm string) bool {
+	for _, p := range loggedInUser.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// helpLines - команды для вошедшего пользователя и права, которые для них нужны
+// (пустая строка - команда доступна всем).
+var helpLines = []struct {
+	perm string
+	line string
+}{
+	{protocol.PermSendGlobal, "  <message text>             - Send to current chat (global or private)"},
+	{protocol.PermSendPrivate, "  /pm <user_id_or_name> <msg> - Send private message directly"},
+	{protocol.PermListUsers, "  /users                     - List online users"},
+	{protocol.PermReadHistory, "  /history [chat_id|user_name] - Show history for current/specified chat (last 20)"},
+	{"", "  /chat <user_id_or_name>    - Switch to private chat with user"},
+	{"", "  /chatid <full_chat_id>     - Switch to chat by its full ID"},
+	{"", "  /global                    - Switch to global chat"},
+	{protocol.PermSendPrivate, "  /group create|list|open|members|invite|remove|leave - Group chats (/group for details)"},
+	{protocol.PermReadHistory, "  /channel create|list|join|leave|topic - Public channels like #ops (/channel for details)"},
+	{protocol.PermManageAccount, "  /passwd <old> <new>        - Change your password (ends all sessions)"},
+	{protocol.PermManageAccount, "  /deactivate <password>     - Deactivate your account (history is kept)"},
+	{protocol.PermManageAccount, "  /delete_account <password> - Delete your account permanently"},
+	{protocol.PermManageAccount, "  /logout [all]              - End this session (or all your sessions)"},
+	{protocol.PermManageAccount, "  /2fa enroll|confirm|disable - Set up or turn off two-factor authentication"},
+	{protocol.PermManageAccount, "  /readreceipts on|off       - Let others see when you have read their messages"},
+	{protocol.PermManageAccount, "  /token create|list|revoke  - Manage api tokens for bots and scripts"},
+	{protocol.PermManageInvites, "  /invite create|list|revoke - Manage registration invite codes"},
+	{protocol.PermKickUsers, "  /kick <user_id_or_name> [reason] - Disconnect a user and end their sessions"},
+	{protocol.PermManageRoles, "  /role <user_id_or_name> <user|moderator|admin> - Change a user's role"},
+	{"", "  /exit                      - Exit the client"},
+	{"", "  /help                      - Show this help message"},
+}
+
+// describeInvite кратко описывает состояние кода приглашения.
+func describeInvite(inv protocol.InviteInfo) string {
+	desc := fmt.Sprintf("used %d/%d", inv.Uses, inv.MaxUses)
+	if inv.ExpiresAt != 0 {
+		desc += ", expires " + time.Unix(inv.ExpiresAt, 0).Format("02.01.06 15:04:05")
+	}
+	if inv.Revoked {
+		desc += ", revoked"
+	}
+	return desc
+}
+
+// findKnownUser ищет пользователя среди knownUsers по ID или отображаемому имени
+// (без учета регистра). Если имя подходит нескольким пользователям, возвращает ошибку
+// со списком их ID, чтобы пользователь указал нужный явно.
+func findKnownUser(identifier string) (protocol.UserInfo, bool, error) {
+	if u, ok := knownUsers[identifier]; ok {
+		return u, true, nil
+	}
+	var matches []protocol.UserInfo
+	for _, u := range knownUsers {
+		if strings.EqualFold(u.DisplayName, identifier) {
+			matches = append(matches, u)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return protocol.UserInfo{}, false, nil
+	case 1:
+		return matches[0], true, nil
+	}
+	ids := make([]string, 0, len(matches))
+	for _, u := range matches {
+		ids = append(ids, fmt.Sprintf("%s (%s)", u.DisplayName, u.UserID))
+	}
+	return protocol.UserInfo{}, false, fmt.Errorf("name '%s' is ambiguous, use a user ID: %s", identifier, strings.Join(ids, ", "))
+}
+
+// findKnownGroup ищет группу пользователя по ID или названию (без учета регистра).
+func findKnownGroup(identifier string) (protocol.GroupInfo, bool, error) {
+	if g, ok := knownGroups[identifier]; ok {
+		return g, true, nil
+	}
+	var matches []protocol.GroupInfo
+	for _, g := range knownGroups {
+		if strings.EqualFold(g.Title, identifier) {
+			matches = append(matches, g)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return protocol.GroupInfo{}, false, nil
+	case 1:
+		return matches[0], true, nil
+	}
+	ids := make([]string, 0, len(matches))
+	for _, g := range matches {
+		ids = append(ids, fmt.Sprintf("%s (%s)", g.Title, g.ChatID))
+	}
+	return protocol.GroupInfo{}, false, fmt.Errorf("group title '%s' is ambiguous, use a group ID: %s", identifier, strings.Join(ids, ", "))
+}
+
+// groupTitle возвращает название известной группы или ее ID.
+func groupTitle(chatID string) string {
+	if g, ok := knownGroups[chatID]; ok {
+		return g.Title
+	}
+	return chatID
+}
+
+// groupMemberName возвращает имя участника из описания группы или его ID.
+func groupMemberName(group *protocol.GroupInfo, userID string) string {
+	if group != nil {
+		for _, m := range group.Members {
+			if m.UserID == userID {
+				return m.DisplayName
+			}
+		}
+	}
+	return knownUserName(userID)
+}
+
+// knownUserName возвращает имя пользователя из списка известных или его ID.
+func knownUserName(userID string) string {
+	if u, ok := knownUsers[userID]; ok {
+		return u.DisplayName
+	}
+	return userID
+}
+
+// channelName приводит введенное название канала ("#Ops") к виду протокола ("ops").
+func channelName(input string) string {
+	return strings.ToLower(strings.TrimPrefix(input, "#"))
+}
+
+// currentChannelName возвращает название канала текущего чата или "", если это не канал.
+func currentChannelName() string {
+	if currentChatID == "global_broadcast" {
+		return protocol.DefaultChannelName
+	}
+	if strings.HasPrefix(currentChatID, protocol.ChannelChatIDPrefix) {
+		return strings.TrimPrefix(currentChatID, protocol.ChannelChatIDPrefix)
+	}
+	return ""
+}
+
+// printChannel выводит название, тему и число участников канала.
+func printChannel(printf func(format string, a ...interface{}), ch protocol.ChannelInfo) {
+	line := "  #" + ch.Name
+	if ch.Default {
+		line += " (default, everyone)"
+	} else {
+		line += fmt.Sprintf(" (%d member(s))", ch.MemberCount)
+	}
+	if ch.Joined {
+		line += " [joined]"
+	}
+	if ch.Topic != "" {
+		line += " - " + ch.Topic
+	}
+	printf("%s\n", line)
+}
+
+// printGroup выводит название, ID и участников группы.
+func printGroup(printf func(format string, a ...interface{}), g protocol.GroupInfo) {
+	printf("  %s (%s), %d member(s):\n", g.Title, g.ChatID, len(g.Members))
+	for _, m := range g.Members {
+		printf("    - %s (%s) [%s]\n", m.DisplayName, m.UserID, m.Role)
+	}
+}
+
 func updatePrompt() {
 	if !isAuthenticated {
 		inputPrompt = "> "
@@ -68,36 +393,103 @@ func updatePrompt() {
 				chatDisplayName = fmt.Sprintf("PM with %s", otherUserID)
 			}
 		}
+	} else if group, ok := knownGroups[currentChatID]; ok {
+		chatDisplayName = fmt.Sprintf("Group %s", group.Title)
+	} else if strings.HasPrefix(currentChatID, protocol.ChannelChatIDPrefix) {
+		chatDisplayName = "#" + strings.TrimPrefix(currentChatID, protocol.ChannelChatIDPrefix)
 	} else if currentChatID == "global_broadcast" {
 		chatDisplayName = "Global Chat"
 	}
 	inputPrompt = fmt.Sprintf("[%s] %s: ", chatDisplayName, loggedInUser.DisplayName)
 }
 
-// sendRequest отправляет сообщение на WebSocket сервер
+// Сколько ждать ответа сервера на запрос, отправленный через request.
+const replyTimeout = 10 * time.Second
+
+var (
+	lastRequestID  uint64
+	pendingMu      sync.Mutex
+	pendingReplies = make(map[string]chan protocol.WebSocketMessage) // request_id -> ожидающий ответа
+)
+
+// newRequestID возвращает ID для поля request_id, уникальный в пределах запуска клиента.
+func newRequestID() string {
+	return strconv.FormatUint(atomic.AddUint64(&lastRequestID, 1), 10)
+}
+
+// sendRequest отправляет сообщение на WebSocket сервер, не дожидаясь ответа
 func sendRequest(msgType string, payload interface{}) error {
+	return writeRequest(newRequestID(), msgType, payload)
+}
+
+// writeRequest отправляет сообщение с указанным request_id
+func writeRequest(requestID, msgType string, payload interface{}) error {
 	mu.Lock()
 	defer mu.Unlock()
 	if conn == nil {
 		return fmt.Errorf("not connected")
 	}
 
-	payloadBytes, err := json.Marshal(payload)
+	msgBytes, err := codec.Encode(msgType, requestID, payload)
 	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %w", err)
+		return err
 	}
+	return conn.WriteMessage(codec.FrameType(), msgBytes)
+}
+
+// awaitReply отправляет запрос и ждет сообщение сервера с тем же request_id (ответ или ERROR_NOTIFY).
+// Сам ответ по-прежнему выводит listenToServer; awaitReply нужен, чтобы дождаться его по порядку
+// и сообщить, если сервер не ответил за timeout.
+func awaitReply(msgType string, payload interface{}, timeout time.Duration) (protocol.WebSocketMessage, error) {
+	return awaitReplyTo(newRequestID(), msgType, payload, timeout)
+}
 
-	wsMsg := protocol.WebSocketMessage{
-		Type:    msgType,
-		Payload: json.RawMessage(payloadBytes),
+// awaitReplyTo работает как awaitReply, но с request_id, выбранным вызывающим.
+func awaitReplyTo(requestID, msgType string, payload interface{}, timeout time.Duration) (protocol.WebSocketMessage, error) {
+	reply := make(chan protocol.WebSocketMessage, 1)
+	pendingMu.Lock()
+	pendingReplies[requestID] = reply
+	pendingMu.Unlock()
+	defer func() {
+		pendingMu.Lock()
+		delete(pendingReplies, requestID)
+		pendingMu.Unlock()
+	}()
+
+	if err := writeRequest(requestID, msgType, payload); err != nil {
+		return protocol.WebSocketMessage{}, err
 	}
 
-	msgBytes, err := json.Marshal(wsMsg)
-	if err != nil {
-		return fmt.Errorf("failed to marshal WebSocketMessage: %w", err)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case msg := <-reply:
+		return msg, nil
+	case <-timer.C:
+		return protocol.WebSocketMessage{}, fmt.Errorf("no reply to %s within %v", msgType, timeout)
+	}
+}
+
+// request отправляет запрос и ждет ответа не дольше replyTimeout.
+func request(msgType string, payload interface{}) error {
+	_, err := awaitReply(msgType, payload, replyTimeout)
+	return err
+}
+
+// deliverReply передает сообщение тому, кто ждет ответа с его request_id, если такой есть.
+func deliverReply(msg protocol.WebSocketMessage) {
+	if msg.RequestID == "" {
+		return
+	}
+	pendingMu.Lock()
+	reply, ok := pendingReplies[msg.RequestID]
+	pendingMu.Unlock()
+	if ok {
+		select {
+		case reply <- msg:
+		default: // Ответ уже получен
+		}
 	}
-	
-	return conn.WriteMessage(websocket.TextMessage, msgBytes)
 }
 
 // listenToServer читает сообщения от сервера и обрабатывает их
@@ -116,15 +508,41 @@ func listenToServer() {
 		}
 		_, messageBytes, err := conn.ReadMessage()
 		if err != nil {
-			log.Printf("Read error: %v. Attempting to reconnect or exiting...", err)
+			var closeErr *websocket.CloseError
+			// Вытесненное или отклоненное по лимиту устройств соединение не возобновляем автоматически,
+			// иначе два устройства будут бесконечно вытеснять друг друга.
+			autoResume := true
+			if errors.As(err, &closeErr) && (closeErr.Code == protocol.CloseCodeEvicted || closeErr.Code == protocol.CloseCodeConnectionLimit) {
+				autoResume = false
+			}
+			if errors.As(err, &closeErr) && closeErr.Text != "" {
+				log.Printf("Connection closed by server: %s.", closeErr.Text)
+			} else {
+				log.Printf("Read error: %v. Attempting to reconnect or exiting...", err)
+			}
 			isAuthenticated = false // Сбрасываем аутентификацию при потере соединения
 
 			// Попытка переподключения (простая)
 			for {
 				log.Println("Attempting to reconnect...")
-				if e := connectToServer(); e == nil {
-					log.Println("Reconnected. Please log in again.")
-					fmt.Print(inputPrompt)
+				e := connectToServer()
+				if errors.Is(e, errProtocolRejected) {
+					log.Fatalf("Reconnect failed: %v. Please upgrade the client.", e)
+				}
+				if e == nil {
+					if loggedInUser.Token != "" && autoResume {
+						// Возобновляем сессию молча, без повторного ввода пароля
+						req := protocol.ResumeSessionRequestPayload{SessionToken: loggedInUser.Token}
+						if err := sendRequest(protocol.MsgTypeResumeSessionRequest, req); err != nil {
+							log.Printf("Error sending resume session request: %v", err)
+						}
+					} else if loggedInUser.Token != "" {
+						log.Println("Reconnected. The session was not resumed automatically; use /login to sign in on this device again.")
+						fmt.Print(inputPrompt)
+					} else {
+						log.Println("Reconnected. Please log in again.")
+						fmt.Print(inputPrompt)
+					}
 					break
 				}
 				time.Sleep(5 * time.Second)
@@ -132,177 +550,813 @@ func listenToServer() {
 			continue // Продолжаем слушать на новом соединении
 		}
 
-		var wsMsg protocol.WebSocketMessage
-		if err := json.Unmarshal(messageBytes, &wsMsg); err != nil {
-			log.Printf("Failed to unmarshal WebSocketMessage: %v. Raw: %s", err, string(messageBytes))
+		// Фрейм может содержать одно сообщение или пакет BATCH
+		messages, err := protocol.DecodeFrame(codec, messageBytes)
+		if err != nil {
+			log.Printf("Failed to decode WebSocketMessage: %v. Raw: %q", err, messageBytes)
 			continue
 		}
 
-		clearLineAndPrint := func(a ...interface{}) {
-			fmt.Print("\r" + strings.Repeat(" ", len(inputPrompt)+50) + "\r")
-			fmt.Println(a...)
-			fmt.Print(inputPrompt) // Печатаем промпт снова
+		for _, wsMsg := range messages {
+			handleServerMessage(wsMsg)
+			// Ответ уже выведен; будим команду, которая его ждет
+			deliverReply(wsMsg)
+		}
+	}
+}
+
+// handleServerMessage выводит сообщение сервера и обновляет состояние клиента
+func handleServerMessage(wsMsg protocol.WebSocketMessage) {
+	clearLineAndPrint := func(a ...interface{}) {
+		fmt.Print("\r" + strings.Repeat(" ", len(inputPrompt)+50) + "\r")
+		fmt.Println(a...)
+		fmt.Print(inputPrompt) // Печатаем промпт снова
+	}
+	clearLineAndPrintf := func(format string, a ...interface{}) {
+		fmt.Print("\r" + strings.Repeat(" ", len(inputPrompt)+50) + "\r")
+		fmt.Printf(format, a...)
+		fmt.Print(inputPrompt)
+	}
+
+	switch wsMsg.Type {
+	case protocol.MsgTypeRegisterResponse:
+		var resp protocol.RegisterResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling RegisterResponse: %v\n", err)
+			return
 		}
-		clearLineAndPrintf := func(format string, a ...interface{}) {
-			fmt.Print("\r" + strings.Repeat(" ", len(inputPrompt)+50) + "\r")
-			fmt.Printf(format, a...)
-			fmt.Print(inputPrompt)
+		if resp.Success {
+			clearLineAndPrintf("CLIENT: Registration successful! UserID: %s. Please log in.\n", resp.UserID)
+		} else {
+			if len(resp.FieldErrors) == 0 {
+				clearLineAndPrintf("CLIENT: Registration failed: %s\n", resp.ErrorMessage)
+				return
+			}
+			clearLineAndPrint("CLIENT: Registration failed:")
+			for _, fe := range resp.FieldErrors {
+				clearLineAndPrintf("  %s: %s\n", fe.Field, fe.Message)
+			}
 		}
 
-		switch wsMsg.Type {
-		case protocol.MsgTypeRegisterResponse:
-			var resp protocol.RegisterResponsePayload
-			if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
-				clearLineAndPrintf("CLIENT: Error unmarshalling RegisterResponse: %v\n", err)
-				continue
+	case protocol.MsgTypeLoginResponse:
+		var resp protocol.LoginResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling LoginResponse: %v\n", err)
+			return
+		}
+		if resp.Success {
+			loggedInUser.ID = resp.UserID
+			loggedInUser.DisplayName = resp.DisplayName
+			loggedInUser.Token = resp.SessionToken
+			loggedInUser.Role = resp.Role
+			loggedInUser.Permissions = resp.Permissions
+			isAuthenticated = true
+			clearLineAndPrintf("CLIENT: Login successful! Welcome, %s (ID: %s, role: %s)\n", resp.DisplayName, resp.UserID, resp.Role)
+			updatePrompt()
+			// Запросим список пользователей после успешного логина
+			if err := sendRequest(protocol.MsgTypeGetUserListRequest, protocol.GetUserListRequestPayload{}); err != nil {
+				log.Printf("Error requesting user list after login: %v", err)
 			}
-			if resp.Success {
-				clearLineAndPrintf("CLIENT: Registration successful! UserID: %s. Please log in.\n", resp.UserID)
+			// И группы, чтобы к ним можно было обращаться по названию
+			if err := sendRequest(protocol.MsgTypeListGroupsRequest, protocol.ListGroupsRequestPayload{}); err != nil {
+				log.Printf("Error requesting group list after login: %v", err)
+			}
+			if err := sendRequest(protocol.MsgTypeListChannelsRequest, protocol.ListChannelsRequestPayload{JoinedOnly: true}); err != nil {
+				log.Printf("Error requesting channel list after login: %v", err)
+			}
+			// Запросим историю текущего (глобального) чата
+			if err := sendRequest(protocol.MsgTypeGetChatHistoryRequest, protocol.GetChatHistoryRequestPayload{ChatID: currentChatID, Limit: 20}); err != nil {
+				log.Printf("Error requesting initial chat history: %v", err)
+			}
+
+		} else if resp.SecondFactorRequired && resp.ErrorCode == protocol.ErrCodeSecondFactorRequired {
+			clearLineAndPrint("CLIENT: Two-factor authentication is enabled. Enter /code <code> with a code from your authenticator app or a recovery code.")
+		} else {
+			if resp.RetryAfterSeconds > 0 {
+				clearLineAndPrintf("CLIENT: Login failed [%s]: %s. Try again in %d s.\n", resp.ErrorCode, resp.ErrorMessage, resp.RetryAfterSeconds)
 			} else {
-				clearLineAndPrintf("CLIENT: Registration failed: %s\n", resp.ErrorMessage)
+				clearLineAndPrintf("CLIENT: Login failed [%s]: %s\n", resp.ErrorCode, resp.ErrorMessage)
 			}
+			isAuthenticated = false
+		}
 
-		case protocol.MsgTypeLoginResponse:
-			var resp protocol.LoginResponsePayload
-			if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
-				clearLineAndPrintf("CLIENT: Error unmarshalling LoginResponse: %v\n", err)
-				continue
+	case protocol.MsgTypeResumeSessionResponse:
+		var resp protocol.ResumeSessionResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling ResumeSessionResponse: %v\n", err)
+			return
+		}
+		if resp.Success {
+			loggedInUser.ID = resp.UserID
+			loggedInUser.DisplayName = resp.DisplayName
+			loggedInUser.Role = resp.Role
+			loggedInUser.Permissions = resp.Permissions
+			isAuthenticated = true
+			updatePrompt()
+			fmt.Print("\r" + inputPrompt)
+			resendPendingSends()
+			requestSync(nil)
+		} else {
+			resetSession()
+			clearLineAndPrintf("CLIENT: Could not resume session (%s). Please log in again.\n", resp.ErrorMessage)
+		}
+
+	case protocol.MsgTypeLogoutResponse:
+		var resp protocol.LogoutResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling LogoutResponse: %v\n", err)
+			return
+		}
+		if resp.Success {
+			resetSession()
+			clearLineAndPrintf("CLIENT: Logged out (%d session(s) ended). Use /login to sign in again.\n", resp.SessionsRevoked)
+		} else {
+			clearLineAndPrintf("CLIENT: Logout failed: %s\n", resp.ErrorMessage)
+		}
+
+	case protocol.MsgTypeChangePasswordResponse, protocol.MsgTypeDeactivateAccountResponse, protocol.MsgTypeDeleteAccountResponse:
+		var resp protocol.AccountActionResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling %s: %v\n", wsMsg.Type, err)
+			return
+		}
+		if !resp.Success {
+			clearLineAndPrintf("CLIENT: Request failed: %s\n", resp.ErrorMessage)
+			return
+		}
+		// Сервер завершает все сессии пользователя после любого из этих действий
+		resetSession()
+		switch wsMsg.Type {
+		case protocol.MsgTypeChangePasswordResponse:
+			clearLineAndPrint("CLIENT: Password changed. All sessions were ended, please /login with the new password.")
+		case protocol.MsgTypeDeactivateAccountResponse:
+			clearLineAndPrint("CLIENT: Account deactivated. You have been logged out.")
+		case protocol.MsgTypeDeleteAccountResponse:
+			clearLineAndPrint("CLIENT: Account deleted. You have been logged out.")
+		}
+
+	case protocol.MsgTypeRoleChangedNotify:
+		var notify protocol.RoleChangedNotifyPayload
+		if err := json.Unmarshal(wsMsg.Payload, &notify); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling RoleChangedNotify: %v\n", err)
+			return
+		}
+		loggedInUser.Role = notify.Role
+		loggedInUser.Permissions = notify.Permissions
+		clearLineAndPrintf("CLIENT: Your role is now %s. Type /help to see available commands.\n", notify.Role)
+
+	case protocol.MsgTypeKickUserResponse, protocol.MsgTypeSetUserRoleResponse:
+		var resp protocol.ModerationResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling %s: %v\n", wsMsg.Type, err)
+			return
+		}
+		if !resp.Success {
+			clearLineAndPrintf("CLIENT: Request failed: %s\n", resp.ErrorMessage)
+			return
+		}
+		targetName := resp.TargetUserID
+		if u, ok := knownUsers[resp.TargetUserID]; ok {
+			targetName = u.DisplayName
+		}
+		if wsMsg.Type == protocol.MsgTypeKickUserResponse {
+			clearLineAndPrintf("CLIENT: %s has been kicked.\n", targetName)
+		} else {
+			clearLineAndPrintf("CLIENT: %s now has role %s.\n", targetName, resp.Role)
+		}
+
+	case protocol.MsgTypeCreateAPITokenResponse:
+		var resp protocol.CreateAPITokenResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling CreateAPITokenResponse: %v\n", err)
+			return
+		}
+		if !resp.Success {
+			clearLineAndPrintf("CLIENT: Could not create api token: %s\n", resp.ErrorMessage)
+			return
+		}
+		clearLineAndPrintf("CLIENT: Api token '%s' created (ID: %s, scopes: %s).\n", resp.TokenInfo.Name, resp.TokenInfo.TokenID, strings.Join(resp.TokenInfo.Scopes, ","))
+		clearLineAndPrintf("CLIENT: Token: %s\n", resp.Token)
+		clearLineAndPrint("CLIENT: Store it now, it will not be shown again.")
+
+	case protocol.MsgTypeListAPITokensResponse:
+		var resp protocol.ListAPITokensResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling ListAPITokensResponse: %v\n", err)
+			return
+		}
+		clearLineAndPrint("CLIENT: Api tokens:")
+		for _, t := range resp.Tokens {
+			lastUsed := "never"
+			if t.LastUsedAt != 0 {
+				lastUsed = time.Unix(t.LastUsedAt, 0).Format("02.01.06 15:04:05")
 			}
-			if resp.Success {
-				loggedInUser.ID = resp.UserID
-				loggedInUser.DisplayName = resp.DisplayName
-				loggedInUser.Token = resp.SessionToken
-				isAuthenticated = true
-				clearLineAndPrintf("CLIENT: Login successful! Welcome, %s (ID: %s)\n", resp.DisplayName, resp.UserID)
-				updatePrompt()
-				// Запросим список пользователей после успешного логина
-				if err := sendRequest(protocol.MsgTypeGetUserListRequest, protocol.GetUserListRequestPayload{}); err != nil {
-					log.Printf("Error requesting user list after login: %v", err)
-				}
-				// Запросим историю текущего (глобального) чата
-				if err := sendRequest(protocol.MsgTypeGetChatHistoryRequest, protocol.GetChatHistoryRequestPayload{ChatID: currentChatID, Limit: 20}); err != nil {
-					log.Printf("Error requesting initial chat history: %v", err)
-				}
+			clearLineAndPrintf(" - %s (ID: %s, scopes: %s, last used: %s)\n", t.Name, t.TokenID, strings.Join(t.Scopes, ","), lastUsed)
+		}
+		if len(resp.Tokens) == 0 {
+			clearLineAndPrint("  (No api tokens)")
+		}
+
+	case protocol.MsgTypeRevokeAPITokenResponse:
+		var resp protocol.RevokeAPITokenResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling RevokeAPITokenResponse: %v\n", err)
+			return
+		}
+		if resp.Success {
+			clearLineAndPrintf("CLIENT: Api token %s revoked.\n", resp.TokenID)
+		} else {
+			clearLineAndPrintf("CLIENT: Could not revoke api token: %s\n", resp.ErrorMessage)
+		}
+
+	case protocol.MsgTypeTOTPEnrollResponse:
+		var resp protocol.TOTPEnrollResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling TOTPEnrollResponse: %v\n", err)
+			return
+		}
+		if !resp.Success {
+			clearLineAndPrintf("CLIENT: Could not start two-factor enrollment: %s\n", resp.ErrorMessage)
+			return
+		}
+		clearLineAndPrintf("CLIENT: Add this secret to your authenticator app: %s\n", resp.Secret)
+		clearLineAndPrintf("CLIENT: Or use this link: %s\n", resp.OTPAuthURI)
+		clearLineAndPrint("CLIENT: Then confirm with /2fa confirm <code>.")
+
+	case protocol.MsgTypeTOTPConfirmResponse:
+		var resp protocol.TOTPConfirmResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling TOTPConfirmResponse: %v\n", err)
+			return
+		}
+		if !resp.Success {
+			clearLineAndPrintf("CLIENT: Could not enable two-factor authentication: %s\n", resp.ErrorMessage)
+			return
+		}
+		clearLineAndPrint("CLIENT: Two-factor authentication enabled. Recovery codes (each works once, store them safely):")
+		for _, code := range resp.RecoveryCodes {
+			clearLineAndPrintf("  %s\n", code)
+		}
+
+	case protocol.MsgTypeTOTPDisableResponse:
+		var resp protocol.AccountActionResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling TOTPDisableResponse: %v\n", err)
+			return
+		}
+		if resp.Success {
+			clearLineAndPrint("CLIENT: Two-factor authentication disabled.")
+		} else {
+			clearLineAndPrintf("CLIENT: Could not disable two-factor authentication: %s\n", resp.ErrorMessage)
+		}
+
+	case protocol.MsgTypeCreateInviteResponse:
+		var resp protocol.CreateInviteResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling CreateInviteResponse: %v\n", err)
+			return
+		}
+		if !resp.Success {
+			clearLineAndPrintf("CLIENT: Could not create invite: %s\n", resp.ErrorMessage)
+			return
+		}
+		clearLineAndPrintf("CLIENT: Invite code: %s (%s)\n", resp.Invite.Code, describeInvite(*resp.Invite))
+
+	case protocol.MsgTypeListInvitesResponse:
+		var resp protocol.ListInvitesResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling ListInvitesResponse: %v\n", err)
+			return
+		}
+		clearLineAndPrint("CLIENT: Invites:")
+		for _, inv := range resp.Invites {
+			clearLineAndPrintf(" - %s (%s)\n", inv.Code, describeInvite(inv))
+			if len(inv.UsedBy) > 0 {
+				clearLineAndPrintf("     used by: %s\n", strings.Join(inv.UsedBy, ", "))
+			}
+		}
+		if len(resp.Invites) == 0 {
+			clearLineAndPrint("  (No invites)")
+		}
 
+	case protocol.MsgTypeRevokeInviteResponse:
+		var resp protocol.RevokeInviteResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling RevokeInviteResponse: %v\n", err)
+			return
+		}
+		if resp.Success {
+			clearLineAndPrintf("CLIENT: Invite %s revoked.\n", resp.Code)
+		} else {
+			clearLineAndPrintf("CLIENT: Could not revoke invite: %s\n", resp.ErrorMessage)
+		}
+
+	case protocol.MsgTypeBroadcastText:
+		var bcastMsg protocol.BroadcastTextPayload
+		if err := json.Unmarshal(wsMsg.Payload, &bcastMsg); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling BroadcastText: %v\n", err)
+			return
+		}
+		// Обновляем knownUsers, если отправитель неизвестен
+		if _, ok := knownUsers[bcastMsg.SenderID]; !ok && bcastMsg.SenderID != "" {
+			knownUsers[bcastMsg.SenderID] = protocol.UserInfo{UserID: bcastMsg.SenderID, DisplayName: bcastMsg.SenderName, IsOnline: true}
+		}
+
+		if bcastMsg.SenderID == loggedInUser.ID && bcastMsg.ClientMsgID != "" {
+			removePendingSend(func(p *pendingSend) bool { return p.clientMsgID == bcastMsg.ClientMsgID })
+		}
+
+		noteSeq("global_broadcast", bcastMsg.Seq)
+		timestamp := time.UnixMilli(bcastMsg.Timestamp).Format("15:04:05")
+		clearLineAndPrintf("[%s Global] %s (%s): %s\n", timestamp, bcastMsg.SenderName, bcastMsg.SenderID, bcastMsg.Text)
+
+	case protocol.MsgTypeNewPrivateMessageNotify:
+		var pm protocol.NewPrivateMessageNotifyPayload
+		if err := json.Unmarshal(wsMsg.Payload, &pm); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling NewPrivateMessageNotify: %v\n", err)
+			return
+		}
+		// Обновляем knownUsers
+		if _, ok := knownUsers[pm.SenderID]; !ok && pm.SenderID != "" {
+			knownUsers[pm.SenderID] = protocol.UserInfo{UserID: pm.SenderID, DisplayName: pm.SenderName, IsOnline: true}
+		}
+		if _, ok := knownUsers[pm.ReceiverID]; !ok && pm.ReceiverID != "" {
+		}
+
+		noteSeq(pm.ChatID, pm.Seq)
+		timestamp := time.UnixMilli(pm.Timestamp).Format("15:04:05")
+		direction := "To"
+		interlocutorName := pm.ReceiverID // По умолчанию ID
+		if otherUser, ok := knownUsers[pm.ReceiverID]; ok {
+			interlocutorName = otherUser.DisplayName
+		}
+
+		if pm.SenderID == loggedInUser.ID && pm.ClientMsgID != "" {
+			removePendingSend(func(p *pendingSend) bool { return p.clientMsgID == pm.ClientMsgID })
+		}
+
+		marker := ""
+		if pm.SenderID != loggedInUser.ID { // Сообщение пришло нам
+			direction = "From"
+			interlocutorName = pm.SenderName
+		} else if pm.MessageID != "" && pm.ReceiverID != loggedInUser.ID {
+			sentMessages[pm.MessageID] = pm.Text
+			marker = " [sent]"
+			if pm.Queued {
+				marker = " [sent, recipient offline]"
+			}
+		}
+
+		// Если текущий чат не совпадает с чатом сообщения, уведомить и не менять активный чат
+		// Иначе просто показать сообщение
+		if pm.ChatID == currentChatID {
+			clearLineAndPrintf("[%s PM %s %s (%s)] %s%s\n", timestamp, direction, interlocutorName, pm.SenderID, pm.Text, marker)
+		} else {
+			clearLineAndPrintf("[%s PM %s %s (%s) in chat %s] %s%s\n", timestamp, direction, interlocutorName, pm.SenderID, pm.ChatID, pm.Text, marker)
+			clearLineAndPrint("(To switch: /chat <user_id_or_name> or /chatid <chat_id>)")
+		}
+
+		// Сообщение в открытом чате пользователь уже видит; остальные только доставлены
+		// и будут отмечены прочитанными, когда он откроет чат и получит историю.
+		if pm.SenderID != loggedInUser.ID && pm.MessageID != "" {
+			if pm.ChatID == currentChatID {
+				sendReceipt(protocol.MsgTypeMessageRead, pm.ChatID, []string{pm.MessageID})
 			} else {
-				clearLineAndPrintf("CLIENT: Login failed: %s\n", resp.ErrorMessage)
-				isAuthenticated = false
+				sendReceipt(protocol.MsgTypeMessageDelivered, pm.ChatID, []string{pm.MessageID})
 			}
+		}
 
-		case protocol.MsgTypeBroadcastText:
-			var bcastMsg protocol.BroadcastTextPayload
-			if err := json.Unmarshal(wsMsg.Payload, &bcastMsg); err != nil {
-				clearLineAndPrintf("CLIENT: Error unmarshalling BroadcastText: %v\n", err)
-				continue
+	case protocol.MsgTypeMessageReceiptNotify:
+		var notify protocol.MessageReceiptNotifyPayload
+		if err := json.Unmarshal(wsMsg.Payload, &notify); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling MessageReceiptNotify: %v\n", err)
+			return
+		}
+		readerName := notify.UserID
+		if reader, ok := knownUsers[notify.UserID]; ok {
+			readerName = reader.DisplayName
+		}
+		timestamp := time.UnixMilli(notify.Timestamp).Format("15:04:05")
+		for _, id := range notify.MessageIDs {
+			text, ok := sentMessages[id]
+			if !ok {
+				text = id // Отправлено до запуска клиента или с другого устройства
 			}
-			// Обновляем knownUsers, если отправитель неизвестен
-			if _, ok := knownUsers[bcastMsg.SenderID]; !ok && bcastMsg.SenderID != "" {
-				knownUsers[bcastMsg.SenderID] = protocol.UserInfo{UserID: bcastMsg.SenderID, DisplayName: bcastMsg.SenderName, IsOnline: true}
+			if notify.Status == protocol.ReceiptStatusRead {
+				delete(sentMessages, id)
 			}
+			clearLineAndPrintf("[%s] %s %s: %s\n", timestamp, readerName, notify.Status, text)
+		}
 
-			timestamp := time.Unix(bcastMsg.Timestamp, 0).Format("15:04:05")
-			clearLineAndPrintf("[%s Global] %s (%s): %s\n", timestamp, bcastMsg.SenderName, bcastMsg.SenderID, bcastMsg.Text)
+	case protocol.MsgTypeUserListResponse:
+		var resp protocol.UserListResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling UserListResponse: %v\n", err)
+			return
+		}
+		clearLineAndPrint("CLIENT: Online Users:")
+		// Очистим старых известных пользователей, чтобы isOnline был актуален
+		tempKnownUsers := make(map[string]protocol.UserInfo)
+		for _, u := range resp.Users {
+			clearLineAndPrintf(" - %s (ID: %s, Online: %v, Role: %s)\n", u.DisplayName, u.UserID, u.IsOnline, u.Role)
+			tempKnownUsers[u.UserID] = u
+		}
+		// Добавим себя, если нас нет
+		if loggedInUser.ID != "" {
+			if _, ok := tempKnownUsers[loggedInUser.ID]; !ok {
+				tempKnownUsers[loggedInUser.ID] = protocol.UserInfo{UserID: loggedInUser.ID, DisplayName: loggedInUser.DisplayName, IsOnline: true}
+			}
+		}
+		knownUsers = tempKnownUsers
 
-		case protocol.MsgTypeNewPrivateMessageNotify:
-			var pm protocol.NewPrivateMessageNotifyPayload
-			if err := json.Unmarshal(wsMsg.Payload, &pm); err != nil {
-				clearLineAndPrintf("CLIENT: Error unmarshalling NewPrivateMessageNotify: %v\n", err)
-				continue
+	case protocol.MsgTypeChatHistoryResponse:
+		var resp protocol.ChatHistoryResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling ChatHistoryResponse: %v\n", err)
+			return
+		}
+		clearLineAndPrintf("CLIENT: Chat History for %s (Last %d messages):\n", resp.ChatID, len(resp.Messages))
+		isPrivate := strings.HasPrefix(resp.ChatID, "private:")
+		var unread []string
+		for _, msg := range resp.Messages {
+			noteSeq(resp.ChatID, msg.Seq)
+			timestamp := time.UnixMilli(msg.Timestamp).Format("02.01.06 15:04:05")
+			senderDisplayName := msg.SenderName
+			if sender, ok := knownUsers[msg.SenderID]; ok {
+				senderDisplayName = sender.DisplayName
 			}
-			// Обновляем knownUsers
-			if _, ok := knownUsers[pm.SenderID]; !ok && pm.SenderID != "" {
-				knownUsers[pm.SenderID] = protocol.UserInfo{UserID: pm.SenderID, DisplayName: pm.SenderName, IsOnline: true}
+			marker := ""
+			if isPrivate && msg.SenderID == loggedInUser.ID {
+				marker = receiptMarker(msg)
+			} else if isPrivate && msg.ReadAt == 0 {
+				unread = append(unread, msg.MessageID)
 			}
-			if _, ok := knownUsers[pm.ReceiverID]; !ok && pm.ReceiverID != "" {	}
+			clearLineAndPrintf("  [%s] %s: %s%s\n", timestamp, senderDisplayName, msg.Text, marker)
+		}
+		if len(resp.Messages) == 0 {
+			clearLineAndPrint("  (No messages in this chat yet)")
+		}
+		// Показанная история прочитана
+		sendReceipt(protocol.MsgTypeMessageRead, resp.ChatID, unread)
+
+	case protocol.MsgTypeNewGroupMessageNotify:
+		var gm protocol.NewGroupMessageNotifyPayload
+		if err := json.Unmarshal(wsMsg.Payload, &gm); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling NewGroupMessageNotify: %v\n", err)
+			return
+		}
+		if gm.SenderID == loggedInUser.ID && gm.ClientMsgID != "" {
+			removePendingSend(func(p *pendingSend) bool { return p.clientMsgID == gm.ClientMsgID })
+		}
+		noteSeq(gm.ChatID, gm.Seq)
+		timestamp := time.UnixMilli(gm.Timestamp).Format("15:04:05")
+		clearLineAndPrintf("[%s Group %s] %s (%s): %s\n", timestamp, groupTitle(gm.ChatID), gm.SenderName, gm.SenderID, gm.Text)
+		if gm.ChatID != currentChatID && gm.SenderID != loggedInUser.ID {
+			clearLineAndPrint("(To switch: /group open <group_id_or_title>)")
+		}
+
+	case protocol.MsgTypeCreateGroupResponse, protocol.MsgTypeGroupInviteResponse,
+		protocol.MsgTypeGroupRemoveMemberResponse, protocol.MsgTypeLeaveGroupResponse:
+		var resp protocol.GroupResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling %s: %v\n", wsMsg.Type, err)
+			return
+		}
+		if !resp.Success {
+			clearLineAndPrintf("CLIENT: Group request failed [%s]: %s\n", resp.ErrorCode, resp.ErrorMessage)
+			return
+		}
+		switch wsMsg.Type {
+		case protocol.MsgTypeCreateGroupResponse:
+			knownGroups[resp.Group.ChatID] = *resp.Group
+			currentChatID = resp.Group.ChatID
+			updatePrompt()
+			clearLineAndPrintf("CLIENT: Group '%s' created (ID: %s). Invite members with /group invite <user_id_or_name>.\n", resp.Group.Title, resp.Group.ChatID)
+		case protocol.MsgTypeLeaveGroupResponse:
+			clearLineAndPrint("CLIENT: You left the group.")
+		default:
+			knownGroups[resp.Group.ChatID] = *resp.Group
+			clearLineAndPrintf("CLIENT: Group '%s' now has %d member(s).\n", resp.Group.Title, len(resp.Group.Members))
+		}
 
-			timestamp := time.Unix(pm.Timestamp, 0).Format("15:04:05")
-			direction := "To"
-			interlocutorName := pm.ReceiverID // По умолчанию ID
-			if otherUser, ok := knownUsers[pm.ReceiverID]; ok {
-				interlocutorName = otherUser.DisplayName
+	case protocol.MsgTypeListGroupsResponse:
+		var resp protocol.ListGroupsResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling ListGroupsResponse: %v\n", err)
+			return
+		}
+		knownGroups = make(map[string]protocol.GroupInfo, len(resp.Groups))
+		for _, g := range resp.Groups {
+			knownGroups[g.ChatID] = g
+		}
+		updatePrompt()
+		if showGroupList {
+			showGroupList = false
+			if len(resp.Groups) == 0 {
+				clearLineAndPrint("CLIENT: You are not a member of any group. Create one with /group create <title>.")
+				return
 			}
+			clearLineAndPrint("CLIENT: Your groups:")
+			for _, g := range resp.Groups {
+				printGroup(clearLineAndPrintf, g)
+			}
+		}
 
-			if pm.SenderID != loggedInUser.ID { // Сообщение пришло нам
-				direction = "From"
-				interlocutorName = pm.SenderName
+	case protocol.MsgTypeGroupUpdateNotify:
+		var update protocol.GroupUpdateNotifyPayload
+		if err := json.Unmarshal(wsMsg.Payload, &update); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling GroupUpdateNotify: %v\n", err)
+			return
+		}
+		title := groupTitle(update.ChatID)
+		if update.Group != nil {
+			knownGroups[update.ChatID] = *update.Group
+			title = update.Group.Title
+		} else {
+			// Мы больше не в группе (вышли с другого устройства или нас исключили)
+			// Забываем и seq: SYNC_REQUEST по чужому чату отклоняется целиком
+			delete(knownGroups, update.ChatID)
+			delete(lastSeqs, update.ChatID)
+			if currentChatID == update.ChatID {
+				currentChatID = "global_broadcast"
 			}
+		}
+		actor := groupMemberName(update.Group, update.ActorID)
+		target := groupMemberName(update.Group, update.UserID)
+		if update.UserID == loggedInUser.ID {
+			target = "you"
+		}
+		switch update.Event {
+		case protocol.GroupEventCreated:
+			clearLineAndPrintf("CLIENT: %s added you to the new group '%s' (ID: %s).\n", actor, title, update.ChatID)
+		case protocol.GroupEventMemberAdded:
+			clearLineAndPrintf("CLIENT: %s added %s to group '%s'.\n", actor, target, title)
+		case protocol.GroupEventMemberRemoved:
+			clearLineAndPrintf("CLIENT: %s removed %s from group '%s'.\n", actor, target, title)
+		case protocol.GroupEventMemberLeft:
+			clearLineAndPrintf("CLIENT: %s left group '%s'.\n", target, title)
+		}
+		updatePrompt()
 
-			// Если текущий чат не совпадает с чатом сообщения, уведомить и не менять активный чат
-			// Иначе просто показать сообщение
-			if pm.ChatID == currentChatID {
-				clearLineAndPrintf("[%s PM %s %s (%s)] %s\n", timestamp, direction, interlocutorName, pm.SenderID, pm.Text)
-			} else {
-				clearLineAndPrintf("[%s PM %s %s (%s) in chat %s] %s\n", timestamp, direction, interlocutorName, pm.SenderID, pm.ChatID, pm.Text)
-				clearLineAndPrint("(To switch: /chat <user_id_or_name> or /chatid <chat_id>)")
+	case protocol.MsgTypeNewChannelMessageNotify:
+		var cm protocol.NewChannelMessageNotifyPayload
+		if err := json.Unmarshal(wsMsg.Payload, &cm); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling NewChannelMessageNotify: %v\n", err)
+			return
+		}
+		if cm.SenderID == loggedInUser.ID && cm.ClientMsgID != "" {
+			removePendingSend(func(p *pendingSend) bool { return p.clientMsgID == cm.ClientMsgID })
+		}
+		noteSeq(cm.ChatID, cm.Seq)
+		timestamp := time.UnixMilli(cm.Timestamp).Format("15:04:05")
+		clearLineAndPrintf("[%s #%s] %s (%s): %s\n", timestamp, cm.Name, cm.SenderName, cm.SenderID, cm.Text)
+		if cm.ChatID != currentChatID && cm.SenderID != loggedInUser.ID {
+			clearLineAndPrintf("(To switch: /channel join #%s)\n", cm.Name)
+		}
+
+	case protocol.MsgTypeCreateChannelResponse, protocol.MsgTypeJoinChannelResponse,
+		protocol.MsgTypeLeaveChannelResponse, protocol.MsgTypeSetChannelTopicResponse:
+		var resp protocol.ChannelResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling %s: %v\n", wsMsg.Type, err)
+			return
+		}
+		if !resp.Success {
+			clearLineAndPrintf("CLIENT: Channel request failed [%s]: %s\n", resp.ErrorCode, resp.ErrorMessage)
+			return
+		}
+		ch := *resp.Channel
+		switch wsMsg.Type {
+		case protocol.MsgTypeLeaveChannelResponse:
+			delete(knownChannels, ch.Name)
+			delete(lastSeqs, ch.ChatID)
+			clearLineAndPrintf("CLIENT: You left #%s.\n", ch.Name)
+		case protocol.MsgTypeSetChannelTopicResponse:
+			knownChannels[ch.Name] = ch
+			clearLineAndPrintf("CLIENT: Topic of #%s set to: %s\n", ch.Name, ch.Topic)
+		default:
+			// Вступили или создали канал - переходим в него
+			knownChannels[ch.Name] = ch
+			currentChatID = ch.ChatID
+			updatePrompt()
+			clearLineAndPrintf("CLIENT: Switched to #%s (Chat ID: %s).\n", ch.Name, ch.ChatID)
+			if ch.Topic != "" {
+				clearLineAndPrintf("CLIENT: Topic: %s\n", ch.Topic)
+			}
+			// Ответ ждать нельзя: обработчик работает в горутине чтения
+			if err := sendRequest(protocol.MsgTypeGetChatHistoryRequest, protocol.GetChatHistoryRequestPayload{ChatID: ch.ChatID, Limit: 20}); err != nil {
+				log.Printf("Error requesting chat history for #%s: %v", ch.Name, err)
 			}
+		}
 
-		case protocol.MsgTypeUserListResponse:
-			var resp protocol.UserListResponsePayload
-			if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
-				clearLineAndPrintf("CLIENT: Error unmarshalling UserListResponse: %v\n", err)
-				continue
+	case protocol.MsgTypeListChannelsResponse:
+		var resp protocol.ListChannelsResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling ListChannelsResponse: %v\n", err)
+			return
+		}
+		for _, ch := range resp.Channels {
+			if ch.Joined {
+				knownChannels[ch.Name] = ch
 			}
-			clearLineAndPrint("CLIENT: Online Users:")
-			// Очистим старых известных пользователей, чтобы isOnline был актуален
-			tempKnownUsers := make(map[string]protocol.UserInfo)
-			for _, u := range resp.Users {
-				clearLineAndPrintf(" - %s (ID: %s, Online: %v)\n", u.DisplayName, u.UserID, u.IsOnline)
-				tempKnownUsers[u.UserID] = u
+		}
+		if showChannelList {
+			showChannelList = false
+			if len(resp.Channels) == 0 {
+				clearLineAndPrint("CLIENT: No channels found. Create one with /channel create <#name> [topic].")
+				return
 			}
-			// Добавим себя, если нас нет
-			if loggedInUser.ID != "" {
-				if _, ok := tempKnownUsers[loggedInUser.ID]; !ok {
-					tempKnownUsers[loggedInUser.ID] = protocol.UserInfo{UserID: loggedInUser.ID, DisplayName: loggedInUser.DisplayName, IsOnline: true}
-				}
+			clearLineAndPrint("CLIENT: Channels:")
+			for _, ch := range resp.Channels {
+				printChannel(clearLineAndPrintf, ch)
 			}
-			knownUsers = tempKnownUsers
+		}
 
-		case protocol.MsgTypeChatHistoryResponse:
-			var resp protocol.ChatHistoryResponsePayload
-			if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
-				clearLineAndPrintf("CLIENT: Error unmarshalling ChatHistoryResponse: %v\n", err)
-				continue
+	case protocol.MsgTypeChannelUpdateNotify:
+		var update protocol.ChannelUpdateNotifyPayload
+		if err := json.Unmarshal(wsMsg.Payload, &update); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling ChannelUpdateNotify: %v\n", err)
+			return
+		}
+		ch := update.Channel
+		switch update.Event {
+		case protocol.ChannelEventJoined:
+			knownChannels[ch.Name] = *ch
+			clearLineAndPrintf("CLIENT: You joined #%s on another device.\n", ch.Name)
+		case protocol.ChannelEventLeft:
+			delete(knownChannels, ch.Name)
+			delete(lastSeqs, ch.ChatID)
+			if currentChatID == ch.ChatID {
+				currentChatID = "global_broadcast"
+				updatePrompt()
 			}
-			clearLineAndPrintf("CLIENT: Chat History for %s (Last %d messages):\n", resp.ChatID, len(resp.Messages))
-			for _, msg := range resp.Messages {
-				timestamp := time.Unix(msg.Timestamp, 0).Format("02.01.06 15:04:05")
-				senderDisplayName := msg.SenderName
-				if sender, ok := knownUsers[msg.SenderID]; ok {
-					senderDisplayName = sender.DisplayName
-				}
-				clearLineAndPrintf("  [%s] %s: %s\n", timestamp, senderDisplayName, msg.Text)
+			clearLineAndPrintf("CLIENT: You left #%s on another device.\n", ch.Name)
+		case protocol.ChannelEventTopicChanged:
+			if ch.Joined {
+				knownChannels[ch.Name] = *ch
 			}
-			if len(resp.Messages) == 0 {
-				clearLineAndPrint("  (No messages in this chat yet)")
+			if ch.Topic == "" {
+				clearLineAndPrintf("CLIENT: %s cleared the topic of #%s.\n", knownUserName(update.ActorID), ch.Name)
+			} else {
+				clearLineAndPrintf("CLIENT: %s changed the topic of #%s: %s\n", knownUserName(update.ActorID), ch.Name, ch.Topic)
 			}
+		}
 
-		case protocol.MsgTypeErrorNotify:
-			var errMsg protocol.ErrorPayload
-			if err := json.Unmarshal(wsMsg.Payload, &errMsg); err != nil {
-				clearLineAndPrintf("CLIENT: Error unmarshalling ErrorNotify: %v\n", err)
+	case protocol.MsgTypeUnreadSummaryNotify:
+		var summary protocol.UnreadSummaryPayload
+		if err := json.Unmarshal(wsMsg.Payload, &summary); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling UnreadSummaryNotify: %v\n", err)
+			return
+		}
+		clearLineAndPrintf("CLIENT: %d unread message(s) in %d chat(s) while you were away:\n", summary.TotalUnread, len(summary.Chats))
+		for _, chat := range summary.Chats {
+			// Отправитель может быть не в сети; запоминаем его, чтобы работала команда /chat
+			if _, ok := knownUsers[chat.SenderID]; !ok {
+				knownUsers[chat.SenderID] = protocol.UserInfo{UserID: chat.SenderID, DisplayName: chat.SenderName}
+			}
+			clearLineAndPrintf("  %s (%s): %d message(s)\n", chat.SenderName, chat.SenderID, chat.UnreadCount)
+		}
+		clearLineAndPrint("(To read: /chat <user_id_or_name>)")
+
+	case protocol.MsgTypeSyncResponse:
+		var resp protocol.SyncResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling SyncResponse: %v\n", err)
+			return
+		}
+		var more []string
+		for _, chat := range resp.Chats {
+			var missed []protocol.StoredMessage
+			for _, msg := range chat.Messages {
+				// Сообщение могло прийти вживую, пока запрос был в пути
+				if msg.Seq > lastSeqs[chat.ChatID] {
+					missed = append(missed, msg)
+				}
+			}
+			if chat.HasMore {
+				more = append(more, chat.ChatID)
+			}
+			if len(missed) == 0 {
 				continue
 			}
-			clearLineAndPrintf("CLIENT: Server Error [%s]: %s\n", errMsg.ErrorCode, errMsg.ErrorMessage)
+			clearLineAndPrintf("CLIENT: %d missed message(s) in %s:\n", len(missed), chat.ChatID)
+			var received []string
+			for _, msg := range missed {
+				noteSeq(chat.ChatID, msg.Seq)
+				timestamp := time.UnixMilli(msg.Timestamp).Format("02.01.06 15:04:05")
+				clearLineAndPrintf("  [%s] %s: %s\n", timestamp, msg.SenderName, msg.Text)
+				if strings.HasPrefix(chat.ChatID, "private:") && msg.SenderID != loggedInUser.ID {
+					received = append(received, msg.MessageID)
+				}
+			}
+			if chat.ChatID == currentChatID {
+				sendReceipt(protocol.MsgTypeMessageRead, chat.ChatID, received)
+			} else {
+				sendReceipt(protocol.MsgTypeMessageDelivered, chat.ChatID, received)
+			}
+		}
+		if len(more) > 0 {
+			requestSync(more)
+		}
 
+	case protocol.MsgTypeSetReadReceiptsResponse:
+		var resp protocol.SetReadReceiptsResponsePayload
+		if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling SetReadReceiptsResponse: %v\n", err)
+			return
+		}
+		switch {
+		case !resp.Success:
+			clearLineAndPrintf("CLIENT: Could not change read receipts setting: %s\n", resp.ErrorMessage)
+		case resp.Enabled:
+			clearLineAndPrint("CLIENT: Read receipts enabled. Others will see when you read their messages.")
 		default:
-			clearLineAndPrintf("CLIENT: Received unknown message type: %s\n", wsMsg.Type)
+			clearLineAndPrint("CLIENT: Read receipts disabled. Others will only see that their messages were delivered.")
+		}
+
+	case protocol.MsgTypeErrorNotify:
+		var errMsg protocol.ErrorPayload
+		if err := json.Unmarshal(wsMsg.Payload, &errMsg); err != nil {
+			clearLineAndPrintf("CLIENT: Error unmarshalling ErrorNotify: %v\n", err)
+			return
+		}
+		clearLineAndPrintf("CLIENT: Server Error [%s]: %s\n", errMsg.ErrorCode, errMsg.ErrorMessage)
+		// Сервер отклонил сообщение - повторять его после переподключения бессмысленно
+		if wsMsg.RequestID != "" {
+			removePendingSend(func(p *pendingSend) bool { return p.requestID == wsMsg.RequestID })
 		}
+
+	default:
+		clearLineAndPrintf("CLIENT: Received unknown message type: %s\n", wsMsg.Type)
 	}
 }
 
 func connectToServer() error {
 	u := "ws://" + *addr + "/ws"
 	log.Printf("Connecting to %s", u)
-	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	dialer := *websocket.DefaultDialer
+	if *encoding == "binary" {
+		dialer.Subprotocols = []string{protocol.SubprotocolBinary}
+	}
+	c, _, err := dialer.Dial(u, nil)
 	if err != nil {
 		log.Printf("Failed to connect to %s: %v", u, err)
 		return err
 	}
+	// Сервер, не поддерживающий запрошенный подпротокол, отвечает без него - тогда остаемся на JSON.
+	connCodec := protocol.CodecForSubprotocol(c.Subprotocol())
+	hello, err := helloHandshake(c, connCodec)
+	if err != nil {
+		c.Close()
+		return err
+	}
 	conn = c
-	log.Println("Connected to server.")
+	codec = connCodec
+	log.Printf("Connected to server (protocol version %d, %s encoding).", hello.ProtocolVersion, connCodec.Subprotocol())
 	return nil
 }
 
+// errProtocolRejected - сервер не поддерживает версию протокола клиента; переподключение не поможет.
+var errProtocolRejected = errors.New("server rejected the client protocol version")
+
+// helloHandshake сообщает серверу версию протокола и возможности клиента и ждет HELLO_RESPONSE.
+// Выполняется до запуска слушателя, поэтому ответ читается здесь же.
+func helloHandshake(c *websocket.Conn, connCodec protocol.Codec) (protocol.HelloResponsePayload, error) {
+	var resp protocol.HelloResponsePayload
+	helloBytes, err := connCodec.Encode(protocol.MsgTypeHello, "", protocol.HelloPayload{
+		ProtocolVersion: protocol.ProtocolVersion,
+		Features:        []string{protocol.FeatureRequestID, protocol.FeatureSecondFactor, protocol.FeatureBatch, protocol.FeatureReceipts, protocol.FeatureUnreadSummary},
+		ClientName:      "messengor-console",
+	})
+	if err != nil {
+		return resp, fmt.Errorf("failed to encode hello: %w", err)
+	}
+	if err := c.WriteMessage(connCodec.FrameType(), helloBytes); err != nil {
+		return resp, fmt.Errorf("failed to send hello: %w", err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(replyTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	_, messageBytes, err := c.ReadMessage()
+	if err != nil {
+		return resp, fmt.Errorf("no hello response from server: %w", err)
+	}
+	wsMsg, err := connCodec.Decode(messageBytes)
+	if err != nil {
+		return resp, fmt.Errorf("failed to decode hello response: %w", err)
+	}
+	if wsMsg.Type != protocol.MsgTypeHelloResponse {
+		return resp, fmt.Errorf("unexpected %s instead of hello response", wsMsg.Type)
+	}
+	if err := json.Unmarshal(wsMsg.Payload, &resp); err != nil {
+		return resp, fmt.Errorf("failed to parse hello response: %w", err)
+	}
+	if !resp.Success {
+		return resp, fmt.Errorf("%w: %s (%s)", errProtocolRejected, resp.ErrorMessage, resp.ErrorCode)
+	}
+	return resp, nil
+}
+
 func handleUserInput() {
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Println("Console Client Started. Type /help for commands.")
@@ -323,12 +1377,15 @@ func handleUserInput() {
 		if !isAuthenticated {
 			switch command {
 			case "/register":
-				if len(parts) != 4 {
-					fmt.Println("Usage: /register <username> <password> <display_name>")
+				if len(parts) != 4 && len(parts) != 5 {
+					fmt.Println("Usage: /register <username> <password> <display_name> [invite_code]")
 					continue
 				}
 				req := protocol.RegisterRequestPayload{Username: parts[1], Password: parts[2], DisplayName: parts[3]}
-				if err := sendRequest(protocol.MsgTypeRegisterRequest, req); err != nil {
+				if len(parts) == 5 {
+					req.InviteCode = parts[4]
+				}
+				if err := request(protocol.MsgTypeRegisterRequest, req); err != nil {
 					log.Printf("Error sending register request: %v", err)
 				}
 			case "/login":
@@ -337,9 +1394,18 @@ func handleUserInput() {
 					continue
 				}
 				req := protocol.LoginRequestPayload{Username: parts[1], Password: parts[2]}
-				if err := sendRequest(protocol.MsgTypeLoginRequest, req); err != nil {
+				if err := request(protocol.MsgTypeLoginRequest, req); err != nil {
 					log.Printf("Error sending login request: %v", err)
 				}
+			case "/code":
+				if len(parts) != 2 {
+					fmt.Println("Usage: /code <authenticator_code_or_recovery_code>")
+					continue
+				}
+				req := protocol.SecondFactorRequestPayload{Code: parts[1]}
+				if err := request(protocol.MsgTypeSecondFactorRequest, req); err != nil {
+					log.Printf("Error sending second factor request: %v", err)
+				}
 			case "/exit":
 				fmt.Println("Exiting...")
 				if conn != nil {
@@ -348,8 +1414,9 @@ func handleUserInput() {
 				os.Exit(0)
 			case "/help":
 				fmt.Println("Available commands (when not logged in):")
-				fmt.Println("  /register <username> <password> <display_name>")
+				fmt.Println("  /register <username> <password> <display_name> [invite_code]")
 				fmt.Println("  /login <username> <password>")
+				fmt.Println("  /code <code>  (second factor after /login, if enabled)")
 				fmt.Println("  /exit")
 				fmt.Println("  /help")
 			default:
@@ -362,7 +1429,7 @@ func handleUserInput() {
 		switch command {
 		case "/users":
 			req := protocol.GetUserListRequestPayload{} // Пустой payload
-			if err := sendRequest(protocol.MsgTypeGetUserListRequest, req); err != nil {
+			if err := request(protocol.MsgTypeGetUserListRequest, req); err != nil {
 				log.Printf("Error requesting user list: %v", err)
 			}
 		case "/pm":
@@ -374,16 +1441,15 @@ func handleUserInput() {
 			text := strings.Join(parts[2:], " ")
 
 			var targetUserID string
-			// Пытаемся найти пользователя по DisplayName, затем по UserID
-			found := false
-			for _, u := range knownUsers {
-				if u.DisplayName == targetIdentifier || u.UserID == targetIdentifier {
-					targetUserID = u.UserID
-					found = true
-					break
-				}
+			// Пытаемся найти пользователя по UserID, затем по DisplayName
+			user, found, err := findKnownUser(targetIdentifier)
+			if err != nil {
+				fmt.Println(err)
+				continue
 			}
-			if !found {
+			if found {
+				targetUserID = user.UserID
+			} else {
 				// Если не нашли, считаем, что это UserID (может, пользователь еще не в knownUsers)
 				fmt.Printf("Warning: User '%s' not in known users list. Assuming it's a UserID.\n", targetIdentifier)
 				targetUserID = targetIdentifier
@@ -392,8 +1458,9 @@ func handleUserInput() {
 			req := protocol.SendPrivateMessageRequestPayload{
 				TargetUserID: targetUserID,
 				Text:         text,
+				ClientMsgID:  uuid.NewString(),
 			}
-			if err := sendRequest(protocol.MsgTypeSendPrivateMessageRequest, req); err != nil {
+			if err := sendChatMessage(req.ClientMsgID, protocol.MsgTypeSendPrivateMessageRequest, req, true); err != nil {
 				log.Printf("Error sending private message: %v", err)
 			}
 		case "/history":
@@ -401,22 +1468,25 @@ func handleUserInput() {
 			limit := 20 // Default limit
 			if len(parts) > 1 {
 				chatIDForHistory = parts[1]
+				if strings.HasPrefix(chatIDForHistory, "#") {
+					chatIDForHistory = protocol.ChannelChatID(channelName(chatIDForHistory))
+				}
 				// Проверим, является ли аргумент именем пользователя, чтобы получить историю с ним
-				foundUser := false
-				for _, u := range knownUsers {
-					if u.DisplayName == chatIDForHistory || u.UserID == chatIDForHistory {
-						var genErr error
-						chatIDForHistory, genErr = generatePrivateChatIDClient(loggedInUser.ID, u.UserID)
-						if genErr != nil {
-							fmt.Printf("Error generating chat ID for history with %s: %v\n", u.DisplayName, genErr)
-							continue
-						}
-						foundUser = true
-						break
+				u, foundUser, err := findKnownUser(chatIDForHistory)
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				if foundUser {
+					var genErr error
+					chatIDForHistory, genErr = generatePrivateChatIDClient(loggedInUser.ID, u.UserID)
+					if genErr != nil {
+						fmt.Printf("Error generating chat ID for history with %s: %v\n", u.DisplayName, genErr)
+						continue
 					}
 				}
 				if !foundUser && !strings.Contains(chatIDForHistory, ":") && chatIDForHistory != "global_broadcast" {
-					fmt.Printf("Cannot determine chat ID for history: '%s'. Use user ID, display name, 'global_broadcast', or a full private chat ID (private:X:Y).\n", chatIDForHistory)
+					fmt.Printf("Cannot determine chat ID for history: '%s'. Use user ID, display name, #channel, 'global_broadcast', or a full private chat ID (private:X:Y).\n", chatIDForHistory)
 					continue
 				}
 			} else {
@@ -426,7 +1496,7 @@ func handleUserInput() {
 				ChatID: chatIDForHistory,
 				Limit:  limit,
 			}
-			if err := sendRequest(protocol.MsgTypeGetChatHistoryRequest, req); err != nil {
+			if err := request(protocol.MsgTypeGetChatHistoryRequest, req); err != nil {
 				log.Printf("Error requesting chat history for %s: %v", chatIDForHistory, err)
 			}
 		case "/chat": // Переключиться на чат с пользователем
@@ -435,14 +1505,10 @@ func handleUserInput() {
 				continue
 			}
 			targetIdentifier := parts[1]
-			var targetUserID string
-			found := false
-			for _, u := range knownUsers {
-				if u.DisplayName == targetIdentifier || u.UserID == targetIdentifier {
-					targetUserID = u.UserID
-					found = true
-					break
-				}
+			user, found, err := findKnownUser(targetIdentifier)
+			if err != nil {
+				fmt.Println(err)
+				continue
 			}
 			if !found {
 				fmt.Printf("User '%s' not found in known users list. Cannot switch chat.\n", targetIdentifier)
@@ -452,6 +1518,7 @@ func handleUserInput() {
 				}
 				continue
 			}
+			targetUserID := user.UserID
 			if targetUserID == loggedInUser.ID {
 				fmt.Println("Cannot start a private chat with yourself this way.")
 				continue
@@ -467,7 +1534,7 @@ func handleUserInput() {
 			fmt.Printf("Switched to private chat with %s (Chat ID: %s).\n", targetIdentifier, currentChatID)
 			// Запросим историю для нового чата
 			reqHistory := protocol.GetChatHistoryRequestPayload{ChatID: currentChatID, Limit: 20}
-			if err := sendRequest(protocol.MsgTypeGetChatHistoryRequest, reqHistory); err != nil {
+			if err := request(protocol.MsgTypeGetChatHistoryRequest, reqHistory); err != nil {
 				log.Printf("Error requesting chat history for new chat %s: %v", currentChatID, err)
 			}
 
@@ -477,15 +1544,15 @@ func handleUserInput() {
 				continue
 			}
 			newChatID := parts[1]
-			if newChatID != "global_broadcast" && !strings.HasPrefix(newChatID, "private:") {
-				fmt.Println("Invalid chat ID format. Must be 'global_broadcast' or start with 'private:'.")
+			if newChatID != "global_broadcast" && !strings.HasPrefix(newChatID, "private:") && !strings.HasPrefix(newChatID, protocol.GroupChatIDPrefix) && !strings.HasPrefix(newChatID, protocol.ChannelChatIDPrefix) {
+				fmt.Println("Invalid chat ID format. Must be 'global_broadcast' or start with 'private:', 'group:' or 'channel:'.")
 				continue
 			}
 			currentChatID = newChatID
 			updatePrompt()
 			fmt.Printf("Switched to chat ID: %s.\n", currentChatID)
 			reqHistory := protocol.GetChatHistoryRequestPayload{ChatID: currentChatID, Limit: 20}
-			if err := sendRequest(protocol.MsgTypeGetChatHistoryRequest, reqHistory); err != nil {
+			if err := request(protocol.MsgTypeGetChatHistoryRequest, reqHistory); err != nil {
 				log.Printf("Error requesting chat history for new chat %s: %v", currentChatID, err)
 			}
 
@@ -495,10 +1562,317 @@ func handleUserInput() {
 			fmt.Println("Switched to Global Chat.")
 			// Запросим историю для глобального чата
 			reqHistory := protocol.GetChatHistoryRequestPayload{ChatID: currentChatID, Limit: 20}
-			if err := sendRequest(protocol.MsgTypeGetChatHistoryRequest, reqHistory); err != nil {
+			if err := request(protocol.MsgTypeGetChatHistoryRequest, reqHistory); err != nil {
 				log.Printf("Error requesting chat history for global chat: %v", err)
 			}
 
+		case "/channel":
+			usage := "Usage: /channel create <#name> [topic] | /channel list [query] | /channel join <#name>\n" +
+				"       /channel leave [#name] | /channel topic [text]\n" +
+				"topic shows or sets the topic of the current channel; leave without a name leaves the current channel."
+			if len(parts) < 2 {
+				fmt.Println(usage)
+				continue
+			}
+			var err error
+			switch {
+			case parts[1] == "create" && len(parts) >= 3:
+				err = request(protocol.MsgTypeCreateChannelRequest, protocol.CreateChannelRequestPayload{
+					Name:  channelName(parts[2]),
+					Topic: strings.Join(parts[3:], " "),
+				})
+			case parts[1] == "list":
+				showChannelList = true
+				err = request(protocol.MsgTypeListChannelsRequest, protocol.ListChannelsRequestPayload{Query: strings.Join(parts[2:], " ")})
+			case parts[1] == "join" && len(parts) == 3:
+				name := channelName(parts[2])
+				if name == protocol.DefaultChannelName {
+					fmt.Println("Everyone is in #global already. Use /global to switch to it.")
+					continue
+				}
+				err = request(protocol.MsgTypeJoinChannelRequest, protocol.ChannelRequestPayload{Name: name})
+			case parts[1] == "leave" && len(parts) <= 3:
+				name := currentChannelName()
+				if len(parts) == 3 {
+					name = channelName(parts[2])
+				}
+				if name == "" {
+					fmt.Println("Switch to a channel first or name it: /channel leave <#name>")
+					continue
+				}
+				if protocol.ChannelChatID(name) == currentChatID {
+					currentChatID = "global_broadcast"
+					updatePrompt()
+				}
+				err = request(protocol.MsgTypeLeaveChannelRequest, protocol.ChannelRequestPayload{Name: name})
+			case parts[1] == "topic":
+				name := currentChannelName()
+				if name == "" {
+					fmt.Println("Switch to a channel first: /channel join <#name>")
+					continue
+				}
+				if len(parts) == 2 {
+					if ch, ok := knownChannels[name]; ok && ch.Topic != "" {
+						fmt.Printf("Topic of #%s: %s\n", name, ch.Topic)
+					} else {
+						fmt.Printf("#%s has no topic. Set one with /channel topic <text>.\n", name)
+					}
+					continue
+				}
+				err = request(protocol.MsgTypeSetChannelTopicRequest, protocol.SetChannelTopicRequestPayload{Name: name, Topic: strings.Join(parts[2:], " ")})
+			default:
+				fmt.Println(usage)
+				continue
+			}
+			if err != nil {
+				log.Printf("Error sending channel request: %v", err)
+			}
+
+		case "/group":
+			usage := "Usage: /group create <title> | /group list | /group open <group_id_or_title>\n" +
+				"       /group members | /group invite <user_id_or_name> [admin] | /group remove <user_id_or_name> | /group leave\n" +
+				"members, invite, remove and leave act on the current group."
+			if len(parts) < 2 {
+				fmt.Println(usage)
+				continue
+			}
+			// Команды, относящиеся к текущей группе
+			group, inGroup := knownGroups[currentChatID]
+			if !inGroup && (parts[1] == "members" || parts[1] == "invite" || parts[1] == "remove" || parts[1] == "leave") {
+				fmt.Println("Switch to a group first: /group open <group_id_or_title>")
+				continue
+			}
+			var err error
+			switch {
+			case parts[1] == "create" && len(parts) >= 3:
+				err = request(protocol.MsgTypeCreateGroupRequest, protocol.CreateGroupRequestPayload{Title: strings.Join(parts[2:], " ")})
+			case parts[1] == "list" && len(parts) == 2:
+				showGroupList = true
+				err = request(protocol.MsgTypeListGroupsRequest, protocol.ListGroupsRequestPayload{})
+			case parts[1] == "open" && len(parts) >= 3:
+				g, found, findErr := findKnownGroup(strings.Join(parts[2:], " "))
+				if findErr != nil {
+					fmt.Println(findErr)
+					continue
+				}
+				if !found {
+					fmt.Printf("Group '%s' not found. Use /group list to refresh your groups.\n", strings.Join(parts[2:], " "))
+					continue
+				}
+				currentChatID = g.ChatID
+				updatePrompt()
+				fmt.Printf("Switched to group %s (Chat ID: %s).\n", g.Title, g.ChatID)
+				err = request(protocol.MsgTypeGetChatHistoryRequest, protocol.GetChatHistoryRequestPayload{ChatID: g.ChatID, Limit: 20})
+			case parts[1] == "members" && len(parts) == 2:
+				printGroup(func(format string, a ...interface{}) { fmt.Printf(format, a...) }, group)
+			case parts[1] == "invite" && (len(parts) == 3 || (len(parts) == 4 && parts[3] == protocol.GroupRoleAdmin)),
+				parts[1] == "remove" && len(parts) == 3:
+				// Участников группы знаем по ее описанию, остальных - по списку пользователей
+				targetUserID := ""
+				for _, m := range group.Members {
+					if m.UserID == parts[2] || strings.EqualFold(m.DisplayName, parts[2]) {
+						targetUserID = m.UserID
+						break
+					}
+				}
+				if targetUserID == "" {
+					u, found, findErr := findKnownUser(parts[2])
+					if findErr != nil {
+						fmt.Println(findErr)
+						continue
+					}
+					if found {
+						targetUserID = u.UserID
+					} else {
+						fmt.Printf("Warning: User '%s' not in known users list. Assuming it's a UserID.\n", parts[2])
+						targetUserID = parts[2]
+					}
+				}
+				if parts[1] == "remove" {
+					err = request(protocol.MsgTypeGroupRemoveMemberRequest, protocol.GroupRemoveMemberRequestPayload{ChatID: group.ChatID, UserID: targetUserID})
+				} else {
+					req := protocol.GroupInviteRequestPayload{ChatID: group.ChatID, UserID: targetUserID}
+					if len(parts) == 4 {
+						req.Role = protocol.GroupRoleAdmin
+					}
+					err = request(protocol.MsgTypeGroupInviteRequest, req)
+				}
+			case parts[1] == "leave" && len(parts) == 2:
+				delete(knownGroups, group.ChatID)
+				delete(lastSeqs, group.ChatID)
+				currentChatID = "global_broadcast"
+				updatePrompt()
+				err = request(protocol.MsgTypeLeaveGroupRequest, protocol.LeaveGroupRequestPayload{ChatID: group.ChatID})
+			default:
+				fmt.Println(usage)
+				continue
+			}
+			if err != nil {
+				log.Printf("Error sending group request: %v", err)
+			}
+
+		case "/passwd":
+			if len(parts) != 3 {
+				fmt.Println("Usage: /passwd <old_password> <new_password>")
+				continue
+			}
+			req := protocol.ChangePasswordRequestPayload{OldPassword: parts[1], NewPassword: parts[2]}
+			if err := request(protocol.MsgTypeChangePasswordRequest, req); err != nil {
+				log.Printf("Error sending change password request: %v", err)
+			}
+
+		case "/deactivate", "/delete_account":
+			if len(parts) != 2 {
+				fmt.Printf("Usage: %s <password>\n", command)
+				continue
+			}
+			msgType := protocol.MsgTypeDeactivateAccountRequest
+			if command == "/delete_account" {
+				msgType = protocol.MsgTypeDeleteAccountRequest
+			}
+			req := protocol.AccountPasswordConfirmPayload{Password: parts[1]}
+			if err := request(msgType, req); err != nil {
+				log.Printf("Error sending %s request: %v", command, err)
+			}
+
+		case "/readreceipts":
+			if len(parts) != 2 || (parts[1] != "on" && parts[1] != "off") {
+				fmt.Println("Usage: /readreceipts on|off")
+				continue
+			}
+			req := protocol.SetReadReceiptsRequestPayload{Enabled: parts[1] == "on"}
+			if err := request(protocol.MsgTypeSetReadReceiptsRequest, req); err != nil {
+				log.Printf("Error sending read receipts request: %v", err)
+			}
+
+		case "/logout":
+			msgType := protocol.MsgTypeLogoutRequest
+			if len(parts) == 2 && parts[1] == "all" {
+				msgType = protocol.MsgTypeLogoutAllRequest
+			} else if len(parts) != 1 {
+				fmt.Println("Usage: /logout [all]")
+				continue
+			}
+			if err := request(msgType, struct{}{}); err != nil {
+				log.Printf("Error sending logout request: %v", err)
+			}
+
+		case "/token":
+			usage := "Usage: /token create <name> <scope,...> | /token list | /token revoke <token_id>\nScopes: " +
+				strings.Join([]string{protocol.ScopeReadHistory, protocol.ScopeSendGlobal, protocol.ScopeSendPrivate}, ", ")
+			if len(parts) < 2 {
+				fmt.Println(usage)
+				continue
+			}
+			var err error
+			switch {
+			case parts[1] == "create" && len(parts) == 4:
+				req := protocol.CreateAPITokenRequestPayload{Name: parts[2], Scopes: strings.Split(parts[3], ",")}
+				err = request(protocol.MsgTypeCreateAPITokenRequest, req)
+			case parts[1] == "list" && len(parts) == 2:
+				err = request(protocol.MsgTypeListAPITokensRequest, struct{}{})
+			case parts[1] == "revoke" && len(parts) == 3:
+				err = request(protocol.MsgTypeRevokeAPITokenRequest, protocol.RevokeAPITokenRequestPayload{TokenID: parts[2]})
+			default:
+				fmt.Println(usage)
+				continue
+			}
+			if err != nil {
+				log.Printf("Error sending api token request: %v", err)
+			}
+
+		case "/2fa":
+			var err error
+			switch {
+			case len(parts) == 3 && parts[1] == "enroll":
+				err = request(protocol.MsgTypeTOTPEnrollRequest, protocol.AccountPasswordConfirmPayload{Password: parts[2]})
+			case len(parts) == 3 && parts[1] == "confirm":
+				err = request(protocol.MsgTypeTOTPConfirmRequest, protocol.TOTPCodePayload{Code: parts[2]})
+			case len(parts) == 4 && parts[1] == "disable":
+				err = request(protocol.MsgTypeTOTPDisableRequest, protocol.TOTPDisableRequestPayload{Password: parts[2], Code: parts[3]})
+			default:
+				fmt.Println("Usage: /2fa enroll <password> | /2fa confirm <code> | /2fa disable <password> <code>")
+				continue
+			}
+			if err != nil {
+				log.Printf("Error sending two-factor request: %v", err)
+			}
+
+		case "/invite":
+			usage := "Usage: /invite create [max_uses] [valid_for, e.g. 24h] | /invite list | /invite revoke <code>"
+			if len(parts) < 2 {
+				fmt.Println(usage)
+				continue
+			}
+			var err error
+			switch {
+			case parts[1] == "create" && len(parts) <= 4:
+				req := protocol.CreateInviteRequestPayload{MaxUses: 1}
+				if len(parts) >= 3 {
+					if _, scanErr := fmt.Sscanf(parts[2], "%d", &req.MaxUses); scanErr != nil {
+						fmt.Println(usage)
+						continue
+					}
+				}
+				if len(parts) == 4 {
+					validFor, parseErr := time.ParseDuration(parts[3])
+					if parseErr != nil {
+						fmt.Println(usage)
+						continue
+					}
+					req.ExpiresInSeconds = int64(validFor.Seconds())
+				}
+				err = request(protocol.MsgTypeCreateInviteRequest, req)
+			case parts[1] == "list" && len(parts) == 2:
+				err = request(protocol.MsgTypeListInvitesRequest, struct{}{})
+			case parts[1] == "revoke" && len(parts) == 3:
+				err = request(protocol.MsgTypeRevokeInviteRequest, protocol.RevokeInviteRequestPayload{Code: parts[2]})
+			default:
+				fmt.Println(usage)
+				continue
+			}
+			if err != nil {
+				log.Printf("Error sending invite request: %v", err)
+			}
+
+		case "/kick":
+			if len(parts) < 2 {
+				fmt.Println("Usage: /kick <user_id_or_name> [reason]")
+				continue
+			}
+			user, found, err := findKnownUser(parts[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			targetUserID := parts[1]
+			if found {
+				targetUserID = user.UserID
+			}
+			req := protocol.KickUserRequestPayload{TargetUserID: targetUserID, Reason: strings.Join(parts[2:], " ")}
+			if err := request(protocol.MsgTypeKickUserRequest, req); err != nil {
+				log.Printf("Error sending kick request: %v", err)
+			}
+
+		case "/role":
+			if len(parts) != 3 {
+				fmt.Println("Usage: /role <user_id_or_name> <user|moderator|admin>")
+				continue
+			}
+			user, found, err := findKnownUser(parts[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			targetUserID := parts[1]
+			if found {
+				targetUserID = user.UserID
+			}
+			req := protocol.SetUserRoleRequestPayload{TargetUserID: targetUserID, Role: parts[2]}
+			if err := request(protocol.MsgTypeSetUserRoleRequest, req); err != nil {
+				log.Printf("Error sending set role request: %v", err)
+			}
+
 		case "/exit":
 			fmt.Println("Exiting...")
 			if conn != nil {
@@ -512,22 +1886,18 @@ func handleUserInput() {
 			}
 			os.Exit(0)
 		case "/help":
-			fmt.Println("Available commands (when logged in):")
-			fmt.Println("  <message text>             - Send to current chat (global or private)")
-			fmt.Println("  /pm <user_id_or_name> <msg> - Send private message directly")
-			fmt.Println("  /users                     - List online users")
-			fmt.Println("  /history [chat_id|user_name] - Show history for current/specified chat (last 20)")
-			fmt.Println("  /chat <user_id_or_name>    - Switch to private chat with user")
-			fmt.Println("  /chatid <full_chat_id>     - Switch to chat by its full ID")
-			fmt.Println("  /global                    - Switch to global chat")
-			fmt.Println("  /exit                      - Exit the client")
-			fmt.Println("  /help                      - Show this help message")
+			fmt.Printf("Available commands (logged in as %s):\n", loggedInUser.Role)
+			for _, h := range helpLines {
+				if h.perm == "" || hasPermission(h.perm) {
+					fmt.Println(h.line)
+				}
+			}
 
 		default: // Считаем, что это текст сообщения для текущего чата
 			text := input
 			if currentChatID == "global_broadcast" {
-				req := protocol.TextPayload{Text: text}
-				if err := sendRequest(protocol.MsgTypeText, req); err != nil { // MsgTypeText для broadcast
+				req := protocol.TextPayload{Text: text, ClientMsgID: uuid.NewString()}
+				if err := sendChatMessage(req.ClientMsgID, protocol.MsgTypeText, req, false); err != nil { // Подтверждение - собственная рассылка BROADCAST_TEXT_MESSAGE
 					log.Printf("Error sending broadcast message: %v", err)
 				}
 			} else if strings.HasPrefix(currentChatID, "private:") {
@@ -545,10 +1915,21 @@ func handleUserInput() {
 				req := protocol.SendPrivateMessageRequestPayload{
 					TargetUserID: targetUserID,
 					Text:         text,
+					ClientMsgID:  uuid.NewString(),
 				}
-				if err := sendRequest(protocol.MsgTypeSendPrivateMessageRequest, req); err != nil {
+				if err := sendChatMessage(req.ClientMsgID, protocol.MsgTypeSendPrivateMessageRequest, req, true); err != nil {
 					log.Printf("Error sending private message to current chat: %v", err)
 				}
+			} else if strings.HasPrefix(currentChatID, protocol.ChannelChatIDPrefix) {
+				req := protocol.SendChannelMessageRequestPayload{Name: currentChannelName(), Text: text, ClientMsgID: uuid.NewString()}
+				if err := sendChatMessage(req.ClientMsgID, protocol.MsgTypeSendChannelMessageRequest, req, true); err != nil {
+					log.Printf("Error sending channel message: %v", err)
+				}
+			} else if strings.HasPrefix(currentChatID, protocol.GroupChatIDPrefix) {
+				req := protocol.SendGroupMessageRequestPayload{ChatID: currentChatID, Text: text, ClientMsgID: uuid.NewString()}
+				if err := sendChatMessage(req.ClientMsgID, protocol.MsgTypeSendGroupMessageRequest, req, true); err != nil {
+					log.Printf("Error sending group message: %v", err)
+				}
 			} else {
 				fmt.Println("Unknown current chat ID type:", currentChatID, " - Cannot send message.")
 			}
@@ -559,6 +1940,9 @@ func handleUserInput() {
 func main() {
 	flag.Parse()
 	log.SetFlags(0)
+	if *encoding != "json" && *encoding != "binary" {
+		log.Fatalf("Invalid -encoding %q: must be json or binary", *encoding)
+	}
 
 	// Обработка Ctrl+C
 	interrupt := make(chan os.Signal, 1)
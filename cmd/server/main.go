@@ -1,15 +1,128 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
 
+	"github.com/vladimirruppel/messengor/internal/protocol"
 	"github.com/vladimirruppel/messengor/internal/server"
 )
 
+var (
+	addr                  = flag.String("addr", "localhost:8088", "http service address")
+	usersFile             = flag.String("users", "users_data.json", "path to the user data file")
+	sessionsFile          = flag.String("sessions", "sessions_data.json", "path to the session data file")
+	apiTokensFile         = flag.String("api-tokens", "api_tokens.json", "path to the api token data file")
+	inviteOnly            = flag.Bool("invite-only", false, "require a valid invite code for registration (invites are issued by admins, see -bootstrap-admin)")
+	historyDir            = flag.String("history", "./chat_history", "directory for chat history files")
+	usernameUniqueness    = flag.String("username-uniqueness", "normalized", "username uniqueness: normalized (case-insensitive) or exact")
+	displayNameUniqueness = flag.String("displayname-uniqueness", "normalized", "display name uniqueness: normalized, exact or none")
+	registrationPolicy    = flag.String("registration-policy", "", "path to a JSON registration policy (defaults are used when empty)")
+	checkNames            = flag.Bool("check-names", false, "report existing username/display name collisions under the current rules and exit")
+	maxConnsPerUser       = flag.Int("max-connections-per-user", 5, "maximum simultaneous connections per account (0 means unlimited)")
+	bootstrapAdmin        = flag.String("bootstrap-admin", "", "username of an existing user to promote to admin at startup")
+	connLimitPolicy       = flag.String("connection-limit-policy", "reject", "what to do when the per-user connection limit is reached: reject or evict-oldest")
+	minProtocolVersion    = flag.Int("min-protocol-version", protocol.LegacyProtocolVersion, "oldest client protocol version to accept (1 also accepts clients that do not send HELLO)")
+)
+
 func main() {
-	addr := "localhost:8088"
-	hub := server.NewHub()
+	flag.Parse()
+
+	var rules server.UniquenessRules
+	var err error
+	if rules.Username, err = server.ParseNameUniqueness(*usernameUniqueness); err != nil {
+		log.Fatalf("Invalid -username-uniqueness: %v", err)
+	}
+	if rules.Username == server.NotUnique {
+		// Логин - ключ для входа, поэтому совпадать он не может
+		log.Fatalf("Invalid -username-uniqueness: usernames must be unique (expected normalized or exact)")
+	}
+	if rules.DisplayName, err = server.ParseNameUniqueness(*displayNameUniqueness); err != nil {
+		log.Fatalf("Invalid -displayname-uniqueness: %v", err)
+	}
+	limitPolicy, err := server.ParseConnectionLimitPolicy(*connLimitPolicy)
+	if err != nil {
+		log.Fatalf("Invalid -connection-limit-policy: %v", err)
+	}
+	if *minProtocolVersion < protocol.LegacyProtocolVersion || *minProtocolVersion > protocol.ProtocolVersion {
+		log.Fatalf("Invalid -min-protocol-version: must be between %d and %d", protocol.LegacyProtocolVersion, protocol.ProtocolVersion)
+	}
+
+	users, err := server.NewJSONFileUserStore(*usersFile, rules)
+	if err != nil {
+		log.Fatalf("Failed to open user store: %v", err)
+	}
+
+	allUsers, err := users.List()
+	if err != nil {
+		log.Fatalf("Failed to list users: %v", err)
+	}
+	collisions := server.FindNameCollisions(allUsers, rules)
+	for _, c := range collisions {
+		log.Printf("Name collision: %s", c)
+	}
+	if *checkNames {
+		fmt.Printf("%d name collision(s) found.\n", len(collisions))
+		os.Exit(0)
+	}
+
+	if *bootstrapAdmin != "" {
+		if err := server.BootstrapAdmin(users, *bootstrapAdmin); err != nil {
+			log.Fatalf("Failed to bootstrap admin: %v", err)
+		}
+	} else if *inviteOnly && !hasAdmin(allUsers) {
+		// Без администратора выпустить приглашения некому, а регистрация без них закрыта
+		log.Printf("Warning: -invite-only is set but there is no admin to issue invites; promote an existing user with -bootstrap-admin <username>")
+	}
+
+	sessions, err := server.NewSessionStore(*sessionsFile)
+	if err != nil {
+		log.Fatalf("Failed to open session store: %v", err)
+	}
+	apiTokens, err := server.NewAPITokenStore(*apiTokensFile)
+	if err != nil {
+		log.Fatalf("Failed to open api token store: %v", err)
+	}
+	invites, err := server.NewInviteStore(server.InviteStorePath(*usersFile))
+	if err != nil {
+		log.Fatalf("Failed to open invite store: %v", err)
+	}
+	groups, err := server.NewGroupStore(server.GroupStorePath(*usersFile))
+	if err != nil {
+		log.Fatalf("Failed to open group store: %v", err)
+	}
+	channels, err := server.NewChannelStore(server.ChannelStorePath(*usersFile))
+	if err != nil {
+		log.Fatalf("Failed to open channel store: %v", err)
+	}
+	if err := server.InitHistoryStore(*historyDir); err != nil {
+		log.Fatalf("Failed to initialize history store: %v", err)
+	}
+
+	policy := server.DefaultRegistrationPolicy()
+	if *registrationPolicy != "" {
+		if policy, err = server.LoadRegistrationPolicy(*registrationPolicy); err != nil {
+			log.Fatalf("Failed to load registration policy: %v", err)
+		}
+	}
+
+	hub := server.NewHub(server.HubConfig{
+		Users:              users,
+		Sessions:           sessions,
+		APITokens:          apiTokens,
+		RegistrationPolicy: policy,
+		Invites:            invites,
+		InviteOnly:         *inviteOnly,
+		Groups:             groups,
+		Channels:           channels,
+
+		MaxConnectionsPerUser: *maxConnsPerUser,
+		ConnectionLimitPolicy: limitPolicy,
+		MinProtocolVersion:    *minProtocolVersion,
+	})
 
 	go hub.Run()
 
@@ -17,9 +130,19 @@ func main() {
 		server.HandleWebSocketConnections(hub, w, r)
 	})
 
-	log.Printf("Starting server on %s\n", addr)
-	err := http.ListenAndServe(addr, nil)
+	log.Printf("Starting server on %s\n", *addr)
+	err = http.ListenAndServe(*addr, nil)
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
 }
+
+// hasAdmin сообщает, есть ли среди пользователей активный администратор.
+func hasAdmin(users []*server.User) bool {
+	for _, u := range users {
+		if u.EffectiveRole() == server.RoleAdmin && !u.Deactivated {
+			return true
+		}
+	}
+	return false
+}
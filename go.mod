@@ -3,7 +3,8 @@ module github.com/vladimirruppel/messengor
 go 1.24.2
 
 require (
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
-	golang.org/x/crypto v0.38.0 // indirect
+	github.com/google/uuid v1.6.0
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/crypto v0.38.0
+	golang.org/x/text v0.25.0
 )
@@ -0,0 +1,219 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// Подпротоколы WebSocket (Sec-WebSocket-Protocol), которыми клиент выбирает кодировку.
+// Клиент, не запросивший подпротокол, общается в JSON.
+const (
+	SubprotocolJSON   = "messengor.json"
+	SubprotocolBinary = "messengor.bin"
+)
+
+// Subprotocols - подпротоколы в порядке предпочтения сервера.
+var Subprotocols = []string{SubprotocolBinary, SubprotocolJSON}
+
+// Codec кодирует конверт сообщения для передачи по WebSocket. Payload внутри конверта остается JSON,
+// поэтому обработчики разбирают его одинаково при любой кодировке.
+type Codec interface {
+	// Subprotocol - имя подпротокола, которым выбирается кодек.
+	Subprotocol() string
+	// FrameType - тип фрейма WebSocket (websocket.TextMessage или websocket.BinaryMessage).
+	FrameType() int
+	Encode(msgType, requestID string, payload interface{}) ([]byte, error)
+	Decode(data []byte) (WebSocketMessage, error)
+	// EncodeBatch объединяет уже закодированные сообщения в один фрейм BATCH.
+	EncodeBatch(frames [][]byte) ([]byte, error)
+	// SplitBatch возвращает сообщения из payload фрейма BATCH.
+	SplitBatch(payload []byte) ([][]byte, error)
+}
+
+// DecodeFrame декодирует фрейм, который может содержать одно сообщение или пакет BATCH.
+// Вложенные пакеты не допускаются.
+func DecodeFrame(codec Codec, data []byte) ([]WebSocketMessage, error) {
+	msg, err := codec.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type != MsgTypeBatch {
+		return []WebSocketMessage{msg}, nil
+	}
+	frames, err := codec.SplitBatch(msg.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split batch: %w", err)
+	}
+	messages := make([]WebSocketMessage, 0, len(frames))
+	for _, frame := range frames {
+		inner, err := codec.Decode(frame)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode batched message: %w", err)
+		}
+		if inner.Type == MsgTypeBatch {
+			return nil, errors.New("nested batch")
+		}
+		messages = append(messages, inner)
+	}
+	return messages, nil
+}
+
+// CodecForSubprotocol возвращает кодек согласованного подпротокола; по умолчанию JSON.
+func CodecForSubprotocol(subprotocol string) Codec {
+	if subprotocol == SubprotocolBinary {
+		return BinaryCodec{}
+	}
+	return JSONCodec{}
+}
+
+// JSONCodec - исходная кодировка: payload сериализуется в JSON и вкладывается в JSON-конверт.
+type JSONCodec struct{}
+
+func (JSONCodec) Subprotocol() string { return SubprotocolJSON }
+
+func (JSONCodec) FrameType() int { return websocket.TextMessage }
+
+func (JSONCodec) Encode(msgType, requestID string, payload interface{}) ([]byte, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	return json.Marshal(WebSocketMessage{Type: msgType, Payload: payloadBytes, RequestID: requestID})
+}
+
+func (JSONCodec) Decode(data []byte) (WebSocketMessage, error) {
+	var msg WebSocketMessage
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+// EncodeBatch собирает {"type":"BATCH","payload":[сообщение, ...]}. Сообщения уже являются
+// JSON-объектами и вставляются как есть, без повторной сериализации.
+func (JSONCodec) EncodeBatch(frames [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"type":"` + MsgTypeBatch + `","payload":[`)
+	for i, frame := range frames {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(frame)
+	}
+	buf.WriteString("]}")
+	return buf.Bytes(), nil
+}
+
+func (JSONCodec) SplitBatch(payload []byte) ([][]byte, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, err
+	}
+	frames := make([][]byte, len(raw))
+	for i, r := range raw {
+		frames[i] = r
+	}
+	return frames, nil
+}
+
+// binaryFrameVersion - первый байт бинарного фрейма; меняется при несовместимом изменении формата.
+const binaryFrameVersion = 1
+
+// ErrMalformedFrame - бинарный фрейм обрезан или имеет неизвестную версию.
+var ErrMalformedFrame = errors.New("malformed binary frame")
+
+// BinaryCodec - кодировка конверта с префиксами длины:
+//
+//	версия (1 байт) | uvarint длина + type | uvarint длина + request_id | payload в JSON до конца фрейма
+//
+// Payload сериализуется один раз, а конверт не разбирается JSON-парсером, в отличие от JSONCodec,
+// где payload повторно проходит через json.Marshal и json.Unmarshal вместе с конвертом. Выигрыш -
+// в процессорном времени и выделениях памяти. Фрейм почти не меньше JSON: сам payload остается JSON,
+// экономятся только ключи и кавычки конверта.
+type BinaryCodec struct{}
+
+func (BinaryCodec) Subprotocol() string { return SubprotocolBinary }
+
+func (BinaryCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (BinaryCodec) Encode(msgType, requestID string, payload interface{}) ([]byte, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	buf := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(msgType)+len(requestID)+len(payloadBytes))
+	buf = append(buf, binaryFrameVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(msgType)))
+	buf = append(buf, msgType...)
+	buf = binary.AppendUvarint(buf, uint64(len(requestID)))
+	buf = append(buf, requestID...)
+	return append(buf, payloadBytes...), nil
+}
+
+func (BinaryCodec) Decode(data []byte) (WebSocketMessage, error) {
+	var msg WebSocketMessage
+	if len(data) == 0 || data[0] != binaryFrameVersion {
+		return msg, ErrMalformedFrame
+	}
+	rest := data[1:]
+	msgType, rest, err := readBinaryString(rest)
+	if err != nil {
+		return msg, err
+	}
+	requestID, rest, err := readBinaryString(rest)
+	if err != nil {
+		return msg, err
+	}
+	msg.Type = msgType
+	msg.RequestID = requestID
+	if len(rest) > 0 {
+		msg.Payload = rest
+	}
+	return msg, nil
+}
+
+// EncodeBatch кодирует пакет как сообщение BATCH, payload которого - последовательность
+// вложенных фреймов, каждый с префиксом длины (uvarint).
+func (BinaryCodec) EncodeBatch(frames [][]byte) ([]byte, error) {
+	size := 0
+	for _, frame := range frames {
+		size += binary.MaxVarintLen64 + len(frame)
+	}
+	buf := make([]byte, 0, 2+len(MsgTypeBatch)+size)
+	buf = append(buf, binaryFrameVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(MsgTypeBatch)))
+	buf = append(buf, MsgTypeBatch...)
+	buf = binary.AppendUvarint(buf, 0) // У пакета нет request_id
+	for _, frame := range frames {
+		buf = binary.AppendUvarint(buf, uint64(len(frame)))
+		buf = append(buf, frame...)
+	}
+	return buf, nil
+}
+
+func (BinaryCodec) SplitBatch(payload []byte) ([][]byte, error) {
+	var frames [][]byte
+	for len(payload) > 0 {
+		n, size := binary.Uvarint(payload)
+		if size <= 0 || n > uint64(len(payload)-size) {
+			return nil, ErrMalformedFrame
+		}
+		end := size + int(n)
+		frames = append(frames, payload[size:end])
+		payload = payload[end:]
+	}
+	return frames, nil
+}
+
+// readBinaryString читает строку с префиксом длины и возвращает остаток фрейма.
+func readBinaryString(data []byte) (string, []byte, error) {
+	n, size := binary.Uvarint(data)
+	if size <= 0 || n > uint64(len(data)-size) {
+		return "", nil, ErrMalformedFrame
+	}
+	end := size + int(n)
+	return string(data[size:end]), data[end:], nil
+}
@@ -0,0 +1,264 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sample - сообщение, на котором сравниваются кодеки. decodeInto создает значение для разбора payload.
+type sample struct {
+	name       string
+	msgType    string
+	requestID  string
+	payload    interface{}
+	decodeInto func() interface{}
+}
+
+func samples() []sample {
+	now := time.Now().UnixMilli()
+	history := ChatHistoryResponsePayload{ChatID: "global_broadcast"}
+	for i := 0; i < 50; i++ {
+		history.Messages = append(history.Messages, StoredMessage{
+			ChatID:     "global_broadcast",
+			MessageID:  fmt.Sprintf("6f1c2d3e-4b5a-4c7d-8e9f-%012d", i),
+			SenderID:   "ca88033d-662a-43c0-a6b6-fc6f6d00c15a",
+			SenderName: "frank",
+			Text:       fmt.Sprintf("message number %d in a busy global chat", i),
+			Timestamp:  now + int64(i),
+			Seq:        uint64(i + 1),
+		})
+	}
+
+	return []sample{
+		{
+			name:    "broadcast",
+			msgType: MsgTypeBroadcastText,
+			payload: BroadcastTextPayload{
+				MessageID:  "6f1c2d3e-4b5a-4c7d-8e9f-000000000051",
+				SenderID:   "ca88033d-662a-43c0-a6b6-fc6f6d00c15a",
+				SenderName: "frank",
+				Text:       "hello everyone, \"quoted\" <tags> & unicode: привет",
+				Timestamp:  now,
+				Seq:        51,
+			},
+			decodeInto: func() interface{} { return new(BroadcastTextPayload) },
+		},
+		{
+			name:      "private_request",
+			msgType:   MsgTypeSendPrivateMessageRequest,
+			requestID: "42",
+			payload: SendPrivateMessageRequestPayload{
+				TargetUserID: "e8d3a4f6-6303-404d-9b3c-2f5a8d1e7c90",
+				Text:         strings.Repeat("long private message ", 20),
+			},
+			decodeInto: func() interface{} { return new(SendPrivateMessageRequestPayload) },
+		},
+		{
+			name:       "history_page",
+			msgType:    MsgTypeChatHistoryResponse,
+			requestID:  "43",
+			payload:    history,
+			decodeInto: func() interface{} { return new(ChatHistoryResponsePayload) },
+		},
+	}
+}
+
+func encodeBatch(codec Codec, batch []sample) ([]byte, error) {
+	frames := make([][]byte, 0, len(batch))
+	for _, s := range batch {
+		frame, err := codec.Encode(s.msgType, s.requestID, s.payload)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+	return codec.EncodeBatch(frames)
+}
+
+// decodeBatch разбирает фрейм так же, как консольный клиент, и сверяет его с исходными сообщениями.
+// Одиночный фрейм тоже проходит через DecodeFrame.
+func decodeBatch(codec Codec, frame []byte, batch []sample) error {
+	messages, err := DecodeFrame(codec, frame)
+	if err != nil {
+		return err
+	}
+	if len(messages) != len(batch) {
+		return fmt.Errorf("got %d messages, want %d", len(messages), len(batch))
+	}
+	for i, msg := range messages {
+		s := batch[i]
+		if msg.Type != s.msgType || msg.RequestID != s.requestID {
+			return fmt.Errorf("message %d: got type %q, request_id %q", i, msg.Type, msg.RequestID)
+		}
+		if err := json.Unmarshal(msg.Payload, s.decodeInto()); err != nil {
+			return fmt.Errorf("message %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func TestDecodeFrame(t *testing.T) {
+	all := samples()
+	tests := []struct {
+		name  string
+		batch []sample
+		// single - фрейм с одним сообщением, а не BATCH из одного
+		single bool
+	}{
+		{name: "single", batch: all[:1], single: true},
+		{name: "single_with_request_id", batch: all[1:2], single: true},
+		{name: "batch_of_one", batch: all[:1]},
+		{name: "batch", batch: all},
+	}
+	for _, codec := range []Codec{JSONCodec{}, BinaryCodec{}} {
+		for _, tt := range tests {
+			t.Run(codec.Subprotocol()+"/"+tt.name, func(t *testing.T) {
+				var frame []byte
+				var err error
+				if tt.single {
+					s := tt.batch[0]
+					frame, err = codec.Encode(s.msgType, s.requestID, s.payload)
+				} else {
+					frame, err = encodeBatch(codec, tt.batch)
+				}
+				if err != nil {
+					t.Fatalf("encode: %v", err)
+				}
+				if err := decodeBatch(codec, frame, tt.batch); err != nil {
+					t.Fatalf("decode: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeFrameRejectsNestedBatch(t *testing.T) {
+	s := samples()[0]
+	for _, codec := range []Codec{JSONCodec{}, BinaryCodec{}} {
+		t.Run(codec.Subprotocol(), func(t *testing.T) {
+			inner, err := encodeBatch(codec, []sample{s})
+			if err != nil {
+				t.Fatalf("encode inner batch: %v", err)
+			}
+			single, err := codec.Encode(s.msgType, s.requestID, s.payload)
+			if err != nil {
+				t.Fatalf("encode message: %v", err)
+			}
+			outer, err := codec.EncodeBatch([][]byte{single, inner})
+			if err != nil {
+				t.Fatalf("encode outer batch: %v", err)
+			}
+			if _, err := DecodeFrame(codec, outer); err == nil || !strings.Contains(err.Error(), "nested batch") {
+				t.Fatalf("DecodeFrame() error = %v, want nested batch", err)
+			}
+		})
+	}
+}
+
+func TestBinaryCodecMalformedFrames(t *testing.T) {
+	// overflow - uvarint длиннее 64 бит: binary.Uvarint возвращает отрицательный размер
+	overflow := bytes.Repeat([]byte{0xff}, binary.MaxVarintLen64+1)
+	batchHeader := []byte{binaryFrameVersion, byte(len(MsgTypeBatch))}
+	batchHeader = append(append(batchHeader, MsgTypeBatch...), 0)
+
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{name: "empty", frame: nil},
+		{name: "unknown_version", frame: []byte{binaryFrameVersion + 1, 1, 'A', 0}},
+		{name: "no_type_length", frame: []byte{binaryFrameVersion}},
+		{name: "type_longer_than_frame", frame: []byte{binaryFrameVersion, 10, 'A', 'B'}},
+		{name: "type_length_overflow", frame: append([]byte{binaryFrameVersion}, overflow...)},
+		{name: "huge_type_length", frame: binary.AppendUvarint([]byte{binaryFrameVersion}, 1<<62)},
+		{name: "no_request_id_length", frame: []byte{binaryFrameVersion, 1, 'A'}},
+		{name: "request_id_longer_than_frame", frame: []byte{binaryFrameVersion, 1, 'A', 5, '1'}},
+		{name: "batch_frame_longer_than_payload", frame: append(append([]byte{}, batchHeader...), 20, 1, 1, 'A', 0)},
+		{name: "batch_frame_length_overflow", frame: append(append([]byte{}, batchHeader...), overflow...)},
+		{name: "batch_frame_huge_length", frame: binary.AppendUvarint(append([]byte{}, batchHeader...), 1<<62)},
+		{name: "batch_with_malformed_frame", frame: append(append([]byte{}, batchHeader...), 2, binaryFrameVersion, 5)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages, err := DecodeFrame(BinaryCodec{}, tt.frame)
+			if err == nil {
+				t.Fatalf("DecodeFrame() = %v, want error", messages)
+			}
+			if !errors.Is(err, ErrMalformedFrame) {
+				t.Fatalf("DecodeFrame() error = %v, want ErrMalformedFrame", err)
+			}
+		})
+	}
+}
+
+func TestJSONCodecMalformedFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+	}{
+		{name: "empty", frame: ""},
+		{name: "not_json", frame: "BATCH"},
+		{name: "truncated", frame: `{"type":"TEXT_MESSAGE","payload":{"text":"hi"`},
+		{name: "batch_payload_not_array", frame: `{"type":"BATCH","payload":{"type":"TEXT_MESSAGE"}}`},
+		{name: "batch_with_invalid_message", frame: `{"type":"BATCH","payload":[{"type":1}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if messages, err := DecodeFrame(JSONCodec{}, []byte(tt.frame)); err == nil {
+				t.Fatalf("DecodeFrame() = %v, want error", messages)
+			}
+		})
+	}
+}
+
+func BenchmarkJSONCodec(b *testing.B)   { benchmarkCodec(b, JSONCodec{}) }
+func BenchmarkBinaryCodec(b *testing.B) { benchmarkCodec(b, BinaryCodec{}) }
+
+// benchmarkCodec замеряет кодирование и декодирование (включая разбор payload, как это делают
+// обработчики) каждого образца и пакета BATCH из всех образцов. Размер фрейма - метрика bytes/frame.
+func benchmarkCodec(b *testing.B, codec Codec) {
+	for _, s := range samples() {
+		frame, err := codec.Encode(s.msgType, s.requestID, s.payload)
+		if err != nil {
+			b.Fatalf("%s: encode failed: %v", s.name, err)
+		}
+		batch := []sample{s}
+		benchmarkFrame(b, s.name, codec, frame, batch,
+			func() ([]byte, error) { return codec.Encode(s.msgType, s.requestID, s.payload) })
+	}
+
+	// Пакет BATCH из всех образцов: так writePump отправляет накопившуюся очередь.
+	batch := samples()
+	frame, err := encodeBatch(codec, batch)
+	if err != nil {
+		b.Fatalf("batch: encode failed: %v", err)
+	}
+	benchmarkFrame(b, "batch", codec, frame, batch, func() ([]byte, error) { return encodeBatch(codec, batch) })
+}
+
+func benchmarkFrame(b *testing.B, name string, codec Codec, frame []byte, batch []sample, encode func() ([]byte, error)) {
+	b.Run(name+"/encode", func(b *testing.B) {
+		b.ReportAllocs()
+		b.ReportMetric(float64(len(frame)), "bytes/frame")
+		for i := 0; i < b.N; i++ {
+			if _, err := encode(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run(name+"/decode", func(b *testing.B) {
+		b.ReportAllocs()
+		b.ReportMetric(float64(len(frame)), "bytes/frame")
+		for i := 0; i < b.N; i++ {
+			if err := decodeBatch(codec, frame, batch); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package protocol
+
+// Коды ошибок протокола. Передаются в поле error_code ответов и ERROR_NOTIFY.
+// Коды стабильны: клиенты могут опираться на них, а error_message предназначено только для человека
+// и может меняться. Новые коды добавляются сюда, существующие не переименовываются.
+const (
+	// Ошибки формата сообщений.
+	ErrCodeInvalidMessageType    = "INVALID_MESSAGE_TYPE"    // Фрейм не текстовый
+	ErrCodeInvalidJSON           = "INVALID_JSON"            // Сообщение не разбирается как WebSocketMessage
+	ErrCodeInvalidPayload        = "INVALID_PAYLOAD"         // Payload не соответствует типу сообщения
+	ErrCodeUnknownMessageType    = "UNKNOWN_MESSAGE_TYPE"    // Сервер не обрабатывает такой тип сообщения
+	ErrCodeUnexpectedMessageType = "UNEXPECTED_MESSAGE_TYPE" // Тип сообщения недопустим до входа
+	ErrCodeInvalidRequest        = "INVALID_REQUEST"         // Недопустимое значение в запросе (например, пустое имя токена)
+	ErrCodeInternal              = "INTERNAL_ERROR"          // Ошибка сервера; подробности только в логе сервера
+
+	// Рукопожатие HELLO.
+	ErrCodeUnsupportedProtocolVersion = "UNSUPPORTED_PROTOCOL_VERSION" // См. min/max_protocol_version в HELLO_RESPONSE
+	ErrCodeClientUpgradeRequired      = "CLIENT_UPGRADE_REQUIRED"      // Действию нужна возможность, которую клиент не заявил
+
+	// Регистрация и вход.
+	ErrCodeValidationFailed     = "VALIDATION_FAILED"      // Подробности в field_errors
+	ErrCodeInvalidCredentials   = "INVALID_CREDENTIALS"    // Неизвестный логин или неверный пароль - намеренно неразличимы
+	ErrCodeAccountDeactivated   = "ACCOUNT_DEACTIVATED"    // Учетные данные верны, но аккаунт деактивирован
+	ErrCodeTooManyAttempts      = "TOO_MANY_ATTEMPTS"      // См. retry_after_seconds
+	ErrCodeSecondFactorRequired = "SECOND_FACTOR_REQUIRED" // Пароль принят, ожидается SECOND_FACTOR_REQUEST
+	ErrCodeInvalidSecondFactor  = "INVALID_SECOND_FACTOR"  // Неверный, устаревший или уже использованный код
+	ErrCodeNoPendingLogin       = "NO_PENDING_LOGIN"       // SECOND_FACTOR_REQUEST без предшествующего входа по паролю
+	ErrCodeInvalidSession       = "INVALID_SESSION"        // Токен сессии неизвестен, отозван или истек
+
+	// Действия с аккаунтом.
+	ErrCodeInvalidPassword    = "INVALID_PASSWORD" // Неверный текущий пароль при подтверждении действия
+	ErrCodeTOTPAlreadyEnabled = "TOTP_ALREADY_ENABLED"
+	ErrCodeTOTPNotEnabled     = "TOTP_NOT_ENABLED"
+	ErrCodeTOTPNotPending     = "TOTP_NOT_PENDING" // TOTP_CONFIRM_REQUEST без TOTP_ENROLL_REQUEST
+	ErrCodeAPITokenNotFound   = "API_TOKEN_NOT_FOUND"
+	ErrCodeInvalidScope       = "INVALID_SCOPE"
+	ErrCodeTooManyAPITokens   = "TOO_MANY_API_TOKENS"
+
+	// Права и модерация.
+	ErrCodePermissionDenied = "PERMISSION_DENIED" // Нет права на тип сообщения
+	ErrCodeAccessDenied     = "ACCESS_DENIED"     // Нет доступа к конкретному чату
+	ErrCodeUserNotFound     = "USER_NOT_FOUND"    // Адресат или цель действия не найдены
+	ErrCodeCannotTargetSelf = "CANNOT_TARGET_SELF"
+	ErrCodeInsufficientRank = "INSUFFICIENT_RANK" // Роль цели не ниже роли модератора
+	ErrCodeUnknownRole      = "UNKNOWN_ROLE"
+	ErrCodeLastAdmin        = "LAST_ADMIN" // Нельзя понизить, деактивировать или удалить последнего администратора
+
+	// Приглашения.
+	ErrCodeInviteNotFound = "INVITE_NOT_FOUND"
+
+	// Групповые чаты.
+	ErrCodeGroupNotFound      = "GROUP_NOT_FOUND"
+	ErrCodeGroupAdminRequired = "GROUP_ADMIN_REQUIRED" // Действие доступно владельцу и администраторам группы
+	ErrCodeAlreadyGroupMember = "ALREADY_GROUP_MEMBER"
+	ErrCodeNotGroupMember     = "NOT_GROUP_MEMBER" // Цель действия не состоит в группе
+	ErrCodeGroupMemberLimit   = "GROUP_MEMBER_LIMIT"
+
+	// Публичные каналы.
+	ErrCodeChannelNotFound = "CHANNEL_NOT_FOUND"
+	ErrCodeChannelExists   = "CHANNEL_EXISTS"
+
+	// История.
+	ErrCodeHistorySaveFailed = "HISTORY_SAVE_FAILED"
+	ErrCodeHistoryLoadFailed = "HISTORY_LOAD_FAILED"
+)
@@ -7,39 +7,294 @@ import (
 type WebSocketMessage struct {
 	Type    string          `json:"type"`
 	Payload json.RawMessage `json:"payload"`
+	// Необязательный ID запроса, выбранный клиентом. Сервер повторяет его во всех ответах
+	// и ошибках, вызванных этим запросом; в уведомлениях (новые сообщения, смена роли) его нет.
+	RequestID string `json:"request_id,omitempty"`
 }
 
 type StoredMessage struct {
 	ChatID     string `json:"chat_id,omitempty"` // Полезно, если один файл для многих чатов, или для проверки
 	MessageID  string `json:"message_id"`        // Уникальный ID сообщения (например, UUID, генерируемый сервером)
+	Seq        uint64 `json:"seq"`               // Номер сообщения в чате: 1, 2, 3... без пропусков
 	SenderID   string `json:"sender_id"`
 	SenderName string `json:"sender_name"`
 	Text       string `json:"text"`
-	Timestamp  int64  `json:"timestamp"` // Unix
+	Timestamp  int64  `json:"timestamp"` // Unix, миллисекунды (см. UnixSecondsProtocolVersion)
+
+	// Отметки получателя личного сообщения (Unix, миллисекунды). Хранятся отдельно от сообщения
+	// и заполняются только в ответе с историей личного чата.
+	DeliveredAt int64 `json:"delivered_at,omitempty"`
+	ReadAt      int64 `json:"read_at,omitempty"`
 }
 
+// Версии протокола. Клиент версии 2 и новее начинает соединение с HELLO; клиент, который сразу
+// отправляет запрос входа или регистрации, считается клиентом версии 1.
+const (
+	ProtocolVersion       = 3 // Версия, которую реализует этот пакет
+	LegacyProtocolVersion = 1 // Протокол без HELLO
+	// Последняя версия, в которой время сообщений (timestamp, delivered_at, read_at) передается в секундах.
+	// Начиная с версии 3 оно передается в миллисекундах, а сообщения чатов содержат seq.
+	UnixSecondsProtocolVersion = 2
+)
+
+// Возможности, которые клиент перечисляет в HELLO, а сервер - в HELLO_RESPONSE.
+// Соединение использует только возможности, заявленные обеими сторонами.
+const (
+	FeatureRequestID    = "request_id"    // Поле request_id в конверте сообщения
+	FeatureSecondFactor = "second_factor" // Вход со вторым фактором (SECOND_FACTOR_REQUEST)
+	FeatureInviteOnly   = "invite_only"   // Только сервер: регистрация требует код приглашения
+	FeatureBatch        = "batch"         // Сервер может объединять несколько сообщений в один фрейм BATCH
+	FeatureReceipts     = "receipts"      // Клиент принимает MESSAGE_RECEIPT_NOTIFY
+	// Клиент принимает UNREAD_SUMMARY_NOTIFY вместо длинной очереди сообщений, пришедших без него.
+	FeatureUnreadSummary = "unread_summary"
+)
+
 const (
+	MsgTypeHello                     = "HELLO"          // C->S: Первое сообщение соединения: версия протокола и возможности клиента
+	MsgTypeHelloResponse             = "HELLO_RESPONSE" // S->C: Согласованная версия, возможности и ограничения сервера
+	MsgTypeBatch                     = "BATCH"          // S->C: Несколько сообщений в одном фрейме (см. Codec.EncodeBatch)
 	MsgTypeText                      = "TEXT_MESSAGE"
 	MsgTypeRegisterRequest           = "REGISTER_REQUEST"
 	MsgTypeRegisterResponse          = "REGISTER_RESPONSE"
 	MsgTypeLoginRequest              = "LOGIN_REQUEST"
 	MsgTypeLoginResponse             = "LOGIN_RESPONSE"
+	MsgTypeSecondFactorRequest       = "SECOND_FACTOR_REQUEST"       // C->S: Код TOTP или код восстановления после LOGIN_RESPONSE с second_factor_required; ответ - LOGIN_RESPONSE
+	MsgTypeResumeSessionRequest      = "RESUME_SESSION_REQUEST"      // C->S: Возобновление сессии по токену
+	MsgTypeResumeSessionResponse     = "RESUME_SESSION_RESPONSE"     // S->C
+	MsgTypeLogoutRequest             = "LOGOUT_REQUEST"              // C->S: Завершение текущей сессии
+	MsgTypeLogoutAllRequest          = "LOGOUT_ALL_REQUEST"          // C->S: Завершение всех сессий пользователя
+	MsgTypeLogoutResponse            = "LOGOUT_RESPONSE"             // S->C
+	MsgTypeChangePasswordRequest     = "CHANGE_PASSWORD_REQUEST"     // C->S
+	MsgTypeChangePasswordResponse    = "CHANGE_PASSWORD_RESPONSE"    // S->C
+	MsgTypeDeactivateAccountRequest  = "DEACTIVATE_ACCOUNT_REQUEST"  // C->S: Вход запрещается, история сохраняется
+	MsgTypeDeactivateAccountResponse = "DEACTIVATE_ACCOUNT_RESPONSE" // S->C
+	MsgTypeDeleteAccountRequest      = "DELETE_ACCOUNT_REQUEST"      // C->S: Аккаунт удаляется, имя в истории анонимизируется
+	MsgTypeDeleteAccountResponse     = "DELETE_ACCOUNT_RESPONSE"     // S->C
 	MsgTypeBroadcastText             = "BROADCAST_TEXT_MESSAGE"
 	MsgTypeGetUserListRequest        = "GET_USER_LIST_REQUEST"        // C->S: Запрос списка пользователей
 	MsgTypeUserListResponse          = "USER_LIST_RESPONSE"           // S->C: Ответ со списком пользователей
 	MsgTypeSendPrivateMessageRequest = "SEND_PRIVATE_MESSAGE_REQUEST" // C->S: Отправка личного сообщения
 	MsgTypeNewPrivateMessageNotify   = "NEW_PRIVATE_MESSAGE_NOTIFY"   // S->C: Уведомление о новом личном сообщении (обоим участникам)
 	MsgTypeErrorNotify               = "ERROR_NOTIFY"
-	MsgTypeGetChatHistoryRequest     = "GET_CHAT_HISTORY_REQUEST" // C->S
-	MsgTypeChatHistoryResponse       = "CHAT_HISTORY_RESPONSE"    // S->C
+	MsgTypeGetChatHistoryRequest     = "GET_CHAT_HISTORY_REQUEST"  // C->S
+	MsgTypeChatHistoryResponse       = "CHAT_HISTORY_RESPONSE"     // S->C
+	MsgTypeKickUserRequest           = "KICK_USER_REQUEST"         // C->S: Модерация: отключить пользователя и завершить его сессии
+	MsgTypeKickUserResponse          = "KICK_USER_RESPONSE"        // S->C
+	MsgTypeSetUserRoleRequest        = "SET_USER_ROLE_REQUEST"     // C->S: Администрирование: назначить роль
+	MsgTypeSetUserRoleResponse       = "SET_USER_ROLE_RESPONSE"    // S->C
+	MsgTypeRoleChangedNotify         = "ROLE_CHANGED_NOTIFY"       // S->C: Роль и права пользователя изменились
+	MsgTypeCreateAPITokenRequest     = "CREATE_API_TOKEN_REQUEST"  // C->S: Выпуск токена для бота или скрипта
+	MsgTypeCreateAPITokenResponse    = "CREATE_API_TOKEN_RESPONSE" // S->C: Содержит токен; повторно его получить нельзя
+	MsgTypeListAPITokensRequest      = "LIST_API_TOKENS_REQUEST"   // C->S
+	MsgTypeListAPITokensResponse     = "LIST_API_TOKENS_RESPONSE"  // S->C
+	MsgTypeRevokeAPITokenRequest     = "REVOKE_API_TOKEN_REQUEST"  // C->S
+	MsgTypeRevokeAPITokenResponse    = "REVOKE_API_TOKEN_RESPONSE" // S->C
+	MsgTypeCreateInviteRequest       = "CREATE_INVITE_REQUEST"     // C->S: Администрирование: выпуск кода приглашения
+	MsgTypeCreateInviteResponse      = "CREATE_INVITE_RESPONSE"    // S->C
+	MsgTypeListInvitesRequest        = "LIST_INVITES_REQUEST"      // C->S
+	MsgTypeListInvitesResponse       = "LIST_INVITES_RESPONSE"     // S->C
+	MsgTypeRevokeInviteRequest       = "REVOKE_INVITE_REQUEST"     // C->S
+	MsgTypeRevokeInviteResponse      = "REVOKE_INVITE_RESPONSE"    // S->C
+	MsgTypeTOTPEnrollRequest         = "TOTP_ENROLL_REQUEST"       // C->S: Начать подключение TOTP
+	MsgTypeTOTPEnrollResponse        = "TOTP_ENROLL_RESPONSE"      // S->C: Секрет и otpauth:// ссылка
+	MsgTypeTOTPConfirmRequest        = "TOTP_CONFIRM_REQUEST"      // C->S: Первый код из приложения
+	MsgTypeTOTPConfirmResponse       = "TOTP_CONFIRM_RESPONSE"     // S->C: Коды восстановления
+	MsgTypeTOTPDisableRequest        = "TOTP_DISABLE_REQUEST"      // C->S
+	MsgTypeTOTPDisableResponse       = "TOTP_DISABLE_RESPONSE"     // S->C
+
+	// Отчеты о доставке и прочтении личных сообщений.
+	MsgTypeMessageDelivered        = "MESSAGE_DELIVERED"          // C->S: Клиент получил личные сообщения
+	MsgTypeMessageRead             = "MESSAGE_READ"               // C->S: Личные сообщения показаны пользователю
+	MsgTypeMessageReceiptNotify    = "MESSAGE_RECEIPT_NOTIFY"     // S->C: Отправителю: его сообщения доставлены или прочитаны
+	MsgTypeSetReadReceiptsRequest  = "SET_READ_RECEIPTS_REQUEST"  // C->S: Включить или отключить отчеты о прочтении
+	MsgTypeSetReadReceiptsResponse = "SET_READ_RECEIPTS_RESPONSE" // S->C
+
+	// Досылка сообщений, пропущенных во время переподключения.
+	MsgTypeSyncRequest  = "SYNC_REQUEST"  // C->S: Последний seq, полученный клиентом в каждом чате
+	MsgTypeSyncResponse = "SYNC_RESPONSE" // S->C: Сообщения после этих seq
+
+	// Личные сообщения, полученные, пока пользователь был не в сети.
+	MsgTypeUnreadSummaryNotify = "UNREAD_SUMMARY_NOTIFY" // S->C: При входе, если таких сообщений много
+
+	// Групповые чаты.
+	MsgTypeCreateGroupRequest        = "CREATE_GROUP_REQUEST"         // C->S
+	MsgTypeCreateGroupResponse       = "CREATE_GROUP_RESPONSE"        // S->C
+	MsgTypeGroupInviteRequest        = "GROUP_INVITE_REQUEST"         // C->S: Добавить участника (владелец или администратор группы)
+	MsgTypeGroupInviteResponse       = "GROUP_INVITE_RESPONSE"        // S->C
+	MsgTypeGroupRemoveMemberRequest  = "GROUP_REMOVE_MEMBER_REQUEST"  // C->S: Исключить участника (владелец или администратор группы)
+	MsgTypeGroupRemoveMemberResponse = "GROUP_REMOVE_MEMBER_RESPONSE" // S->C
+	MsgTypeLeaveGroupRequest         = "LEAVE_GROUP_REQUEST"          // C->S
+	MsgTypeLeaveGroupResponse        = "LEAVE_GROUP_RESPONSE"         // S->C
+	MsgTypeListGroupsRequest         = "LIST_GROUPS_REQUEST"          // C->S: Группы, в которых состоит пользователь
+	MsgTypeListGroupsResponse        = "LIST_GROUPS_RESPONSE"         // S->C
+	MsgTypeSendGroupMessageRequest   = "SEND_GROUP_MESSAGE_REQUEST"   // C->S
+	MsgTypeNewGroupMessageNotify     = "NEW_GROUP_MESSAGE_NOTIFY"     // S->C: Участникам группы; отправителю - как ответ
+	MsgTypeGroupUpdateNotify         = "GROUP_UPDATE_NOTIFY"          // S->C: Участникам: группа создана, состав изменился
+
+	// Публичные каналы.
+	MsgTypeCreateChannelRequest      = "CREATE_CHANNEL_REQUEST"       // C->S: Создатель сразу вступает в канал
+	MsgTypeCreateChannelResponse     = "CREATE_CHANNEL_RESPONSE"      // S->C
+	MsgTypeListChannelsRequest       = "LIST_CHANNELS_REQUEST"        // C->S: Все каналы или поиск по названию и теме
+	MsgTypeListChannelsResponse      = "LIST_CHANNELS_RESPONSE"       // S->C
+	MsgTypeJoinChannelRequest        = "JOIN_CHANNEL_REQUEST"         // C->S
+	MsgTypeJoinChannelResponse       = "JOIN_CHANNEL_RESPONSE"        // S->C
+	MsgTypeLeaveChannelRequest       = "LEAVE_CHANNEL_REQUEST"        // C->S
+	MsgTypeLeaveChannelResponse      = "LEAVE_CHANNEL_RESPONSE"       // S->C
+	MsgTypeSetChannelTopicRequest    = "SET_CHANNEL_TOPIC_REQUEST"    // C->S: Участник канала; тему канала по умолчанию - модератор
+	MsgTypeSetChannelTopicResponse   = "SET_CHANNEL_TOPIC_RESPONSE"   // S->C
+	MsgTypeSendChannelMessageRequest = "SEND_CHANNEL_MESSAGE_REQUEST" // C->S: Только участники канала
+	MsgTypeNewChannelMessageNotify   = "NEW_CHANNEL_MESSAGE_NOTIFY"   // S->C: Участникам канала; отправителю - как ответ
+	MsgTypeChannelUpdateNotify       = "CHANNEL_UPDATE_NOTIFY"        // S->C: Участникам - смена темы; другим устройствам - вступление и выход
+)
+
+// GroupChatIDPrefix - префикс ID группового чата: "group:<uuid>".
+const GroupChatIDPrefix = "group:"
+
+// Роли участников группового чата. Владелец один; владелец и администраторы управляют составом.
+const (
+	GroupRoleOwner  = "owner"
+	GroupRoleAdmin  = "admin"
+	GroupRoleMember = "member"
+)
+
+// События в GroupUpdateNotifyPayload.
+const (
+	GroupEventCreated       = "created"
+	GroupEventMemberAdded   = "member_added"
+	GroupEventMemberRemoved = "member_removed"
+	GroupEventMemberLeft    = "member_left"
+)
+
+// MaxGroupTitleLength - максимальная длина названия группы в байтах.
+const MaxGroupTitleLength = 64
+
+// MaxGroupMembers - сколько участников может быть в группе вместе с владельцем.
+const MaxGroupMembers = 100
+
+// ChannelChatIDPrefix - префикс ID чата публичного канала: "channel:<name>".
+const ChannelChatIDPrefix = "channel:"
+
+// DefaultChannelName - канал по умолчанию. Это глобальный чат: в нем состоят все пользователи,
+// его ID остается "global_broadcast", а сообщения в него отправляются TEXT_MESSAGE.
+const DefaultChannelName = "global"
+
+// Ограничения каналов. Название - от MinChannelNameLength до MaxChannelNameLength строчных
+// латинских букв, цифр, "-" и "_"; клиенты показывают его с "#" (например, #ops).
+const (
+	MinChannelNameLength  = 2
+	MaxChannelNameLength  = 32
+	MaxChannelTopicLength = 200 // В байтах
+)
+
+// События в ChannelUpdateNotifyPayload.
+const (
+	ChannelEventJoined       = "joined" // Пользователь вступил в канал с другого устройства
+	ChannelEventLeft         = "left"   // Пользователь вышел из канала с другого устройства
+	ChannelEventTopicChanged = "topic_changed"
+)
+
+// ChannelChatID возвращает ID чата канала name.
+func ChannelChatID(name string) string {
+	if name == DefaultChannelName {
+		return "global_broadcast"
+	}
+	return ChannelChatIDPrefix + name
+}
+
+// Статусы в MessageReceiptNotifyPayload. Прочитанное сообщение считается и доставленным.
+const (
+	ReceiptStatusDelivered = "delivered"
+	ReceiptStatusRead      = "read"
+)
+
+// MaxClientMsgIDLength - максимальная длина client_msg_id. Клиент выбирает этот ключ сам (например, UUID)
+// и повторяет его при повторной отправке сообщения: сервер не сохраняет сообщение второй раз,
+// а возвращает уже сохраненное.
+const MaxClientMsgIDLength = 64
+
+// MaxSyncChats - сколько чатов можно перечислить в одном SYNC_REQUEST.
+const MaxSyncChats = 100
+
+// MaxReceiptMessageIDs - сколько сообщений можно отметить одним MESSAGE_DELIVERED или MESSAGE_READ.
+const MaxReceiptMessageIDs = 100
+
+// Области доступа API-токенов. Совпадают с соответствующими правами пользователя.
+const (
+	ScopeReadHistory = PermReadHistory
+	ScopeSendGlobal  = PermSendGlobal
+	ScopeSendPrivate = PermSendPrivate
+)
+
+// Способы передать API-токен при HTTP upgrade: заголовок "Authorization: Bearer <token>"
+// или параметр запроса "?access_token=<token>".
+const (
+	APITokenAuthScheme = "Bearer"
+	APITokenQueryParam = "access_token"
+)
+
+// Роли пользователей.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Права пользователей. Сервер проверяет их перед обработкой каждого сообщения.
+const (
+	PermListUsers     = "list_users"
+	PermSendGlobal    = "send_global"
+	PermSendPrivate   = "send_private"
+	PermReadHistory   = "read_history"
+	PermManageAccount = "manage_account" // Выход, смена пароля, деактивация и удаление своего аккаунта
+	PermKickUsers     = "kick_users"
+	PermManageRoles   = "manage_roles"
+	PermManageInvites = "manage_invites"
+)
+
+// Коды закрытия WebSocket, которые сервер использует помимо стандартных (диапазон 4000-4999 зарезервирован для приложений).
+// Клиент не должен автоматически переподключаться после них, иначе устройства будут вытеснять друг друга по кругу.
+const (
+	CloseCodeEvicted             = 4001 // Соединение вытеснено новым устройством того же пользователя
+	CloseCodeConnectionLimit     = 4002 // Новое соединение отклонено: достигнут лимит устройств пользователя
+	CloseCodeUnsupportedProtocol = 4003 // Версия протокола клиента не поддерживается сервером
 )
 
 ///
 /// PAYLOAD STRUCTURES
 ///
 
+// HelloPayload - первое сообщение клиента версии 2 и новее.
+type HelloPayload struct {
+	ProtocolVersion int      `json:"protocol_version"`      // Максимальная версия, которую понимает клиент
+	Features        []string `json:"features,omitempty"`    // Значения Feature*
+	ClientName      string   `json:"client_name,omitempty"` // Для логов сервера, например "messengor-console/2"
+}
+
+// HelloResponsePayload - ответ на HELLO. При Success == false сервер закрывает соединение
+// с кодом CloseCodeUnsupportedProtocol.
+type HelloResponsePayload struct {
+	Success            bool          `json:"success"`
+	ProtocolVersion    int           `json:"protocol_version,omitempty"` // Согласованная версия: не выше версии клиента
+	MinProtocolVersion int           `json:"min_protocol_version"`       // Диапазон версий, которые обслуживает сервер
+	MaxProtocolVersion int           `json:"max_protocol_version"`
+	Features           []string      `json:"features,omitempty"` // Возможности, включенные на сервере
+	Limits             *ServerLimits `json:"limits,omitempty"`
+	ErrorCode          string        `json:"error_code,omitempty"`
+	ErrorMessage       string        `json:"error_message,omitempty"`
+}
+
+// ServerLimits - ограничения сервера, которые клиенту стоит учитывать.
+type ServerLimits struct {
+	MaxMessageSize        int `json:"max_message_size"`                   // Байт в одном сообщении клиента
+	HistoryPageSize       int `json:"history_page_size"`                  // Сообщений истории, если limit не указан
+	MaxHistoryPageSize    int `json:"max_history_page_size"`              // Больший limit уменьшается до этого значения
+	MaxConnectionsPerUser int `json:"max_connections_per_user,omitempty"` // 0 - без ограничения
+	MaxBatchSize          int `json:"max_batch_size,omitempty"`           // Сообщений в одном фрейме BATCH
+}
+
 type TextPayload struct {
-	Text string `json:"text"`
+	Text        string `json:"text"`
+	ClientMsgID string `json:"client_msg_id,omitempty"` // См. MaxClientMsgIDLength
 }
 
 // RegisterRequestPayload содержит данные для запроса регистрации.
@@ -47,13 +302,43 @@ type RegisterRequestPayload struct {
 	Username    string `json:"username"`
 	Password    string `json:"password"`
 	DisplayName string `json:"display_name"`
+	InviteCode  string `json:"invite_code,omitempty"` // Обязателен, если сервер работает в режиме регистрации по приглашениям
 }
 
 // RegisterResponsePayload содержит данные для ответа на регистрацию.
 type RegisterResponsePayload struct {
-	Success      bool   `json:"success"`
-	UserID       string `json:"user_id,omitempty"`       // Используем string для UUID, omitempty если ошибка
-	ErrorMessage string `json:"error_message,omitempty"` // omitempty если успех
+	Success      bool         `json:"success"`
+	UserID       string       `json:"user_id,omitempty"`       // Используем string для UUID, omitempty если ошибка
+	ErrorCode    string       `json:"error_code,omitempty"`    // VALIDATION_FAILED, если заполнено FieldErrors
+	ErrorMessage string       `json:"error_message,omitempty"` // omitempty если успех
+	FieldErrors  []FieldError `json:"field_errors,omitempty"`  // Ошибки по отдельным полям запроса
+}
+
+// Имена полей в FieldError.
+const (
+	FieldUsername    = "username"
+	FieldPassword    = "password"
+	FieldDisplayName = "display_name"
+	FieldInviteCode  = "invite_code"
+)
+
+// Коды ошибок в FieldError.
+const (
+	FieldErrRequired          = "REQUIRED"
+	FieldErrTooShort          = "TOO_SHORT"
+	FieldErrTooLong           = "TOO_LONG"
+	FieldErrInvalidCharacters = "INVALID_CHARACTERS"
+	FieldErrTooWeak           = "TOO_WEAK"
+	FieldErrReserved          = "RESERVED"
+	FieldErrTaken             = "TAKEN"
+	FieldErrInvalid           = "INVALID" // Например, неизвестный, истекший или исчерпанный код приглашения
+)
+
+// FieldError - машиночитаемая ошибка проверки одного поля запроса.
+type FieldError struct {
+	Field   string `json:"field"`   // Например, FieldUsername
+	Code    string `json:"code"`    // Например, FieldErrTooShort
+	Message string `json:"message"` // Человекочитаемое описание
 }
 
 // LoginRequestPayload содержит данные для запроса входа.
@@ -68,7 +353,64 @@ type LoginResponsePayload struct {
 	UserID       string `json:"user_id,omitempty"`       // omitempty если ошибка
 	DisplayName  string `json:"display_name,omitempty"`  // omitempty если ошибка
 	SessionToken string `json:"session_token,omitempty"` // Токен сессии, omitempty если ошибка
+	ErrorCode    string `json:"error_code,omitempty"`    // Код из каталога ErrCode*, omitempty если успех
 	ErrorMessage string `json:"error_message,omitempty"` // omitempty если успех
+	// Через сколько секунд можно повторить попытку, если сервер ограничил частоту входа.
+	RetryAfterSeconds int `json:"retry_after_seconds,omitempty"`
+
+	Role        string   `json:"role,omitempty"`        // Роль пользователя, omitempty если ошибка
+	Permissions []string `json:"permissions,omitempty"` // Права, по которым клиент решает, какие команды показать
+
+	// Пароль верный, но для входа нужен второй фактор: клиент должен отправить SECOND_FACTOR_REQUEST.
+	SecondFactorRequired bool `json:"second_factor_required,omitempty"`
+}
+
+// ResumeSessionRequestPayload содержит токен, полученный ранее в LoginResponsePayload.
+type ResumeSessionRequestPayload struct {
+	SessionToken string `json:"session_token"`
+}
+
+// ResumeSessionResponsePayload содержит данные для ответа на возобновление сессии.
+type ResumeSessionResponsePayload struct {
+	Success      bool   `json:"success"`
+	UserID       string `json:"user_id,omitempty"`
+	DisplayName  string `json:"display_name,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+	// Через сколько секунд можно повторить попытку, если сервер ограничил частоту попыток.
+	RetryAfterSeconds int `json:"retry_after_seconds,omitempty"`
+
+	Role        string   `json:"role,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// LogoutResponsePayload - ответ на LOGOUT_REQUEST и LOGOUT_ALL_REQUEST.
+// Запросы не содержат данных: сервер определяет сессию по соединению.
+type LogoutResponsePayload struct {
+	Success         bool   `json:"success"`
+	SessionsRevoked int    `json:"sessions_revoked"`
+	ErrorCode       string `json:"error_code,omitempty"`
+	ErrorMessage    string `json:"error_message,omitempty"`
+}
+
+// ChangePasswordRequestPayload содержит данные для смены пароля.
+type ChangePasswordRequestPayload struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// AccountPasswordConfirmPayload - запрос на деактивацию или удаление аккаунта,
+// подтвержденный текущим паролем.
+type AccountPasswordConfirmPayload struct {
+	Password string `json:"password"`
+}
+
+// AccountActionResponsePayload - ответ на смену пароля, деактивацию и удаление аккаунта.
+// После успешного действия все сессии пользователя завершаются.
+type AccountActionResponsePayload struct {
+	Success      bool   `json:"success"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
 }
 
 // Общая структура для сообщений об ошибках от сервера,
@@ -79,10 +421,13 @@ type ErrorPayload struct {
 }
 
 type BroadcastTextPayload struct {
-	SenderID   string `json:"sender_id"`
-	SenderName string `json:"sender_name"`
-	Text       string `json:"text"`
-	Timestamp  int64  `json:"timestamp"`
+	MessageID   string `json:"message_id,omitempty"` // Пусто, если сообщение не удалось сохранить
+	Seq         uint64 `json:"seq,omitempty"`        // Номер в чате global_broadcast; 0, если сообщение не сохранено
+	SenderID    string `json:"sender_id"`
+	SenderName  string `json:"sender_name"`
+	Text        string `json:"text"`
+	Timestamp   int64  `json:"timestamp"`               // Unix, миллисекунды
+	ClientMsgID string `json:"client_msg_id,omitempty"` // Ключ отправителя из TextPayload
 }
 
 // UserInfo содержит публичную информацию о пользователе.
@@ -90,6 +435,7 @@ type UserInfo struct {
 	UserID      string `json:"user_id"`
 	DisplayName string `json:"display_name"`
 	IsOnline    bool   `json:"is_online"`
+	Role        string `json:"role,omitempty"`
 }
 
 // GetUserListRequestPayload - полезная нагрузка для запроса списка пользователей.
@@ -105,20 +451,73 @@ type UserListResponsePayload struct {
 
 // SendPrivateMessageRequestPayload содержит данные для отправки личного сообщения.
 type SendPrivateMessageRequestPayload struct {
-	TargetUserID string `json:"target_user_id"` // Кому предназначено сообщение
-	Text         string `json:"text"`           // Текст сообщения
+	TargetUserID string `json:"target_user_id"`          // Кому предназначено сообщение
+	Text         string `json:"text"`                    // Текст сообщения
+	ClientMsgID  string `json:"client_msg_id,omitempty"` // См. MaxClientMsgIDLength
 }
 
 // NewPrivateMessageNotifyPayload содержит данные нового личного сообщения.
 // Отправляется и получателю, и отправителю (для синхронизации UI).
 type NewPrivateMessageNotifyPayload struct {
-	ChatID     string `json:"chat_id"`     // Уникальный ID для этой личной беседы (например, user1ID:user2ID)
+	ChatID     string `json:"chat_id"` // Уникальный ID для этой личной беседы (например, user1ID:user2ID)
 	MessageID  string `json:"message_id"`
-	SenderID   string `json:"sender_id"`   // ID отправителя
-	SenderName string `json:"sender_name"` // Имя отправителя
-	ReceiverID string `json:"receiver_id"` // ID получателя (полезно для клиента, чтобы понять, это ему или от него)
+	Seq        uint64 `json:"seq,omitempty"` // Номер в чате; 0, если сообщение не сохранено
+	SenderID   string `json:"sender_id"`     // ID отправителя
+	SenderName string `json:"sender_name"`   // Имя отправителя
+	ReceiverID string `json:"receiver_id"`   // ID получателя (полезно для клиента, чтобы понять, это ему или от него)
 	Text       string `json:"text"`
-	Timestamp  int64  `json:"timestamp"` // Unix time
+	Timestamp  int64  `json:"timestamp"` // Unix, миллисекунды
+	// Ключ отправителя из SendPrivateMessageRequestPayload: по нему отправитель находит свое неподтвержденное сообщение.
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	// Только устройствам отправителя: получатель не в сети, сообщение будет доставлено при его входе.
+	Queued bool `json:"queued,omitempty"`
+}
+
+// UnreadChatSummary - личные сообщения одного чата, полученные без пользователя.
+type UnreadChatSummary struct {
+	ChatID      string `json:"chat_id"`
+	SenderID    string `json:"sender_id"`
+	SenderName  string `json:"sender_name"`
+	UnreadCount int    `json:"unread_count"`
+	FirstSeq    uint64 `json:"first_seq"` // Сообщения можно получить SYNC_REQUEST с last_seq = first_seq - 1
+	LastSeq     uint64 `json:"last_seq"`
+}
+
+// UnreadSummaryPayload - сводка "N непрочитанных в M чатах", которая при входе заменяет
+// отдельные NEW_PRIVATE_MESSAGE_NOTIFY, если сообщений пришло слишком много.
+type UnreadSummaryPayload struct {
+	TotalUnread int                 `json:"total_unread"`
+	Chats       []UnreadChatSummary `json:"chats"`
+}
+
+// MessageReceiptPayload - подтверждение MESSAGE_DELIVERED или MESSAGE_READ от получателя личных сообщений.
+// Ответа на подтверждение нет; ошибки приходят в ERROR_NOTIFY.
+type MessageReceiptPayload struct {
+	ChatID     string   `json:"chat_id"`
+	MessageIDs []string `json:"message_ids"` // Не больше MaxReceiptMessageIDs
+}
+
+// MessageReceiptNotifyPayload - уведомление отправителю о том, что получатель получил или прочитал его сообщения.
+type MessageReceiptNotifyPayload struct {
+	ChatID     string   `json:"chat_id"`
+	MessageIDs []string `json:"message_ids"`
+	UserID     string   `json:"user_id"`   // Кто получил или прочитал
+	Status     string   `json:"status"`    // ReceiptStatus*
+	Timestamp  int64    `json:"timestamp"` // Unix, миллисекунды
+}
+
+// SetReadReceiptsRequestPayload - настройка приватности: сообщать ли собеседникам о прочтении.
+// Отчеты о доставке отправляются всегда.
+type SetReadReceiptsRequestPayload struct {
+	Enabled bool `json:"enabled"`
+}
+
+// SetReadReceiptsResponsePayload - ответ на SET_READ_RECEIPTS_REQUEST.
+type SetReadReceiptsResponsePayload struct {
+	Success      bool   `json:"success"`
+	Enabled      bool   `json:"enabled"` // Текущее значение настройки
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
 }
 
 // GetChatHistoryRequestPayload - запрос истории чата.
@@ -134,3 +533,330 @@ type ChatHistoryResponsePayload struct {
 	Messages []StoredMessage `json:"messages"`           // Отправляем массив объектов StoredMessage
 	HasMore  bool            `json:"has_more,omitempty"` // Есть ли еще более старые сообщения
 }
+
+// ChatSyncState - последний seq, который клиент видел в чате (0 - ни одного сообщения).
+type ChatSyncState struct {
+	ChatID  string `json:"chat_id"`
+	LastSeq uint64 `json:"last_seq"`
+}
+
+// SyncRequestPayload - запрос сообщений, пропущенных клиентом, например во время переподключения.
+type SyncRequestPayload struct {
+	Chats []ChatSyncState `json:"chats"` // Не больше MaxSyncChats
+}
+
+// SyncResponsePayload - пропущенные сообщения по чатам в порядке seq. Чаты без новых сообщений не включаются.
+// Если у чата has_more, клиент повторяет запрос с seq последнего полученного сообщения.
+type SyncResponsePayload struct {
+	Chats []ChatHistoryResponsePayload `json:"chats"`
+}
+
+// GroupMemberInfo - участник группового чата.
+type GroupMemberInfo struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"display_name"`
+	Role        string `json:"role"` // GroupRole*
+}
+
+// GroupInfo - описание группового чата.
+type GroupInfo struct {
+	ChatID    string            `json:"chat_id"` // "group:<uuid>"
+	Title     string            `json:"title"`
+	OwnerID   string            `json:"owner_id"`
+	CreatedAt int64             `json:"created_at"` // Unix
+	Members   []GroupMemberInfo `json:"members"`    // В порядке вступления
+}
+
+// CreateGroupRequestPayload - создание группы. Создатель становится ее владельцем.
+type CreateGroupRequestPayload struct {
+	Title     string   `json:"title"`
+	MemberIDs []string `json:"member_ids,omitempty"` // Первые участники, кроме создателя
+}
+
+// GroupInviteRequestPayload - добавление пользователя в группу.
+type GroupInviteRequestPayload struct {
+	ChatID string `json:"chat_id"`
+	UserID string `json:"user_id"`
+	Role   string `json:"role,omitempty"` // GroupRoleMember (по умолчанию) или GroupRoleAdmin (только владелец)
+}
+
+// GroupRemoveMemberRequestPayload - исключение участника из группы.
+type GroupRemoveMemberRequestPayload struct {
+	ChatID string `json:"chat_id"`
+	UserID string `json:"user_id"`
+}
+
+// LeaveGroupRequestPayload - выход из группы. Если выходит владелец, группа переходит
+// к первому по времени вступления администратору, а если их нет - к первому участнику.
+type LeaveGroupRequestPayload struct {
+	ChatID string `json:"chat_id"`
+}
+
+// GroupResponsePayload - ответ на CREATE_GROUP_REQUEST, GROUP_INVITE_REQUEST,
+// GROUP_REMOVE_MEMBER_REQUEST и LEAVE_GROUP_REQUEST.
+type GroupResponsePayload struct {
+	Success      bool       `json:"success"`
+	Group        *GroupInfo `json:"group,omitempty"` // Группа после изменения (после выхода - не передается)
+	ErrorCode    string     `json:"error_code,omitempty"`
+	ErrorMessage string     `json:"error_message,omitempty"`
+}
+
+// ListGroupsRequestPayload - запрос групп текущего пользователя.
+type ListGroupsRequestPayload struct{}
+
+// ListGroupsResponsePayload - ответ на LIST_GROUPS_REQUEST.
+type ListGroupsResponsePayload struct {
+	Groups []GroupInfo `json:"groups"`
+}
+
+// SendGroupMessageRequestPayload - сообщение в групповой чат.
+type SendGroupMessageRequestPayload struct {
+	ChatID      string `json:"chat_id"`
+	Text        string `json:"text"`
+	ClientMsgID string `json:"client_msg_id,omitempty"` // См. MaxClientMsgIDLength
+}
+
+// NewGroupMessageNotifyPayload - новое сообщение группового чата.
+type NewGroupMessageNotifyPayload struct {
+	ChatID      string `json:"chat_id"`
+	MessageID   string `json:"message_id"`
+	Seq         uint64 `json:"seq"`
+	SenderID    string `json:"sender_id"`
+	SenderName  string `json:"sender_name"`
+	Text        string `json:"text"`
+	Timestamp   int64  `json:"timestamp"` // Unix, миллисекунды
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+}
+
+// GroupUpdateNotifyPayload - изменение группы. Приходит ее участникам и пользователю, которого
+// добавили или исключили; исключенный и вышедший получают его без group.
+type GroupUpdateNotifyPayload struct {
+	Event   string     `json:"event"` // GroupEvent*
+	ChatID  string     `json:"chat_id"`
+	UserID  string     `json:"user_id,omitempty"`  // Кого добавили, исключили или кто вышел
+	ActorID string     `json:"actor_id,omitempty"` // Кто выполнил действие
+	Group   *GroupInfo `json:"group,omitempty"`
+}
+
+// ChannelInfo - описание публичного канала.
+type ChannelInfo struct {
+	ChatID      string `json:"chat_id"` // "channel:<name>"; у канала по умолчанию - "global_broadcast"
+	Name        string `json:"name"`    // Без "#"
+	Topic       string `json:"topic,omitempty"`
+	CreatedBy   string `json:"created_by,omitempty"` // ID создателя; у канала по умолчанию не передается
+	CreatedAt   int64  `json:"created_at,omitempty"` // Unix
+	MemberCount int    `json:"member_count"`         // У канала по умолчанию - 0: в нем все пользователи
+	Joined      bool   `json:"joined"`               // Состоит ли в канале запросивший пользователь
+	Default     bool   `json:"default,omitempty"`
+}
+
+// CreateChannelRequestPayload - создание публичного канала.
+type CreateChannelRequestPayload struct {
+	Name  string `json:"name"`
+	Topic string `json:"topic,omitempty"`
+}
+
+// ListChannelsRequestPayload - список каналов. Query ищет подстроку в названии и теме без учета регистра.
+type ListChannelsRequestPayload struct {
+	Query      string `json:"query,omitempty"`
+	JoinedOnly bool   `json:"joined_only,omitempty"` // Только каналы, в которых состоит пользователь
+}
+
+// ListChannelsResponsePayload - ответ на LIST_CHANNELS_REQUEST, каналы по алфавиту.
+type ListChannelsResponsePayload struct {
+	Channels []ChannelInfo `json:"channels"`
+}
+
+// ChannelRequestPayload - вступление в канал или выход из него. Вступление в канал,
+// в котором пользователь уже состоит, успешно и ничего не меняет.
+type ChannelRequestPayload struct {
+	Name string `json:"name"`
+}
+
+// SetChannelTopicRequestPayload - смена темы канала. Пустая тема удаляет ее.
+type SetChannelTopicRequestPayload struct {
+	Name  string `json:"name"`
+	Topic string `json:"topic"`
+}
+
+// ChannelResponsePayload - ответ на CREATE_CHANNEL_REQUEST, JOIN_CHANNEL_REQUEST,
+// LEAVE_CHANNEL_REQUEST и SET_CHANNEL_TOPIC_REQUEST.
+type ChannelResponsePayload struct {
+	Success      bool         `json:"success"`
+	Channel      *ChannelInfo `json:"channel,omitempty"` // Канал после изменения
+	ErrorCode    string       `json:"error_code,omitempty"`
+	ErrorMessage string       `json:"error_message,omitempty"`
+}
+
+// SendChannelMessageRequestPayload - сообщение в публичный канал.
+type SendChannelMessageRequestPayload struct {
+	Name        string `json:"name"`
+	Text        string `json:"text"`
+	ClientMsgID string `json:"client_msg_id,omitempty"` // См. MaxClientMsgIDLength
+}
+
+// NewChannelMessageNotifyPayload - новое сообщение публичного канала.
+type NewChannelMessageNotifyPayload struct {
+	ChatID      string `json:"chat_id"`
+	Name        string `json:"name"`
+	MessageID   string `json:"message_id"`
+	Seq         uint64 `json:"seq"`
+	SenderID    string `json:"sender_id"`
+	SenderName  string `json:"sender_name"`
+	Text        string `json:"text"`
+	Timestamp   int64  `json:"timestamp"` // Unix, миллисекунды
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+}
+
+// ChannelUpdateNotifyPayload - изменение канала.
+type ChannelUpdateNotifyPayload struct {
+	Event   string       `json:"event"` // ChannelEvent*
+	ActorID string       `json:"actor_id,omitempty"`
+	Channel *ChannelInfo `json:"channel"`
+}
+
+// KickUserRequestPayload - запрос модератора на отключение пользователя.
+type KickUserRequestPayload struct {
+	TargetUserID string `json:"target_user_id"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// SetUserRoleRequestPayload - запрос администратора на смену роли пользователя.
+type SetUserRoleRequestPayload struct {
+	TargetUserID string `json:"target_user_id"`
+	Role         string `json:"role"`
+}
+
+// ModerationResponsePayload - ответ на KICK_USER_REQUEST и SET_USER_ROLE_REQUEST.
+type ModerationResponsePayload struct {
+	Success      bool   `json:"success"`
+	TargetUserID string `json:"target_user_id,omitempty"`
+	Role         string `json:"role,omitempty"` // Новая роль (для SET_USER_ROLE_RESPONSE)
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+// RoleChangedNotifyPayload - уведомление пользователю о смене его роли.
+type RoleChangedNotifyPayload struct {
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+}
+
+// CreateAPITokenRequestPayload - запрос на выпуск API-токена.
+type CreateAPITokenRequestPayload struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"` // Значения Scope*
+}
+
+// APITokenInfo - описание API-токена без самого секрета.
+type APITokenInfo struct {
+	TokenID    string   `json:"token_id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  int64    `json:"created_at"`             // Unix
+	LastUsedAt int64    `json:"last_used_at,omitempty"` // Unix, omitempty если токен не использовался
+}
+
+// CreateAPITokenResponsePayload - ответ на CREATE_API_TOKEN_REQUEST.
+type CreateAPITokenResponsePayload struct {
+	Success      bool          `json:"success"`
+	Token        string        `json:"token,omitempty"` // Показывается только один раз
+	TokenInfo    *APITokenInfo `json:"token_info,omitempty"`
+	ErrorCode    string        `json:"error_code,omitempty"`
+	ErrorMessage string        `json:"error_message,omitempty"`
+}
+
+// ListAPITokensResponsePayload - ответ на LIST_API_TOKENS_REQUEST.
+type ListAPITokensResponsePayload struct {
+	Tokens []APITokenInfo `json:"tokens"`
+}
+
+// RevokeAPITokenRequestPayload - запрос на отзыв API-токена.
+type RevokeAPITokenRequestPayload struct {
+	TokenID string `json:"token_id"`
+}
+
+// RevokeAPITokenResponsePayload - ответ на REVOKE_API_TOKEN_REQUEST.
+type RevokeAPITokenResponsePayload struct {
+	Success      bool   `json:"success"`
+	TokenID      string `json:"token_id,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+// CreateInviteRequestPayload - запрос на выпуск кода приглашения.
+type CreateInviteRequestPayload struct {
+	MaxUses          int   `json:"max_uses"`                     // 1 - одноразовый код
+	ExpiresInSeconds int64 `json:"expires_in_seconds,omitempty"` // 0 - без срока действия
+}
+
+// InviteInfo - описание кода приглашения.
+type InviteInfo struct {
+	Code      string   `json:"code"`
+	CreatedBy string   `json:"created_by"`
+	CreatedAt int64    `json:"created_at"`           // Unix
+	ExpiresAt int64    `json:"expires_at,omitempty"` // Unix, omitempty если без срока действия
+	MaxUses   int      `json:"max_uses"`
+	Uses      int      `json:"uses"`
+	UsedBy    []string `json:"used_by,omitempty"` // ID аккаунтов, созданных по коду
+	Revoked   bool     `json:"revoked,omitempty"`
+}
+
+// CreateInviteResponsePayload - ответ на CREATE_INVITE_REQUEST.
+type CreateInviteResponsePayload struct {
+	Success      bool        `json:"success"`
+	Invite       *InviteInfo `json:"invite,omitempty"`
+	ErrorCode    string      `json:"error_code,omitempty"`
+	ErrorMessage string      `json:"error_message,omitempty"`
+}
+
+// ListInvitesResponsePayload - ответ на LIST_INVITES_REQUEST.
+type ListInvitesResponsePayload struct {
+	Invites []InviteInfo `json:"invites"`
+}
+
+// RevokeInviteRequestPayload - запрос на отзыв кода приглашения.
+type RevokeInviteRequestPayload struct {
+	Code string `json:"code"`
+}
+
+// RevokeInviteResponsePayload - ответ на REVOKE_INVITE_REQUEST.
+type RevokeInviteResponsePayload struct {
+	Success      bool   `json:"success"`
+	Code         string `json:"code,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+// SecondFactorRequestPayload - код TOTP или код восстановления при входе.
+type SecondFactorRequestPayload struct {
+	Code string `json:"code"`
+}
+
+// TOTPEnrollResponsePayload - ответ на TOTP_ENROLL_REQUEST (запрос - AccountPasswordConfirmPayload).
+type TOTPEnrollResponsePayload struct {
+	Success      bool   `json:"success"`
+	Secret       string `json:"secret,omitempty"`      // Base32, для ручного ввода в приложение
+	OTPAuthURI   string `json:"otpauth_uri,omitempty"` // otpauth://totp/... для QR-кода
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+// TOTPCodePayload - запрос с кодом из приложения (TOTP_CONFIRM_REQUEST).
+type TOTPCodePayload struct {
+	Code string `json:"code"`
+}
+
+// TOTPConfirmResponsePayload - ответ на TOTP_CONFIRM_REQUEST.
+type TOTPConfirmResponsePayload struct {
+	Success       bool     `json:"success"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"` // Показываются только один раз
+	ErrorCode     string   `json:"error_code,omitempty"`
+	ErrorMessage  string   `json:"error_message,omitempty"`
+}
+
+// TOTPDisableRequestPayload - запрос на отключение TOTP. Ответ - AccountActionResponsePayload.
+type TOTPDisableRequestPayload struct {
+	Password string `json:"password"`
+	Code     string `json:"code"` // Код TOTP или код восстановления
+}
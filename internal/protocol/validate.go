@@ -0,0 +1,184 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Проверки обязательных полей запросов. Сервер вызывает Validate после разбора payload
+// и отвечает INVALID_PAYLOAD, не передавая запрос обработчику.
+
+func (p *TextPayload) Validate() error {
+	if p.Text == "" {
+		return errors.New("text is required")
+	}
+	return validateClientMsgID(p.ClientMsgID)
+}
+
+func (p *SendPrivateMessageRequestPayload) Validate() error {
+	if p.TargetUserID == "" {
+		return errors.New("target_user_id is required")
+	}
+	if p.Text == "" {
+		return errors.New("text is required")
+	}
+	return validateClientMsgID(p.ClientMsgID)
+}
+
+func validateClientMsgID(id string) error {
+	if len(id) > MaxClientMsgIDLength {
+		return fmt.Errorf("client_msg_id must be at most %d bytes", MaxClientMsgIDLength)
+	}
+	return nil
+}
+
+func (p *GetChatHistoryRequestPayload) Validate() error {
+	if p.ChatID == "" {
+		return errors.New("chat_id is required")
+	}
+	return nil
+}
+
+func (p *KickUserRequestPayload) Validate() error {
+	if p.TargetUserID == "" {
+		return errors.New("target_user_id is required")
+	}
+	return nil
+}
+
+func (p *SetUserRoleRequestPayload) Validate() error {
+	if p.TargetUserID == "" {
+		return errors.New("target_user_id is required")
+	}
+	return nil
+}
+
+func (p *MessageReceiptPayload) Validate() error {
+	if p.ChatID == "" {
+		return errors.New("chat_id is required")
+	}
+	if len(p.MessageIDs) == 0 {
+		return errors.New("message_ids is required")
+	}
+	if len(p.MessageIDs) > MaxReceiptMessageIDs {
+		return fmt.Errorf("at most %d message_ids are allowed", MaxReceiptMessageIDs)
+	}
+	return nil
+}
+
+func (p *SyncRequestPayload) Validate() error {
+	if len(p.Chats) > MaxSyncChats {
+		return fmt.Errorf("at most %d chats are allowed", MaxSyncChats)
+	}
+	for _, chat := range p.Chats {
+		if chat.ChatID == "" {
+			return errors.New("chat_id is required")
+		}
+	}
+	return nil
+}
+
+func (p *CreateGroupRequestPayload) Validate() error {
+	if strings.TrimSpace(p.Title) == "" {
+		return errors.New("title is required")
+	}
+	if len(p.Title) > MaxGroupTitleLength {
+		return fmt.Errorf("title must be at most %d bytes", MaxGroupTitleLength)
+	}
+	if len(p.MemberIDs) >= MaxGroupMembers {
+		return fmt.Errorf("at most %d member_ids are allowed", MaxGroupMembers-1)
+	}
+	return nil
+}
+
+func (p *GroupInviteRequestPayload) Validate() error {
+	if p.ChatID == "" {
+		return errors.New("chat_id is required")
+	}
+	if p.UserID == "" {
+		return errors.New("user_id is required")
+	}
+	if p.Role != "" && p.Role != GroupRoleMember && p.Role != GroupRoleAdmin {
+		return fmt.Errorf("role must be %q or %q", GroupRoleMember, GroupRoleAdmin)
+	}
+	return nil
+}
+
+func (p *GroupRemoveMemberRequestPayload) Validate() error {
+	if p.ChatID == "" {
+		return errors.New("chat_id is required")
+	}
+	if p.UserID == "" {
+		return errors.New("user_id is required")
+	}
+	return nil
+}
+
+func (p *LeaveGroupRequestPayload) Validate() error {
+	if p.ChatID == "" {
+		return errors.New("chat_id is required")
+	}
+	return nil
+}
+
+func (p *SendGroupMessageRequestPayload) Validate() error {
+	if p.ChatID == "" {
+		return errors.New("chat_id is required")
+	}
+	if p.Text == "" {
+		return errors.New("text is required")
+	}
+	return validateClientMsgID(p.ClientMsgID)
+}
+
+// ValidateChannelName проверяет название канала (без "#").
+func ValidateChannelName(name string) error {
+	if len(name) < MinChannelNameLength || len(name) > MaxChannelNameLength {
+		return fmt.Errorf("name must be %d-%d characters long", MinChannelNameLength, MaxChannelNameLength)
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return errors.New("name may contain only lowercase latin letters, digits, '-' and '_'")
+		}
+	}
+	return nil
+}
+
+func validateChannelTopic(topic string) error {
+	if len(topic) > MaxChannelTopicLength {
+		return fmt.Errorf("topic must be at most %d bytes", MaxChannelTopicLength)
+	}
+	return nil
+}
+
+func (p *CreateChannelRequestPayload) Validate() error {
+	if err := ValidateChannelName(p.Name); err != nil {
+		return err
+	}
+	return validateChannelTopic(p.Topic)
+}
+
+func (p *ChannelRequestPayload) Validate() error {
+	return ValidateChannelName(p.Name)
+}
+
+func (p *SetChannelTopicRequestPayload) Validate() error {
+	if err := ValidateChannelName(p.Name); err != nil {
+		return err
+	}
+	return validateChannelTopic(p.Topic)
+}
+
+func (p *SendChannelMessageRequestPayload) Validate() error {
+	if err := ValidateChannelName(p.Name); err != nil {
+		return err
+	}
+	if p.Name == DefaultChannelName {
+		return errors.New("messages to the default channel are sent as TEXT_MESSAGE")
+	}
+	if p.Text == "" {
+		return errors.New("text is required")
+	}
+	return validateClientMsgID(p.ClientMsgID)
+}
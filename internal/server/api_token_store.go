@@ -0,0 +1,260 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+// APIToken - долгоживущий токен для ботов и скриптов. Предъявляется при HTTP upgrade
+// и дает доступ только к действиям из Scopes.
+type APIToken struct {
+	ID         string       `json:"id"`
+	TokenHash  string       `json:"token_hash"` // SHA-256 от токена; сам токен показывается только при создании
+	UserID     string       `json:"user_id"`
+	Name       string       `json:"name"`
+	Scopes     []Permission `json:"scopes"`
+	CreatedAt  time.Time    `json:"created_at"`
+	LastUsedAt time.Time    `json:"last_used_at"`
+}
+
+const (
+	// Префикс, по которому токен легко опознать в логах и конфигурации.
+	apiTokenPrefix = "mgr_"
+
+	// Сколько токенов может быть у одного пользователя.
+	maxAPITokensPerUser = 20
+
+	// Отметку последнего использования сохраняем на диск не чаще этого интервала.
+	apiTokenTouchInterval = time.Minute
+)
+
+var (
+	ErrAPITokenNotFound = errors.New("api token not found")
+	ErrInvalidScope     = errors.New("invalid scope")
+	ErrTooManyAPITokens = errors.New("too many api tokens")
+)
+
+// apiTokenScopes - права, которые можно выдать API-токену.
+var apiTokenScopes = map[Permission]bool{
+	protocol.ScopeReadHistory: true,
+	protocol.ScopeSendGlobal:  true,
+	protocol.ScopeSendPrivate: true,
+}
+
+// ParseAPITokenScopes проверяет список областей доступа и убирает повторы.
+func ParseAPITokenScopes(scopes []string) ([]Permission, error) {
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidScope)
+	}
+	seen := make(map[Permission]bool)
+	var out []Permission
+	for _, s := range scopes {
+		p := Permission(strings.TrimSpace(s))
+		if !apiTokenScopes[p] {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidScope, s)
+		}
+		if !seen[p] {
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+// APITokenStore хранит API-токены в памяти и сохраняет их в JSON-файл после каждого изменения.
+type APITokenStore struct {
+	path   string
+	mu     sync.Mutex
+	tokens map[string]*APIToken // Ключ - хеш токена
+}
+
+// NewAPITokenStore загружает API-токены из файла path.
+// Пустой path - хранилище только в памяти.
+func NewAPITokenStore(path string) (*APITokenStore, error) {
+	s := &APITokenStore{path: path, tokens: make(map[string]*APIToken)}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil // Токенов еще нет
+		}
+		return nil, fmt.Errorf("failed to read api token file '%s': %w", path, err)
+	}
+	if len(data) == 0 {
+		return s, nil
+	}
+
+	if err := json.Unmarshal(data, &s.tokens); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal api tokens from '%s': %w", path, err)
+	}
+
+	log.Printf("Successfully loaded %d api tokens from '%s'.", len(s.tokens), path)
+	return s, nil
+}
+
+// save сохраняет токены в JSON-файл. Вызывается при захваченном s.mu.
+func (s *APITokenStore) save() error {
+	if s.path == "" {
+		return nil // Хранилище только в памяти
+	}
+	data, err := json.MarshalIndent(s.tokens, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal api token store: %w", err)
+	}
+	if err := writeFileAtomic(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write api tokens to file '%s': %w", s.path, err)
+	}
+	return nil
+}
+
+// newAPITokenSecret генерирует случайный токен с префиксом apiTokenPrefix.
+func newAPITokenSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate api token: %w", err)
+	}
+	return apiTokenPrefix + hex.EncodeToString(buf), nil
+}
+
+// Create выпускает новый токен пользователя и возвращает его вместе с сохраненной записью.
+// Сам токен больше нигде не хранится, поэтому его нужно сразу передать пользователю.
+func (s *APITokenStore) Create(userID, name string, scopes []Permission) (string, *APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, t := range s.tokens {
+		if t.UserID == userID {
+			count++
+		}
+	}
+	if count >= maxAPITokensPerUser {
+		return "", nil, ErrTooManyAPITokens
+	}
+
+	secret, err := newAPITokenSecret()
+	if err != nil {
+		return "", nil, err
+	}
+	token := &APIToken{
+		ID:        uuid.NewString(),
+		TokenHash: hashSessionToken(secret),
+		UserID:    userID,
+		Name:      name,
+		Scopes:    append([]Permission(nil), scopes...),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	s.tokens[token.TokenHash] = token
+	if err := s.save(); err != nil {
+		delete(s.tokens, token.TokenHash)
+		return "", nil, fmt.Errorf("failed to save new api token: %w", err)
+	}
+	created := *token
+	return secret, &created, nil
+}
+
+// Authenticate ищет токен и отмечает его использование.
+func (s *APITokenStore) Authenticate(secret string) (*APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, exists := s.tokens[hashSessionToken(secret)]
+	if !exists {
+		return nil, ErrAPITokenNotFound
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(token.LastUsedAt) > apiTokenTouchInterval {
+		token.LastUsedAt = now
+		if err := s.save(); err != nil {
+			// Токен остается действительным, теряется лишь отметка использования.
+			log.Printf("Error saving api tokens after use of token %s: %v", token.ID, err)
+		}
+	}
+	found := *token
+	return &found, nil
+}
+
+// List возвращает токены пользователя, от старых к новым.
+func (s *APITokenStore) List(userID string) []*APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tokens []*APIToken
+	for _, t := range s.tokens {
+		if t.UserID == userID {
+			c := *t
+			tokens = append(tokens, &c)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+	return tokens
+}
+
+// Revoke удаляет токен пользователя по его ID.
+func (s *APITokenStore) Revoke(userID, tokenID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, t := range s.tokens {
+		if t.ID == tokenID && t.UserID == userID {
+			delete(s.tokens, key)
+			if err := s.save(); err != nil {
+				return fmt.Errorf("failed to save api tokens after revocation: %w", err)
+			}
+			return nil
+		}
+	}
+	return ErrAPITokenNotFound
+}
+
+// RevokeUser удаляет все токены пользователя и возвращает их количество.
+func (s *APITokenStore) RevokeUser(userID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revoked := 0
+	for key, t := range s.tokens {
+		if t.UserID == userID {
+			delete(s.tokens, key)
+			revoked++
+		}
+	}
+	if revoked == 0 {
+		return 0, nil
+	}
+	if err := s.save(); err != nil {
+		return revoked, fmt.Errorf("failed to save api tokens after revocation: %w", err)
+	}
+	return revoked, nil
+}
+
+// info переводит токен в описание для протокола (без секрета и хеша).
+func (t *APIToken) info() protocol.APITokenInfo {
+	info := protocol.APITokenInfo{
+		TokenID:   t.ID,
+		Name:      t.Name,
+		Scopes:    permissionStrings(t.Scopes),
+		CreatedAt: t.CreatedAt.Unix(),
+	}
+	if !t.LastUsedAt.IsZero() {
+		info.LastUsedAt = t.LastUsedAt.Unix()
+	}
+	return info
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// writeFileAtomic записывает data в path так, что после сбоя в path остается
+// либо старое, либо новое содержимое целиком: данные пишутся во временный файл
+// в той же директории, синхронизируются на диск и атомарно переименовываются.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for '%s': %w", path, err)
+	}
+	tmpPath := tmp.Name()
+	// При любой ошибке ниже временный файл не должен оставаться на диске.
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file for '%s': %w", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temp file for '%s': %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file for '%s': %w", path, err)
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		return fmt.Errorf("failed to set permissions on temp file for '%s': %w", path, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace '%s': %w", path, err)
+	}
+	return syncDir(dir)
+}
+
+// syncDir сбрасывает на диск запись директории, чтобы переименование пережило сбой питания.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil // На Windows директорию нельзя открыть для Sync, а переименование и так надежно
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory '%s': %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory '%s': %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AttemptPolicy задает, как быстро растут задержки после неудачных попыток входа.
+type AttemptPolicy struct {
+	FreeAttempts     int           // Неудачных попыток без задержки
+	BaseDelay        time.Duration // Задержка после первой "платной" попытки, далее удваивается
+	MaxDelay         time.Duration // Верхняя граница задержки
+	LockoutThreshold int           // После стольких неудач ключ блокируется на LockoutDuration
+	LockoutDuration  time.Duration
+}
+
+// AuthLimiterConfig - настройки защиты AUTH_LOOP от перебора паролей.
+type AuthLimiterConfig struct {
+	PerUsername AttemptPolicy
+	PerIP       AttemptPolicy // Мягче, чем для логина: за одним IP может быть много пользователей
+	// Счетчик неудач сбрасывается, если попыток не было дольше этого времени.
+	ResetAfter time.Duration
+	// Сколько попыток входа разрешено в одном соединении, после чего оно закрывается.
+	MaxAttemptsPerConn int
+}
+
+// DefaultAuthLimiterConfig - настройки по умолчанию.
+var DefaultAuthLimiterConfig = AuthLimiterConfig{
+	PerUsername: AttemptPolicy{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: 10,
+		LockoutDuration:  15 * time.Minute,
+	},
+	PerIP: AttemptPolicy{
+		FreeAttempts:     10,
+		BaseDelay:        time.Second,
+		MaxDelay:         5 * time.Minute,
+		LockoutThreshold: 50,
+		LockoutDuration:  15 * time.Minute,
+	},
+	ResetAfter:         time.Hour,
+	MaxAttemptsPerConn: 5,
+}
+
+// authLimiterSweepEvery - раз в столько неудач из карты удаляются устаревшие записи.
+const authLimiterSweepEvery = 256
+
+type authAttempts struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// AuthLimiter считает неудачные попытки входа по логину и по IP-адресу
+// и сообщает, сколько нужно подождать до следующей попытки.
+type AuthLimiter struct {
+	cfg AuthLimiterConfig
+	now func() time.Time // Источник времени; подменяется в тестах
+
+	mu       sync.Mutex
+	entries  map[string]*authAttempts
+	failures int // Всего неудач с последней очистки
+}
+
+// NewAuthLimiter создает ограничитель. Если now == nil, используется time.Now.
+func NewAuthLimiter(cfg AuthLimiterConfig, now func() time.Time) *AuthLimiter {
+	if now == nil {
+		now = time.Now
+	}
+	return &AuthLimiter{cfg: cfg, now: now, entries: make(map[string]*authAttempts)}
+}
+
+// MaxAttemptsPerConn возвращает лимит попыток входа в одном соединении (0 - без лимита).
+func (l *AuthLimiter) MaxAttemptsPerConn() int {
+	return l.cfg.MaxAttemptsPerConn
+}
+
+// limiterKeys возвращает ключи счетчиков. Пустой логин или IP не учитываются.
+func limiterKeys(username, ip string) []string {
+	var keys []string
+	if username != "" {
+		keys = append(keys, "user:"+NormalizeName(username))
+	}
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+	return keys
+}
+
+func (l *AuthLimiter) policyFor(key string) AttemptPolicy {
+	if strings.HasPrefix(key, "ip:") {
+		return l.cfg.PerIP
+	}
+	return l.cfg.PerUsername
+}
+
+// Check возвращает 0, если попытку можно выполнять, иначе - сколько осталось ждать.
+func (l *AuthLimiter) Check(username, ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	var wait time.Duration
+	for _, key := range limiterKeys(username, ip) {
+		entry := l.entryLocked(key, now)
+		if entry != nil && entry.blockedUntil.After(now) {
+			wait = max(wait, entry.blockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// Failure учитывает неудачную попытку и возвращает задержку до следующей (0 - без задержки).
+func (l *AuthLimiter) Failure(username, ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	var wait time.Duration
+	for _, key := range limiterKeys(username, ip) {
+		entry := l.entryLocked(key, now)
+		if entry == nil {
+			entry = &authAttempts{}
+			l.entries[key] = entry
+		}
+		entry.failures++
+		entry.lastFailure = now
+		if delay := l.policyFor(key).delayAfter(entry.failures); delay > 0 {
+			entry.blockedUntil = now.Add(delay)
+			wait = max(wait, delay)
+		}
+	}
+
+	l.failures++
+	if l.failures >= authLimiterSweepEvery {
+		l.sweepLocked(now)
+	}
+	return wait
+}
+
+// Success сбрасывает счетчик логина после успешного входа. Счетчик IP не сбрасывается,
+// чтобы один известный пароль не давал перебирать другие аккаунты с того же адреса.
+func (l *AuthLimiter) Success(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range limiterKeys(username, "") {
+		delete(l.entries, key)
+	}
+}
+
+// entryLocked возвращает запись счетчика, предварительно сбросив устаревшую.
+func (l *AuthLimiter) entryLocked(key string, now time.Time) *authAttempts {
+	entry, exists := l.entries[key]
+	if !exists {
+		return nil
+	}
+	if l.isStale(entry, now) {
+		delete(l.entries, key)
+		return nil
+	}
+	return entry
+}
+
+func (l *AuthLimiter) isStale(entry *authAttempts, now time.Time) bool {
+	return !entry.blockedUntil.After(now) && now.Sub(entry.lastFailure) > l.cfg.ResetAfter
+}
+
+// sweepLocked удаляет устаревшие записи, чтобы карта не росла бесконечно.
+func (l *AuthLimiter) sweepLocked(now time.Time) {
+	for key, entry := range l.entries {
+		if l.isStale(entry, now) {
+			delete(l.entries, key)
+		}
+	}
+	l.failures = 0
+}
+
+// delayAfter возвращает задержку после failures неудачных попыток подряд.
+func (p AttemptPolicy) delayAfter(failures int) time.Duration {
+	if p.LockoutThreshold > 0 && failures >= p.LockoutThreshold {
+		return p.LockoutDuration
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	exp := failures - p.FreeAttempts - 1
+	delay := time.Duration(float64(p.BaseDelay) * math.Pow(2, float64(exp)))
+	if delay <= 0 || delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// retryAfterSeconds округляет задержку вверх до целых секунд для ответа клиенту.
+func retryAfterSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
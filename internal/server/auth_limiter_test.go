@@ -0,0 +1,215 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+// fakeClock - источник времени для NewAuthLimiter, который двигается только вручную.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+var testAttemptPolicy = AttemptPolicy{
+	FreeAttempts:     2,
+	BaseDelay:        time.Second,
+	MaxDelay:         10 * time.Second,
+	LockoutThreshold: 8,
+	LockoutDuration:  time.Hour,
+}
+
+func newTestAuthLimiter() (*AuthLimiter, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	cfg := AuthLimiterConfig{
+		PerUsername:        testAttemptPolicy,
+		PerIP:              AttemptPolicy{FreeAttempts: 100, BaseDelay: time.Second, MaxDelay: time.Minute},
+		ResetAfter:         30 * time.Minute,
+		MaxAttemptsPerConn: 3,
+	}
+	return NewAuthLimiter(cfg, clock.now), clock
+}
+
+func TestAttemptPolicyDelayAfter(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 1, want: 0},
+		{failures: 2, want: 0},
+		{failures: 3, want: time.Second},
+		{failures: 4, want: 2 * time.Second},
+		{failures: 5, want: 4 * time.Second},
+		{failures: 6, want: 8 * time.Second},
+		{failures: 7, want: 10 * time.Second}, // Ограничено MaxDelay
+		{failures: 8, want: time.Hour},        // Порог блокировки
+		{failures: 100, want: time.Hour},
+	}
+	for _, tt := range tests {
+		if got := testAttemptPolicy.delayAfter(tt.failures); got != tt.want {
+			t.Errorf("delayAfter(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestAuthLimiterBackoff(t *testing.T) {
+	limiter, clock := newTestAuthLimiter()
+
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		delays = append(delays, limiter.Failure("alice", "10.0.0.1"))
+	}
+	want := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second}
+	for i := range want {
+		if delays[i] != want[i] {
+			t.Fatalf("Failure delays = %v, want %v", delays, want)
+		}
+	}
+
+	if wait := limiter.Check("alice", "10.0.0.1"); wait != 4*time.Second {
+		t.Fatalf("Check right after failure = %v, want 4s", wait)
+	}
+	// Логин сравнивается после нормализации, как при входе
+	if wait := limiter.Check("ALICE", "10.0.0.2"); wait != 4*time.Second {
+		t.Fatalf("Check with other case = %v, want 4s", wait)
+	}
+	if wait := limiter.Check("bob", "10.0.0.1"); wait != 0 {
+		t.Fatalf("Check for other user from the same IP = %v, want 0", wait)
+	}
+
+	clock.advance(3 * time.Second)
+	if wait := limiter.Check("alice", "10.0.0.1"); wait != time.Second {
+		t.Fatalf("Check after 3s = %v, want 1s", wait)
+	}
+	clock.advance(time.Second)
+	if wait := limiter.Check("alice", "10.0.0.1"); wait != 0 {
+		t.Fatalf("Check after the delay = %v, want 0", wait)
+	}
+	// Счетчик не сбрасывается по окончании задержки: следующая неудача удваивает ее
+	if delay := limiter.Failure("alice", "10.0.0.1"); delay != 8*time.Second {
+		t.Fatalf("next Failure = %v, want 8s", delay)
+	}
+}
+
+func TestAuthLimiterLockout(t *testing.T) {
+	limiter, clock := newTestAuthLimiter()
+
+	var delay time.Duration
+	for i := 0; i < testAttemptPolicy.LockoutThreshold; i++ {
+		delay = limiter.Failure("alice", "")
+	}
+	if delay != time.Hour {
+		t.Fatalf("Failure at lockout threshold = %v, want %v", delay, time.Hour)
+	}
+
+	// Блокировка длиннее ResetAfter, но запись не считается устаревшей, пока она действует
+	clock.advance(45 * time.Minute)
+	if wait := limiter.Check("alice", ""); wait != 15*time.Minute {
+		t.Fatalf("Check during lockout = %v, want 15m", wait)
+	}
+	clock.advance(15 * time.Minute)
+	if wait := limiter.Check("alice", ""); wait != 0 {
+		t.Fatalf("Check after lockout = %v, want 0", wait)
+	}
+}
+
+func TestAuthLimiterStaleEntryReset(t *testing.T) {
+	limiter, clock := newTestAuthLimiter()
+
+	for i := 0; i < 4; i++ {
+		limiter.Failure("alice", "10.0.0.1")
+	}
+	clock.advance(30*time.Minute + time.Second) // Дольше ResetAfter после последней неудачи
+
+	if wait := limiter.Check("alice", "10.0.0.1"); wait != 0 {
+		t.Fatalf("Check after ResetAfter = %v, want 0", wait)
+	}
+	// Счет начинается заново: снова доступны бесплатные попытки
+	for i := 0; i < testAttemptPolicy.FreeAttempts; i++ {
+		if delay := limiter.Failure("alice", "10.0.0.1"); delay != 0 {
+			t.Fatalf("Failure %d after reset = %v, want 0", i+1, delay)
+		}
+	}
+	if delay := limiter.Failure("alice", "10.0.0.1"); delay != time.Second {
+		t.Fatalf("first paid Failure after reset = %v, want 1s", delay)
+	}
+}
+
+func TestAuthLimiterSuccessResetsUsername(t *testing.T) {
+	limiter, _ := newTestAuthLimiter()
+	limiter.cfg.PerIP = AttemptPolicy{FreeAttempts: 1, BaseDelay: time.Minute, MaxDelay: time.Minute}
+
+	for i := 0; i < 4; i++ {
+		limiter.Failure("alice", "10.0.0.1")
+	}
+	limiter.Success("Alice")
+
+	if wait := limiter.Check("alice", ""); wait != 0 {
+		t.Fatalf("Check for username after Success = %v, want 0", wait)
+	}
+	// Счетчик IP после успешного входа остается
+	if wait := limiter.Check("", "10.0.0.1"); wait != time.Minute {
+		t.Fatalf("Check for IP after Success = %v, want 1m", wait)
+	}
+	if delay := limiter.Failure("alice", ""); delay != 0 {
+		t.Fatalf("Failure after Success = %v, want 0 (counter reset)", delay)
+	}
+}
+
+func TestAuthLimiterPerConnectionCap(t *testing.T) {
+	limiter, _ := newTestAuthLimiter()
+	hub := NewHub(HubConfig{Users: NewMemoryUserStore(DefaultUniquenessRules), AuthLimiter: limiter})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleWebSocketConnections(hub, w, r)
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	login := `{"type":"LOGIN_REQUEST","request_id":"%d","payload":{"username":"nobody","password":"wrong-password"}}`
+	for i := 1; i <= limiter.MaxAttemptsPerConn(); i++ {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(login, i))); err != nil {
+			t.Fatalf("write login %d: %v", i, err)
+		}
+		var resp struct {
+			Type    string                        `json:"type"`
+			Payload protocol.LoginResponsePayload `json:"payload"`
+		}
+		if err := conn.ReadJSON(&resp); err != nil {
+			t.Fatalf("read login response %d: %v", i, err)
+		}
+		if resp.Type != protocol.MsgTypeLoginResponse || resp.Payload.ErrorCode != protocol.ErrCodeInvalidCredentials {
+			t.Fatalf("login %d: got %s %+v, want INVALID_CREDENTIALS", i, resp.Type, resp.Payload)
+		}
+	}
+
+	// После последней разрешенной попытки сервер сообщает о лимите и закрывает соединение
+	var notify struct {
+		Type    string                `json:"type"`
+		Payload protocol.ErrorPayload `json:"payload"`
+	}
+	if err := conn.ReadJSON(&notify); err != nil {
+		t.Fatalf("read error notify: %v", err)
+	}
+	if notify.Type != protocol.MsgTypeErrorNotify || notify.Payload.ErrorCode != protocol.ErrCodeTooManyAttempts {
+		t.Fatalf("got %s %+v, want %s", notify.Type, notify.Payload, protocol.ErrCodeTooManyAttempts)
+	}
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+		t.Fatalf("read after cap = %v, want close %d", err, websocket.ClosePolicyViolation)
+	}
+}
@@ -1,188 +1,393 @@
 package server
 
 import (
-	"encoding/json"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"log"
-	"os" // Используем os для работы с файлами
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/vladimirruppel/messengor/internal/protocol"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// User представляет пользователя в системе.
-type User struct {
-	ID           string    `json:"id"`
-	Username     string    `json:"username"`
-	PasswordHash string    `json:"password_hash"`
-	DisplayName  string    `json:"display_name"`
-	CreatedAt    time.Time `json:"created_at"`
-}
+// RegisterNewUser проверяет данные по политике регистрации, создает и сохраняет нового пользователя.
+// Ошибки проверки возвращаются как *ValidationError.
+// Если invites не nil, сервер работает в режиме регистрации по приглашениям и inviteCode обязателен.
+// Новый пользователь всегда получает RoleUser: первого администратора назначает оператор
+// флагом -bootstrap-admin (см. BootstrapAdmin).
+func RegisterNewUser(users UserStore, policy *RegistrationPolicy, invites *InviteStore, username, password, displayName, inviteCode string) (*User, error) {
+	if err := policy.Validate(username, password, displayName); err != nil {
+		return nil, err
+	}
 
-var (
-	// userStore хранит пользователей. Ключ - username.
-	userStore      map[string]*User // Будет инициализирован в loadUsersFromFile или init
-	userStoreMutex = &sync.RWMutex{}
+	if _, err := users.GetByUsername(username); err == nil {
+		return nil, ErrUsernameTaken
+	} else if !errors.Is(err, ErrUserNotFound) {
+		return nil, err
+	}
 
-	// Ошибки, специфичные для хранилища/аутентификации
-	ErrUserNotFound    = errors.New("user not found")
-	ErrUsernameTaken   = errors.New("username is already taken")
-	ErrInvalidPassword = errors.New("invalid password")
-	ErrPasswordHashing = errors.New("failed to hash password")
-)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("Error hashing password for %s: %v", username, err)
+		return nil, ErrPasswordHashing
+	}
 
-const userStoreFile = "users_data.json" // Файл для хранения данных пользователей
+	userID := uuid.NewString()
+	if invites != nil {
+		if strings.TrimSpace(inviteCode) == "" {
+			return nil, inviteValidationError(ErrInviteRequired, protocol.FieldErrRequired)
+		}
+		if err := invites.Redeem(inviteCode, userID); err != nil {
+			if errors.Is(err, ErrInviteNotFound) || errors.Is(err, ErrInviteExpired) || errors.Is(err, ErrInviteUsedUp) || errors.Is(err, ErrInviteRevoked) {
+				return nil, inviteValidationError(err, protocol.FieldErrInvalid)
+			}
+			return nil, err
+		}
+		inviteCode = normalizeInviteCode(inviteCode)
+	} else {
+		inviteCode = ""
+	}
 
-// init вызывается один раз при импорте пакета.
-func init() {
-	if err := loadUsersFromFile(); err != nil {
-		log.Printf("Warning: Could not load users from '%s': %v. Starting with an empty user store.", userStoreFile, err)
-		// Убедимся, что userStore инициализирован в любом случае
-		userStoreMutex.Lock()
-		if userStore == nil {
-			userStore = make(map[string]*User)
+	newUser := &User{
+		ID:           userID,
+		Username:     username,
+		PasswordHash: string(hashedPassword),
+		DisplayName:  displayName,
+		CreatedAt:    time.Now().UTC(),
+		Role:         RoleUser,
+		Permissions:  RolePermissions(RoleUser),
+		InviteCode:   inviteCode,
+	}
+
+	// Create повторно проверяет уникальность, так что гонка двух регистраций не страшна.
+	if err := users.Create(newUser); err != nil {
+		if inviteCode != "" {
+			invites.Release(inviteCode, userID)
+		}
+		if errors.Is(err, ErrUsernameTaken) || errors.Is(err, ErrDisplayNameTaken) {
+			return nil, err
 		}
-		userStoreMutex.Unlock()
+		log.Printf("CRITICAL: Failed to save new user %s: %v", username, err)
+		return nil, fmt.Errorf("failed to save new user to persistent store: %w", err)
 	}
+
+	if inviteCode != "" {
+		log.Printf("User registered and saved: %s (ID: %s, role: %s, invite: %s)", newUser.Username, newUser.ID, newUser.Role, inviteCode)
+	} else {
+		log.Printf("User registered and saved: %s (ID: %s, role: %s)", newUser.Username, newUser.ID, newUser.Role)
+	}
+	return newUser, nil
 }
 
-// loadUsersFromFile загружает данные пользователей из JSON-файла.
-func loadUsersFromFile() error {
-	userStoreMutex.Lock() // Полная блокировка на время загрузки
-	defer userStoreMutex.Unlock()
+// dummyPasswordHash - хеш, с которым сравнивается пароль несуществующего пользователя,
+// чтобы время ответа не выдавало, есть ли такой логин. Вычисляется при запуске с той же
+// стоимостью, что и настоящие хеши.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("messengor-dummy-password"), bcrypt.DefaultCost)
 
-	// Инициализируем userStore, даже если файл не существует или пуст
-	userStore = make(map[string]*User)
+// AuthenticateUser проверяет учетные данные пользователя.
+// Неизвестный логин и неверный пароль неразличимы для клиента: в обоих случаях возвращается
+// ErrInvalidCredentials, а bcrypt выполняется одинаково.
+func AuthenticateUser(users UserStore, username, password string) (*User, error) {
+	user, err := users.GetByUsername(username)
+	if errors.Is(err, ErrUserNotFound) {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		log.Printf("Authentication failed: unknown username %s", username)
+		return nil, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
 
-	data, err := os.ReadFile(userStoreFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			log.Printf("User data file '%s' not found. A new one will be created on first registration.", userStoreFile)
-			return nil // Это не ошибка, просто нет сохраненных пользователей
+	if err := checkPassword(user, password); err != nil {
+		if !errors.Is(err, ErrInvalidPassword) {
+			log.Printf("Error comparing password for %s: %v", username, err)
+			return nil, err
 		}
-		return fmt.Errorf("failed to read user data file '%s': %w", userStoreFile, err)
+		log.Printf("Authentication failed: wrong password for %s", username)
+		return nil, ErrInvalidCredentials
 	}
 
-	// Если файл пустой, также считаем, что нет сохраненных пользователей.
-	if len(data) == 0 {
-		log.Printf("User data file '%s' is empty.", userStoreFile)
-		return nil
+	if user.Deactivated {
+		return nil, ErrUserDeactivated
 	}
 
-	if err := json.Unmarshal(data, &userStore); err != nil {
-		// Если файл поврежден, лучше начать с чистого листа, чем с некорректными данными.
-		log.Printf("Error unmarshalling user data from '%s': %v. Store will be treated as empty.", userStoreFile, err)
-		userStore = make(map[string]*User) // Сбрасываем до пустого состояния
-		return fmt.Errorf("failed to unmarshal user data: %w", err)
-	}
+	log.Printf("User authenticated: %s (ID: %s)", user.Username, user.ID)
+	return user, nil
+}
 
-	log.Printf("Successfully loaded %d users from '%s'.", len(userStore), userStoreFile)
-	return nil
+// checkPassword сравнивает пароль с хешем пользователя.
+func checkPassword(user *User, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrInvalidPassword
+	}
+	return err
 }
 
-// saveUsersToFile сохраняет текущее состояние userStore в JSON-файл.
-// Эта функция должна вызываться, когда userStoreMutex уже ЗАХВАЧЕН НА ЗАПИСЬ (Lock),
-// так как она отражает состояние userStore, которое только что было изменено.
-func saveUsersToFile() error {
-	data, err := json.MarshalIndent(userStore, "", "  ")
+// ChangeUserPassword меняет пароль пользователя после проверки старого.
+// Новый пароль должен соответствовать политике регистрации.
+func ChangeUserPassword(users UserStore, policy *RegistrationPolicy, userID, oldPassword, newPassword string) error {
+	user, err := users.GetByID(userID)
 	if err != nil {
-		return fmt.Errorf("failed to marshal user store: %w", err)
+		return err
+	}
+	if err := checkPassword(user, oldPassword); err != nil {
+		return err
+	}
+	if err := policy.ValidatePassword(newPassword); err != nil {
+		return err
 	}
 
-	if err := os.WriteFile(userStoreFile, data, 0644); err != nil {
-		return fmt.Errorf("failed to write user data to file '%s': %w", userStoreFile, err)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("Error hashing new password for %s: %v", user.Username, err)
+		return ErrPasswordHashing
+	}
+
+	if err := updateUser(users, userID, "changed password", func(u *User) error {
+		if err := ensurePasswordUnchanged(u, user); err != nil {
+			return err
+		}
+		u.PasswordHash = string(hashedPassword)
+		return nil
+	}); err != nil {
+		return err
 	}
-	
+
+	log.Printf("Password changed for user %s (ID: %s)", user.Username, user.ID)
 	return nil
 }
 
-// RegisterNewUser создает и сохраняет нового пользователя.
-func RegisterNewUser(username, password, displayName string) (*User, error) {
-	userStoreMutex.Lock() // Блокируем на время проверки и модификации userStore и сохранения в файл
-	defer userStoreMutex.Unlock()
+// DeactivateUser запрещает вход в аккаунт, сохраняя сам аккаунт и его историю.
+func DeactivateUser(users UserStore, userID, password string) error {
+	user, err := users.GetByID(userID)
+	if err != nil {
+		return err
+	}
+	if err := checkPassword(user, password); err != nil {
+		return err
+	}
 
-	if userStore == nil { // Дополнительная страховка, если init не смог инициализировать
-		log.Println("User store was nil in RegisterNewUser, re-initializing.")
-		userStore = make(map[string]*User)
+	if err := ensureNotLastAdmin(users, user); err != nil {
+		return err
 	}
 
-	if _, exists := userStore[username]; exists {
-		return nil, ErrUsernameTaken
+	if err := updateUser(users, userID, "deactivated user", func(u *User) error {
+		if err := ensurePasswordUnchanged(u, user); err != nil {
+			return err
+		}
+		u.Deactivated = true
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	log.Printf("User deactivated: %s (ID: %s)", user.Username, user.ID)
+	return nil
+}
+
+// DeleteUser удаляет аккаунт из хранилища пользователей.
+// Анонимизация истории выполняется отдельно (см. AnonymizeSenderInHistory).
+func DeleteUser(users UserStore, userID, password string) error {
+	user, err := users.GetByID(userID)
 	if err != nil {
-		log.Printf("Error hashing password for %s: %v", username, err)
-		return nil, ErrPasswordHashing
+		return err
+	}
+	if err := checkPassword(user, password); err != nil {
+		return err
 	}
 
-	newUser := &User{
-		ID:           uuid.NewString(),
-		Username:     username,
-		PasswordHash: string(hashedPassword),
-		DisplayName:  displayName,
-		CreatedAt:    time.Now().UTC(),
+	if err := ensureNotLastAdmin(users, user); err != nil {
+		return err
 	}
 
-	userStore[username] = newUser // Добавляем в map в памяти
+	if err := users.Delete(user.ID); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
 
-	// Сохраняем обновленный userStore в файл
-	if err := saveUsersToFile(); err != nil {
-		log.Printf("CRITICAL: User %s registered in memory, but FAILED TO SAVE to '%s': %v. Rolling back in-memory registration.", username, userStoreFile, err)
-		delete(userStore, username) // Откатываем добавление в память
-		return nil, fmt.Errorf("failed to save new user to persistent store: %w", err)
+	log.Printf("User deleted: %s (ID: %s)", user.Username, user.ID)
+	return nil
+}
+
+// SetReadReceipts включает или отключает отчеты о прочтении сообщений пользователя.
+func SetReadReceipts(users UserStore, userID string, enabled bool) error {
+	var username string
+	if err := updateUser(users, userID, "read receipts setting", func(u *User) error {
+		u.ReadReceiptsDisabled = !enabled
+		username = u.Username
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	log.Printf("User registered and saved: %s (ID: %s)", newUser.Username, newUser.ID)
-	return newUser, nil
+	log.Printf("Read receipts enabled=%t for user %s (ID: %s)", enabled, username, userID)
+	return nil
 }
 
-// AuthenticateUser проверяет учетные данные пользователя.
-func AuthenticateUser(username, password string) (*User, error) {
-	userStoreMutex.RLock() // Блокировка на чтение
-	// Проверка на nil, если вдруг init не отработал
-	if userStore == nil {
-		userStoreMutex.RUnlock()
-		log.Printf("CRITICAL: userStore is nil during AuthenticateUser for %s. This should not happen.", username)
-		return nil, errors.New("user store not initialized, please try again or contact admin")
+// updateUser атомарно изменяет пользователя через users.Update. Ошибки, у которых есть код
+// протокола (их возвращает fn или хранилище), передаются как есть, остальные оборачиваются
+// описанием what.
+func updateUser(users UserStore, userID, what string, fn func(*User) error) error {
+	err := users.Update(userID, fn)
+	if err != nil && errorCode(err) == protocol.ErrCodeInternal {
+		return fmt.Errorf("failed to save %s: %w", what, err)
 	}
-	user, exists := userStore[username]
-	userStoreMutex.RUnlock()
+	return err
+}
 
-	if !exists {
-		return nil, ErrUserNotFound
+// ensurePasswordUnchanged проверяет, что пароль, проверенный по копии checked, не сменили
+// до начала Update. Иначе изменение отклоняется: старый пароль уже не действует.
+func ensurePasswordUnchanged(u, checked *User) error {
+	if u.PasswordHash != checked.PasswordHash {
+		return ErrInvalidPassword
 	}
+	return nil
+}
 
-	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+// inviteValidationError оформляет ошибку кода приглашения как ошибку поля invite_code.
+func inviteValidationError(err error, code string) *ValidationError {
+	return &ValidationError{Fields: []protocol.FieldError{{Field: protocol.FieldInviteCode, Code: code, Message: err.Error()}}}
+}
+
+// BeginTOTPEnrollment создает новый секрет TOTP для пользователя. Двухфакторная аутентификация
+// включается только после ConfirmTOTPEnrollment с кодом из приложения.
+func BeginTOTPEnrollment(users UserStore, userID, password string) (secret, uri string, err error) {
+	user, err := users.GetByID(userID)
 	if err != nil {
-		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
-			return nil, ErrInvalidPassword
+		return "", "", err
+	}
+	if err := checkPassword(user, password); err != nil {
+		return "", "", err
+	}
+	if user.TOTPEnabled {
+		return "", "", ErrTOTPAlreadyEnabled
+	}
+
+	if secret, err = newTOTPSecret(); err != nil {
+		return "", "", err
+	}
+	if err := updateUser(users, userID, "totp enrollment", func(u *User) error {
+		if err := ensurePasswordUnchanged(u, user); err != nil {
+			return err
+		}
+		if u.TOTPEnabled {
+			return ErrTOTPAlreadyEnabled
 		}
-		log.Printf("Error comparing password for %s: %v", username, err)
-		return nil, err // Возвращаем оригинальную ошибку bcrypt
+		u.TOTPPendingSecret = secret
+		return nil
+	}); err != nil {
+		return "", "", err
 	}
+	return secret, totpURI(user.Username, secret), nil
+}
 
-	log.Printf("User authenticated: %s (ID: %s)", user.Username, user.ID)
-	return user, nil
+// ConfirmTOTPEnrollment включает TOTP, если code совпадает с секретом из BeginTOTPEnrollment,
+// и возвращает одноразовые коды восстановления. Они показываются пользователю только один раз.
+func ConfirmTOTPEnrollment(users UserStore, userID, code string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	var username string
+	if err := updateUser(users, userID, "totp settings", func(u *User) error {
+		if u.TOTPEnabled {
+			return ErrTOTPAlreadyEnabled
+		}
+		if u.TOTPPendingSecret == "" {
+			return ErrTOTPNotPending
+		}
+		step, ok := verifyTOTP(u.TOTPPendingSecret, code, time.Now(), 0)
+		if !ok {
+			return ErrInvalidTOTPCode
+		}
+		u.TOTPEnabled = true
+		u.TOTPSecret = u.TOTPPendingSecret
+		u.TOTPPendingSecret = ""
+		u.TOTPLastStep = step
+		u.RecoveryCodeHashes = hashes
+		username = u.Username
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Two-factor authentication enabled for user %s (ID: %s)", username, userID)
+	return codes, nil
 }
 
-// GetUserByID находит пользователя по ID.
-func GetUserByID(userID string) (*User, bool) {
-	userStoreMutex.RLock()
-	defer userStoreMutex.RUnlock()
+// DisableTOTP выключает двухфакторную аутентификацию. Нужны пароль и действующий код
+// (или код восстановления), чтобы украденной сессии было недостаточно.
+func DisableTOTP(users UserStore, userID, password, code string) error {
+	user, err := users.GetByID(userID)
+	if err != nil {
+		return err
+	}
+	if err := checkPassword(user, password); err != nil {
+		return err
+	}
+
+	// Код проверяется и отмечается использованным в том же Update, что и выключение
+	if err := updateUser(users, userID, "totp settings", func(u *User) error {
+		if err := ensurePasswordUnchanged(u, user); err != nil {
+			return err
+		}
+		if !u.TOTPEnabled {
+			return ErrTOTPNotEnabled
+		}
+		if !consumeSecondFactor(u, code) {
+			return ErrInvalidTOTPCode
+		}
+		u.TOTPEnabled = false
+		u.TOTPSecret = ""
+		u.TOTPPendingSecret = ""
+		u.TOTPLastStep = 0
+		u.RecoveryCodeHashes = nil
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	log.Printf("Two-factor authentication disabled for user %s (ID: %s)", user.Username, user.ID)
+	return nil
+}
 
-	if userStore == nil {
-		log.Printf("CRITICAL: userStore is nil during GetUserByID for %s. This should not happen.", userID)
-		return nil, false
+// VerifySecondFactor проверяет второй фактор при входе: код TOTP или код восстановления.
+// Использованный код восстановления удаляется, а шаг TOTP запоминается. Проверка и отметка
+// выполняются в одном Update, поэтому два одновременных запроса с одним кодом не пройдут оба.
+func VerifySecondFactor(users UserStore, userID, code string) (*User, error) {
+	var user *User
+	if err := updateUser(users, userID, "totp state", func(u *User) error {
+		if !u.TOTPEnabled {
+			return ErrTOTPNotEnabled
+		}
+		if !consumeSecondFactor(u, code) {
+			return ErrInvalidTOTPCode
+		}
+		user = u.clone()
+		return nil
+	}); err != nil {
+		return nil, err
 	}
+	return user, nil
+}
 
-	for _, u := range userStore {
-		if u.ID == userID {
-			return u, true
+// consumeSecondFactor проверяет код TOTP или код восстановления и отмечает его использование в user.
+// Вызывается внутри UserStore.Update, чтобы проверка и отметка были атомарными.
+func consumeSecondFactor(user *User, code string) bool {
+	if step, ok := verifyTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep); ok {
+		user.TOTPLastStep = step
+		return true
+	}
+	hash := hashRecoveryCode(normalizeRecoveryCode(code))
+	for i, h := range user.RecoveryCodeHashes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			user.RecoveryCodeHashes = append(user.RecoveryCodeHashes[:i], user.RecoveryCodeHashes[i+1:]...)
+			log.Printf("Recovery code used by user %s (ID: %s), %d left", user.Username, user.ID, len(user.RecoveryCodeHashes))
+			return true
 		}
 	}
-	return nil, false
+	return false
 }
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegisterNewUserFirstUserIsNotAdmin(t *testing.T) {
+	users := NewMemoryUserStore(DefaultUniquenessRules)
+	user, err := RegisterNewUser(users, DefaultRegistrationPolicy(), nil, "alice", "password1", "Alice", "")
+	if err != nil {
+		t.Fatalf("RegisterNewUser: %v", err)
+	}
+	if user.EffectiveRole() != RoleUser || user.HasPermission(PermManageRoles) {
+		t.Fatalf("first user got role %q, want %q", user.Role, RoleUser)
+	}
+}
+
+func TestRegisterNewUserInviteOnlyEmptyStore(t *testing.T) {
+	users := NewMemoryUserStore(DefaultUniquenessRules)
+	invites, err := NewInviteStore(filepath.Join(t.TempDir(), "invites_data.json"))
+	if err != nil {
+		t.Fatalf("NewInviteStore: %v", err)
+	}
+
+	// На пустом закрытом сервере код нужен и первому пользователю
+	_, err = RegisterNewUser(users, DefaultRegistrationPolicy(), invites, "alice", "password1", "Alice", "")
+	var verr *ValidationError
+	if !errors.As(err, &verr) || verr.Fields[0].Message != ErrInviteRequired.Error() {
+		t.Fatalf("RegisterNewUser without invite error = %v, want invite required", err)
+	}
+	if all, _ := users.List(); len(all) != 0 {
+		t.Fatalf("user created without invite: %+v", all[0])
+	}
+
+	invite, err := invites.Create("operator", 1, 0)
+	if err != nil {
+		t.Fatalf("Create invite: %v", err)
+	}
+	user, err := RegisterNewUser(users, DefaultRegistrationPolicy(), invites, "alice", "password1", "Alice", invite.Code)
+	if err != nil {
+		t.Fatalf("RegisterNewUser with invite: %v", err)
+	}
+	if user.EffectiveRole() != RoleUser {
+		t.Fatalf("user registered by invite got role %q, want %q", user.Role, RoleUser)
+	}
+}
+
+// newTOTPUser создает пользователя с включенной TOTP и возвращает его секрет и коды восстановления.
+func newTOTPUser(t *testing.T, users UserStore) (secret string, recovery []string) {
+	t.Helper()
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatalf("newTOTPSecret: %v", err)
+	}
+	recovery, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatalf("newRecoveryCodes: %v", err)
+	}
+	u := testUser("1", "alice", "Alice")
+	u.TOTPEnabled = true
+	u.TOTPSecret = secret
+	u.RecoveryCodeHashes = hashes
+	if err := users.Create(u); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	return secret, recovery
+}
+
+func TestVerifySecondFactorConcurrentReplay(t *testing.T) {
+	users := NewMemoryUserStore(DefaultUniquenessRules)
+	secret, recovery := newTOTPUser(t, users)
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		code string
+	}{
+		{name: "totp", code: hotp(key, uint64(totpStep(time.Now())))},
+		{name: "recovery_code", code: recovery[0]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Несколько SECOND_FACTOR с одним кодом одновременно: принят должен быть только один
+			const attempts = 8
+			var wg sync.WaitGroup
+			var accepted atomic.Int32
+			for i := 0; i < attempts; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := VerifySecondFactor(users, "1", tt.code); err == nil {
+						accepted.Add(1)
+					} else if !errors.Is(err, ErrInvalidTOTPCode) {
+						t.Errorf("VerifySecondFactor error = %v, want ErrInvalidTOTPCode", err)
+					}
+				}()
+			}
+			wg.Wait()
+			if n := accepted.Load(); n != 1 {
+				t.Fatalf("code accepted %d times, want once", n)
+			}
+		})
+	}
+
+	u, _ := users.GetByID("1")
+	if len(u.RecoveryCodeHashes) != len(recovery)-1 {
+		t.Fatalf("%d recovery codes left, want %d", len(u.RecoveryCodeHashes), len(recovery)-1)
+	}
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+// Channel - публичный канал. Сообщения хранятся в истории под ID чата канала, как и у других чатов.
+type Channel struct {
+	Name      string               `json:"name"` // Без "#"
+	Topic     string               `json:"topic,omitempty"`
+	CreatedBy string               `json:"created_by,omitempty"`
+	CreatedAt time.Time            `json:"created_at"`
+	Members   map[string]time.Time `json:"members,omitempty"` // UserID -> время вступления; у канала по умолчанию пусто
+}
+
+var (
+	ErrChannelNotFound = errors.New("channel not found")
+	ErrChannelExists   = errors.New("channel already exists")
+	ErrNotInChannel    = errors.New("you are not a member of this channel")
+	ErrDefaultChannel  = errors.New("everyone is a member of the default channel, it cannot be left")
+
+	// errAlreadyInChannel прерывает Join без сохранения: повторное вступление ничего не меняет.
+	errAlreadyInChannel = errors.New("already a member of the channel")
+)
+
+// ChannelStorePath возвращает путь к файлу каналов рядом с файлом пользователей.
+func ChannelStorePath(usersPath string) string {
+	return filepath.Join(filepath.Dir(usersPath), "channels_data.json")
+}
+
+// IsChannelChatID сообщает, является ли chatID ID чата публичного канала (кроме канала по умолчанию).
+func IsChannelChatID(chatID string) bool {
+	return strings.HasPrefix(chatID, protocol.ChannelChatIDPrefix)
+}
+
+// ChannelStore хранит публичные каналы в памяти и сохраняет их в JSON-файл после каждого изменения.
+// Канал по умолчанию (глобальный чат) существует всегда; в нем состоят все пользователи.
+type ChannelStore struct {
+	path     string
+	mu       sync.Mutex
+	channels map[string]*Channel // Ключ - название канала
+}
+
+// NewChannelStore загружает каналы из файла path.
+// Пустой path - хранилище только в памяти.
+func NewChannelStore(path string) (*ChannelStore, error) {
+	s := &ChannelStore{path: path, channels: make(map[string]*Channel)}
+
+	var data []byte
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read channel data file '%s': %w", path, err)
+		}
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.channels); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal channel data from '%s': %w", path, err)
+		}
+		log.Printf("Successfully loaded %d channels from '%s'.", len(s.channels), path)
+	}
+
+	// Канал по умолчанию сохраняется в файл только вместе с первым изменением (например, темы)
+	if _, exists := s.channels[protocol.DefaultChannelName]; !exists {
+		s.channels[protocol.DefaultChannelName] = &Channel{Name: protocol.DefaultChannelName, CreatedAt: time.Now().UTC()}
+	}
+	return s, nil
+}
+
+// save сохраняет каналы в JSON-файл. Вызывается при захваченном s.mu.
+func (s *ChannelStore) save() error {
+	if s.path == "" {
+		return nil // Хранилище только в памяти
+	}
+	data, err := json.MarshalIndent(s.channels, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal channel store: %w", err)
+	}
+	if err := writeFileAtomic(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write channel data to file '%s': %w", s.path, err)
+	}
+	return nil
+}
+
+// update применяет change к копии канала и сохраняет ее. Если change или сохранение не удались,
+// канал остается прежним. Возвращает описание канала для userID.
+func (s *ChannelStore) update(name, userID string, change func(ch *Channel) error) (protocol.ChannelInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists := s.channels[name]
+	if !exists {
+		return protocol.ChannelInfo{}, ErrChannelNotFound
+	}
+	updated := current.clone()
+	if err := change(updated); err != nil {
+		return protocol.ChannelInfo{}, err
+	}
+
+	s.channels[name] = updated
+	if err := s.save(); err != nil {
+		s.channels[name] = current
+		return protocol.ChannelInfo{}, fmt.Errorf("failed to save channel %s: %w", name, err)
+	}
+	return updated.info(userID), nil
+}
+
+// Create создает канал name; создатель creatorID сразу в него вступает.
+func (s *ChannelStore) Create(name, creatorID, topic string) (protocol.ChannelInfo, error) {
+	now := time.Now().UTC()
+	channel := &Channel{
+		Name:      name,
+		Topic:     strings.TrimSpace(topic),
+		CreatedBy: creatorID,
+		CreatedAt: now,
+		Members:   map[string]time.Time{creatorID: now},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.channels[name]; exists {
+		return protocol.ChannelInfo{}, ErrChannelExists
+	}
+	s.channels[name] = channel
+	if err := s.save(); err != nil {
+		delete(s.channels, name)
+		return protocol.ChannelInfo{}, fmt.Errorf("failed to save new channel: %w", err)
+	}
+	return channel.info(creatorID), nil
+}
+
+// Exists сообщает, существует ли канал name.
+func (s *ChannelStore) Exists(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exists := s.channels[name]
+	return exists
+}
+
+// IsMember сообщает, состоит ли userID в канале name. В канале по умолчанию состоят все.
+func (s *ChannelStore) IsMember(name, userID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channel, exists := s.channels[name]
+	return exists && channel.isMember(userID)
+}
+
+// Members возвращает ID участников канала name. Для канала по умолчанию список пуст:
+// его сообщения рассылаются всем клиентам через Hub.Run.
+func (s *ChannelStore) Members(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channel, exists := s.channels[name]
+	if !exists {
+		return nil
+	}
+	members := make([]string, 0, len(channel.Members))
+	for id := range channel.Members {
+		members = append(members, id)
+	}
+	return members
+}
+
+// List возвращает описания каналов для userID по алфавиту. query ищет подстроку в названии
+// и теме без учета регистра; joinedOnly оставляет только каналы, в которых состоит userID.
+func (s *ChannelStore) List(userID, query string, joinedOnly bool) []protocol.ChannelInfo {
+	query = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(query), "#"))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channels := make([]protocol.ChannelInfo, 0, len(s.channels))
+	for _, channel := range s.channels {
+		if joinedOnly && !channel.isMember(userID) {
+			continue
+		}
+		if query != "" && !strings.Contains(channel.Name, query) && !strings.Contains(strings.ToLower(channel.Topic), query) {
+			continue
+		}
+		channels = append(channels, channel.info(userID))
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	return channels
+}
+
+// Join добавляет userID в канал name. Возвращает false, если он уже состоял в канале.
+func (s *ChannelStore) Join(name, userID string) (protocol.ChannelInfo, bool, error) {
+	joined := false
+	info, err := s.update(name, userID, func(ch *Channel) error {
+		if ch.isMember(userID) {
+			return errAlreadyInChannel
+		}
+		ch.Members[userID] = time.Now().UTC()
+		joined = true
+		return nil
+	})
+	if errors.Is(err, errAlreadyInChannel) {
+		return s.info(name, userID), false, nil
+	}
+	return info, joined, err
+}
+
+// Leave удаляет userID из канала name. Пустой канал не удаляется: его название и тема остаются.
+func (s *ChannelStore) Leave(name, userID string) (protocol.ChannelInfo, error) {
+	return s.update(name, userID, func(ch *Channel) error {
+		if ch.Name == protocol.DefaultChannelName {
+			return ErrDefaultChannel
+		}
+		if !ch.isMember(userID) {
+			return ErrNotInChannel
+		}
+		delete(ch.Members, userID)
+		return nil
+	})
+}
+
+// SetTopic меняет тему канала name. Менять тему могут участники канала; права на тему
+// канала по умолчанию проверяет вызывающий.
+func (s *ChannelStore) SetTopic(name, userID, topic string) (protocol.ChannelInfo, error) {
+	return s.update(name, userID, func(ch *Channel) error {
+		if !ch.isMember(userID) {
+			return ErrNotInChannel
+		}
+		ch.Topic = strings.TrimSpace(topic)
+		return nil
+	})
+}
+
+// RemoveUser удаляет userID из всех каналов (например, при удалении аккаунта).
+func (s *ChannelStore) RemoveUser(userID string) error {
+	for _, info := range s.List(userID, "", true) {
+		if info.Default {
+			continue
+		}
+		if _, err := s.Leave(info.Name, userID); err != nil && !errors.Is(err, ErrNotInChannel) {
+			return err
+		}
+	}
+	return nil
+}
+
+// info возвращает описание канала name для userID (пустое, если канала нет).
+func (s *ChannelStore) info(name, userID string) protocol.ChannelInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channel, exists := s.channels[name]
+	if !exists {
+		return protocol.ChannelInfo{}
+	}
+	return channel.info(userID)
+}
+
+func (ch *Channel) isMember(userID string) bool {
+	if ch.Name == protocol.DefaultChannelName {
+		return true
+	}
+	_, ok := ch.Members[userID]
+	return ok
+}
+
+func (ch *Channel) clone() *Channel {
+	c := *ch
+	c.Members = make(map[string]time.Time, len(ch.Members))
+	for id, joinedAt := range ch.Members {
+		c.Members[id] = joinedAt
+	}
+	return &c
+}
+
+// info переводит канал в описание для протокола с точки зрения userID.
+func (ch *Channel) info(userID string) protocol.ChannelInfo {
+	info := protocol.ChannelInfo{
+		ChatID:      protocol.ChannelChatID(ch.Name),
+		Name:        ch.Name,
+		Topic:       ch.Topic,
+		CreatedBy:   ch.CreatedBy,
+		MemberCount: len(ch.Members),
+		Joined:      ch.isMember(userID),
+		Default:     ch.Name == protocol.DefaultChannelName,
+	}
+	if !info.Default {
+		info.CreatedAt = ch.CreatedAt.Unix()
+	}
+	return info
+}
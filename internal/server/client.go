@@ -1,9 +1,8 @@
 package server
 
 import (
-	"encoding/json"
 	"log"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -22,6 +21,13 @@ const (
 
 	// Максимальный размер сообщения, разрешенный от клиента.
 	maxMessageSize = 1024 * 10 // 10KB, можно настроить
+
+	// Сколько сообщений истории отдавать, если клиент не указал limit, и сколько максимум.
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 100
+
+	// Сколько сообщений из очереди writePump объединяет в один фрейм BATCH.
+	maxBatchSize = 32
 )
 
 // Client представляет одного подключенного пользователя через WebSocket.
@@ -32,11 +38,43 @@ type Client struct {
 
 	// Буферизованный канал для исходящих сообщений этому клиенту.
 	// Хаб будет писать в этот канал, а writePump клиента будет читать из него.
-	send chan []byte
+	// Канал никогда не закрывается: пока работает readPump, обработчик может отправить ответ
+	// в любой момент. Отключение отмечается флагом closed и закрытием done (см. closeSend).
+	send chan outgoingMessage
+
+	sendMu sync.Mutex    // Защищает closed: проверка и отправка в send выполняются под ним
+	closed bool          // Хаб отключил клиента; новые сообщения в очередь не ставятся
+	done   chan struct{} // Закрывается вместе с установкой closed; writePump дописывает очередь и закрывает соединение
+
+	// Версия протокола и возможности, согласованные при HELLO.
+	proto negotiatedProtocol
+	// Кодировка сообщений, выбранная подпротоколом WebSocket.
+	codec protocol.Codec
 
 	UserID          string // Идентификатор аутентифицированного пользователя
 	DisplayName     string // Отображаемое имя пользователя
+	SessionToken    string // Токен сессии, по которой клиент вошел (пусто при входе по API-токену)
 	IsAuthenticated bool   // Флаг, что клиент прошел аутентификацию
+
+	// Для соединений по API-токену: ID токена и его области доступа.
+	// scopes == nil означает обычную интерактивную сессию без дополнительных ограничений.
+	apiTokenID string
+	scopes     []Permission
+
+	// Момент установления соединения; по нему выбирается самое старое устройство при вытеснении.
+	connectedAt time.Time
+
+	// Код и причина отключения для фрейма закрытия. Записываются в closeSend до закрытия done.
+	closeCode   int
+	closeReason string
+}
+
+// outgoingMessage - сообщение в очереди клиента. Кодируется в writePump,
+// после приведения к версии протокола соединения.
+type outgoingMessage struct {
+	Type      string
+	RequestID string
+	Payload   interface{}
 }
 
 // readPump читает сообщения от клиента и передает их в хаб.
@@ -61,164 +99,20 @@ func (c *Client) readPump() {
 			break // Выход из цикла при ошибке чтения
 		}
 
-		if messageType == websocket.TextMessage {
-			// Десериализуем общее сообщение, чтобы проверить тип
-			var wsMsg protocol.WebSocketMessage
-			if err := json.Unmarshal(messageBytes, &wsMsg); err != nil {
-				log.Printf("Client %s: Failed to unmarshal message: %v. Raw: %s", c.UserID, err, string(messageBytes))
+		if messageType == c.codec.FrameType() {
+			// Декодируем конверт; права, разбор payload и вызов обработчика - в dispatch
+			wsMsg, err := c.codec.Decode(messageBytes)
+			if err != nil {
+				log.Printf("Client %s: Failed to decode message: %v. Raw: %q", c.UserID, err, messageBytes)
 				continue
 			}
 
-			switch wsMsg.Type {
-			case protocol.MsgTypeGetUserListRequest:
-				log.Printf("Client %s (ID: %s) requested user list.", c.DisplayName, c.UserID)
-				userList := c.hub.GetAuthenticatedUsersInfo(c.UserID) // Исключаем себя
-				respPayload := protocol.UserListResponsePayload{Users: userList}
-				c.sendResponse(protocol.MsgTypeUserListResponse, respPayload)
-
-			case protocol.MsgTypeSendPrivateMessageRequest:
-				var reqPayload protocol.SendPrivateMessageRequestPayload
-				if err := json.Unmarshal(wsMsg.Payload, &reqPayload); err != nil {
-					log.Printf("Client %s: Failed to unmarshal SendPrivateMessageRequest payload: %v\n", c.UserID, err)
-					c.sendError("INVALID_PAYLOAD", "Could not parse private message request payload.")
-					continue
-				}
-
-				log.Printf("Client %s sending private message to UserID: %s.", c.DisplayName, reqPayload.TargetUserID)
-
-				targetClient, found := c.hub.FindClientByUserID(reqPayload.TargetUserID)
-				if !found {
-					log.Printf("Client %s: Target user ID %s for private message not found or not online.", c.UserID, reqPayload.TargetUserID)
-					c.sendError("USER_NOT_FOUND", "Recipient is not online or does not exist.")
-					continue
-				}
-
-				chatID, chatIDErr := GeneratePrivateChatID(c.UserID, targetClient.UserID)
-				if chatIDErr != nil {
-					log.Printf("Client %s: Error generating ChatID for private message: %v", c.UserID, chatIDErr)
-					c.sendError("INTERNAL_ERROR", "Could not process private message.")
-					continue
-				}
-
-				storedMsg, errSave := SaveMessage(chatID, c.UserID, c.DisplayName, reqPayload.Text)
-				if errSave != nil {
-					log.Printf("Error saving private message to history for chat %s: %v", chatID, errSave)
-					c.sendError("HISTORY_SAVE_FAILED", "Could not save your message.")
-				}
-
-				notifyPayload := protocol.NewPrivateMessageNotifyPayload{
-					ChatID:     chatID,
-					MessageID:  "",
-					SenderID:   c.UserID,
-					SenderName: c.DisplayName,
-					ReceiverID: targetClient.UserID,
-					Text:       reqPayload.Text,
-					Timestamp:  time.Now().Unix(),
-				}
-
-				if storedMsg != nil { // Если сохранение было успешным
-					notifyPayload.MessageID = storedMsg.MessageID
-					notifyPayload.Timestamp = storedMsg.Timestamp // Используем timestamp сохраненного сообщения
-				}
-
-				// Отправляем получателю
-				targetClient.sendResponse(protocol.MsgTypeNewPrivateMessageNotify, notifyPayload)
-				// Отправляем "эхо" отправителю
-				c.sendResponse(protocol.MsgTypeNewPrivateMessageNotify, notifyPayload)
-
-			case protocol.MsgTypeText: // Это для Global Broadcast (если клиент шлет MsgTypeText)
-				var textPayload protocol.TextPayload
-				if err := json.Unmarshal(wsMsg.Payload, &textPayload); err != nil {
-					log.Printf("Client %s: Failed to unmarshal TextPayload for broadcast: %v", c.UserID, err)
-					c.sendError("INVALID_PAYLOAD", "Could not parse text payload for broadcast.")
-					continue
-				}
-
-				broadcastData := protocol.BroadcastTextPayload{
-					SenderID:   c.UserID,
-					SenderName: c.DisplayName,
-					Text:       textPayload.Text,
-					Timestamp:  time.Now().Unix(),
-				}
-				broadcastPayloadBytes, err := json.Marshal(broadcastData)
-				if err != nil {
-					log.Printf("Client %s: Error marshalling broadcast payload: %v", c.UserID, err)
-					continue
-				}
-				broadcastWsMsg := protocol.WebSocketMessage{
-					Type:    protocol.MsgTypeBroadcastText,
-					Payload: broadcastPayloadBytes,
-				}
-				finalMsgBytes, err := json.Marshal(broadcastWsMsg)
-				if err != nil {
-					log.Printf("Client %s: Error marshalling final broadcast message: %v", c.UserID, err)
-					continue
-				}
-
-				globalChatID := "global_broadcast"
-				_, errSave := SaveMessage(globalChatID, c.UserID, c.DisplayName, textPayload.Text)
-				if errSave != nil {
-					log.Printf("Error saving broadcast message to history for chat %s: %v", globalChatID, errSave)
-					// Решаем, продолжать ли отправку, если сохранение не удалось. Для MVP - да.
-				}
-
-				c.hub.broadcast <- finalMsgBytes
-
-			case protocol.MsgTypeGetChatHistoryRequest:
-				var reqPayload protocol.GetChatHistoryRequestPayload
-				if err := json.Unmarshal(wsMsg.Payload, &reqPayload); err != nil {
-					log.Printf("Client %s: Failed to unmarshal GetChatHistoryRequest payload: %v\n", c.UserID, err)
-					c.sendError("INVALID_PAYLOAD", "Could not parse get history request payload.")
-					continue
-				}
-
-				log.Printf("Client %s (ID: %s) requested history for chat: %s (Limit: %d)",
-					c.DisplayName, c.UserID, reqPayload.ChatID, reqPayload.Limit)
-
-				// Проверка прав доступа: может ли этот UserID читать историю этого ChatID?
-				// Для личных чатов: UserID должен быть одним из участников ChatID.
-				// ChatID у нас вида "private:id1:id2". Проверим, что c.UserID есть в нем.
-				// Для broadcast чата ("global_broadcast") доступ разрешен всем аутентифицированным.
-				canAccess := false
-				if reqPayload.ChatID == "global_broadcast" { // Имя для broadcast чата
-					canAccess = true
-				} else if strings.HasPrefix(reqPayload.ChatID, "private:") {
-					parts := strings.Split(reqPayload.ChatID, ":")
-					if len(parts) == 3 && (parts[1] == c.UserID || parts[2] == c.UserID) {
-						canAccess = true
-					}
-				}
-
-				if !canAccess {
-					log.Printf("Client %s (ID: %s) - Access denied for chat history: %s", c.DisplayName, c.UserID, reqPayload.ChatID)
-					c.sendError("ACCESS_DENIED", "You do not have permission to access this chat history.")
-					continue
-				}
-
-				// Устанавливаем лимит по умолчанию, если не указан или слишком большой
-				limit := reqPayload.Limit
-				if limit <= 0 || limit > 100 { // Максимум 100 сообщений за раз
-					limit = 50
-				}
-
-				messages, err := LoadChatHistory(reqPayload.ChatID, limit)
-				if err != nil {
-					log.Printf("Client %s: Error loading history for chat %s: %v", c.UserID, reqPayload.ChatID, err)
-					c.sendError("HISTORY_LOAD_FAILED", "Could not load chat history.")
-					continue
-				}
-
-				respPayload := protocol.ChatHistoryResponsePayload{
-					ChatID:   reqPayload.ChatID,
-					Messages: messages,
-					// HasMore: true/false - можно добавить, если реализована пагинация
-				}
-				c.sendResponse(protocol.MsgTypeChatHistoryResponse, respPayload)
-
-			default:
-				log.Printf("Client %s: Received unhandled message type: %s\n", c.UserID, wsMsg.Type)
-				c.sendError("UNKNOWN_MESSAGE_TYPE", "Unhandled message type by server.")
+			// После отключения хабом запросы не обрабатываются. Чтение продолжается, пока
+			// writePump не допишет очередь и не закроет соединение.
+			if c.isClosed() {
+				continue
 			}
+			c.dispatch(wsMsg)
 		}
 	}
 }
@@ -233,29 +127,27 @@ func (c *Client) writePump() {
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
+		case message := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// Канал c.send был закрыт (хаб удалил этого клиента).
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+			if err := c.writeMessages(c.collectBatch(message)); err != nil {
 				return
 			}
-			w.Write(message)
-
-			// Если в канале send есть еще сообщения, добавляем их в текущий фрейм
-			// Это оптимизация, чтобы не создавать новый фрейм для каждого маленького сообщения
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write([]byte{'\n'})
-			}
-
-			if err := w.Close(); err != nil {
-				return
+		case <-c.done:
+			// Хаб отключил клиента: отправляем то, что уже в очереди (например, ответ на LOGOUT_REQUEST),
+			// затем фрейм закрытия. Новые сообщения после closeSend в очередь не попадают.
+			for {
+				var message outgoingMessage
+				select {
+				case message = <-c.send:
+				default:
+					c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+					c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeReason))
+					return
+				}
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := c.writeMessages(c.collectBatch(message)); err != nil {
+					return
+				}
 			}
 		case <-ticker.C: // Таймер для отправки ping-сообщений
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
@@ -266,34 +158,130 @@ func (c *Client) writePump() {
 	}
 }
 
-// sendResponse - вспомогательный метод для Client для отправки ответа/уведомления
-func (c *Client) sendResponse(msgType string, payloadData interface{}) {
-	payloadBytes, err := json.Marshal(payloadData)
-	if err != nil {
-		log.Printf("Client %s: Error marshalling payload for type %s: %v\n", c.UserID, msgType, err)
-		return
+// collectBatch дополняет сообщение накопившимися в очереди, если клиент поддерживает пакеты:
+// они отправляются одним фреймом.
+func (c *Client) collectBatch(first outgoingMessage) []outgoingMessage {
+	batch := []outgoingMessage{first}
+	if !c.proto.has(protocol.FeatureBatch) {
+		return batch
 	}
-	wsMsg := protocol.WebSocketMessage{Type: msgType, Payload: payloadBytes}
-	messageBytes, err := json.Marshal(wsMsg)
-	if err != nil {
-		log.Printf("Client %s: Error marshalling WebSocket message for type %s: %v\n", c.UserID, msgType, err)
-		return
+	for len(batch) < maxBatchSize {
+		select {
+		case next := <-c.send:
+			batch = append(batch, next)
+		default:
+			return batch
+		}
 	}
+	return batch
+}
 
+// writeMessages кодирует сообщения и отправляет их одним фреймом: одиночное сообщение - как есть,
+// несколько - пакетом BATCH. Сообщения, которые не удалось закодировать, пропускаются.
+func (c *Client) writeMessages(batch []outgoingMessage) error {
+	frames := make([][]byte, 0, len(batch))
+	for _, message := range batch {
+		if !c.proto.adapter.adapt(&message) {
+			continue // Клиент этой версии протокола такое сообщение не понимает
+		}
+		messageBytes, err := c.codec.Encode(message.Type, message.RequestID, message.Payload)
+		if err != nil {
+			log.Printf("Client %s: Error encoding %s: %v", c.UserID, message.Type, err)
+			continue
+		}
+		frames = append(frames, messageBytes)
+	}
+
+	var data []byte
+	switch len(frames) {
+	case 0:
+		return nil
+	case 1:
+		data = frames[0]
+	default:
+		var err error
+		if data, err = c.codec.EncodeBatch(frames); err != nil {
+			log.Printf("Client %s: Error encoding batch of %d messages: %v", c.UserID, len(frames), err)
+			return nil
+		}
+	}
+	return c.conn.WriteMessage(c.codec.FrameType(), data)
+}
+
+// hasScope проверяет, разрешено ли действие областями доступа API-токена.
+// Интерактивным сессиям разрешено все, что позволяют права пользователя.
+func (c *Client) hasScope(perm Permission) bool {
+	if c.scopes == nil {
+		return true
+	}
+	for _, s := range c.scopes {
+		if s == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// terminateAllSessions отзывает все сессии пользователя и отключает все его соединения,
+// включая текущее (после отправки уже поставленного в очередь ответа).
+func (c *Client) terminateAllSessions(reason string) {
+	c.hub.terminateUserSessions(c.UserID, reason)
+}
+
+// enqueue ставит сообщение в очередь отправки. Возвращает false, если очередь полна
+// или хаб уже отключил клиента: тогда сообщение не будет отправлено.
+func (c *Client) enqueue(message outgoingMessage) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.closed {
+		return false
+	}
 	select {
-	case c.send <- messageBytes:
+	case c.send <- message:
+		return true
 	default:
-		log.Printf("Client %s: Send channel full or closed when trying to send %s.", c.UserID, msgType)
+		return false
+	}
+}
+
+// closeSend отключает клиента: новые сообщения больше не ставятся в очередь, а writePump
+// отправляет уже поставленные, затем фрейм закрытия с closeCode и reason. Повторный вызов ничего не делает.
+func (c *Client) closeSend(closeCode int, reason string) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.closeCode = closeCode
+	c.closeReason = reason
+	close(c.done)
+}
+
+// isClosed сообщает, отключил ли хаб клиента.
+func (c *Client) isClosed() bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.closed
+}
+
+// sendResponse - вспомогательный метод для Client для отправки ответа/уведомления.
+// requestID - ID запроса, на который отвечаем; для уведомлений пустой.
+func (c *Client) sendResponse(requestID, msgType string, payloadData interface{}) {
+	if !c.enqueue(outgoingMessage{Type: msgType, RequestID: requestID, Payload: payloadData}) {
+		log.Printf("Client %s: Send queue full or client disconnected when trying to send %s.", c.UserID, msgType)
 		// Хаб должен будет обработать отписку этого клиента, если он не может принимать сообщения.
 	}
 }
 
 // sendError - вспомогательный метод для Client для отправки сообщения об ошибке
-func (c *Client) sendError(errorCode string, errorMessage string) {
+func (c *Client) sendError(requestID, errorCode, errorMessage string) {
 	payload := protocol.ErrorPayload{
 		ErrorCode:    errorCode,
 		ErrorMessage: errorMessage,
 	}
 	log.Printf("Sending error to client %s: Code=%s, Message=%s\n", c.UserID, errorCode, errorMessage)
-	c.sendResponse(protocol.MsgTypeErrorNotify, payload)
+	c.sendResponse(requestID, protocol.MsgTypeErrorNotify, payload)
 }
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+// newTestClient соединяет Client с тестовым WebSocket-клиентом. Насосы не запускаются:
+// тест сам решает, когда стартует writePump.
+func newTestClient(t *testing.T, features ...string) (*Client, *websocket.Conn) {
+	t.Helper()
+	serverConns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		serverConns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { peer.Close() })
+
+	proto := negotiatedProtocol{version: protocol.ProtocolVersion, features: make(map[string]bool), adapter: currentProtocolAdapter{}}
+	for _, f := range features {
+		proto.features[f] = true
+	}
+	client := &Client{
+		conn:  <-serverConns,
+		send:  make(chan outgoingMessage, 256),
+		done:  make(chan struct{}),
+		codec: protocol.JSONCodec{},
+		proto: proto,
+	}
+	return client, peer
+}
+
+func TestWritePumpDrainsQueueOnClose(t *testing.T) {
+	const queued = maxBatchSize + 8
+	tests := []struct {
+		name       string
+		features   []string
+		wantFrames []int // Сообщений в каждом фрейме
+	}{
+		{name: "batch", features: []string{protocol.FeatureBatch}, wantFrames: []int{maxBatchSize, 8}},
+		{name: "no_batch", wantFrames: repeatInt(1, queued)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, peer := newTestClient(t, tt.features...)
+			for i := 0; i < queued; i++ {
+				if !client.enqueue(outgoingMessage{Type: protocol.MsgTypeText, RequestID: fmt.Sprint(i), Payload: protocol.TextPayload{Text: "hi"}}) {
+					t.Fatalf("enqueue %d failed", i)
+				}
+			}
+			// Очередь заполнена до отключения: writePump должен отправить ее целиком, затем фрейм закрытия
+			client.closeSend(protocol.CloseCodeEvicted, "signed in on another device")
+			if client.enqueue(outgoingMessage{Type: protocol.MsgTypeText}) {
+				t.Fatal("enqueue after closeSend succeeded")
+			}
+			go client.writePump()
+
+			peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var gotFrames []int
+			next := 0
+			for {
+				_, data, err := peer.ReadMessage()
+				if err != nil {
+					var closeErr *websocket.CloseError
+					if !errors.As(err, &closeErr) {
+						t.Fatalf("read: %v", err)
+					}
+					if closeErr.Code != protocol.CloseCodeEvicted || closeErr.Text != "signed in on another device" {
+						t.Fatalf("close = %d %q, want %d", closeErr.Code, closeErr.Text, protocol.CloseCodeEvicted)
+					}
+					break
+				}
+				messages, err := protocol.DecodeFrame(client.codec, data)
+				if err != nil {
+					t.Fatalf("decode frame: %v", err)
+				}
+				for _, msg := range messages {
+					if msg.RequestID != fmt.Sprint(next) {
+						t.Fatalf("message request_id = %q, want %d", msg.RequestID, next)
+					}
+					next++
+				}
+				gotFrames = append(gotFrames, len(messages))
+			}
+
+			if fmt.Sprint(gotFrames) != fmt.Sprint(tt.wantFrames) {
+				t.Fatalf("frames = %v, want %v", gotFrames, tt.wantFrames)
+			}
+		})
+	}
+}
+
+func TestSendResponseAfterCloseDoesNotPanic(t *testing.T) {
+	client, _ := newTestClient(t)
+	client.closeSend(websocket.CloseNormalClosure, "logged out")
+	client.closeSend(websocket.CloseNormalClosure, "logged out") // Повторное отключение ничего не делает
+	// Обработчик, который еще выполняется в readPump, отвечает уже отключенному клиенту
+	client.sendResponse("1", protocol.MsgTypeLogoutResponse, protocol.LogoutResponsePayload{Success: true})
+	if len(client.send) != 0 {
+		t.Fatalf("queued %d message(s) after closeSend", len(client.send))
+	}
+}
+
+func repeatInt(v, n int) []int {
+	s := make([]int, n)
+	for i := range s {
+		s[i] = v
+	}
+	return s
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+// ErrInvalidRequest - недопустимое значение в запросе клиента. Оборачивается с описанием поля.
+var ErrInvalidRequest = errors.New("invalid request")
+
+// errorCodes сопоставляет ошибки хранилищ и бизнес-логики с кодами протокола.
+// Проверяются по порядку через errors.Is, поэтому обернутые ошибки тоже распознаются.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrInvalidCredentials, protocol.ErrCodeInvalidCredentials},
+	{ErrUserDeactivated, protocol.ErrCodeAccountDeactivated},
+	{ErrUserNotFound, protocol.ErrCodeUserNotFound},
+	{ErrInvalidPassword, protocol.ErrCodeInvalidPassword},
+	{ErrUsernameTaken, protocol.ErrCodeValidationFailed},
+	{ErrDisplayNameTaken, protocol.ErrCodeValidationFailed},
+	{ErrSessionNotFound, protocol.ErrCodeInvalidSession},
+	{ErrSessionExpired, protocol.ErrCodeInvalidSession},
+
+	{ErrTOTPAlreadyEnabled, protocol.ErrCodeTOTPAlreadyEnabled},
+	{ErrTOTPNotEnabled, protocol.ErrCodeTOTPNotEnabled},
+	{ErrTOTPNotPending, protocol.ErrCodeTOTPNotPending},
+	{ErrInvalidTOTPCode, protocol.ErrCodeInvalidSecondFactor},
+
+	{ErrPermissionDenied, protocol.ErrCodePermissionDenied},
+	{ErrUnknownRole, protocol.ErrCodeUnknownRole},
+	{ErrLastAdmin, protocol.ErrCodeLastAdmin},
+
+	{ErrAPITokenNotFound, protocol.ErrCodeAPITokenNotFound},
+	{ErrInvalidScope, protocol.ErrCodeInvalidScope},
+	{ErrTooManyAPITokens, protocol.ErrCodeTooManyAPITokens},
+
+	{ErrInviteNotFound, protocol.ErrCodeInviteNotFound},
+
+	{ErrGroupNotFound, protocol.ErrCodeGroupNotFound},
+	{ErrNotInGroup, protocol.ErrCodeAccessDenied},
+	{ErrGroupAdminRequired, protocol.ErrCodeGroupAdminRequired},
+	{ErrGroupOwnerRequired, protocol.ErrCodeGroupAdminRequired},
+	{ErrAlreadyGroupMember, protocol.ErrCodeAlreadyGroupMember},
+	{ErrNotGroupMember, protocol.ErrCodeNotGroupMember},
+	{ErrGroupMemberLimit, protocol.ErrCodeGroupMemberLimit},
+
+	{ErrChannelNotFound, protocol.ErrCodeChannelNotFound},
+	{ErrChannelExists, protocol.ErrCodeChannelExists},
+	{ErrNotInChannel, protocol.ErrCodeAccessDenied},
+	{ErrDefaultChannel, protocol.ErrCodeInvalidRequest},
+
+	{ErrInvalidRequest, protocol.ErrCodeInvalidRequest},
+}
+
+// errorCode возвращает код протокола для ошибки; неизвестные ошибки считаются внутренними.
+func errorCode(err error) string {
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return protocol.ErrCodeValidationFailed
+	}
+	for _, m := range errorCodes {
+		if errors.Is(err, m.err) {
+			return m.code
+		}
+	}
+	return protocol.ErrCodeInternal
+}
+
+// errorResponse возвращает код и текст ошибки для ответа клиенту. Текст внутренних ошибок
+// (пути к файлам, ошибки ввода-вывода) клиенту не раскрывается - он остается в логе сервера.
+func errorResponse(err error) (code, message string) {
+	code = errorCode(err)
+	if code == protocol.ErrCodeInternal {
+		return code, "internal server error, please try again later"
+	}
+	return code, err.Error()
+}
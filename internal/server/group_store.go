@@ -0,0 +1,335 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+// GroupMember - участник группового чата.
+type GroupMember struct {
+	UserID   string    `json:"user_id"`
+	Role     string    `json:"role"` // protocol.GroupRole*
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// Group - метаданные группового чата. Сообщения хранятся в истории под ID группы, как и у других чатов.
+type Group struct {
+	ID        string        `json:"id"` // "group:<uuid>"
+	Title     string        `json:"title"`
+	OwnerID   string        `json:"owner_id"`
+	CreatedAt time.Time     `json:"created_at"`
+	Members   []GroupMember `json:"members"` // В порядке вступления, включая владельца
+}
+
+var (
+	ErrGroupNotFound      = errors.New("group not found")
+	ErrNotInGroup         = errors.New("you are not a member of this group")
+	ErrGroupAdminRequired = errors.New("only the group owner and admins can do this")
+	ErrGroupOwnerRequired = errors.New("only the group owner can do this")
+	ErrAlreadyGroupMember = errors.New("user is already a member of this group")
+	ErrNotGroupMember     = errors.New("user is not a member of this group")
+	ErrGroupMemberLimit   = errors.New("group has reached the member limit")
+)
+
+// GroupStorePath возвращает путь к файлу групп рядом с файлом пользователей.
+func GroupStorePath(usersPath string) string {
+	return filepath.Join(filepath.Dir(usersPath), "groups_data.json")
+}
+
+// IsGroupChatID сообщает, является ли chatID ID группового чата.
+func IsGroupChatID(chatID string) bool {
+	return strings.HasPrefix(chatID, protocol.GroupChatIDPrefix)
+}
+
+// GroupStore хранит групповые чаты в памяти и сохраняет их в JSON-файл после каждого изменения.
+// Существование пользователей проверяет вызывающий: хранилище знает только их ID.
+type GroupStore struct {
+	path   string
+	mu     sync.Mutex
+	groups map[string]*Group // Ключ - ID группы
+}
+
+// NewGroupStore загружает группы из файла path.
+// Пустой path - хранилище только в памяти.
+func NewGroupStore(path string) (*GroupStore, error) {
+	s := &GroupStore{path: path, groups: make(map[string]*Group)}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil // Групп еще нет
+		}
+		return nil, fmt.Errorf("failed to read group data file '%s': %w", path, err)
+	}
+	if len(data) == 0 {
+		return s, nil
+	}
+
+	if err := json.Unmarshal(data, &s.groups); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal group data from '%s': %w", path, err)
+	}
+
+	log.Printf("Successfully loaded %d groups from '%s'.", len(s.groups), path)
+	return s, nil
+}
+
+// save сохраняет группы в JSON-файл. Вызывается при захваченном s.mu.
+func (s *GroupStore) save() error {
+	if s.path == "" {
+		return nil // Хранилище только в памяти
+	}
+	data, err := json.MarshalIndent(s.groups, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal group store: %w", err)
+	}
+	if err := writeFileAtomic(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write group data to file '%s': %w", s.path, err)
+	}
+	return nil
+}
+
+// update применяет change к копии группы и сохраняет ее. Если change или сохранение не удались,
+// группа остается прежней. Если после изменения в группе никого нет, она удаляется.
+func (s *GroupStore) update(chatID string, change func(g *Group) error) (*Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, exists := s.groups[chatID]
+	if !exists {
+		return nil, ErrGroupNotFound
+	}
+	updated := current.clone()
+	if err := change(updated); err != nil {
+		return nil, err
+	}
+
+	if len(updated.Members) == 0 {
+		delete(s.groups, chatID)
+	} else {
+		s.groups[chatID] = updated
+	}
+	if err := s.save(); err != nil {
+		s.groups[chatID] = current
+		return nil, fmt.Errorf("failed to save group %s: %w", chatID, err)
+	}
+	return updated.clone(), nil
+}
+
+// Create создает группу с владельцем ownerID и участниками memberIDs (повторы и сам владелец пропускаются).
+func (s *GroupStore) Create(ownerID, title string, memberIDs []string) (*Group, error) {
+	now := time.Now().UTC()
+	group := &Group{
+		ID:        protocol.GroupChatIDPrefix + uuid.NewString(),
+		Title:     strings.TrimSpace(title),
+		OwnerID:   ownerID,
+		CreatedAt: now,
+		Members:   []GroupMember{{UserID: ownerID, Role: protocol.GroupRoleOwner, JoinedAt: now}},
+	}
+	for _, id := range memberIDs {
+		if group.memberIndex(id) >= 0 {
+			continue
+		}
+		if len(group.Members) >= protocol.MaxGroupMembers {
+			return nil, ErrGroupMemberLimit
+		}
+		group.Members = append(group.Members, GroupMember{UserID: id, Role: protocol.GroupRoleMember, JoinedAt: now})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.groups[group.ID] = group
+	if err := s.save(); err != nil {
+		delete(s.groups, group.ID)
+		return nil, fmt.Errorf("failed to save new group: %w", err)
+	}
+	return group.clone(), nil
+}
+
+// Get возвращает копию группы.
+func (s *GroupStore) Get(chatID string) (*Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, exists := s.groups[chatID]
+	if !exists {
+		return nil, ErrGroupNotFound
+	}
+	return group.clone(), nil
+}
+
+// IsMember сообщает, состоит ли userID в группе chatID.
+func (s *GroupStore) IsMember(chatID, userID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, exists := s.groups[chatID]
+	return exists && group.memberIndex(userID) >= 0
+}
+
+// ListForUser возвращает группы, в которых состоит userID, от старых к новым.
+func (s *GroupStore) ListForUser(userID string) []*Group {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var groups []*Group
+	for _, group := range s.groups {
+		if group.memberIndex(userID) >= 0 {
+			groups = append(groups, group.clone())
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].CreatedAt.Before(groups[j].CreatedAt) })
+	return groups
+}
+
+// AddMember добавляет userID в группу с ролью role. Добавлять могут владелец и администраторы,
+// назначать администратора - только владелец.
+func (s *GroupStore) AddMember(chatID, actorID, userID, role string) (*Group, error) {
+	if role == "" {
+		role = protocol.GroupRoleMember
+	}
+	return s.update(chatID, func(g *Group) error {
+		if err := g.requireAdmin(actorID); err != nil {
+			return err
+		}
+		if role == protocol.GroupRoleAdmin && actorID != g.OwnerID {
+			return ErrGroupOwnerRequired
+		}
+		if g.memberIndex(userID) >= 0 {
+			return ErrAlreadyGroupMember
+		}
+		if len(g.Members) >= protocol.MaxGroupMembers {
+			return ErrGroupMemberLimit
+		}
+		g.Members = append(g.Members, GroupMember{UserID: userID, Role: role, JoinedAt: time.Now().UTC()})
+		return nil
+	})
+}
+
+// RemoveMember исключает userID из группы. Исключать могут владелец и администраторы;
+// администратора - только владелец. Владельца исключить нельзя, он может только выйти.
+func (s *GroupStore) RemoveMember(chatID, actorID, userID string) (*Group, error) {
+	return s.update(chatID, func(g *Group) error {
+		if err := g.requireAdmin(actorID); err != nil {
+			return err
+		}
+		i := g.memberIndex(userID)
+		if i < 0 {
+			return ErrNotGroupMember
+		}
+		if g.Members[i].Role != protocol.GroupRoleMember && actorID != g.OwnerID {
+			return ErrGroupOwnerRequired
+		}
+		if userID == g.OwnerID {
+			return fmt.Errorf("%w: the group owner cannot be removed", ErrInvalidRequest)
+		}
+		g.removeMember(i)
+		return nil
+	})
+}
+
+// Leave удаляет userID из группы. Последний участник удаляет группу; тогда возвращается nil.
+func (s *GroupStore) Leave(chatID, userID string) (*Group, error) {
+	group, err := s.update(chatID, func(g *Group) error {
+		i := g.memberIndex(userID)
+		if i < 0 {
+			return ErrNotInGroup
+		}
+		g.removeMember(i)
+		return nil
+	})
+	if err != nil || len(group.Members) == 0 {
+		return nil, err
+	}
+	return group, nil
+}
+
+// RemoveUser удаляет userID из всех групп (например, при удалении аккаунта).
+func (s *GroupStore) RemoveUser(userID string) error {
+	for _, group := range s.ListForUser(userID) {
+		if _, err := s.Leave(group.ID, userID); err != nil && !errors.Is(err, ErrGroupNotFound) && !errors.Is(err, ErrNotInGroup) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *Group) memberIndex(userID string) int {
+	for i, m := range g.Members {
+		if m.UserID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
+// requireAdmin проверяет, что userID - владелец или администратор группы.
+func (g *Group) requireAdmin(userID string) error {
+	i := g.memberIndex(userID)
+	if i < 0 {
+		return ErrNotInGroup
+	}
+	if g.Members[i].Role == protocol.GroupRoleMember {
+		return ErrGroupAdminRequired
+	}
+	return nil
+}
+
+// removeMember удаляет участника с индексом i. Если это владелец, группа переходит
+// к первому администратору, а если их нет - к первому участнику.
+func (g *Group) removeMember(i int) {
+	wasOwner := g.Members[i].UserID == g.OwnerID
+	g.Members = append(g.Members[:i], g.Members[i+1:]...)
+	if !wasOwner || len(g.Members) == 0 {
+		return
+	}
+	heir := 0
+	for j, m := range g.Members {
+		if m.Role == protocol.GroupRoleAdmin {
+			heir = j
+			break
+		}
+	}
+	g.Members[heir].Role = protocol.GroupRoleOwner
+	g.OwnerID = g.Members[heir].UserID
+}
+
+func (g *Group) clone() *Group {
+	c := *g
+	c.Members = append([]GroupMember(nil), g.Members...)
+	return &c
+}
+
+// info переводит группу в описание для протокола. Имена участников берутся из users;
+// если пользователя не удалось прочитать, вместо имени передается его ID.
+func (g *Group) info(users UserStore) protocol.GroupInfo {
+	info := protocol.GroupInfo{
+		ChatID:    g.ID,
+		Title:     g.Title,
+		OwnerID:   g.OwnerID,
+		CreatedAt: g.CreatedAt.Unix(),
+		Members:   make([]protocol.GroupMemberInfo, 0, len(g.Members)),
+	}
+	for _, m := range g.Members {
+		name := m.UserID
+		if u, err := users.GetByID(m.UserID); err == nil {
+			name = u.DisplayName
+		}
+		info.Members = append(info.Members, protocol.GroupMemberInfo{UserID: m.UserID, DisplayName: name, Role: m.Role})
+	}
+	return info
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+// authState - в каком состоянии соединения принимается тип сообщения.
+type authState int
+
+const (
+	authNone     authState = iota // До входа: обрабатывается в AUTH_LOOP
+	authRequired                  // После входа: обрабатывается в readPump
+)
+
+// clientRequest - разобранное и проверенное сообщение клиента, которое получает обработчик.
+type clientRequest[P any] struct {
+	ID      string // request_id, который нужно повторить в ответе
+	Payload P
+	// Пользователь, перечитанный из хранилища перед обработкой (только для authRequired).
+	Actor *User
+}
+
+// noPayload - payload сообщений, у которых нет параметров. Такой payload не разбирается.
+type noPayload struct{}
+
+// payloadValidator - payload, который может проверить свои обязательные поля.
+type payloadValidator interface {
+	Validate() error
+}
+
+// messageHandler - запись реестра: когда принимается тип сообщения и кто его обрабатывает.
+// Ошибка, которую возвращают serve-функции, означает неверный payload; обработчик при этом не вызывается.
+type messageHandler struct {
+	auth       authState
+	permission Permission // Право, необходимое для authRequired
+
+	servePreAuth func(a *authFlow, requestID string, raw json.RawMessage) error
+	serve        func(c *Client, actor *User, requestID string, raw json.RawMessage) error
+}
+
+// messageHandlers - реестр обработчиков по типу сообщения. Заполняется в init() файлов handlers_*.go;
+// чтобы добавить тип сообщения, достаточно зарегистрировать для него обработчик.
+var messageHandlers = make(map[string]messageHandler)
+
+// handle регистрирует обработчик сообщения аутентифицированного клиента, требующего право perm.
+func handle[P any](msgType string, perm Permission, fn func(c *Client, req clientRequest[P])) {
+	registerHandler(msgType, messageHandler{
+		auth:       authRequired,
+		permission: perm,
+		serve: func(c *Client, actor *User, requestID string, raw json.RawMessage) error {
+			payload, err := decodePayload[P](raw)
+			if err != nil {
+				return err
+			}
+			fn(c, clientRequest[P]{ID: requestID, Payload: payload, Actor: actor})
+			return nil
+		},
+	})
+}
+
+// handlePreAuth регистрирует обработчик сообщения, которое принимается до входа.
+func handlePreAuth[P any](msgType string, fn func(a *authFlow, req clientRequest[P])) {
+	registerHandler(msgType, messageHandler{
+		auth: authNone,
+		servePreAuth: func(a *authFlow, requestID string, raw json.RawMessage) error {
+			payload, err := decodePayload[P](raw)
+			if err != nil {
+				return err
+			}
+			fn(a, clientRequest[P]{ID: requestID, Payload: payload})
+			return nil
+		},
+	})
+}
+
+func registerHandler(msgType string, h messageHandler) {
+	if _, exists := messageHandlers[msgType]; exists {
+		panic("server: duplicate handler for message type " + msgType)
+	}
+	messageHandlers[msgType] = h
+}
+
+// decodePayload разбирает payload в структуру P и проверяет ее, если P реализует payloadValidator.
+// Отсутствующий payload равносилен пустому: обязательные поля проверяет Validate.
+func decodePayload[P any](raw json.RawMessage) (P, error) {
+	var payload P
+	if _, empty := any(payload).(noPayload); empty {
+		return payload, nil
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &payload); err != nil {
+			return payload, err
+		}
+	}
+	if v, ok := any(&payload).(payloadValidator); ok {
+		if err := v.Validate(); err != nil {
+			return payload, err
+		}
+	}
+	return payload, nil
+}
+
+// payloadErrorMessage - единый текст ошибки для неверного payload.
+func payloadErrorMessage(msgType string, err error) string {
+	return fmt.Sprintf("Invalid %s payload: %v.", msgType, err)
+}
+
+// dispatch проверяет права на сообщение аутентифицированного клиента и передает его обработчику.
+func (c *Client) dispatch(wsMsg protocol.WebSocketMessage) {
+	h, ok := messageHandlers[wsMsg.Type]
+	if !ok {
+		log.Printf("Client %s: Received unhandled message type: %s\n", c.UserID, wsMsg.Type)
+		c.sendError(wsMsg.RequestID, protocol.ErrCodeUnknownMessageType, "Unhandled message type by server.")
+		return
+	}
+	if h.auth != authRequired {
+		log.Printf("Client %s: Received %s after authentication.", c.UserID, wsMsg.Type)
+		c.sendError(wsMsg.RequestID, protocol.ErrCodeUnexpectedMessageType, "You are already logged in.")
+		return
+	}
+	// Права читаем из хранилища при каждом сообщении, чтобы смена роли действовала сразу.
+	actor, err := c.hub.users.GetByID(c.UserID)
+	if err != nil || actor.Deactivated || !actor.HasPermission(h.permission) || !c.hasScope(h.permission) {
+		log.Printf("Client %s (ID: %s): permission %s denied for %s", c.DisplayName, c.UserID, h.permission, wsMsg.Type)
+		c.sendError(wsMsg.RequestID, protocol.ErrCodePermissionDenied, "You do not have permission to perform this action.")
+		return
+	}
+	if err := h.serve(c, actor, wsMsg.RequestID, wsMsg.Payload); err != nil {
+		log.Printf("Client %s: Invalid %s payload: %v\n", c.UserID, wsMsg.Type, err)
+		c.sendError(wsMsg.RequestID, protocol.ErrCodeInvalidPayload, payloadErrorMessage(wsMsg.Type, err))
+	}
+}
+
+// dispatch передает обработчику сообщение, полученное до входа.
+func (a *authFlow) dispatch(msg protocol.WebSocketMessage) {
+	h, ok := messageHandlers[msg.Type]
+	if !ok {
+		log.Printf("Auth: Received unknown message type %s from client %p.", msg.Type, a.conn)
+		sendErrorMessage(a.conn, msg.RequestID, protocol.ErrCodeUnknownMessageType, "Unhandled message type by server.")
+		return
+	}
+	if h.auth != authNone {
+		log.Printf("Auth: Received unexpected message type %s from client %p before authentication.", msg.Type, a.conn)
+		sendErrorMessage(a.conn, msg.RequestID, protocol.ErrCodeUnexpectedMessageType, "Expected LoginRequest, SecondFactorRequest, RegisterRequest or ResumeSessionRequest.")
+		return
+	}
+	if err := h.servePreAuth(a, msg.RequestID, msg.Payload); err != nil {
+		log.Printf("Auth: Invalid %s payload from client %p: %v\n", msg.Type, a.conn, err)
+		sendErrorMessage(a.conn, msg.RequestID, protocol.ErrCodeInvalidPayload, payloadErrorMessage(msg.Type, err))
+	}
+}
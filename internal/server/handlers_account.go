@@ -0,0 +1,194 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+func init() {
+	handle(protocol.MsgTypeLogoutRequest, PermManageAccount, (*Client).logout)
+	handle(protocol.MsgTypeLogoutAllRequest, PermManageAccount, (*Client).logoutAll)
+	handle(protocol.MsgTypeChangePasswordRequest, PermManageAccount, (*Client).changePassword)
+	handle(protocol.MsgTypeDeactivateAccountRequest, PermManageAccount, (*Client).deactivateAccount)
+	handle(protocol.MsgTypeDeleteAccountRequest, PermManageAccount, (*Client).deleteAccount)
+	handle(protocol.MsgTypeSetReadReceiptsRequest, PermManageAccount, (*Client).setReadReceipts)
+
+	handle(protocol.MsgTypeCreateAPITokenRequest, PermManageAccount, (*Client).createAPIToken)
+	handle(protocol.MsgTypeListAPITokensRequest, PermManageAccount, (*Client).listAPITokens)
+	handle(protocol.MsgTypeRevokeAPITokenRequest, PermManageAccount, (*Client).revokeAPIToken)
+
+	handle(protocol.MsgTypeTOTPEnrollRequest, PermManageAccount, (*Client).enrollTOTP)
+	handle(protocol.MsgTypeTOTPConfirmRequest, PermManageAccount, (*Client).confirmTOTP)
+	handle(protocol.MsgTypeTOTPDisableRequest, PermManageAccount, (*Client).disableTOTP)
+}
+
+func (c *Client) logout(req clientRequest[noPayload]) {
+	log.Printf("Client %s (ID: %s) logging out of current session.", c.DisplayName, c.UserID)
+	if err := c.hub.sessions.Revoke(c.SessionToken); err != nil && !errors.Is(err, ErrSessionNotFound) {
+		log.Printf("Client %s: Error revoking session: %v", c.UserID, err)
+		c.sendResponse(req.ID, protocol.MsgTypeLogoutResponse, protocol.LogoutResponsePayload{Success: false, ErrorCode: protocol.ErrCodeInternal, ErrorMessage: "Could not revoke session."})
+		return
+	}
+	c.sendResponse(req.ID, protocol.MsgTypeLogoutResponse, protocol.LogoutResponsePayload{Success: true, SessionsRevoked: 1})
+	c.hub.DisconnectSession(c.SessionToken, "logged out")
+}
+
+func (c *Client) logoutAll(req clientRequest[noPayload]) {
+	log.Printf("Client %s (ID: %s) logging out of all sessions.", c.DisplayName, c.UserID)
+	revoked, err := c.hub.sessions.RevokeUser(c.UserID)
+	if err != nil {
+		log.Printf("Client %s: Error revoking sessions: %v", c.UserID, err)
+		c.sendResponse(req.ID, protocol.MsgTypeLogoutResponse, protocol.LogoutResponsePayload{Success: false, ErrorCode: protocol.ErrCodeInternal, ErrorMessage: "Could not revoke sessions."})
+		return
+	}
+	c.sendResponse(req.ID, protocol.MsgTypeLogoutResponse, protocol.LogoutResponsePayload{Success: true, SessionsRevoked: revoked})
+	c.hub.DisconnectUser(c.UserID, "logged out from all sessions")
+}
+
+func (c *Client) changePassword(req clientRequest[protocol.ChangePasswordRequestPayload]) {
+	if err := ChangeUserPassword(c.hub.users, c.hub.registrationPolicy, c.UserID, req.Payload.OldPassword, req.Payload.NewPassword); err != nil {
+		log.Printf("Client %s: Password change failed: %v", c.UserID, err)
+		code, message := errorResponse(err)
+		c.sendResponse(req.ID, protocol.MsgTypeChangePasswordResponse, protocol.AccountActionResponsePayload{Success: false, ErrorCode: code, ErrorMessage: message})
+		return
+	}
+	c.sendResponse(req.ID, protocol.MsgTypeChangePasswordResponse, protocol.AccountActionResponsePayload{Success: true})
+	c.terminateAllSessions("password changed")
+}
+
+func (c *Client) deactivateAccount(req clientRequest[protocol.AccountPasswordConfirmPayload]) {
+	if err := DeactivateUser(c.hub.users, c.UserID, req.Payload.Password); err != nil {
+		log.Printf("Client %s: Account deactivation failed: %v", c.UserID, err)
+		code, message := errorResponse(err)
+		c.sendResponse(req.ID, protocol.MsgTypeDeactivateAccountResponse, protocol.AccountActionResponsePayload{Success: false, ErrorCode: code, ErrorMessage: message})
+		return
+	}
+	c.sendResponse(req.ID, protocol.MsgTypeDeactivateAccountResponse, protocol.AccountActionResponsePayload{Success: true})
+	c.terminateAllSessions("account deactivated")
+}
+
+func (c *Client) deleteAccount(req clientRequest[protocol.AccountPasswordConfirmPayload]) {
+	if err := DeleteUser(c.hub.users, c.UserID, req.Payload.Password); err != nil {
+		log.Printf("Client %s: Account deletion failed: %v", c.UserID, err)
+		code, message := errorResponse(err)
+		c.sendResponse(req.ID, protocol.MsgTypeDeleteAccountResponse, protocol.AccountActionResponsePayload{Success: false, ErrorCode: code, ErrorMessage: message})
+		return
+	}
+	if _, err := c.hub.apiTokens.RevokeUser(c.UserID); err != nil {
+		log.Printf("Client %s: Error revoking api tokens of deleted account: %v", c.UserID, err)
+	}
+	if err := AnonymizeSenderInHistory(c.UserID); err != nil {
+		// Аккаунт уже удален; ошибку только логируем, чтобы ее можно было устранить вручную.
+		log.Printf("Client %s: Error anonymizing history of deleted account: %v", c.UserID, err)
+	}
+	if err := DeletePendingDeliveries(c.UserID); err != nil {
+		log.Printf("Client %s: Error deleting pending deliveries of deleted account: %v", c.UserID, err)
+	}
+	if err := c.hub.groups.RemoveUser(c.UserID); err != nil {
+		log.Printf("Client %s: Error removing deleted account from groups: %v", c.UserID, err)
+	}
+	if err := c.hub.channels.RemoveUser(c.UserID); err != nil {
+		log.Printf("Client %s: Error removing deleted account from channels: %v", c.UserID, err)
+	}
+	c.sendResponse(req.ID, protocol.MsgTypeDeleteAccountResponse, protocol.AccountActionResponsePayload{Success: true})
+	c.terminateAllSessions("account deleted")
+}
+
+func (c *Client) setReadReceipts(req clientRequest[protocol.SetReadReceiptsRequestPayload]) {
+	enabled := req.Payload.Enabled
+	if err := SetReadReceipts(c.hub.users, c.UserID, enabled); err != nil {
+		log.Printf("Client %s: Changing read receipts setting failed: %v", c.UserID, err)
+		code, message := errorResponse(err)
+		c.sendResponse(req.ID, protocol.MsgTypeSetReadReceiptsResponse, protocol.SetReadReceiptsResponsePayload{Success: false, Enabled: !req.Actor.ReadReceiptsDisabled, ErrorCode: code, ErrorMessage: message})
+		return
+	}
+	c.sendResponse(req.ID, protocol.MsgTypeSetReadReceiptsResponse, protocol.SetReadReceiptsResponsePayload{Success: true, Enabled: enabled})
+}
+
+func (c *Client) createAPIToken(req clientRequest[protocol.CreateAPITokenRequestPayload]) {
+	scopes, err := ParseAPITokenScopes(req.Payload.Scopes)
+	if err == nil && strings.TrimSpace(req.Payload.Name) == "" {
+		err = fmt.Errorf("%w: token name is required", ErrInvalidRequest)
+	}
+	if err == nil {
+		// Токен не может дать больше, чем есть у самого пользователя.
+		for _, scope := range scopes {
+			if !req.Actor.HasPermission(scope) {
+				err = fmt.Errorf("%w: you do not have the %s permission yourself", ErrInvalidScope, scope)
+				break
+			}
+		}
+	}
+	if err != nil {
+		code, message := errorResponse(err)
+		c.sendResponse(req.ID, protocol.MsgTypeCreateAPITokenResponse, protocol.CreateAPITokenResponsePayload{Success: false, ErrorCode: code, ErrorMessage: message})
+		return
+	}
+	secret, token, err := c.hub.apiTokens.Create(c.UserID, strings.TrimSpace(req.Payload.Name), scopes)
+	if err != nil {
+		log.Printf("Client %s: Failed to create api token: %v", c.UserID, err)
+		code, message := errorResponse(err)
+		c.sendResponse(req.ID, protocol.MsgTypeCreateAPITokenResponse, protocol.CreateAPITokenResponsePayload{Success: false, ErrorCode: code, ErrorMessage: message})
+		return
+	}
+	log.Printf("Client %s (ID: %s) created api token %s with scopes %v", c.DisplayName, c.UserID, token.ID, token.Scopes)
+	info := token.info()
+	c.sendResponse(req.ID, protocol.MsgTypeCreateAPITokenResponse, protocol.CreateAPITokenResponsePayload{Success: true, Token: secret, TokenInfo: &info})
+}
+
+func (c *Client) listAPITokens(req clientRequest[noPayload]) {
+	tokens := c.hub.apiTokens.List(c.UserID)
+	infos := make([]protocol.APITokenInfo, 0, len(tokens))
+	for _, t := range tokens {
+		infos = append(infos, t.info())
+	}
+	c.sendResponse(req.ID, protocol.MsgTypeListAPITokensResponse, protocol.ListAPITokensResponsePayload{Tokens: infos})
+}
+
+func (c *Client) revokeAPIToken(req clientRequest[protocol.RevokeAPITokenRequestPayload]) {
+	tokenID := req.Payload.TokenID
+	if err := c.hub.apiTokens.Revoke(c.UserID, tokenID); err != nil {
+		code, message := errorResponse(err)
+		c.sendResponse(req.ID, protocol.MsgTypeRevokeAPITokenResponse, protocol.RevokeAPITokenResponsePayload{Success: false, TokenID: tokenID, ErrorCode: code, ErrorMessage: message})
+		return
+	}
+	log.Printf("Client %s (ID: %s) revoked api token %s", c.DisplayName, c.UserID, tokenID)
+	c.sendResponse(req.ID, protocol.MsgTypeRevokeAPITokenResponse, protocol.RevokeAPITokenResponsePayload{Success: true, TokenID: tokenID})
+	c.hub.DisconnectAPIToken(tokenID, "api token revoked")
+}
+
+func (c *Client) enrollTOTP(req clientRequest[protocol.AccountPasswordConfirmPayload]) {
+	secret, uri, err := BeginTOTPEnrollment(c.hub.users, c.UserID, req.Payload.Password)
+	if err != nil {
+		log.Printf("Client %s: TOTP enrollment failed: %v", c.UserID, err)
+		code, message := errorResponse(err)
+		c.sendResponse(req.ID, protocol.MsgTypeTOTPEnrollResponse, protocol.TOTPEnrollResponsePayload{Success: false, ErrorCode: code, ErrorMessage: message})
+		return
+	}
+	c.sendResponse(req.ID, protocol.MsgTypeTOTPEnrollResponse, protocol.TOTPEnrollResponsePayload{Success: true, Secret: secret, OTPAuthURI: uri})
+}
+
+func (c *Client) confirmTOTP(req clientRequest[protocol.TOTPCodePayload]) {
+	recoveryCodes, err := ConfirmTOTPEnrollment(c.hub.users, c.UserID, req.Payload.Code)
+	if err != nil {
+		log.Printf("Client %s: TOTP confirmation failed: %v", c.UserID, err)
+		code, message := errorResponse(err)
+		c.sendResponse(req.ID, protocol.MsgTypeTOTPConfirmResponse, protocol.TOTPConfirmResponsePayload{Success: false, ErrorCode: code, ErrorMessage: message})
+		return
+	}
+	c.sendResponse(req.ID, protocol.MsgTypeTOTPConfirmResponse, protocol.TOTPConfirmResponsePayload{Success: true, RecoveryCodes: recoveryCodes})
+}
+
+func (c *Client) disableTOTP(req clientRequest[protocol.TOTPDisableRequestPayload]) {
+	if err := DisableTOTP(c.hub.users, c.UserID, req.Payload.Password, req.Payload.Code); err != nil {
+		log.Printf("Client %s: Disabling TOTP failed: %v", c.UserID, err)
+		code, message := errorResponse(err)
+		c.sendResponse(req.ID, protocol.MsgTypeTOTPDisableResponse, protocol.AccountActionResponsePayload{Success: false, ErrorCode: code, ErrorMessage: message})
+		return
+	}
+	c.sendResponse(req.ID, protocol.MsgTypeTOTPDisableResponse, protocol.AccountActionResponsePayload{Success: true})
+}
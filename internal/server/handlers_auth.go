@@ -0,0 +1,233 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+func init() {
+	handlePreAuth(protocol.MsgTypeRegisterRequest, (*authFlow).register)
+	handlePreAuth(protocol.MsgTypeLoginRequest, (*authFlow).login)
+	handlePreAuth(protocol.MsgTypeSecondFactorRequest, (*authFlow).secondFactor)
+	handlePreAuth(protocol.MsgTypeResumeSessionRequest, (*authFlow).resumeSession)
+}
+
+// authFlow - состояние соединения до входа. Живет в пределах AUTH_LOOP одного соединения.
+type authFlow struct {
+	hub      *Hub
+	conn     *websocket.Conn
+	proto    negotiatedProtocol
+	remoteIP string
+	attempts int // Попытки входа и возобновления сессии в этом соединении
+
+	// Пользователь, который ввел верный пароль и должен подтвердить вход вторым фактором.
+	pendingUser     *User
+	pendingUsername string
+	pendingSince    time.Time
+
+	// Заполняются при успешном входе; после этого AUTH_LOOP завершается.
+	user         *User
+	sessionToken string
+}
+
+// completeLogin создает сессию и отправляет успешный LOGIN_RESPONSE.
+// Если сессию создать не удалось, клиент получает ошибку и может повторить вход.
+func (a *authFlow) completeLogin(requestID string, user *User, username string) {
+	a.pendingUser = nil
+	a.hub.authLimiter.Success(username)
+	token, _, err := a.hub.sessions.Create(user.ID)
+	if err != nil {
+		log.Printf("Auth: Failed to create session for %s: %v", user.Username, err)
+		respPayload := protocol.LoginResponsePayload{Success: false, ErrorCode: protocol.ErrCodeInternal, ErrorMessage: "could not create session, please try again"}
+		sendWebSocketResponse(a.conn, requestID, protocol.MsgTypeLoginResponse, respPayload)
+		return
+	}
+	a.user = user
+	a.sessionToken = token
+	respPayload := protocol.LoginResponsePayload{
+		Success:      true,
+		UserID:       user.ID,
+		DisplayName:  user.DisplayName,
+		SessionToken: token,
+		Role:         string(user.EffectiveRole()),
+		Permissions:  permissionStrings(user.EffectivePermissions()),
+	}
+	sendWebSocketResponse(a.conn, requestID, protocol.MsgTypeLoginResponse, respPayload)
+	log.Printf("Client %s (ID: %s) authenticated successfully.", user.DisplayName, user.ID)
+}
+
+func (a *authFlow) register(req clientRequest[protocol.RegisterRequestPayload]) {
+	p := req.Payload
+	log.Printf("Processing RegisterRequest for username: %s\n", p.Username)
+	user, err := RegisterNewUser(a.hub.users, a.hub.registrationPolicy, a.hub.registrationInvites(), p.Username, p.Password, p.DisplayName, p.InviteCode)
+
+	var respPayload protocol.RegisterResponsePayload
+	if err != nil {
+		log.Printf("Registration failed for %s: %v\n", p.Username, err)
+		respPayload = registerErrorResponse(err)
+	} else {
+		log.Printf("Registration successful for %s, UserID: %s\n", p.Username, user.ID)
+		respPayload = protocol.RegisterResponsePayload{
+			Success: true,
+			UserID:  user.ID,
+		}
+	}
+	sendWebSocketResponse(a.conn, req.ID, protocol.MsgTypeRegisterResponse, respPayload)
+}
+
+func (a *authFlow) login(req clientRequest[protocol.LoginRequestPayload]) {
+	p := req.Payload
+	a.attempts++
+	if wait := a.hub.authLimiter.Check(p.Username, a.remoteIP); wait > 0 {
+		// Пароль не проверяем вовсе, чтобы не тратить bcrypt на перебор.
+		log.Printf("Auth: Login for %s from %s rate limited for %v", p.Username, a.remoteIP, wait)
+		sendWebSocketResponse(a.conn, req.ID, protocol.MsgTypeLoginResponse, protocol.LoginResponsePayload{
+			Success:           false,
+			ErrorCode:         protocol.ErrCodeTooManyAttempts,
+			ErrorMessage:      "too many failed login attempts, try again later",
+			RetryAfterSeconds: retryAfterSeconds(wait),
+		})
+		return
+	}
+
+	user, err := AuthenticateUser(a.hub.users, p.Username, p.Password)
+	if err != nil {
+		var wait time.Duration
+		if errors.Is(err, ErrInvalidCredentials) {
+			wait = a.hub.authLimiter.Failure(p.Username, a.remoteIP)
+		}
+		code, message := errorResponse(err)
+		sendWebSocketResponse(a.conn, req.ID, protocol.MsgTypeLoginResponse, protocol.LoginResponsePayload{
+			Success:           false,
+			ErrorCode:         code,
+			ErrorMessage:      message,
+			RetryAfterSeconds: retryAfterSeconds(wait),
+		})
+		log.Printf("Authentication failed for %s from %s: %v", p.Username, a.remoteIP, err)
+		return
+	}
+
+	switch {
+	case user.TOTPEnabled && !a.proto.has(protocol.FeatureSecondFactor):
+		sendWebSocketResponse(a.conn, req.ID, protocol.MsgTypeLoginResponse, protocol.LoginResponsePayload{
+			Success:      false,
+			ErrorCode:    protocol.ErrCodeClientUpgradeRequired,
+			ErrorMessage: "this account uses two-factor authentication, which your client does not support; please upgrade",
+		})
+		log.Printf("Auth: Client %p of %s does not support second factor.", a.conn, user.Username)
+	case user.TOTPEnabled:
+		// Пароль верный, но вход завершится только после SECOND_FACTOR_REQUEST.
+		// Счетчик неудач по логину не сбрасываем, пока не проверен второй фактор.
+		a.pendingUser = user
+		a.pendingUsername = p.Username
+		a.pendingSince = time.Now()
+		sendWebSocketResponse(a.conn, req.ID, protocol.MsgTypeLoginResponse, protocol.LoginResponsePayload{
+			Success:              false,
+			ErrorCode:            protocol.ErrCodeSecondFactorRequired,
+			ErrorMessage:         "enter the code from your authenticator app or a recovery code",
+			SecondFactorRequired: true,
+		})
+		log.Printf("Auth: Password accepted for %s, waiting for second factor.", user.Username)
+	default:
+		a.completeLogin(req.ID, user, p.Username)
+	}
+}
+
+func (a *authFlow) secondFactor(req clientRequest[protocol.SecondFactorRequestPayload]) {
+	if a.pendingUser == nil || time.Since(a.pendingSince) > secondFactorTimeout {
+		a.pendingUser = nil
+		sendWebSocketResponse(a.conn, req.ID, protocol.MsgTypeLoginResponse, protocol.LoginResponsePayload{
+			Success:      false,
+			ErrorCode:    protocol.ErrCodeNoPendingLogin,
+			ErrorMessage: "log in with your password first",
+		})
+		return
+	}
+
+	a.attempts++
+	if wait := a.hub.authLimiter.Check(a.pendingUsername, a.remoteIP); wait > 0 {
+		sendWebSocketResponse(a.conn, req.ID, protocol.MsgTypeLoginResponse, protocol.LoginResponsePayload{
+			Success:              false,
+			ErrorCode:            protocol.ErrCodeTooManyAttempts,
+			ErrorMessage:         "too many failed login attempts, try again later",
+			RetryAfterSeconds:    retryAfterSeconds(wait),
+			SecondFactorRequired: true,
+		})
+		return
+	}
+
+	user, err := VerifySecondFactor(a.hub.users, a.pendingUser.ID, req.Payload.Code)
+	if err != nil {
+		var wait time.Duration
+		if errors.Is(err, ErrInvalidTOTPCode) {
+			wait = a.hub.authLimiter.Failure(a.pendingUsername, a.remoteIP)
+		}
+		log.Printf("Auth: Second factor failed for %s from %s: %v", a.pendingUser.Username, a.remoteIP, err)
+		code, message := errorResponse(err)
+		sendWebSocketResponse(a.conn, req.ID, protocol.MsgTypeLoginResponse, protocol.LoginResponsePayload{
+			Success:              false,
+			ErrorCode:            code,
+			ErrorMessage:         message,
+			RetryAfterSeconds:    retryAfterSeconds(wait),
+			SecondFactorRequired: true,
+		})
+		return
+	}
+	a.completeLogin(req.ID, user, a.pendingUsername)
+}
+
+func (a *authFlow) resumeSession(req clientRequest[protocol.ResumeSessionRequestPayload]) {
+	a.attempts++
+	if wait := a.hub.authLimiter.Check("", a.remoteIP); wait > 0 {
+		sendWebSocketResponse(a.conn, req.ID, protocol.MsgTypeResumeSessionResponse, protocol.ResumeSessionResponsePayload{
+			Success:           false,
+			ErrorCode:         protocol.ErrCodeTooManyAttempts,
+			ErrorMessage:      "too many failed attempts, try again later",
+			RetryAfterSeconds: retryAfterSeconds(wait),
+		})
+		return
+	}
+
+	session, err := a.hub.sessions.Resume(req.Payload.SessionToken)
+	if err != nil {
+		log.Printf("Auth: Session resume failed for client %p: %v", a.conn, err)
+		wait := a.hub.authLimiter.Failure("", a.remoteIP)
+		sendWebSocketResponse(a.conn, req.ID, protocol.MsgTypeResumeSessionResponse, protocol.ResumeSessionResponsePayload{
+			Success:           false,
+			ErrorCode:         protocol.ErrCodeInvalidSession,
+			ErrorMessage:      err.Error(),
+			RetryAfterSeconds: retryAfterSeconds(wait),
+		})
+		return
+	}
+
+	user, err := a.hub.users.GetByID(session.UserID)
+	if err == nil && user.Deactivated {
+		err = ErrUserDeactivated
+	}
+	if err != nil {
+		log.Printf("Auth: Session of user %s presented by client %p cannot be resumed: %v", session.UserID, a.conn, err)
+		code, message := errorResponse(err)
+		if errors.Is(err, ErrUserNotFound) {
+			// Аккаунт удален: для клиента это просто недействительная сессия.
+			code, message = protocol.ErrCodeInvalidSession, ErrSessionNotFound.Error()
+		}
+		sendWebSocketResponse(a.conn, req.ID, protocol.MsgTypeResumeSessionResponse, protocol.ResumeSessionResponsePayload{Success: false, ErrorCode: code, ErrorMessage: message})
+		return
+	}
+
+	a.user = user
+	a.sessionToken = req.Payload.SessionToken
+	sendWebSocketResponse(a.conn, req.ID, protocol.MsgTypeResumeSessionResponse, protocol.ResumeSessionResponsePayload{
+		Success:     true,
+		UserID:      user.ID,
+		DisplayName: user.DisplayName,
+		Role:        string(user.EffectiveRole()),
+		Permissions: permissionStrings(user.EffectivePermissions()),
+	})
+	log.Printf("Client %s (ID: %s) resumed session.", user.DisplayName, user.ID)
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+func init() {
+	handle(protocol.MsgTypeCreateChannelRequest, PermSendGlobal, (*Client).createChannel)
+	handle(protocol.MsgTypeListChannelsRequest, PermReadHistory, (*Client).listChannels)
+	handle(protocol.MsgTypeJoinChannelRequest, PermReadHistory, (*Client).joinChannel)
+	handle(protocol.MsgTypeLeaveChannelRequest, PermReadHistory, (*Client).leaveChannel)
+	handle(protocol.MsgTypeSetChannelTopicRequest, PermSendGlobal, (*Client).setChannelTopic)
+	handle(protocol.MsgTypeSendChannelMessageRequest, PermSendGlobal, (*Client).sendChannelMessage)
+}
+
+func (c *Client) createChannel(req clientRequest[protocol.CreateChannelRequestPayload]) {
+	p := req.Payload
+	info, err := c.hub.channels.Create(p.Name, c.UserID, p.Topic)
+	if err != nil {
+		log.Printf("Client %s: Creating channel #%s failed: %v", c.UserID, p.Name, err)
+		c.sendChannelError(req.ID, protocol.MsgTypeCreateChannelResponse, err)
+		return
+	}
+	log.Printf("Client %s (ID: %s) created channel #%s.", c.DisplayName, c.UserID, p.Name)
+
+	c.sendResponse(req.ID, protocol.MsgTypeCreateChannelResponse, protocol.ChannelResponsePayload{Success: true, Channel: &info})
+	c.hub.sendToUserExcept(c.UserID, c, protocol.MsgTypeChannelUpdateNotify, protocol.ChannelUpdateNotifyPayload{
+		Event:   protocol.ChannelEventJoined,
+		ActorID: c.UserID,
+		Channel: &info,
+	})
+}
+
+func (c *Client) listChannels(req clientRequest[protocol.ListChannelsRequestPayload]) {
+	channels := c.hub.channels.List(c.UserID, req.Payload.Query, req.Payload.JoinedOnly)
+	c.sendResponse(req.ID, protocol.MsgTypeListChannelsResponse, protocol.ListChannelsResponsePayload{Channels: channels})
+}
+
+func (c *Client) joinChannel(req clientRequest[protocol.ChannelRequestPayload]) {
+	p := req.Payload
+	info, joined, err := c.hub.channels.Join(p.Name, c.UserID)
+	if err != nil {
+		log.Printf("Client %s: Joining channel #%s failed: %v", c.UserID, p.Name, err)
+		c.sendChannelError(req.ID, protocol.MsgTypeJoinChannelResponse, err)
+		return
+	}
+
+	c.sendResponse(req.ID, protocol.MsgTypeJoinChannelResponse, protocol.ChannelResponsePayload{Success: true, Channel: &info})
+	if joined {
+		log.Printf("Client %s (ID: %s) joined channel #%s.", c.DisplayName, c.UserID, p.Name)
+		c.hub.sendToUserExcept(c.UserID, c, protocol.MsgTypeChannelUpdateNotify, protocol.ChannelUpdateNotifyPayload{
+			Event:   protocol.ChannelEventJoined,
+			ActorID: c.UserID,
+			Channel: &info,
+		})
+	}
+}
+
+func (c *Client) leaveChannel(req clientRequest[protocol.ChannelRequestPayload]) {
+	p := req.Payload
+	info, err := c.hub.channels.Leave(p.Name, c.UserID)
+	if err != nil {
+		log.Printf("Client %s: Leaving channel #%s failed: %v", c.UserID, p.Name, err)
+		c.sendChannelError(req.ID, protocol.MsgTypeLeaveChannelResponse, err)
+		return
+	}
+	log.Printf("Client %s (ID: %s) left channel #%s.", c.DisplayName, c.UserID, p.Name)
+
+	c.sendResponse(req.ID, protocol.MsgTypeLeaveChannelResponse, protocol.ChannelResponsePayload{Success: true, Channel: &info})
+	c.hub.sendToUserExcept(c.UserID, c, protocol.MsgTypeChannelUpdateNotify, protocol.ChannelUpdateNotifyPayload{
+		Event:   protocol.ChannelEventLeft,
+		ActorID: c.UserID,
+		Channel: &info,
+	})
+}
+
+func (c *Client) setChannelTopic(req clientRequest[protocol.SetChannelTopicRequestPayload]) {
+	p := req.Payload
+	// В канале по умолчанию состоят все, поэтому его тему меняют только модераторы
+	if p.Name == protocol.DefaultChannelName && !req.Actor.HasPermission(PermKickUsers) {
+		c.sendChannelError(req.ID, protocol.MsgTypeSetChannelTopicResponse,
+			fmt.Errorf("%w: only moderators can change the topic of the default channel", ErrPermissionDenied))
+		return
+	}
+	info, err := c.hub.channels.SetTopic(p.Name, c.UserID, p.Topic)
+	if err != nil {
+		log.Printf("Client %s: Setting topic of channel #%s failed: %v", c.UserID, p.Name, err)
+		c.sendChannelError(req.ID, protocol.MsgTypeSetChannelTopicResponse, err)
+		return
+	}
+	log.Printf("Client %s (ID: %s) set topic of channel #%s.", c.DisplayName, c.UserID, p.Name)
+
+	c.sendResponse(req.ID, protocol.MsgTypeSetChannelTopicResponse, protocol.ChannelResponsePayload{Success: true, Channel: &info})
+	update := protocol.ChannelUpdateNotifyPayload{Event: protocol.ChannelEventTopicChanged, ActorID: c.UserID, Channel: &info}
+	if info.Default {
+		c.hub.broadcast <- outgoingMessage{Type: protocol.MsgTypeChannelUpdateNotify, Payload: update}
+		return
+	}
+	// Тему меняет участник, поэтому описание (joined) совпадает для всех получателей
+	c.hub.sendToUsers(c.hub.channels.Members(p.Name), c, protocol.MsgTypeChannelUpdateNotify, update)
+}
+
+// sendChannelMessage сохраняет сообщение канала и рассылает его только участникам канала.
+// Остальные могут прочитать его в истории: каналы публичные.
+func (c *Client) sendChannelMessage(req clientRequest[protocol.SendChannelMessageRequestPayload]) {
+	p := req.Payload
+	if !c.hub.channels.Exists(p.Name) {
+		c.sendError(req.ID, protocol.ErrCodeChannelNotFound, ErrChannelNotFound.Error())
+		return
+	}
+	if !c.hub.channels.IsMember(p.Name, c.UserID) {
+		log.Printf("Client %s: Cannot send to channel #%s: not a member", c.UserID, p.Name)
+		c.sendError(req.ID, protocol.ErrCodeAccessDenied, "Join the channel before writing to it.")
+		return
+	}
+	chatID := protocol.ChannelChatID(p.Name)
+
+	if stored, ok := c.hub.recent.lookup(c.UserID, chatID, p.ClientMsgID); ok {
+		log.Printf("Client %s: Duplicate channel message %s (client_msg_id %s) in #%s.", c.UserID, stored.MessageID, p.ClientMsgID, p.Name)
+		c.sendResponse(req.ID, protocol.MsgTypeNewChannelMessageNotify, channelMessageNotify(p.Name, &stored, p.ClientMsgID))
+		return
+	}
+
+	storedMsg, err := SaveMessage(chatID, c.UserID, c.DisplayName, p.Text)
+	if err != nil {
+		log.Printf("Error saving channel message to history for chat %s: %v", chatID, err)
+		c.sendError(req.ID, protocol.ErrCodeHistorySaveFailed, "Could not save your message.")
+		return
+	}
+	c.hub.recent.remember(c.UserID, p.ClientMsgID, *storedMsg)
+
+	notify := channelMessageNotify(p.Name, storedMsg, p.ClientMsgID)
+	members := c.hub.channels.Members(p.Name)
+	log.Printf("Hub: Sending %s in #%s to %d member(s).", protocol.MsgTypeNewChannelMessageNotify, p.Name, len(members))
+	c.hub.sendToUsers(members, c, protocol.MsgTypeNewChannelMessageNotify, notify)
+	c.sendResponse(req.ID, protocol.MsgTypeNewChannelMessageNotify, notify)
+}
+
+func channelMessageNotify(name string, msg *protocol.StoredMessage, clientMsgID string) protocol.NewChannelMessageNotifyPayload {
+	return protocol.NewChannelMessageNotifyPayload{
+		ChatID:      msg.ChatID,
+		Name:        name,
+		MessageID:   msg.MessageID,
+		Seq:         msg.Seq,
+		SenderID:    msg.SenderID,
+		SenderName:  msg.SenderName,
+		Text:        msg.Text,
+		Timestamp:   msg.Timestamp,
+		ClientMsgID: clientMsgID,
+	}
+}
+
+// sendChannelError отвечает на запрос управления каналом ошибкой err.
+func (c *Client) sendChannelError(requestID, msgType string, err error) {
+	code, message := errorResponse(err)
+	c.sendResponse(requestID, msgType, protocol.ChannelResponsePayload{ErrorCode: code, ErrorMessage: message})
+}
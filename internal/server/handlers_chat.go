@@ -0,0 +1,291 @@
+package server
+
+import (
+	"log"
+	"strings"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+func init() {
+	handle(protocol.MsgTypeGetUserListRequest, PermListUsers, (*Client).getUserList)
+	handle(protocol.MsgTypeSendPrivateMessageRequest, PermSendPrivate, (*Client).sendPrivateMessage)
+	handle(protocol.MsgTypeText, PermSendGlobal, (*Client).sendGlobalMessage)
+	handle(protocol.MsgTypeGetChatHistoryRequest, PermReadHistory, (*Client).getChatHistory)
+	handle(protocol.MsgTypeSyncRequest, PermReadHistory, (*Client).syncChats)
+
+	handle(protocol.MsgTypeMessageDelivered, PermReadHistory, (*Client).messageDelivered)
+	handle(protocol.MsgTypeMessageRead, PermReadHistory, (*Client).messageRead)
+}
+
+func (c *Client) getUserList(req clientRequest[protocol.GetUserListRequestPayload]) {
+	log.Printf("Client %s (ID: %s) requested user list.", c.DisplayName, c.UserID)
+	userList := c.hub.GetAuthenticatedUsersInfo(c.UserID) // Исключаем себя
+	c.sendResponse(req.ID, protocol.MsgTypeUserListResponse, protocol.UserListResponsePayload{Users: userList})
+}
+
+func (c *Client) sendPrivateMessage(req clientRequest[protocol.SendPrivateMessageRequestPayload]) {
+	p := req.Payload
+	log.Printf("Client %s sending private message to UserID: %s.", c.DisplayName, p.TargetUserID)
+
+	chatID, err := GeneratePrivateChatID(c.UserID, p.TargetUserID)
+	if err != nil {
+		log.Printf("Client %s: Error generating ChatID for private message: %v", c.UserID, err)
+		c.sendError(req.ID, protocol.ErrCodeInternal, "Could not process private message.")
+		return
+	}
+
+	// Повтор уже сохраненного сообщения (например, после обрыва связи). Получатель его уже получил,
+	// поэтому сохраненное сообщение возвращается только этому устройству - даже если получатель уже не в сети.
+	if stored, ok := c.hub.recent.lookup(c.UserID, chatID, p.ClientMsgID); ok {
+		log.Printf("Client %s: Duplicate private message %s (client_msg_id %s) in chat %s.", c.UserID, stored.MessageID, p.ClientMsgID, chatID)
+		c.sendResponse(req.ID, protocol.MsgTypeNewPrivateMessageNotify, protocol.NewPrivateMessageNotifyPayload{
+			ChatID:      chatID,
+			MessageID:   stored.MessageID,
+			Seq:         stored.Seq,
+			SenderID:    stored.SenderID,
+			SenderName:  stored.SenderName,
+			ReceiverID:  p.TargetUserID,
+			Text:        stored.Text,
+			Timestamp:   stored.Timestamp,
+			ClientMsgID: p.ClientMsgID,
+		})
+		return
+	}
+
+	// Получатель проверяется по хранилищу, а не по хабу: сообщение для пользователя не в сети
+	// сохраняется и доставляется при его следующем входе.
+	target, err := c.hub.users.GetByID(p.TargetUserID)
+	if err != nil || target.Deactivated {
+		log.Printf("Client %s: Target user ID %s for private message not found or deactivated.", c.UserID, p.TargetUserID)
+		c.sendError(req.ID, protocol.ErrCodeUserNotFound, "Recipient does not exist.")
+		return
+	}
+
+	// Без сохранения сообщение нельзя доставить позже, поэтому при ошибке оно не отправляется никому.
+	storedMsg, errSave := SaveMessage(chatID, c.UserID, c.DisplayName, p.Text)
+	if errSave != nil {
+		log.Printf("Error saving private message to history for chat %s: %v", chatID, errSave)
+		c.sendError(req.ID, protocol.ErrCodeHistorySaveFailed, "Could not save your message.")
+		return
+	}
+	c.hub.recent.remember(c.UserID, p.ClientMsgID, *storedMsg)
+
+	notifyPayload := protocol.NewPrivateMessageNotifyPayload{
+		ChatID:      chatID,
+		MessageID:   storedMsg.MessageID,
+		Seq:         storedMsg.Seq,
+		SenderID:    c.UserID,
+		SenderName:  c.DisplayName,
+		ReceiverID:  p.TargetUserID,
+		Text:        p.Text,
+		Timestamp:   storedMsg.Timestamp,
+		ClientMsgID: p.ClientMsgID,
+	}
+
+	// Отправляем на все устройства получателя, а если их нет - ставим в очередь доставки
+	c.hub.sendToUserOrQueue(p.TargetUserID, c, protocol.MsgTypeNewPrivateMessageNotify, notifyPayload, func() {
+		if err := QueuePendingDelivery(p.TargetUserID, storedMsg); err != nil {
+			log.Printf("Client %s: Error queueing private message %s for offline user %s: %v", c.UserID, storedMsg.MessageID, p.TargetUserID, err)
+			return
+		}
+		log.Printf("Client %s: Recipient %s is offline, message %s queued for delivery.", c.UserID, p.TargetUserID, storedMsg.MessageID)
+		notifyPayload.Queued = true
+	})
+	// Отправляем "эхо" на остальные устройства отправителя, если это не чат с самим собой
+	if p.TargetUserID != c.UserID {
+		c.hub.sendToUserExcept(c.UserID, c, protocol.MsgTypeNewPrivateMessageNotify, notifyPayload)
+	}
+	// Это устройство получает сообщение как ответ на свой запрос
+	c.sendResponse(req.ID, protocol.MsgTypeNewPrivateMessageNotify, notifyPayload)
+}
+
+// sendGlobalMessage рассылает TEXT_MESSAGE всем в глобальном чате.
+func (c *Client) sendGlobalMessage(req clientRequest[protocol.TextPayload]) {
+	p := req.Payload
+	globalChatID := "global_broadcast"
+
+	// Повтор уже разосланного сообщения: остальные его получили, возвращаем его только этому устройству.
+	if stored, ok := c.hub.recent.lookup(c.UserID, globalChatID, p.ClientMsgID); ok {
+		log.Printf("Client %s: Duplicate broadcast message %s (client_msg_id %s).", c.UserID, stored.MessageID, p.ClientMsgID)
+		c.sendResponse(req.ID, protocol.MsgTypeBroadcastText, protocol.BroadcastTextPayload{
+			MessageID:   stored.MessageID,
+			Seq:         stored.Seq,
+			SenderID:    stored.SenderID,
+			SenderName:  stored.SenderName,
+			Text:        stored.Text,
+			Timestamp:   stored.Timestamp,
+			ClientMsgID: p.ClientMsgID,
+		})
+		return
+	}
+
+	storedMsg, err := SaveMessage(globalChatID, c.UserID, c.DisplayName, p.Text)
+	if err != nil {
+		// Без seq сообщение нельзя получить синхронизацией, поэтому оно не рассылается
+		log.Printf("Error saving broadcast message to history for chat %s: %v", globalChatID, err)
+		c.sendError(req.ID, protocol.ErrCodeHistorySaveFailed, "Could not save your message.")
+		return
+	}
+	c.hub.recent.remember(c.UserID, p.ClientMsgID, *storedMsg)
+
+	broadcastData := protocol.BroadcastTextPayload{
+		MessageID:   storedMsg.MessageID,
+		Seq:         storedMsg.Seq,
+		SenderID:    c.UserID,
+		SenderName:  c.DisplayName,
+		Text:        p.Text,
+		Timestamp:   storedMsg.Timestamp,
+		ClientMsgID: p.ClientMsgID,
+	}
+	c.hub.broadcast <- outgoingMessage{Type: protocol.MsgTypeBroadcastText, Payload: broadcastData}
+}
+
+func (c *Client) getChatHistory(req clientRequest[protocol.GetChatHistoryRequestPayload]) {
+	p := req.Payload
+	log.Printf("Client %s (ID: %s) requested history for chat: %s (Limit: %d)",
+		c.DisplayName, c.UserID, p.ChatID, p.Limit)
+
+	// Проверка прав доступа: может ли этот UserID читать историю этого ChatID?
+	// Для broadcast чата ("global_broadcast") и публичных каналов доступ разрешен всем аутентифицированным,
+	// для личных и групповых - только участникам.
+	if !c.hub.canReadChat(p.ChatID, c.UserID) {
+		log.Printf("Client %s (ID: %s) - Access denied for chat history: %s", c.DisplayName, c.UserID, p.ChatID)
+		c.sendError(req.ID, protocol.ErrCodeAccessDenied, "You do not have permission to access this chat history.")
+		return
+	}
+
+	// Устанавливаем лимит по умолчанию, если не указан или слишком большой
+	limit := p.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	} else if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+
+	messages, err := LoadChatHistory(p.ChatID, limit)
+	if err != nil {
+		log.Printf("Client %s: Error loading history for chat %s: %v", c.UserID, p.ChatID, err)
+		c.sendError(req.ID, protocol.ErrCodeHistoryLoadFailed, "Could not load chat history.")
+		return
+	}
+
+	if isPrivateChatMember(p.ChatID, c.UserID) {
+		if err := ApplyReceipts(p.ChatID, messages); err != nil {
+			// История важнее отметок: отправляем ее без них
+			log.Printf("Client %s: Error loading receipts for chat %s: %v", c.UserID, p.ChatID, err)
+		}
+	}
+
+	respPayload := protocol.ChatHistoryResponsePayload{
+		ChatID:   p.ChatID,
+		Messages: messages,
+		// HasMore: true/false - можно добавить, если реализована пагинация
+	}
+	c.sendResponse(req.ID, protocol.MsgTypeChatHistoryResponse, respPayload)
+}
+
+// canReadChat сообщает, может ли userID читать историю чата: глобальный чат доступен всем,
+// публичный канал - тоже всем, личный - двум его участникам, групповой - текущим участникам группы.
+func (h *Hub) canReadChat(chatID, userID string) bool {
+	switch {
+	case chatID == "global_broadcast":
+		return true
+	case IsGroupChatID(chatID):
+		return h.groups.IsMember(chatID, userID)
+	case IsChannelChatID(chatID):
+		return h.channels.Exists(strings.TrimPrefix(chatID, protocol.ChannelChatIDPrefix)) // Каналы публичные
+	default:
+		return isPrivateChatMember(chatID, userID)
+	}
+}
+
+// syncChats досылает сообщения, которые клиент пропустил после указанных seq.
+func (c *Client) syncChats(req clientRequest[protocol.SyncRequestPayload]) {
+	for _, chat := range req.Payload.Chats {
+		if !c.hub.canReadChat(chat.ChatID, c.UserID) {
+			log.Printf("Client %s (ID: %s) - Access denied for sync of chat: %s", c.DisplayName, c.UserID, chat.ChatID)
+			c.sendError(req.ID, protocol.ErrCodeAccessDenied, "You do not have permission to access chat "+chat.ChatID+".")
+			return
+		}
+	}
+
+	resp := protocol.SyncResponsePayload{Chats: []protocol.ChatHistoryResponsePayload{}}
+	for _, chat := range req.Payload.Chats {
+		messages, hasMore, err := LoadMessagesAfter(chat.ChatID, chat.LastSeq, maxHistoryLimit)
+		if err != nil {
+			log.Printf("Client %s: Error loading messages after seq %d for chat %s: %v", c.UserID, chat.LastSeq, chat.ChatID, err)
+			c.sendError(req.ID, protocol.ErrCodeHistoryLoadFailed, "Could not load chat history.")
+			return
+		}
+		if len(messages) == 0 {
+			continue
+		}
+		if isPrivateChatMember(chat.ChatID, c.UserID) {
+			if err := ApplyReceipts(chat.ChatID, messages); err != nil {
+				log.Printf("Client %s: Error loading receipts for chat %s: %v", c.UserID, chat.ChatID, err)
+			}
+		}
+		resp.Chats = append(resp.Chats, protocol.ChatHistoryResponsePayload{ChatID: chat.ChatID, Messages: messages, HasMore: hasMore})
+	}
+	log.Printf("Client %s (ID: %s) synced %d chat(s), %d with new messages.", c.DisplayName, c.UserID, len(req.Payload.Chats), len(resp.Chats))
+	c.sendResponse(req.ID, protocol.MsgTypeSyncResponse, resp)
+}
+
+// isPrivateChatMember сообщает, является ли userID участником личного чата chatID ("private:id1:id2").
+// chatID приходит от клиента и потом попадает в пути файлов истории и отметок, поэтому принимается
+// только ID, который сервер сам сформировал бы для userID и собеседника. Существование собеседника
+// не проверяется: после удаления аккаунта история чата с ним остается доступной второму участнику.
+func isPrivateChatMember(chatID, userID string) bool {
+	parts := strings.Split(chatID, ":")
+	if len(parts) != 3 || parts[0] != "private" || checkChatID(chatID) != nil {
+		return false
+	}
+	otherID := parts[1]
+	if otherID == userID {
+		otherID = parts[2]
+	}
+	expected, err := GeneratePrivateChatID(userID, otherID)
+	return err == nil && chatID == expected
+}
+
+func (c *Client) messageDelivered(req clientRequest[protocol.MessageReceiptPayload]) {
+	c.acknowledgeMessages(req, protocol.ReceiptStatusDelivered)
+}
+
+func (c *Client) messageRead(req clientRequest[protocol.MessageReceiptPayload]) {
+	status := protocol.ReceiptStatusRead
+	if req.Actor.ReadReceiptsDisabled {
+		// Собеседник узнает только о доставке: прочитанное сообщение заведомо доставлено
+		status = protocol.ReceiptStatusDelivered
+	}
+	c.acknowledgeMessages(req, status)
+}
+
+// acknowledgeMessages сохраняет отметку получателя и сообщает о ней устройствам отправителей.
+// Ответа нет: подтверждения отправляются автоматически, и клиенту нечего с ним делать.
+func (c *Client) acknowledgeMessages(req clientRequest[protocol.MessageReceiptPayload], status string) {
+	p := req.Payload
+	if !isPrivateChatMember(p.ChatID, c.UserID) {
+		log.Printf("Client %s (ID: %s) - Access denied for receipts in chat: %s", c.DisplayName, c.UserID, p.ChatID)
+		c.sendError(req.ID, protocol.ErrCodeAccessDenied, "You are not a participant of this chat.")
+		return
+	}
+
+	bySender, timestamp, err := SaveReceipts(p.ChatID, c.UserID, status, p.MessageIDs)
+	if err != nil {
+		log.Printf("Client %s: Error saving %s receipts for chat %s: %v", c.UserID, status, p.ChatID, err)
+		c.sendError(req.ID, protocol.ErrCodeHistorySaveFailed, "Could not save message receipts.")
+		return
+	}
+
+	for senderID, messageIDs := range bySender {
+		c.hub.sendToUserWithFeature(senderID, protocol.FeatureReceipts, protocol.MsgTypeMessageReceiptNotify, protocol.MessageReceiptNotifyPayload{
+			ChatID:     p.ChatID,
+			MessageIDs: messageIDs,
+			UserID:     c.UserID,
+			Status:     status,
+			Timestamp:  timestamp,
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+func TestIsPrivateChatMember(t *testing.T) {
+	const me = "b6e0c1a4-0000-4000-8000-000000000002"
+	const other = "a1f3d9c2-0000-4000-8000-000000000001" // Меньше me: в ID чата идет первым
+	tests := []struct {
+		name   string
+		chatID string
+		want   bool
+	}{
+		// Собеседник может быть уже удален: его наличие в хранилище не проверяется
+		{name: "member", chatID: "private:" + other + ":" + me, want: true},
+		{name: "wrong_order", chatID: "private:" + me + ":" + other},
+		{name: "not_member", chatID: "private:" + other + ":c0000000-0000-4000-8000-000000000003"},
+		{name: "traversal", chatID: "private:" + me + ":../../x"},
+		{name: "traversal_sorted_first", chatID: "private:..:" + me},
+		{name: "backslash", chatID: `private:` + me + `:x\y`},
+		{name: "empty_other", chatID: "private::" + me},
+		{name: "extra_part", chatID: "private:" + other + ":" + me + ":x"},
+		{name: "not_private", chatID: "group:" + other + ":" + me},
+	}
+	for _, tt := range tests {
+		if got := isPrivateChatMember(tt.chatID, me); got != tt.want {
+			t.Errorf("%s: isPrivateChatMember(%q) = %t, want %t", tt.name, tt.chatID, got, tt.want)
+		}
+	}
+}
+
+func TestSendGlobalMessageNotBroadcastWhenSaveFails(t *testing.T) {
+	// historyDir внутри обычного файла: создать файл истории не получится
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatalf("write blocker: %v", err)
+	}
+	saved := historyDir
+	historyDir = filepath.Join(blocker, "history")
+	t.Cleanup(func() { historyDir = saved })
+
+	client, _ := newTestClient(t)
+	client.hub = NewHub(HubConfig{Users: NewMemoryUserStore(DefaultUniquenessRules)})
+	client.UserID = "u1"
+	client.DisplayName = "Alice"
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.sendGlobalMessage(clientRequest[protocol.TextPayload]{ID: "7", Payload: protocol.TextPayload{Text: "hi"}})
+	}()
+	select {
+	case <-done:
+	case msg := <-client.hub.broadcast:
+		t.Fatalf("unsaved message was broadcast: %+v", msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("sendGlobalMessage did not return")
+	}
+
+	select {
+	case msg := <-client.send:
+		payload, ok := msg.Payload.(protocol.ErrorPayload)
+		if msg.Type != protocol.MsgTypeErrorNotify || msg.RequestID != "7" || !ok || payload.ErrorCode != protocol.ErrCodeHistorySaveFailed {
+			t.Fatalf("response = %+v, want %s", msg, protocol.ErrCodeHistorySaveFailed)
+		}
+	default:
+		t.Fatal("sender got no error response")
+	}
+}
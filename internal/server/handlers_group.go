@@ -0,0 +1,203 @@
+package server
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+func init() {
+	handle(protocol.MsgTypeCreateGroupRequest, PermSendPrivate, (*Client).createGroup)
+	handle(protocol.MsgTypeGroupInviteRequest, PermSendPrivate, (*Client).inviteToGroup)
+	handle(protocol.MsgTypeGroupRemoveMemberRequest, PermSendPrivate, (*Client).removeGroupMember)
+	handle(protocol.MsgTypeLeaveGroupRequest, PermSendPrivate, (*Client).leaveGroup)
+	handle(protocol.MsgTypeListGroupsRequest, PermReadHistory, (*Client).listGroups)
+	handle(protocol.MsgTypeSendGroupMessageRequest, PermSendPrivate, (*Client).sendGroupMessage)
+}
+
+func (c *Client) createGroup(req clientRequest[protocol.CreateGroupRequestPayload]) {
+	p := req.Payload
+	for _, id := range p.MemberIDs {
+		if err := c.hub.checkGroupCandidate(id); err != nil {
+			c.sendGroupError(req.ID, protocol.MsgTypeCreateGroupResponse, err)
+			return
+		}
+	}
+	group, err := c.hub.groups.Create(c.UserID, p.Title, p.MemberIDs)
+	if err != nil {
+		log.Printf("Client %s: Creating group failed: %v", c.UserID, err)
+		c.sendGroupError(req.ID, protocol.MsgTypeCreateGroupResponse, err)
+		return
+	}
+	log.Printf("Client %s (ID: %s) created group %s with %d member(s).", c.DisplayName, c.UserID, group.ID, len(group.Members))
+
+	info := group.info(c.hub.users)
+	c.sendResponse(req.ID, protocol.MsgTypeCreateGroupResponse, protocol.GroupResponsePayload{Success: true, Group: &info})
+	c.hub.notifyGroupMembers(group, c, protocol.MsgTypeGroupUpdateNotify, protocol.GroupUpdateNotifyPayload{
+		Event:   protocol.GroupEventCreated,
+		ChatID:  group.ID,
+		ActorID: c.UserID,
+		Group:   &info,
+	})
+}
+
+func (c *Client) inviteToGroup(req clientRequest[protocol.GroupInviteRequestPayload]) {
+	p := req.Payload
+	if err := c.hub.checkGroupCandidate(p.UserID); err != nil {
+		c.sendGroupError(req.ID, protocol.MsgTypeGroupInviteResponse, err)
+		return
+	}
+	group, err := c.hub.groups.AddMember(p.ChatID, c.UserID, p.UserID, p.Role)
+	if err != nil {
+		log.Printf("Client %s: Adding %s to group %s failed: %v", c.UserID, p.UserID, p.ChatID, err)
+		c.sendGroupError(req.ID, protocol.MsgTypeGroupInviteResponse, err)
+		return
+	}
+	log.Printf("Client %s (ID: %s) added %s to group %s.", c.DisplayName, c.UserID, p.UserID, group.ID)
+
+	info := group.info(c.hub.users)
+	c.sendResponse(req.ID, protocol.MsgTypeGroupInviteResponse, protocol.GroupResponsePayload{Success: true, Group: &info})
+	c.hub.notifyGroupMembers(group, c, protocol.MsgTypeGroupUpdateNotify, protocol.GroupUpdateNotifyPayload{
+		Event:   protocol.GroupEventMemberAdded,
+		ChatID:  group.ID,
+		UserID:  p.UserID,
+		ActorID: c.UserID,
+		Group:   &info,
+	})
+}
+
+func (c *Client) removeGroupMember(req clientRequest[protocol.GroupRemoveMemberRequestPayload]) {
+	p := req.Payload
+	if p.UserID == c.UserID {
+		c.sendResponse(req.ID, protocol.MsgTypeGroupRemoveMemberResponse, protocol.GroupResponsePayload{
+			ErrorCode: protocol.ErrCodeCannotTargetSelf, ErrorMessage: "use LEAVE_GROUP_REQUEST to leave a group",
+		})
+		return
+	}
+	group, err := c.hub.groups.RemoveMember(p.ChatID, c.UserID, p.UserID)
+	if err != nil {
+		log.Printf("Client %s: Removing %s from group %s failed: %v", c.UserID, p.UserID, p.ChatID, err)
+		c.sendGroupError(req.ID, protocol.MsgTypeGroupRemoveMemberResponse, err)
+		return
+	}
+	log.Printf("Client %s (ID: %s) removed %s from group %s.", c.DisplayName, c.UserID, p.UserID, group.ID)
+
+	info := group.info(c.hub.users)
+	c.sendResponse(req.ID, protocol.MsgTypeGroupRemoveMemberResponse, protocol.GroupResponsePayload{Success: true, Group: &info})
+	update := protocol.GroupUpdateNotifyPayload{
+		Event:   protocol.GroupEventMemberRemoved,
+		ChatID:  group.ID,
+		UserID:  p.UserID,
+		ActorID: c.UserID,
+	}
+	c.hub.SendToUser(p.UserID, protocol.MsgTypeGroupUpdateNotify, update) // Без описания группы: он в ней больше не состоит
+	update.Group = &info
+	c.hub.notifyGroupMembers(group, c, protocol.MsgTypeGroupUpdateNotify, update)
+}
+
+func (c *Client) leaveGroup(req clientRequest[protocol.LeaveGroupRequestPayload]) {
+	p := req.Payload
+	group, err := c.hub.groups.Leave(p.ChatID, c.UserID)
+	if err != nil {
+		log.Printf("Client %s: Leaving group %s failed: %v", c.UserID, p.ChatID, err)
+		c.sendGroupError(req.ID, protocol.MsgTypeLeaveGroupResponse, err)
+		return
+	}
+	log.Printf("Client %s (ID: %s) left group %s.", c.DisplayName, c.UserID, p.ChatID)
+
+	c.sendResponse(req.ID, protocol.MsgTypeLeaveGroupResponse, protocol.GroupResponsePayload{Success: true})
+	update := protocol.GroupUpdateNotifyPayload{
+		Event:   protocol.GroupEventMemberLeft,
+		ChatID:  p.ChatID,
+		UserID:  c.UserID,
+		ActorID: c.UserID,
+	}
+	c.hub.sendToUserExcept(c.UserID, c, protocol.MsgTypeGroupUpdateNotify, update)
+	if group != nil { // Группа удаляется вместе с последним участником
+		info := group.info(c.hub.users)
+		update.Group = &info
+		c.hub.notifyGroupMembers(group, nil, protocol.MsgTypeGroupUpdateNotify, update)
+	}
+}
+
+func (c *Client) listGroups(req clientRequest[protocol.ListGroupsRequestPayload]) {
+	groups := c.hub.groups.ListForUser(c.UserID)
+	resp := protocol.ListGroupsResponsePayload{Groups: make([]protocol.GroupInfo, 0, len(groups))}
+	for _, group := range groups {
+		resp.Groups = append(resp.Groups, group.info(c.hub.users))
+	}
+	c.sendResponse(req.ID, protocol.MsgTypeListGroupsResponse, resp)
+}
+
+// sendGroupMessage сохраняет сообщение группового чата и рассылает его участникам группы.
+// Участники не в сети получают его из истории или через SYNC_REQUEST.
+func (c *Client) sendGroupMessage(req clientRequest[protocol.SendGroupMessageRequestPayload]) {
+	p := req.Payload
+	group, err := c.hub.groups.Get(p.ChatID)
+	if err == nil && group.memberIndex(c.UserID) < 0 {
+		err = ErrNotInGroup
+	}
+	if err != nil {
+		log.Printf("Client %s: Cannot send to group %s: %v", c.UserID, p.ChatID, err)
+		code, message := errorResponse(err)
+		c.sendError(req.ID, code, message)
+		return
+	}
+
+	if stored, ok := c.hub.recent.lookup(c.UserID, p.ChatID, p.ClientMsgID); ok {
+		log.Printf("Client %s: Duplicate group message %s (client_msg_id %s) in chat %s.", c.UserID, stored.MessageID, p.ClientMsgID, p.ChatID)
+		c.sendResponse(req.ID, protocol.MsgTypeNewGroupMessageNotify, groupMessageNotify(&stored, p.ClientMsgID))
+		return
+	}
+
+	storedMsg, err := SaveMessage(p.ChatID, c.UserID, c.DisplayName, p.Text)
+	if err != nil {
+		log.Printf("Error saving group message to history for chat %s: %v", p.ChatID, err)
+		c.sendError(req.ID, protocol.ErrCodeHistorySaveFailed, "Could not save your message.")
+		return
+	}
+	c.hub.recent.remember(c.UserID, p.ClientMsgID, *storedMsg)
+
+	notify := groupMessageNotify(storedMsg, p.ClientMsgID)
+	c.hub.notifyGroupMembers(group, c, protocol.MsgTypeNewGroupMessageNotify, notify)
+	c.sendResponse(req.ID, protocol.MsgTypeNewGroupMessageNotify, notify)
+}
+
+func groupMessageNotify(msg *protocol.StoredMessage, clientMsgID string) protocol.NewGroupMessageNotifyPayload {
+	return protocol.NewGroupMessageNotifyPayload{
+		ChatID:      msg.ChatID,
+		MessageID:   msg.MessageID,
+		Seq:         msg.Seq,
+		SenderID:    msg.SenderID,
+		SenderName:  msg.SenderName,
+		Text:        msg.Text,
+		Timestamp:   msg.Timestamp,
+		ClientMsgID: clientMsgID,
+	}
+}
+
+// sendGroupError отвечает на запрос управления группой ошибкой err.
+func (c *Client) sendGroupError(requestID, msgType string, err error) {
+	code, message := errorResponse(err)
+	c.sendResponse(requestID, msgType, protocol.GroupResponsePayload{ErrorCode: code, ErrorMessage: message})
+}
+
+// checkGroupCandidate проверяет, что пользователя можно добавить в группу: он существует и активен.
+func (h *Hub) checkGroupCandidate(userID string) error {
+	user, err := h.users.GetByID(userID)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, userID)
+	}
+	if user.Deactivated {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, userID)
+	}
+	return nil
+}
+
+// notifyGroupMembers отправляет сообщение всем устройствам участников группы, кроме except.
+func (h *Hub) notifyGroupMembers(group *Group, except *Client, msgType string, payload interface{}) {
+	for _, m := range group.Members {
+		h.sendToUserExcept(m.UserID, except, msgType, payload)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+func init() {
+	handle(protocol.MsgTypeKickUserRequest, PermKickUsers, (*Client).kickUser)
+	handle(protocol.MsgTypeSetUserRoleRequest, PermManageRoles, (*Client).setUserRole)
+
+	handle(protocol.MsgTypeCreateInviteRequest, PermManageInvites, (*Client).createInvite)
+	handle(protocol.MsgTypeListInvitesRequest, PermManageInvites, (*Client).listInvites)
+	handle(protocol.MsgTypeRevokeInviteRequest, PermManageInvites, (*Client).revokeInvite)
+}
+
+func (c *Client) kickUser(req clientRequest[protocol.KickUserRequestPayload]) {
+	p := req.Payload
+	resp := protocol.ModerationResponsePayload{TargetUserID: p.TargetUserID}
+	target, err := c.hub.users.GetByID(p.TargetUserID)
+	switch {
+	case err != nil:
+		resp.ErrorCode, resp.ErrorMessage = errorResponse(err)
+	case target.ID == c.UserID:
+		resp.ErrorCode, resp.ErrorMessage = protocol.ErrCodeCannotTargetSelf, "you cannot kick yourself"
+	case !req.Actor.Outranks(target):
+		resp.ErrorCode, resp.ErrorMessage = protocol.ErrCodeInsufficientRank, "you cannot kick a user with the same or a higher role"
+	}
+	if resp.ErrorCode != "" {
+		c.sendResponse(req.ID, protocol.MsgTypeKickUserResponse, resp)
+		return
+	}
+
+	reason := "kicked by " + c.DisplayName
+	if p.Reason != "" {
+		reason += ": " + p.Reason
+	}
+	log.Printf("Client %s (ID: %s) kicks user %s (ID: %s): %s", c.DisplayName, c.UserID, target.DisplayName, target.ID, reason)
+	c.hub.terminateUserSessions(target.ID, reason)
+	resp.Success = true
+	c.sendResponse(req.ID, protocol.MsgTypeKickUserResponse, resp)
+}
+
+func (c *Client) setUserRole(req clientRequest[protocol.SetUserRoleRequestPayload]) {
+	p := req.Payload
+	resp := protocol.ModerationResponsePayload{TargetUserID: p.TargetUserID}
+	role, err := ParseRole(p.Role)
+	if err != nil {
+		resp.ErrorCode, resp.ErrorMessage = errorResponse(err)
+		c.sendResponse(req.ID, protocol.MsgTypeSetUserRoleResponse, resp)
+		return
+	}
+	target, err := SetUserRole(c.hub.users, p.TargetUserID, role)
+	if err != nil {
+		log.Printf("Client %s: Setting role %s for %s failed: %v", c.UserID, role, p.TargetUserID, err)
+		resp.ErrorCode, resp.ErrorMessage = errorResponse(err)
+		c.sendResponse(req.ID, protocol.MsgTypeSetUserRoleResponse, resp)
+		return
+	}
+	resp.Success = true
+	resp.Role = string(role)
+	c.sendResponse(req.ID, protocol.MsgTypeSetUserRoleResponse, resp)
+	c.hub.SendToUser(target.ID, protocol.MsgTypeRoleChangedNotify, protocol.RoleChangedNotifyPayload{
+		Role:        string(target.EffectiveRole()),
+		Permissions: permissionStrings(target.EffectivePermissions()),
+	})
+}
+
+func (c *Client) createInvite(req clientRequest[protocol.CreateInviteRequestPayload]) {
+	p := req.Payload
+	if p.MaxUses == 0 {
+		p.MaxUses = 1
+	}
+	if p.ExpiresInSeconds < 0 {
+		c.sendResponse(req.ID, protocol.MsgTypeCreateInviteResponse, protocol.CreateInviteResponsePayload{Success: false, ErrorCode: protocol.ErrCodeInvalidRequest, ErrorMessage: "expiry must not be negative"})
+		return
+	}
+	invite, err := c.hub.invites.Create(c.UserID, p.MaxUses, time.Duration(p.ExpiresInSeconds)*time.Second)
+	if err != nil {
+		log.Printf("Client %s: Failed to create invite: %v", c.UserID, err)
+		code, message := errorResponse(err)
+		c.sendResponse(req.ID, protocol.MsgTypeCreateInviteResponse, protocol.CreateInviteResponsePayload{Success: false, ErrorCode: code, ErrorMessage: message})
+		return
+	}
+	log.Printf("Client %s (ID: %s) created invite %s (max uses: %d)", c.DisplayName, c.UserID, invite.Code, invite.MaxUses)
+	info := invite.info()
+	c.sendResponse(req.ID, protocol.MsgTypeCreateInviteResponse, protocol.CreateInviteResponsePayload{Success: true, Invite: &info})
+}
+
+func (c *Client) listInvites(req clientRequest[noPayload]) {
+	invites := c.hub.invites.List()
+	infos := make([]protocol.InviteInfo, 0, len(invites))
+	for _, inv := range invites {
+		infos = append(infos, inv.info())
+	}
+	c.sendResponse(req.ID, protocol.MsgTypeListInvitesResponse, protocol.ListInvitesResponsePayload{Invites: infos})
+}
+
+func (c *Client) revokeInvite(req clientRequest[protocol.RevokeInviteRequestPayload]) {
+	code := req.Payload.Code
+	if err := c.hub.invites.Revoke(code); err != nil {
+		errCode, message := errorResponse(err)
+		c.sendResponse(req.ID, protocol.MsgTypeRevokeInviteResponse, protocol.RevokeInviteResponsePayload{Success: false, Code: code, ErrorCode: errCode, ErrorMessage: message})
+		return
+	}
+	log.Printf("Client %s (ID: %s) revoked invite %s", c.DisplayName, c.UserID, code)
+	c.sendResponse(req.ID, protocol.MsgTypeRevokeInviteResponse, protocol.RevokeInviteResponsePayload{Success: true, Code: code})
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+// protocolAdapter приводит исходящие сообщения к версии протокола, которую понимает клиент.
+// Когда формат сообщений меняется, текущая версия увеличивается, а для прежней добавляется адаптер.
+type protocolAdapter interface {
+	// adapt изменяет сообщение на месте. false - сообщение этому клиенту не отправляется.
+	adapt(msg *outgoingMessage) bool
+}
+
+// currentProtocolAdapter отправляет сообщения без изменений.
+type currentProtocolAdapter struct{}
+
+func (currentProtocolAdapter) adapt(*outgoingMessage) bool { return true }
+
+// unixSecondsAdapter переводит время сообщений из миллисекунд в секунды для клиентов версий 1 и 2.
+// Поле seq, появившееся в версии 3, такие клиенты просто не читают.
+type unixSecondsAdapter struct{}
+
+func (unixSecondsAdapter) adapt(msg *outgoingMessage) bool {
+	switch p := msg.Payload.(type) {
+	case protocol.BroadcastTextPayload:
+		p.Timestamp /= 1000
+		msg.Payload = p
+	case protocol.NewPrivateMessageNotifyPayload:
+		p.Timestamp /= 1000
+		msg.Payload = p
+	case protocol.MessageReceiptNotifyPayload:
+		p.Timestamp /= 1000
+		msg.Payload = p
+	case protocol.NewGroupMessageNotifyPayload:
+		p.Timestamp /= 1000
+		msg.Payload = p
+	case protocol.NewChannelMessageNotifyPayload:
+		p.Timestamp /= 1000
+		msg.Payload = p
+	case protocol.ChatHistoryResponsePayload:
+		msg.Payload = historyInUnixSeconds(p)
+	case protocol.SyncResponsePayload:
+		chats := make([]protocol.ChatHistoryResponsePayload, len(p.Chats))
+		for i, chat := range p.Chats {
+			chats[i] = historyInUnixSeconds(chat)
+		}
+		p.Chats = chats
+		msg.Payload = p
+	}
+	return true
+}
+
+// historyInUnixSeconds возвращает копию истории со временем в секундах. Срез сообщений копируется:
+// payload мог быть создан для нескольких получателей.
+func historyInUnixSeconds(p protocol.ChatHistoryResponsePayload) protocol.ChatHistoryResponsePayload {
+	messages := make([]protocol.StoredMessage, len(p.Messages))
+	for i, m := range p.Messages {
+		m.Timestamp /= 1000
+		m.DeliveredAt /= 1000
+		m.ReadAt /= 1000
+		messages[i] = m
+	}
+	p.Messages = messages
+	return p
+}
+
+// protocolAdapters - адаптер для каждой версии протокола, которую может обслуживать сервер.
+// Версия 2 отличается от версии 1 только рукопожатием HELLO; в версии 3 время сообщений
+// передается в миллисекундах.
+var protocolAdapters = map[int]protocolAdapter{
+	protocol.LegacyProtocolVersion:      unixSecondsAdapter{},
+	protocol.UnixSecondsProtocolVersion: unixSecondsAdapter{},
+	protocol.ProtocolVersion:            currentProtocolAdapter{},
+}
+
+// clientFeatures - возможности, которые сервер включает, если их заявил клиент.
+var clientFeatures = []string{protocol.FeatureRequestID, protocol.FeatureSecondFactor, protocol.FeatureBatch, protocol.FeatureReceipts, protocol.FeatureUnreadSummary}
+
+// legacyFeatures - возможности, появившиеся до HELLO. Их получают клиенты, которые не могут
+// заявить возможности сами: без HELLO и по API-токену.
+var legacyFeatures = []string{protocol.FeatureRequestID, protocol.FeatureSecondFactor}
+
+// negotiatedProtocol - версия протокола и возможности, согласованные для соединения.
+type negotiatedProtocol struct {
+	version  int
+	features map[string]bool
+	adapter  protocolAdapter
+}
+
+// has сообщает, включена ли возможность для соединения.
+func (p negotiatedProtocol) has(feature string) bool {
+	return p.features[feature]
+}
+
+// implicitProtocol - версия с возможностями, которые клиент не заявлял, но заведомо поддерживает.
+func implicitProtocol(version int) negotiatedProtocol {
+	features := make(map[string]bool)
+	for _, f := range legacyFeatures {
+		features[f] = true
+	}
+	return negotiatedProtocol{version: version, features: features, adapter: protocolAdapters[version]}
+}
+
+// legacyProtocol - протокол клиентов, которые начали соединение без HELLO.
+func legacyProtocol() negotiatedProtocol {
+	return implicitProtocol(protocol.LegacyProtocolVersion)
+}
+
+// apiTokenProtocol - версия для соединений по API-токену, в которых нет обмена сообщениями до входа.
+// Бот не может выбрать версию, поэтому получает формат, для которого он был написан: время в секундах.
+func apiTokenProtocol() negotiatedProtocol {
+	return implicitProtocol(protocol.UnixSecondsProtocolVersion)
+}
+
+// rawFrame - сообщение, прочитанное при рукопожатии, которое должен обработать AUTH_LOOP.
+type rawFrame struct {
+	messageType int
+	data        []byte
+}
+
+// serverFeatures возвращает возможности, включенные на сервере.
+func (h *Hub) serverFeatures() []string {
+	features := append([]string(nil), clientFeatures...)
+	if h.inviteOnly {
+		features = append(features, protocol.FeatureInviteOnly)
+	}
+	return features
+}
+
+// serverLimits возвращает ограничения, о которых сервер сообщает в HELLO_RESPONSE.
+func (h *Hub) serverLimits() *protocol.ServerLimits {
+	return &protocol.ServerLimits{
+		MaxMessageSize:        maxMessageSize,
+		HistoryPageSize:       defaultHistoryLimit,
+		MaxHistoryPageSize:    maxHistoryLimit,
+		MaxConnectionsPerUser: h.maxConnectionsPerUser,
+		MaxBatchSize:          maxBatchSize,
+	}
+}
+
+// negotiateProtocol выбирает версию протокола для клиента, приславшего HELLO.
+// Клиент новее сервера обслуживается по версии сервера.
+func (h *Hub) negotiateProtocol(hello protocol.HelloPayload) (negotiatedProtocol, error) {
+	version := min(hello.ProtocolVersion, protocol.ProtocolVersion)
+	if version < h.minProtocolVersion {
+		return negotiatedProtocol{}, fmt.Errorf("protocol version %d is not supported, this server requires %d to %d",
+			hello.ProtocolVersion, h.minProtocolVersion, protocol.ProtocolVersion)
+	}
+
+	features := make(map[string]bool)
+	for _, f := range hello.Features {
+		for _, supported := range clientFeatures {
+			if f == supported {
+				features[f] = true
+			}
+		}
+	}
+	return negotiatedProtocol{version: version, features: features, adapter: protocolAdapters[version]}, nil
+}
+
+// helloHandshake читает первое сообщение соединения. Если это HELLO, согласует версию протокола и отвечает
+// HELLO_RESPONSE. Иначе клиент считается клиентом версии 1, а прочитанное сообщение возвращается,
+// чтобы его обработал AUTH_LOOP. false - соединение нужно закрыть.
+func helloHandshake(hub *Hub, conn *websocket.Conn) (negotiatedProtocol, *rawFrame, bool) {
+	messageType, p, err := conn.ReadMessage()
+	if err != nil {
+		log.Printf("Auth: Read error from client %p before handshake: %v", conn, err)
+		return negotiatedProtocol{}, nil, false
+	}
+
+	codec := protocol.CodecForSubprotocol(conn.Subprotocol())
+	msg, err := codec.Decode(p)
+	if messageType != codec.FrameType() || err != nil || msg.Type != protocol.MsgTypeHello {
+		if hub.minProtocolVersion > protocol.LegacyProtocolVersion {
+			log.Printf("Auth: Client %p did not send HELLO, rejecting legacy protocol.", conn)
+			sendErrorMessage(conn, "", protocol.ErrCodeUnsupportedProtocolVersion, "This server requires a newer client. Please upgrade.")
+			closeUnsupportedProtocol(conn)
+			return negotiatedProtocol{}, nil, false
+		}
+		return legacyProtocol(), &rawFrame{messageType: messageType, data: p}, true
+	}
+
+	var hello protocol.HelloPayload
+	if err := json.Unmarshal(msg.Payload, &hello); err != nil {
+		// Версия остается нулевой, и клиент получит отказ с диапазоном поддерживаемых версий.
+		log.Printf("Auth: Failed to unmarshal Hello payload: %v\n", err)
+	}
+
+	resp := protocol.HelloResponsePayload{
+		MinProtocolVersion: hub.minProtocolVersion,
+		MaxProtocolVersion: protocol.ProtocolVersion,
+		Features:           hub.serverFeatures(),
+	}
+	proto, err := hub.negotiateProtocol(hello)
+	if err != nil {
+		log.Printf("Auth: Rejecting client %p (%s): %v", conn, hello.ClientName, err)
+		resp.ErrorCode = protocol.ErrCodeUnsupportedProtocolVersion
+		resp.ErrorMessage = err.Error()
+		sendWebSocketResponse(conn, msg.RequestID, protocol.MsgTypeHelloResponse, resp)
+		closeUnsupportedProtocol(conn)
+		return negotiatedProtocol{}, nil, false
+	}
+
+	resp.Success = true
+	resp.ProtocolVersion = proto.version
+	resp.Limits = hub.serverLimits()
+	sendWebSocketResponse(conn, msg.RequestID, protocol.MsgTypeHelloResponse, resp)
+	log.Printf("Auth: Client %p (%s) speaks protocol version %d.", conn, hello.ClientName, proto.version)
+	return proto, nil, true
+}
+
+// closeUnsupportedProtocol отправляет фрейм закрытия для клиента с неподдерживаемой версией протокола.
+func closeUnsupportedProtocol(conn *websocket.Conn) {
+	closeMessage := websocket.FormatCloseMessage(protocol.CloseCodeUnsupportedProtocol, "unsupported protocol version")
+	conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeWait))
+}
@@ -2,11 +2,13 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,17 +16,41 @@ import (
 	"github.com/vladimirruppel/messengor/internal/protocol"
 )
 
-const historyDir = "./chat_history" // Директория для хранения файлов истории
+var historyDir = "./chat_history" // Директория для хранения файлов истории, задается в InitHistoryStore
 
 var historyFileMutexes = make(map[string]*sync.Mutex) // Мьютексы для каждого файла чата
 var globalHistoryMutex = &sync.Mutex{}                // Для доступа к map historyFileMutexes
 
-// initStore проверяет и создает директорию для истории, если ее нет.
-func initHistoryStore() {
-	if err := os.MkdirAll(historyDir, 0755); err != nil {
-		log.Fatalf("Failed to create history directory %s: %v", historyDir, err)
+// Последний seq каждого чата. Значение читается из файла при первой записи в чат после запуска
+// и меняется только под мьютексом файла чата.
+var chatLastSeqs = make(map[string]uint64)
+var chatLastSeqsMutex = &sync.Mutex{} // Для доступа к map chatLastSeqs
+
+// legacyTimestampLimit - до перехода на миллисекунды время сообщений хранилось в секундах. Такие значения
+// меньше 1e12 (в миллисекундах это 2001 год), поэтому их можно отличить и привести к миллисекундам.
+const legacyTimestampLimit = 1_000_000_000_000
+
+// InitHistoryStore задает директорию для истории и создает ее, если ее нет.
+// Должна быть вызвана до начала работы хаба.
+func InitHistoryStore(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create history directory %s: %w", dir, err)
 	}
+	historyDir = dir
 	log.Printf("Chat history will be stored in: %s", historyDir)
+	return nil
+}
+
+// checkChatID проверяет, что из chatID можно построить путь внутри historyDir. Права на чат проверяют
+// обработчики; это дополнительная защита на случай, если непроверенный ID все же дойдет до хранилища.
+func checkChatID(chatID string) error {
+	if chatID == "" {
+		return fmt.Errorf("chatID cannot be empty")
+	}
+	if strings.ContainsAny(chatID, `/\`) || strings.Contains(chatID, "..") {
+		return fmt.Errorf("invalid chatID %q", chatID)
+	}
+	return nil
 }
 
 // getChatFilePath возвращает путь к файлу истории для данного ChatID.
@@ -47,9 +73,9 @@ func getFileMutex(chatID string) *sync.Mutex {
 
 // SaveMessage сохраняет сообщение в файл истории для указанного ChatID.
 func SaveMessage(chatID string, senderID string, senderName string, text string) (*protocol.StoredMessage, error) {
-	if chatID == "" { // Добавим проверку
-		log.Println("SaveMessage: Attempted to save message with empty ChatID")
-		return nil, fmt.Errorf("chatID cannot be empty")
+	if err := checkChatID(chatID); err != nil {
+		log.Printf("SaveMessage: Refusing to save message: %v", err)
+		return nil, err
 	}
 
 	fileMutex := getFileMutex(chatID)
@@ -64,13 +90,20 @@ func SaveMessage(chatID string, senderID string, senderName string, text string)
 	}
 	defer file.Close()
 
+	lastSeq, err := lastSeqLocked(chatID, file)
+	if err != nil {
+		log.Printf("Error reading last seq for chat %s: %v", chatID, err)
+		return nil, err
+	}
+
 	storedMsg := &protocol.StoredMessage{
 		ChatID:     chatID,           // Сохраняем для возможной проверки
 		MessageID:  uuid.NewString(), // Генерируем новый ID для каждого сообщения
+		Seq:        lastSeq + 1,      // Хранится в записи: после сбоя последний seq читается из файла
 		SenderID:   senderID,
 		SenderName: senderName,
 		Text:       text,
-		Timestamp:  time.Now().Unix(),
+		Timestamp:  time.Now().UnixMilli(),
 	}
 
 	messageBytes, err := json.Marshal(storedMsg)
@@ -81,22 +114,123 @@ func SaveMessage(chatID string, senderID string, senderName string, text string)
 
 	if _, err := file.Write(append(messageBytes, '\n')); err != nil {
 		log.Printf("Error writing to history file for chat %s: %v", chatID, err)
+		// Строка могла записаться частично: следующая запись перечитает файл и отрежет ее
+		chatLastSeqsMutex.Lock()
+		delete(chatLastSeqs, chatID)
+		chatLastSeqsMutex.Unlock()
 		return nil, err
 	}
+	chatLastSeqsMutex.Lock()
+	chatLastSeqs[chatID] = storedMsg.Seq
+	chatLastSeqsMutex.Unlock()
+	noteMessageSavedLocked(storedMsg)
 	// log.Printf("Message saved to chat %s: (ID: %s) %s: %s", chatID, storedMsg.MessageID, senderName, text)
 	return storedMsg, nil
 }
 
 func LoadChatHistory(chatID string, limit int) ([]protocol.StoredMessage, error) {
-	if chatID == "" {
-		log.Println("LoadChatHistory: Attempted to load history with empty ChatID")
-		return nil, fmt.Errorf("chatID cannot be empty")
+	if err := checkChatID(chatID); err != nil {
+		log.Printf("LoadChatHistory: Refusing to load history: %v", err)
+		return nil, err
 	}
 
-	fileMutex := getFileMutex(chatID) 
+	fileMutex := getFileMutex(chatID)
 	fileMutex.Lock()
 	defer fileMutex.Unlock()
 
+	messages, err := readChatMessagesLocked(chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Если есть лимит, возвращаем последние N сообщений
+	if limit > 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	log.Printf("Loaded %d messages for chat %s", len(messages), chatID)
+	return messages, nil
+}
+
+// LoadMessagesAfter возвращает до limit сообщений чата с seq больше afterSeq в порядке seq.
+// hasMore сообщает, что за ними есть еще сообщения.
+func LoadMessagesAfter(chatID string, afterSeq uint64, limit int) (messages []protocol.StoredMessage, hasMore bool, err error) {
+	if err := checkChatID(chatID); err != nil {
+		return nil, false, err
+	}
+	fileMutex := getFileMutex(chatID)
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
+	all, err := readChatMessagesLocked(chatID)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, msg := range all {
+		if msg.Seq <= afterSeq {
+			continue
+		}
+		if len(messages) == limit {
+			return messages, true, nil
+		}
+		messages = append(messages, msg)
+	}
+	return messages, false, nil
+}
+
+// lastSeqLocked возвращает seq последнего сообщения чата. Вызывающий держит мьютекс файла чата,
+// file - файл истории, открытый на дозапись. При первом обращении seq читается из последней целой
+// строки файла, а недописанный после сбоя хвост отрезается, чтобы новая запись не склеилась с ним.
+func lastSeqLocked(chatID string, file *os.File) (uint64, error) {
+	chatLastSeqsMutex.Lock()
+	seq, ok := chatLastSeqs[chatID]
+	chatLastSeqsMutex.Unlock()
+	if ok {
+		return seq, nil
+	}
+
+	data, err := os.ReadFile(getChatFilePath(chatID))
+	if err != nil {
+		return 0, err
+	}
+
+	var lineSeq uint64
+	validSize := 0
+	for validSize < len(data) {
+		end := bytes.IndexByte(data[validSize:], '\n')
+		if end < 0 {
+			break // Строка без перевода строки - недописанная запись
+		}
+		line := data[validSize : validSize+end]
+		validSize += end + 1
+		if len(line) == 0 {
+			continue
+		}
+		lineSeq++ // Как в readChatMessagesLocked: старые записи без seq нумеруются по строкам
+		var msg protocol.StoredMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			continue
+		}
+		if msg.Seq == 0 {
+			msg.Seq = lineSeq
+		}
+		if msg.Seq > seq {
+			seq = msg.Seq
+		}
+	}
+
+	if validSize < len(data) {
+		log.Printf("History file for chat %s ends with a partial record (%d bytes), truncating it.", chatID, len(data)-validSize)
+		if err := file.Truncate(int64(validSize)); err != nil {
+			return 0, fmt.Errorf("failed to truncate partial record in history of chat %s: %w", chatID, err)
+		}
+	}
+	return seq, nil
+}
+
+// readChatMessagesLocked читает все сообщения чата. Вызывающий держит мьютекс файла чата.
+// Сообщениям, сохраненным до появления seq, он назначается по номеру строки, а их время
+// приводится к миллисекундам.
+func readChatMessagesLocked(chatID string) ([]protocol.StoredMessage, error) {
 	filePath := getChatFilePath(chatID)
 	file, err := os.Open(filePath) // Открываем только на чтение
 	if err != nil {
@@ -110,10 +244,19 @@ func LoadChatHistory(chatID string, limit int) ([]protocol.StoredMessage, error)
 	defer file.Close()
 
 	var messages []protocol.StoredMessage
+	var lineSeq uint64
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		lineSeq++ // Поврежденные строки тоже занимают свой seq
 		var msg protocol.StoredMessage
 		if err := json.Unmarshal(scanner.Bytes(), &msg); err == nil {
+			if msg.Seq == 0 {
+				msg.Seq = lineSeq
+			}
+			msg.Timestamp = unixMillis(msg.Timestamp)
 			messages = append(messages, msg)
 		} else {
 			log.Printf("Error unmarshalling stored message from chat %s: %v. Line: %s", chatID, err, scanner.Text())
@@ -126,15 +269,79 @@ func LoadChatHistory(chatID string, limit int) ([]protocol.StoredMessage, error)
 		return nil, err
 	}
 
-	// Если есть лимит, возвращаем последние N сообщений
-	if limit > 0 && len(messages) > limit {
-		messages = messages[len(messages)-limit:]
-	}
-	log.Printf("Loaded %d messages for chat %s", len(messages), chatID)
 	return messages, nil
 }
 
-// Инициализация хранилища при старте пакета server
-func init() {
-	initHistoryStore()
+// unixMillis приводит сохраненное время к миллисекундам: значения из старых файлов записаны в секундах.
+func unixMillis(ts int64) int64 {
+	if ts > 0 && ts < legacyTimestampLimit {
+		return ts * 1000
+	}
+	return ts
+}
+
+// deletedUserName подставляется вместо имени отправителя после удаления его аккаунта.
+const deletedUserName = "Deleted user"
+
+// AnonymizeSenderInHistory заменяет имя отправителя senderID во всех файлах истории.
+// Каждый файл переписывается через временный файл, чтобы не повредить историю при сбое.
+func AnonymizeSenderInHistory(senderID string) error {
+	files, err := filepath.Glob(filepath.Join(historyDir, "*.jsonl"))
+	if err != nil {
+		return fmt.Errorf("failed to list history files: %w", err)
+	}
+
+	for _, filePath := range files {
+		chatID := strings.TrimSuffix(filepath.Base(filePath), ".jsonl")
+		if err := anonymizeSenderInChat(chatID, senderID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// anonymizeSenderInChat переписывает историю одного чата, если в ней есть сообщения senderID.
+func anonymizeSenderInChat(chatID, senderID string) error {
+	fileMutex := getFileMutex(chatID)
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
+	filePath := getChatFilePath(chatID)
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read history file %s: %w", filePath, err)
+	}
+
+	changed := false
+	var out bytes.Buffer
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		var msg protocol.StoredMessage
+		if err := json.Unmarshal(line, &msg); err != nil || msg.SenderID != senderID {
+			// Чужие и поврежденные строки переносим как есть
+			out.Write(line)
+			out.WriteByte('\n')
+			continue
+		}
+		msg.SenderName = deletedUserName
+		messageBytes, err := json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("failed to marshal anonymized message in chat %s: %w", chatID, err)
+		}
+		out.Write(messageBytes)
+		out.WriteByte('\n')
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if err := writeFileAtomic(filePath, out.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write anonymized history for chat %s: %w", chatID, err)
+	}
+	log.Printf("Anonymized messages of user %s in chat %s", senderID, chatID)
+	return nil
 }
@@ -1,28 +1,162 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"sync"
 
+	"github.com/gorilla/websocket"
 	"github.com/vladimirruppel/messengor/internal/protocol"
 )
 
 // Hub управляет набором активных клиентов и рассылает им сообщения.
 type Hub struct {
-	broadcast  chan []byte  // Входящие сообщения от клиентов для рассылки
-	register   chan *Client // Канал для регистрации клиентов
-	unregister chan *Client // Канал для отмены регистрации клиентов
+	broadcast  chan outgoingMessage   // Входящие сообщения от клиентов для рассылки
+	register   chan registration      // Канал для регистрации клиентов
+	unregister chan *Client           // Канал для отмены регистрации клиентов
+	disconnect chan disconnectRequest // Канал для принудительного отключения клиентов
 
-	clients      map[*Client]bool // Зарегистрированные клиенты
-	clientsMutex sync.RWMutex     // Мьютекс для защиты доступа к карте clients
+	clients      map[*Client]bool            // Зарегистрированные клиенты
+	userClients  map[string]map[*Client]bool // Соединения (устройства) каждого пользователя
+	clientsMutex sync.RWMutex                // Мьютекс для защиты доступа к картам clients и userClients
+
+	maxConnectionsPerUser int                   // 0 - без ограничения
+	connectionLimitPolicy ConnectionLimitPolicy // Что делать с соединением сверх лимита
+
+	users       UserStore      // Хранилище пользователей
+	sessions    *SessionStore  // Хранилище сессий
+	apiTokens   *APITokenStore // Токены ботов и скриптов
+	authLimiter *AuthLimiter   // Защита AUTH_LOOP от перебора паролей
+
+	registrationPolicy *RegistrationPolicy // Правила для новых логинов, паролей и имен
+	invites            *InviteStore        // Коды приглашений
+	inviteOnly         bool                // Регистрация только по коду приглашения
+
+	groups   *GroupStore   // Групповые чаты и их участники
+	channels *ChannelStore // Публичные каналы и их участники
+
+	minProtocolVersion int // Клиенты с более старой версией протокола отклоняются при HELLO
+
+	recent *recentMessages // Недавние сообщения по client_msg_id: повторная отправка не создает дубликат
+}
+
+// HubConfig содержит зависимости и настройки хаба. Незаданные хранилища NewHub создает в памяти.
+type HubConfig struct {
+	Users    UserStore
+	Sessions *SessionStore
+	// APITokens - токены, принимаемые при HTTP upgrade вместо AUTH_LOOP.
+	APITokens *APITokenStore
+	// AuthLimiter по умолчанию создается с DefaultAuthLimiterConfig.
+	AuthLimiter *AuthLimiter
+	// RegistrationPolicy по умолчанию - DefaultRegistrationPolicy().
+	RegistrationPolicy *RegistrationPolicy
+	// Invites хранит коды приглашений. InviteOnly требует код при регистрации.
+	Invites    *InviteStore
+	InviteOnly bool
+	// Groups хранит групповые чаты.
+	Groups *GroupStore
+	// Channels хранит публичные каналы.
+	Channels *ChannelStore
+
+	// MaxConnectionsPerUser ограничивает число одновременных соединений одного аккаунта (0 - без ограничения).
+	MaxConnectionsPerUser int
+	ConnectionLimitPolicy ConnectionLimitPolicy
+
+	// MinProtocolVersion - самая старая версия протокола, которую обслуживает сервер
+	// (по умолчанию protocol.LegacyProtocolVersion, то есть и клиенты без HELLO).
+	MinProtocolVersion int
+}
+
+// ConnectionLimitPolicy определяет, что происходит при превышении MaxConnectionsPerUser.
+type ConnectionLimitPolicy int
+
+const (
+	// RejectNewConnection закрывает новое соединение, уже подключенные устройства не затрагиваются.
+	RejectNewConnection ConnectionLimitPolicy = iota
+	// EvictOldestConnection закрывает самое старое соединение пользователя.
+	EvictOldestConnection
+)
+
+// ParseConnectionLimitPolicy разбирает значение флага: "reject" или "evict-oldest".
+func ParseConnectionLimitPolicy(value string) (ConnectionLimitPolicy, error) {
+	switch value {
+	case "reject":
+		return RejectNewConnection, nil
+	case "evict-oldest":
+		return EvictOldestConnection, nil
+	}
+	return 0, fmt.Errorf("unknown connection limit policy %q (expected reject or evict-oldest)", value)
+}
+
+// registration - запрос на регистрацию клиента; результат (nil или ErrConnectionLimit) возвращается в result.
+type registration struct {
+	client *Client
+	result chan error
 }
 
-func NewHub() *Hub {
+// ErrConnectionLimit - у пользователя уже открыто максимальное число соединений, а политика
+// RejectNewConnection запрещает вытеснять старые.
+var ErrConnectionLimit = errors.New("too many connections for this account")
+
+// disconnectRequest описывает, каких клиентов хаб должен отключить и с какой причиной.
+type disconnectRequest struct {
+	match     func(*Client) bool
+	closeCode int
+	reason    string
+}
+
+// NewHub создает хаб. Тестам достаточно передать только нужные хранилища.
+func NewHub(cfg HubConfig) *Hub {
+	if cfg.Users == nil {
+		cfg.Users = NewMemoryUserStore(DefaultUniquenessRules)
+	}
+	if cfg.Sessions == nil {
+		cfg.Sessions, _ = NewSessionStore("")
+	}
+	if cfg.APITokens == nil {
+		cfg.APITokens, _ = NewAPITokenStore("")
+	}
+	if cfg.Invites == nil {
+		cfg.Invites, _ = NewInviteStore("")
+	}
+	if cfg.Groups == nil {
+		cfg.Groups, _ = NewGroupStore("")
+	}
+	if cfg.Channels == nil {
+		cfg.Channels, _ = NewChannelStore("")
+	}
+	if cfg.AuthLimiter == nil {
+		cfg.AuthLimiter = NewAuthLimiter(DefaultAuthLimiterConfig, nil)
+	}
+	if cfg.RegistrationPolicy == nil {
+		cfg.RegistrationPolicy = DefaultRegistrationPolicy()
+	}
+	if cfg.MinProtocolVersion == 0 {
+		cfg.MinProtocolVersion = protocol.LegacyProtocolVersion
+	}
 	return &Hub{
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
+		broadcast:          make(chan outgoingMessage),
+		register:           make(chan registration),
+		unregister:         make(chan *Client),
+		disconnect:         make(chan disconnectRequest),
+		clients:            make(map[*Client]bool),
+		userClients:        make(map[string]map[*Client]bool),
+		users:              cfg.Users,
+		sessions:           cfg.Sessions,
+		apiTokens:          cfg.APITokens,
+		authLimiter:        cfg.AuthLimiter,
+		registrationPolicy: cfg.RegistrationPolicy,
+		invites:            cfg.Invites,
+		inviteOnly:         cfg.InviteOnly,
+		groups:             cfg.Groups,
+		channels:           cfg.Channels,
+
+		maxConnectionsPerUser: cfg.MaxConnectionsPerUser,
+		connectionLimitPolicy: cfg.ConnectionLimitPolicy,
+		minProtocolVersion:    cfg.MinProtocolVersion,
+
+		recent: newRecentMessages(),
 	}
 }
 
@@ -30,25 +164,17 @@ func NewHub() *Hub {
 func (h *Hub) Run() {
 	for {
 		select {
-		case client := <-h.register:
+		case reg := <-h.register:
 			h.clientsMutex.Lock()
-			h.clients[client] = true
+			err := h.registerLocked(reg.client)
 			h.clientsMutex.Unlock()
-			if client.IsAuthenticated {
-				log.Printf("Hub: Client %s (ID: %s) registered. Total clients: %d", client.DisplayName, client.UserID, len(h.clients))
-			} else {
-				log.Printf("Hub: New client (conn: %p) registered (pending authentication). Total clients: %d", client.conn, len(h.clients))
-			}
+			reg.result <- err
 
 		case client := <-h.unregister:
 			h.clientsMutex.Lock()
 			// Клиент отключается. Проверяем, есть ли он в нашей карте.
 			if _, ok := h.clients[client]; ok {
-				// Удаляем клиента из карты.
-				delete(h.clients, client)
-				// Закрываем его канал `send`, чтобы `writePump` этого клиента завершился.
-				close(client.send)
-
+				h.removeLocked(client, websocket.CloseNormalClosure, "")
 				if client.IsAuthenticated {
 					log.Printf("Hub: Client %s (ID: %s) unregistered. Total clients: %d", client.DisplayName, client.UserID, len(h.clients))
 				} else {
@@ -57,14 +183,23 @@ func (h *Hub) Run() {
 			}
 			h.clientsMutex.Unlock()
 
+		case req := <-h.disconnect:
+			h.clientsMutex.Lock()
+			for client := range h.clients {
+				if !req.match(client) {
+					continue
+				}
+				h.removeLocked(client, req.closeCode, req.reason)
+				log.Printf("Hub: Client %s (ID: %s) disconnected: %s. Total clients: %d", client.DisplayName, client.UserID, req.reason, len(h.clients))
+			}
+			h.clientsMutex.Unlock()
+
 		case message := <-h.broadcast:
 			h.clientsMutex.RLock()
-			log.Printf("Hub: Broadcasting message to %d clients. Message approx: %s", len(h.clients), string(message))
+			log.Printf("Hub: Broadcasting %s to %d clients.", message.Type, len(h.clients))
 			for client := range h.clients {
 				if client.IsAuthenticated {
-					select {
-					case client.send <- message:
-					default:
+					if !client.enqueue(message) {
 						log.Printf("Hub: Client %s (ID: %s) send channel full/closed during broadcast. Initiating unregister.", client.DisplayName, client.UserID)
 						go func(clToUnregister *Client) {
 							h.unregister <- clToUnregister
@@ -77,6 +212,73 @@ func (h *Hub) Run() {
 	}
 }
 
+// Register регистрирует клиента в хабе. Возвращает ErrConnectionLimit, если соединение отклонено
+// по лимиту; тогда клиент в хаб не попадает, и закрыть соединение должен вызывающий.
+func (h *Hub) Register(client *Client) error {
+	result := make(chan error, 1)
+	h.register <- registration{client: client, result: result}
+	return <-result
+}
+
+// registerLocked добавляет клиента с учетом лимита соединений на пользователя.
+// Вызывается при захваченном clientsMutex.
+func (h *Hub) registerLocked(client *Client) error {
+	if !client.IsAuthenticated {
+		h.clients[client] = true
+		log.Printf("Hub: New client (conn: %p) registered (pending authentication). Total clients: %d", client.conn, len(h.clients))
+		return nil
+	}
+
+	devices := h.userClients[client.UserID]
+	if h.maxConnectionsPerUser > 0 && len(devices) >= h.maxConnectionsPerUser {
+		if h.connectionLimitPolicy == RejectNewConnection {
+			log.Printf("Hub: Rejecting connection of %s (ID: %s): %d connections already open", client.DisplayName, client.UserID, len(devices))
+			return ErrConnectionLimit
+		}
+		for len(devices) >= h.maxConnectionsPerUser {
+			oldest := oldestClient(devices)
+			log.Printf("Hub: Evicting oldest connection of %s (ID: %s) to admit a new one", oldest.DisplayName, oldest.UserID)
+			h.removeLocked(oldest, protocol.CloseCodeEvicted, "signed in on another device")
+		}
+	}
+
+	h.clients[client] = true
+	if devices = h.userClients[client.UserID]; devices == nil {
+		devices = make(map[*Client]bool)
+		h.userClients[client.UserID] = devices
+	}
+	devices[client] = true
+	log.Printf("Hub: Client %s (ID: %s) registered (%d device(s)). Total clients: %d", client.DisplayName, client.UserID, len(devices), len(h.clients))
+	// Отдельная горутина: доставке нужна та же блокировка на чтение, а хаб держит ее на запись.
+	go h.deliverPendingMessages(client)
+	return nil
+}
+
+// removeLocked удаляет клиента из карт и отключает его через closeSend: writePump допишет очередь,
+// отправит фрейм закрытия с указанными кодом и причиной и завершится.
+// Вызывается при захваченном clientsMutex.
+func (h *Hub) removeLocked(client *Client, closeCode int, reason string) {
+	delete(h.clients, client)
+	if devices, ok := h.userClients[client.UserID]; ok {
+		delete(devices, client)
+		if len(devices) == 0 {
+			delete(h.userClients, client.UserID)
+		}
+	}
+	client.closeSend(closeCode, reason)
+}
+
+// oldestClient возвращает соединение, установленное раньше остальных.
+func oldestClient(clients map[*Client]bool) *Client {
+	var oldest *Client
+	for c := range clients {
+		if oldest == nil || c.connectedAt.Before(oldest.connectedAt) {
+			oldest = c
+		}
+	}
+	return oldest
+}
+
 // getClientCount возвращает текущее количество клиентов (вспомогательная функция для использования внутри Lock/RLock).
 // Эту функцию лучше вызывать, когда мьютекс уже захвачен.
 func (h *Hub) getClientCount() int {
@@ -84,34 +286,249 @@ func (h *Hub) getClientCount() int {
 }
 
 // GetAuthenticatedUsersInfo возвращает список информации об аутентифицированных пользователях,
-// исключая пользователя с excludeUserID.
+// исключая пользователя с excludeUserID. Пользователь с несколькими устройствами попадает в список один раз.
 func (h *Hub) GetAuthenticatedUsersInfo(excludeUserID string) []protocol.UserInfo {
 	h.clientsMutex.RLock()
 	defer h.clientsMutex.RUnlock()
 
 	var usersInfo []protocol.UserInfo
-	for client := range h.clients {
-		if client.IsAuthenticated && client.UserID != excludeUserID {
-			usersInfo = append(usersInfo, protocol.UserInfo{
+	for userID, devices := range h.userClients {
+		if userID == excludeUserID {
+			continue
+		}
+		for client := range devices {
+			info := protocol.UserInfo{
 				UserID:      client.UserID,
 				DisplayName: client.DisplayName,
-				IsOnline:    true, // Если клиент в хабе и аутентифицирован, он онлайн
-			})
+				IsOnline:    true, // Пользователь онлайн, пока подключено хотя бы одно его устройство
+			}
+			if user, err := h.users.GetByID(userID); err == nil {
+				info.Role = string(user.EffectiveRole())
+			}
+			usersInfo = append(usersInfo, info)
+			break
 		}
 	}
 	return usersInfo
 }
 
-// FindClientByUserID ищет активного и аутентифицированного клиента по его UserID.
-func (h *Hub) FindClientByUserID(userID string) (*Client, bool) {
+// FindClientsByUserID возвращает все активные соединения (устройства) пользователя.
+func (h *Hub) FindClientsByUserID(userID string) []*Client {
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+
+	devices := h.userClients[userID]
+	clients := make([]*Client, 0, len(devices))
+	for client := range devices {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// IsUserOnline сообщает, подключено ли хотя бы одно устройство пользователя.
+func (h *Hub) IsUserOnline(userID string) bool {
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+	return len(h.userClients[userID]) > 0
+}
+
+// SendToUser отправляет сообщение на все устройства пользователя и возвращает их количество.
+func (h *Hub) SendToUser(userID string, msgType string, payload interface{}) int {
+	return h.sendToUserExcept(userID, nil, msgType, payload)
+}
+
+// sendToUserExcept работает как SendToUser, но пропускает устройство except:
+// ему сообщение отправляется отдельно, как ответ на его запрос.
+func (h *Hub) sendToUserExcept(userID string, except *Client, msgType string, payload interface{}) int {
+	// Держим блокировку на время отправки: набор устройств не меняется, пока им рассылается
+	// сообщение, а sendResponse не блокируется.
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+	return h.sendToUserLocked(userID, except, msgType, payload)
+}
+
+// sendToUserOrQueue работает как sendToUserExcept, но если у пользователя нет ни одного устройства,
+// вызывает queue. queue пишет на диск, поэтому выполняется без блокировки хаба, но под мьютексом
+// доставки пользователя: вошедшее в это время устройство прочитает очередь уже с этим сообщением.
+func (h *Hub) sendToUserOrQueue(userID string, except *Client, msgType string, payload interface{}, queue func()) int {
+	deliveryMutex := getPendingDeliveryMutex(userID)
+	deliveryMutex.Lock()
+	defer deliveryMutex.Unlock()
+
+	h.clientsMutex.RLock()
+	if len(h.userClients[userID]) > 0 {
+		defer h.clientsMutex.RUnlock()
+		return h.sendToUserLocked(userID, except, msgType, payload)
+	}
+	h.clientsMutex.RUnlock()
+
+	queue()
+	return 0
+}
+
+// sendToUsers отправляет сообщение устройствам пользователей userIDs, кроме except, под одной
+// блокировкой. В отличие от рассылки в Run, его получают только эти пользователи.
+func (h *Hub) sendToUsers(userIDs []string, except *Client, msgType string, payload interface{}) int {
 	h.clientsMutex.RLock()
 	defer h.clientsMutex.RUnlock()
 
-	for client := range h.clients {
-		// Убедимся, что ищем только среди аутентифицированных клиентов
-		if client.IsAuthenticated && client.UserID == userID {
-			return client, true
+	sent := 0
+	for _, userID := range userIDs {
+		sent += h.sendToUserLocked(userID, except, msgType, payload)
+	}
+	return sent
+}
+
+// sendToUserLocked отправляет сообщение устройствам пользователя, кроме except.
+// Вызывается при захваченном clientsMutex.
+func (h *Hub) sendToUserLocked(userID string, except *Client, msgType string, payload interface{}) int {
+	devices := h.userClients[userID]
+	for client := range devices {
+		if client != except {
+			client.sendResponse("", msgType, payload)
 		}
 	}
-	return nil, false
+	return len(devices)
+}
+
+// sendToUserWithFeature отправляет сообщение только тем устройствам пользователя,
+// которые согласовали возможность feature; остальные не поняли бы этот тип сообщения.
+func (h *Hub) sendToUserWithFeature(userID string, feature string, msgType string, payload interface{}) int {
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+
+	sent := 0
+	for client := range h.userClients[userID] {
+		if client.proto.has(feature) {
+			client.sendResponse("", msgType, payload)
+			sent++
+		}
+	}
+	return sent
+}
+
+// deliverPendingMessages отправляет только что вошедшему устройству личные сообщения, сохраненные,
+// пока пользователь был не в сети. Если их больше pendingSummaryThreshold, клиент с FeatureUnreadSummary
+// получает сводку UNREAD_SUMMARY_NOTIFY; остальные получают не больше maxPendingNotifies сообщений
+// за вход, чтобы не переполнить очередь отправки. Из очереди доставки удаляются только сообщения,
+// поставленные в очередь отправки клиента; остальные дождутся следующего входа.
+func (h *Hub) deliverPendingMessages(client *Client) {
+	deliveryMutex := getPendingDeliveryMutex(client.UserID)
+	deliveryMutex.Lock()
+	defer deliveryMutex.Unlock()
+
+	h.clientsMutex.RLock()
+	registered := h.clients[client]
+	h.clientsMutex.RUnlock()
+	if !registered {
+		return // Устройство уже отключилось; очередь дождется следующего входа
+	}
+
+	summary := client.proto.has(protocol.FeatureUnreadSummary)
+	limit := maxPendingNotifies
+	if summary {
+		limit = 0
+	}
+	deliveries, err := PeekPendingDeliveries(client.UserID, limit)
+	if err != nil {
+		log.Printf("Hub: Error reading pending deliveries of %s (ID: %s): %v", client.DisplayName, client.UserID, err)
+		return
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+
+	var delivered []string
+	if summary && len(deliveries) > pendingSummaryThreshold {
+		payload := unreadSummary(deliveries)
+		log.Printf("Hub: Sending unread summary to %s (ID: %s): %d message(s) in %d chat(s)", client.DisplayName, client.UserID, payload.TotalUnread, len(payload.Chats))
+		if client.enqueue(outgoingMessage{Type: protocol.MsgTypeUnreadSummaryNotify, Payload: payload}) {
+			for _, d := range deliveries {
+				delivered = append(delivered, d.MessageID)
+			}
+		}
+	} else {
+		delivered = sendPendingNotifies(client, deliveries)
+	}
+
+	if err := AckPendingDeliveries(client.UserID, delivered); err != nil {
+		log.Printf("Hub: Error removing delivered messages from the queue of %s (ID: %s): %v", client.DisplayName, client.UserID, err)
+	}
+}
+
+// sendPendingNotifies ставит сообщения очереди доставки в очередь отправки клиента по порядку и
+// возвращает ID тех, что можно удалить из очереди доставки. Если очередь отправки заполнилась,
+// оставшиеся сообщения не отправляются, чтобы при следующем входе прийти в том же порядке.
+func sendPendingNotifies(client *Client, deliveries []pendingDelivery) []string {
+	notifies, err := pendingNotifies(client.UserID, deliveries)
+	if err != nil {
+		log.Printf("Hub: Error loading pending messages of %s (ID: %s): %v", client.DisplayName, client.UserID, err)
+	}
+	log.Printf("Hub: Delivering %d pending message(s) to %s (ID: %s)", len(notifies), client.DisplayName, client.UserID)
+
+	var delivered []string
+	for _, notify := range notifies {
+		if !client.enqueue(outgoingMessage{Type: protocol.MsgTypeNewPrivateMessageNotify, Payload: notify}) {
+			log.Printf("Hub: Send queue of %s (ID: %s) is full or closed, %d pending message(s) left for the next login",
+				client.DisplayName, client.UserID, len(deliveries)-len(delivered))
+			return delivered
+		}
+		delivered = append(delivered, notify.MessageID)
+	}
+	if err == nil {
+		// Сообщения, которых нет в истории (например, чат удален), доставить уже нельзя
+		found := make(map[string]bool, len(notifies))
+		for _, notify := range notifies {
+			found[notify.MessageID] = true
+		}
+		for _, d := range deliveries {
+			if !found[d.MessageID] {
+				delivered = append(delivered, d.MessageID)
+			}
+		}
+	}
+	return delivered
+}
+
+// DisconnectSession закрывает все соединения, вошедшие по указанному токену сессии.
+func (h *Hub) DisconnectSession(sessionToken string, reason string) {
+	h.disconnect <- disconnectRequest{
+		match:     func(c *Client) bool { return c.IsAuthenticated && c.SessionToken == sessionToken },
+		closeCode: websocket.CloseNormalClosure,
+		reason:    reason,
+	}
+}
+
+// DisconnectUser закрывает все соединения пользователя.
+func (h *Hub) DisconnectUser(userID string, reason string) {
+	h.disconnect <- disconnectRequest{
+		match:     func(c *Client) bool { return c.IsAuthenticated && c.UserID == userID },
+		closeCode: websocket.CloseNormalClosure,
+		reason:    reason,
+	}
+}
+
+// DisconnectAPIToken закрывает все соединения, установленные по API-токену с указанным ID.
+func (h *Hub) DisconnectAPIToken(tokenID string, reason string) {
+	h.disconnect <- disconnectRequest{
+		match:     func(c *Client) bool { return c.IsAuthenticated && c.apiTokenID == tokenID },
+		closeCode: websocket.CloseNormalClosure,
+		reason:    reason,
+	}
+}
+
+// registrationInvites возвращает хранилище приглашений, если регистрация возможна только по ним.
+func (h *Hub) registrationInvites() *InviteStore {
+	if !h.inviteOnly {
+		return nil
+	}
+	return h.invites
+}
+
+// terminateUserSessions отзывает все сессии пользователя и отключает все его соединения.
+func (h *Hub) terminateUserSessions(userID string, reason string) {
+	if _, err := h.sessions.RevokeUser(userID); err != nil {
+		log.Printf("Hub: Error revoking sessions of user %s (%s): %v", userID, reason, err)
+	}
+	h.DisconnectUser(userID, reason)
 }
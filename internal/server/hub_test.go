@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+func TestNewHubDefaultsMissingStores(t *testing.T) {
+	// Хранилища в памяти не создают файлов: тест запускается в каталоге пакета
+	hub := NewHub(HubConfig{})
+
+	if _, err := hub.users.List(); err != nil {
+		t.Fatalf("users.List: %v", err)
+	}
+	if _, _, err := hub.sessions.Create("u1"); err != nil {
+		t.Fatalf("sessions.Create: %v", err)
+	}
+	if _, _, err := hub.apiTokens.Create("u1", "bot", []Permission{PermSendGlobal}); err != nil {
+		t.Fatalf("apiTokens.Create: %v", err)
+	}
+	if _, err := hub.invites.Create("u1", 1, 0); err != nil {
+		t.Fatalf("invites.Create: %v", err)
+	}
+	group, err := hub.groups.Create("u1", "team", nil)
+	if err != nil {
+		t.Fatalf("groups.Create: %v", err)
+	}
+	if !hub.groups.IsMember(group.ID, "u1") {
+		t.Fatal("group owner is not a member")
+	}
+	if !hub.channels.Exists(protocol.DefaultChannelName) {
+		t.Fatalf("default channel %q is missing", protocol.DefaultChannelName)
+	}
+}
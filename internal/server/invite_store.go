@@ -0,0 +1,242 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+// Invite - код приглашения, без которого в режиме "только по приглашениям" нельзя зарегистрироваться.
+type Invite struct {
+	Code      string    `json:"code"`
+	CreatedBy string    `json:"created_by"` // ID администратора
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`        // Нулевое время - без срока действия
+	MaxUses   int       `json:"max_uses"`          // 1 - одноразовый код
+	UsedBy    []string  `json:"used_by,omitempty"` // ID созданных по коду аккаунтов
+	Revoked   bool      `json:"revoked,omitempty"`
+}
+
+// Максимальное число использований, которое можно задать одному коду.
+const maxInviteUses = 1000
+
+var (
+	ErrInviteRequired = errors.New("an invite code is required to register")
+	ErrInviteNotFound = errors.New("invite code not found")
+	ErrInviteExpired  = errors.New("invite code has expired")
+	ErrInviteUsedUp   = errors.New("invite code has already been used")
+	ErrInviteRevoked  = errors.New("invite code has been revoked")
+)
+
+// InviteStorePath возвращает путь к файлу приглашений рядом с файлом пользователей.
+func InviteStorePath(usersPath string) string {
+	return filepath.Join(filepath.Dir(usersPath), "invites_data.json")
+}
+
+// InviteStore хранит коды приглашений в памяти и сохраняет их в JSON-файл после каждого изменения.
+type InviteStore struct {
+	path    string
+	mu      sync.Mutex
+	invites map[string]*Invite // Ключ - код
+}
+
+// NewInviteStore загружает приглашения из файла path.
+// Пустой path - хранилище только в памяти.
+func NewInviteStore(path string) (*InviteStore, error) {
+	s := &InviteStore{path: path, invites: make(map[string]*Invite)}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil // Приглашений еще нет
+		}
+		return nil, fmt.Errorf("failed to read invite data file '%s': %w", path, err)
+	}
+	if len(data) == 0 {
+		return s, nil
+	}
+
+	if err := json.Unmarshal(data, &s.invites); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal invite data from '%s': %w", path, err)
+	}
+
+	log.Printf("Successfully loaded %d invites from '%s'.", len(s.invites), path)
+	return s, nil
+}
+
+// save сохраняет приглашения в JSON-файл. Вызывается при захваченном s.mu.
+func (s *InviteStore) save() error {
+	if s.path == "" {
+		return nil // Хранилище только в памяти
+	}
+	data, err := json.MarshalIndent(s.invites, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal invite store: %w", err)
+	}
+	if err := writeFileAtomic(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write invite data to file '%s': %w", s.path, err)
+	}
+	return nil
+}
+
+// newInviteCode генерирует короткий код, который удобно передать и набрать вручную.
+func newInviteCode() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate invite code: %w", err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf), nil
+}
+
+// normalizeInviteCode позволяет вводить код в любом регистре и с пробелами по краям.
+func normalizeInviteCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Create выпускает код на maxUses регистраций. ttl <= 0 - код без срока действия.
+func (s *InviteStore) Create(createdBy string, maxUses int, ttl time.Duration) (*Invite, error) {
+	if maxUses < 1 || maxUses > maxInviteUses {
+		return nil, fmt.Errorf("%w: max uses must be between 1 and %d", ErrInvalidRequest, maxInviteUses)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code, err := newInviteCode()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	invite := &Invite{Code: code, CreatedBy: createdBy, CreatedAt: now, MaxUses: maxUses}
+	if ttl > 0 {
+		invite.ExpiresAt = now.Add(ttl)
+	}
+
+	s.invites[code] = invite
+	if err := s.save(); err != nil {
+		delete(s.invites, code)
+		return nil, fmt.Errorf("failed to save new invite: %w", err)
+	}
+	return invite.clone(), nil
+}
+
+// Redeem проверяет код и засчитывает его использование аккаунтом userID.
+// Если создать аккаунт затем не удалось, использование нужно вернуть через Release.
+func (s *InviteStore) Redeem(code, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	invite, exists := s.invites[normalizeInviteCode(code)]
+	if !exists {
+		return ErrInviteNotFound
+	}
+	if err := invite.usable(time.Now().UTC()); err != nil {
+		return err
+	}
+
+	invite.UsedBy = append(invite.UsedBy, userID)
+	if err := s.save(); err != nil {
+		invite.UsedBy = invite.UsedBy[:len(invite.UsedBy)-1]
+		return fmt.Errorf("failed to save invite use: %w", err)
+	}
+	return nil
+}
+
+// Release отменяет использование кода аккаунтом userID, который так и не был создан.
+func (s *InviteStore) Release(code, userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	invite, exists := s.invites[normalizeInviteCode(code)]
+	if !exists {
+		return
+	}
+	for i, id := range invite.UsedBy {
+		if id == userID {
+			invite.UsedBy = append(invite.UsedBy[:i], invite.UsedBy[i+1:]...)
+			if err := s.save(); err != nil {
+				log.Printf("Error saving invites after releasing code %s: %v", invite.Code, err)
+			}
+			return
+		}
+	}
+}
+
+// Revoke делает код недействительным. История его использований сохраняется.
+func (s *InviteStore) Revoke(code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	invite, exists := s.invites[normalizeInviteCode(code)]
+	if !exists {
+		return ErrInviteNotFound
+	}
+	invite.Revoked = true
+	if err := s.save(); err != nil {
+		return fmt.Errorf("failed to save revoked invite: %w", err)
+	}
+	return nil
+}
+
+// List возвращает все приглашения, от новых к старым.
+func (s *InviteStore) List() []*Invite {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	invites := make([]*Invite, 0, len(s.invites))
+	for _, inv := range s.invites {
+		invites = append(invites, inv.clone())
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].CreatedAt.After(invites[j].CreatedAt) })
+	return invites
+}
+
+// usable проверяет, можно ли еще зарегистрироваться по коду.
+func (inv *Invite) usable(now time.Time) error {
+	switch {
+	case inv.Revoked:
+		return ErrInviteRevoked
+	case !inv.ExpiresAt.IsZero() && now.After(inv.ExpiresAt):
+		return ErrInviteExpired
+	case len(inv.UsedBy) >= inv.MaxUses:
+		return ErrInviteUsedUp
+	}
+	return nil
+}
+
+func (inv *Invite) clone() *Invite {
+	c := *inv
+	c.UsedBy = append([]string(nil), inv.UsedBy...)
+	return &c
+}
+
+// info переводит приглашение в описание для протокола.
+func (inv *Invite) info() protocol.InviteInfo {
+	info := protocol.InviteInfo{
+		Code:      inv.Code,
+		CreatedBy: inv.CreatedBy,
+		CreatedAt: inv.CreatedAt.Unix(),
+		MaxUses:   inv.MaxUses,
+		Uses:      len(inv.UsedBy),
+		UsedBy:    inv.UsedBy,
+		Revoked:   inv.Revoked,
+	}
+	if !inv.ExpiresAt.IsZero() {
+		info.ExpiresAt = inv.ExpiresAt.Unix()
+	}
+	return info
+}
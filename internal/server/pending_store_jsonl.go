@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+const (
+	// pendingSummaryThreshold - сколько сообщений, пришедших без пользователя, доставляется при входе по одному;
+	// если их больше, клиент с FeatureUnreadSummary получает сводку.
+	pendingSummaryThreshold = 20
+	// maxPendingNotifies - сколько таких сообщений за один вход получает клиент без сводки.
+	// Меньше буфера канала send, чтобы доставка не переполнила его.
+	maxPendingNotifies = 100
+)
+
+// pendingDelivery - отметка о личном сообщении, сохраненном, пока получатель был не в сети.
+// Само сообщение хранится в истории чата; отметка нужна, чтобы доставить его при следующем входе.
+type pendingDelivery struct {
+	ChatID     string `json:"chat_id"`
+	MessageID  string `json:"message_id"`
+	Seq        uint64 `json:"seq"`
+	SenderID   string `json:"sender_id"`
+	SenderName string `json:"sender_name"`
+}
+
+// getPendingFilePath возвращает путь к очереди доставки пользователя. Расширение отличается от .jsonl,
+// чтобы файл не принимался за историю чата.
+func getPendingFilePath(userID string) string {
+	return filepath.Join(historyDir, fmt.Sprintf("%s.pending", userID))
+}
+
+// getPendingMutex возвращает мьютекс очереди пользователя. Ключ не пересекается с ID чатов,
+// поэтому используется общая карта мьютексов истории.
+func getPendingMutex(userID string) *sync.Mutex {
+	return getFileMutex("pending:" + userID)
+}
+
+// QueuePendingDelivery добавляет сохраненное сообщение в очередь доставки получателя recipientID.
+func QueuePendingDelivery(recipientID string, msg *protocol.StoredMessage) error {
+	fileMutex := getPendingMutex(recipientID)
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
+	record := pendingDelivery{
+		ChatID:     msg.ChatID,
+		MessageID:  msg.MessageID,
+		Seq:        msg.Seq,
+		SenderID:   msg.SenderID,
+		SenderName: msg.SenderName,
+	}
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pending delivery for user %s: %w", recipientID, err)
+	}
+
+	file, err := os.OpenFile(getPendingFilePath(recipientID), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open pending deliveries file for user %s: %w", recipientID, err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(recordBytes, '\n')); err != nil {
+		return fmt.Errorf("failed to write pending delivery for user %s: %w", recipientID, err)
+	}
+	return nil
+}
+
+// getPendingDeliveryMutex возвращает мьютекс доставки пользователю: под ним проверяется, в сети ли
+// получатель, и ставится в очередь сообщение, а при входе очередь читается, отправляется и подтверждается.
+// Так сообщение не попадет в очередь в промежутке между ее чтением и подтверждением.
+func getPendingDeliveryMutex(userID string) *sync.Mutex {
+	return getFileMutex("delivery:" + userID)
+}
+
+// PeekPendingDeliveries возвращает из очереди доставки пользователя не больше limit самых старых отметок
+// (0 - все), не удаляя их. Доставленные отметки удаляются AckPendingDeliveries.
+func PeekPendingDeliveries(userID string, limit int) ([]pendingDelivery, error) {
+	fileMutex := getPendingMutex(userID)
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
+	deliveries, err := readPendingLocked(userID)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+// AckPendingDeliveries удаляет из очереди доставки пользователя отметки сообщений messageIDs.
+// Остальные отметки, в том числе добавленные после PeekPendingDeliveries, остаются в очереди.
+func AckPendingDeliveries(userID string, messageIDs []string) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+	acked := make(map[string]bool, len(messageIDs))
+	for _, id := range messageIDs {
+		acked[id] = true
+	}
+
+	fileMutex := getPendingMutex(userID)
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
+	deliveries, err := readPendingLocked(userID)
+	if err != nil {
+		return err
+	}
+	var rest []byte
+	for _, record := range deliveries {
+		if acked[record.MessageID] {
+			continue
+		}
+		recordBytes, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal pending delivery for user %s: %w", userID, err)
+		}
+		rest = append(append(rest, recordBytes...), '\n')
+	}
+
+	filePath := getPendingFilePath(userID)
+	if len(rest) == 0 {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to clear pending deliveries of user %s: %w", userID, err)
+		}
+		return nil
+	}
+	if err := writeFileAtomic(filePath, rest, 0644); err != nil {
+		return fmt.Errorf("failed to rewrite pending deliveries of user %s: %w", userID, err)
+	}
+	return nil
+}
+
+// readPendingLocked читает очередь доставки пользователя. Вызывающий держит мьютекс очереди.
+func readPendingLocked(userID string) ([]pendingDelivery, error) {
+	file, err := os.Open(getPendingFilePath(userID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // Очередь пуста
+		}
+		return nil, fmt.Errorf("failed to open pending deliveries file for user %s: %w", userID, err)
+	}
+	defer file.Close()
+
+	var deliveries []pendingDelivery
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record pendingDelivery
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf("Error unmarshalling pending delivery for user %s: %v. Line: %s", userID, err, scanner.Text())
+			continue // Пропускаем поврежденную строку
+		}
+		deliveries = append(deliveries, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan pending deliveries file for user %s: %w", userID, err)
+	}
+	return deliveries, nil
+}
+
+// DeletePendingDeliveries удаляет очередь доставки пользователя (например, при удалении аккаунта).
+func DeletePendingDeliveries(userID string) error {
+	fileMutex := getPendingMutex(userID)
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
+	if err := os.Remove(getPendingFilePath(userID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete pending deliveries of user %s: %w", userID, err)
+	}
+	return nil
+}
+
+// unreadSummary группирует очередь доставки по чатам в порядке первого сообщения каждого чата.
+func unreadSummary(deliveries []pendingDelivery) protocol.UnreadSummaryPayload {
+	payload := protocol.UnreadSummaryPayload{TotalUnread: len(deliveries)}
+	byChat := make(map[string]int) // ChatID -> индекс в payload.Chats
+	for _, d := range deliveries {
+		i, ok := byChat[d.ChatID]
+		if !ok {
+			i = len(payload.Chats)
+			byChat[d.ChatID] = i
+			payload.Chats = append(payload.Chats, protocol.UnreadChatSummary{ChatID: d.ChatID, FirstSeq: d.Seq})
+		}
+		chat := &payload.Chats[i]
+		chat.SenderID = d.SenderID
+		chat.SenderName = d.SenderName
+		chat.UnreadCount++
+		chat.LastSeq = d.Seq
+	}
+	return payload
+}
+
+// pendingNotifies загружает из истории сообщения очереди доставки получателя recipientID.
+// Сообщения, которые не удалось загрузить, пропускаются; возвращается первая ошибка.
+func pendingNotifies(recipientID string, deliveries []pendingDelivery) ([]protocol.NewPrivateMessageNotifyPayload, error) {
+	type seqRange struct{ first, last uint64 }
+	ranges := make(map[string]seqRange)
+	for _, d := range deliveries {
+		r, ok := ranges[d.ChatID]
+		if !ok || d.Seq < r.first {
+			r.first = d.Seq
+		}
+		if d.Seq > r.last {
+			r.last = d.Seq
+		}
+		ranges[d.ChatID] = r
+	}
+
+	var firstErr error
+	messages := make(map[string]protocol.StoredMessage)
+	for chatID, r := range ranges {
+		loaded, _, err := LoadMessagesAfter(chatID, r.first-1, int(r.last-r.first+1))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, msg := range loaded {
+			messages[msg.MessageID] = msg
+		}
+	}
+
+	notifies := make([]protocol.NewPrivateMessageNotifyPayload, 0, len(deliveries))
+	for _, d := range deliveries {
+		msg, ok := messages[d.MessageID]
+		if !ok {
+			continue
+		}
+		notifies = append(notifies, protocol.NewPrivateMessageNotifyPayload{
+			ChatID:     msg.ChatID,
+			MessageID:  msg.MessageID,
+			Seq:        msg.Seq,
+			SenderID:   msg.SenderID,
+			SenderName: msg.SenderName,
+			ReceiverID: recipientID,
+			Text:       msg.Text,
+			Timestamp:  msg.Timestamp,
+		})
+	}
+	return notifies, firstErr
+}
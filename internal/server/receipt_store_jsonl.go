@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+// receiptRecord - строка файла отметок: получатель userID получил или прочитал сообщение.
+type receiptRecord struct {
+	MessageID string `json:"message_id"`
+	UserID    string `json:"user_id"`
+	Status    string `json:"status"`    // protocol.ReceiptStatus*
+	Timestamp int64  `json:"timestamp"` // Unix, миллисекунды
+}
+
+// messageReceipt - итоговые отметки сообщения: первая доставка и первое прочтение.
+type messageReceipt struct {
+	DeliveredAt int64
+	ReadAt      int64
+}
+
+// chatReceiptCache - кэш чата для отметок, чтобы подтверждение не перечитывало историю и файл
+// отметок целиком. Оба поля заполняются при первом обращении (nil - еще не прочитано) и меняются
+// только под мьютексом файла чата.
+type chatReceiptCache struct {
+	senders  map[string]string // message_id -> sender_id сообщений истории
+	receipts map[string]messageReceipt
+}
+
+var receiptCaches = make(map[string]*chatReceiptCache)
+var receiptCachesMutex = &sync.Mutex{} // Для доступа к map receiptCaches
+
+// getReceiptCache возвращает кэш отметок чата, создавая его при необходимости.
+func getReceiptCache(chatID string) *chatReceiptCache {
+	receiptCachesMutex.Lock()
+	defer receiptCachesMutex.Unlock()
+
+	c, exists := receiptCaches[chatID]
+	if !exists {
+		c = &chatReceiptCache{}
+		receiptCaches[chatID] = c
+	}
+	return c
+}
+
+// sendersLocked возвращает отправителей сообщений чата. Вызывающий держит мьютекс файла чата.
+func (c *chatReceiptCache) sendersLocked(chatID string) (map[string]string, error) {
+	if c.senders == nil {
+		messages, err := readChatMessagesLocked(chatID)
+		if err != nil {
+			return nil, err
+		}
+		senders := make(map[string]string, len(messages))
+		for _, msg := range messages {
+			senders[msg.MessageID] = msg.SenderID
+		}
+		c.senders = senders
+	}
+	return c.senders, nil
+}
+
+// receiptsLocked возвращает отметки чата. Вызывающий держит мьютекс файла чата.
+func (c *chatReceiptCache) receiptsLocked(chatID string) (map[string]messageReceipt, error) {
+	if c.receipts == nil {
+		receipts, err := readReceiptsLocked(chatID)
+		if err != nil {
+			return nil, err
+		}
+		c.receipts = receipts
+	}
+	return c.receipts, nil
+}
+
+// noteMessageSavedLocked добавляет новое сообщение в кэш отправителей, если он уже прочитан.
+// Вызывается из SaveMessage под мьютексом файла чата.
+func noteMessageSavedLocked(msg *protocol.StoredMessage) {
+	if c := getReceiptCache(msg.ChatID); c.senders != nil {
+		c.senders[msg.MessageID] = msg.SenderID
+	}
+}
+
+// getReceiptsFilePath возвращает путь к файлу отметок чата. Расширение отличается от .jsonl,
+// чтобы файл не принимался за историю (например, в AnonymizeSenderInHistory).
+func getReceiptsFilePath(chatID string) string {
+	return filepath.Join(historyDir, fmt.Sprintf("%s.receipts", chatID))
+}
+
+// SaveReceipts записывает отметку status пользователя userID для сообщений чата messageIDs.
+// Учитываются только существующие сообщения других отправителей; повторная отметка и доставка
+// уже прочитанного сообщения не записываются. Возвращает новые отметки по отправителям сообщений.
+func SaveReceipts(chatID, userID, status string, messageIDs []string) (map[string][]string, int64, error) {
+	if err := checkChatID(chatID); err != nil {
+		return nil, 0, err
+	}
+	fileMutex := getFileMutex(chatID) // Общий с историей: отметки проверяются по ее сообщениям
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
+	cache := getReceiptCache(chatID)
+	senders, err := cache.sendersLocked(chatID)
+	if err != nil {
+		return nil, 0, err
+	}
+	receipts, err := cache.receiptsLocked(chatID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := time.Now().UnixMilli()
+	bySender := make(map[string][]string)
+	var records []receiptRecord
+	seen := make(map[string]bool, len(messageIDs))
+	for _, id := range messageIDs {
+		senderID, exists := senders[id]
+		if !exists || senderID == userID || seen[id] {
+			continue
+		}
+		seen[id] = true
+		r := receipts[id]
+		if r.ReadAt != 0 || (status == protocol.ReceiptStatusDelivered && r.DeliveredAt != 0) {
+			continue
+		}
+		records = append(records, receiptRecord{MessageID: id, UserID: userID, Status: status, Timestamp: now})
+		bySender[senderID] = append(bySender[senderID], id)
+	}
+	if len(records) == 0 {
+		return bySender, now, nil
+	}
+
+	file, err := os.OpenFile(getReceiptsFilePath(chatID), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open receipts file for chat %s: %w", chatID, err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	for _, record := range records {
+		recordBytes, err := json.Marshal(record)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to marshal receipt for chat %s: %w", chatID, err)
+		}
+		w.Write(recordBytes)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		return nil, 0, fmt.Errorf("failed to write receipts for chat %s: %w", chatID, err)
+	}
+	for _, record := range records {
+		receipts[record.MessageID] = record.apply(receipts[record.MessageID])
+	}
+	return bySender, now, nil
+}
+
+// ApplyReceipts заполняет DeliveredAt и ReadAt сообщений истории чата.
+func ApplyReceipts(chatID string, messages []protocol.StoredMessage) error {
+	if err := checkChatID(chatID); err != nil {
+		return err
+	}
+	fileMutex := getFileMutex(chatID)
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
+	receipts, err := getReceiptCache(chatID).receiptsLocked(chatID)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		r := receipts[messages[i].MessageID]
+		messages[i].DeliveredAt = r.DeliveredAt
+		messages[i].ReadAt = r.ReadAt
+	}
+	return nil
+}
+
+// apply добавляет отметку к итоговым отметкам сообщения r: учитываются первая доставка и первое прочтение.
+func (record receiptRecord) apply(r messageReceipt) messageReceipt {
+	timestamp := unixMillis(record.Timestamp)
+	// Прочитанное сообщение считается и доставленным
+	if r.DeliveredAt == 0 {
+		r.DeliveredAt = timestamp
+	}
+	if record.Status == protocol.ReceiptStatusRead && r.ReadAt == 0 {
+		r.ReadAt = timestamp
+	}
+	return r
+}
+
+// readReceiptsLocked читает отметки чата. Вызывающий держит мьютекс файла чата.
+func readReceiptsLocked(chatID string) (map[string]messageReceipt, error) {
+	receipts := make(map[string]messageReceipt)
+	file, err := os.Open(getReceiptsFilePath(chatID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return receipts, nil // Отметок еще нет
+		}
+		return nil, fmt.Errorf("failed to open receipts file for chat %s: %w", chatID, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record receiptRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf("Error unmarshalling receipt from chat %s: %v. Line: %s", chatID, err, scanner.Text())
+			continue // Пропускаем поврежденную строку
+		}
+		receipts[record.MessageID] = record.apply(receipts[record.MessageID])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan receipts file for chat %s: %w", chatID, err)
+	}
+	return receipts, nil
+}
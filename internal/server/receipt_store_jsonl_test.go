@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+// useTempHistoryDir переключает хранилище истории на временный каталог на время теста.
+func useTempHistoryDir(t *testing.T) {
+	t.Helper()
+	saved := historyDir
+	historyDir = t.TempDir()
+	t.Cleanup(func() { historyDir = saved })
+}
+
+func TestSaveReceipts(t *testing.T) {
+	useTempHistoryDir(t)
+	chatID := "private:receipts-alice:receipts-bob"
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		msg, err := SaveMessage(chatID, "receipts-alice", "Alice", fmt.Sprint("hi ", i))
+		if err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+		ids = append(ids, msg.MessageID)
+	}
+	own, err := SaveMessage(chatID, "receipts-bob", "Bob", "own message")
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+
+	// Свои и неизвестные сообщения не отмечаются, повтор ID в запросе учитывается один раз
+	bySender, _, err := SaveReceipts(chatID, "receipts-bob", protocol.ReceiptStatusDelivered, []string{ids[0], ids[1], ids[0], own.MessageID, "missing"})
+	if err != nil {
+		t.Fatalf("SaveReceipts: %v", err)
+	}
+	if got := fmt.Sprint(bySender); got != fmt.Sprint(map[string][]string{"receipts-alice": ids[:2]}) {
+		t.Fatalf("delivered by sender = %s", got)
+	}
+	// Повторная доставка не записывается, прочтение - записывается
+	if bySender, _, _ = SaveReceipts(chatID, "receipts-bob", protocol.ReceiptStatusDelivered, ids[:1]); len(bySender) != 0 {
+		t.Fatalf("repeated delivery recorded: %v", bySender)
+	}
+	if bySender, _, _ = SaveReceipts(chatID, "receipts-bob", protocol.ReceiptStatusRead, ids[:1]); len(bySender["receipts-alice"]) != 1 {
+		t.Fatalf("read receipt not recorded: %v", bySender)
+	}
+
+	// Сообщение, сохраненное после заполнения кэша, тоже можно отметить
+	later, err := SaveMessage(chatID, "receipts-alice", "Alice", "later")
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	if bySender, _, _ = SaveReceipts(chatID, "receipts-bob", protocol.ReceiptStatusRead, []string{later.MessageID}); len(bySender["receipts-alice"]) != 1 {
+		t.Fatalf("receipt for a message saved after caching not recorded: %v", bySender)
+	}
+
+	messages, err := LoadChatHistory(chatID, 0)
+	if err != nil {
+		t.Fatalf("LoadChatHistory: %v", err)
+	}
+	if err := ApplyReceipts(chatID, messages); err != nil {
+		t.Fatalf("ApplyReceipts: %v", err)
+	}
+	want := map[string][2]bool{ // delivered, read
+		ids[0]: {true, true}, ids[1]: {true, false}, ids[2]: {false, false},
+		own.MessageID: {false, false}, later.MessageID: {true, true},
+	}
+	for _, msg := range messages {
+		w := want[msg.MessageID]
+		if (msg.DeliveredAt != 0) != w[0] || (msg.ReadAt != 0) != w[1] {
+			t.Errorf("message %q: delivered_at %d, read_at %d, want delivered %t, read %t", msg.Text, msg.DeliveredAt, msg.ReadAt, w[0], w[1])
+		}
+	}
+
+	// Отметки берутся из кэша, а не перечитываются: файл истории больше не нужен
+	if err := os.Remove(getChatFilePath(chatID)); err != nil {
+		t.Fatalf("remove history: %v", err)
+	}
+	if bySender, _, err = SaveReceipts(chatID, "receipts-bob", protocol.ReceiptStatusDelivered, ids[2:]); err != nil || len(bySender["receipts-alice"]) != 1 {
+		t.Fatalf("SaveReceipts after history removal = %v, %v", bySender, err)
+	}
+}
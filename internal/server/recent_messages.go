@@ -0,0 +1,75 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+// recentMessagesPerSender - сколько последних client_msg_id помнится для каждого отправителя.
+// Повтор после обрыва связи приходит сразу после переподключения, поэтому длинная память не нужна.
+const recentMessagesPerSender = 100
+
+// recentMessages запоминает сохраненные сообщения по client_msg_id отправителя, чтобы повторная
+// отправка того же сообщения после обрыва связи не создавала дубликат в истории.
+// Хранится только в памяти: после перезапуска сервера повтор сохраняется как новое сообщение.
+type recentMessages struct {
+	mu       sync.Mutex
+	bySender map[string]*senderRecentMessages
+}
+
+// senderRecentMessages - последние сообщения одного отправителя в порядке сохранения.
+type senderRecentMessages struct {
+	order    []recentMessageKey
+	messages map[recentMessageKey]protocol.StoredMessage
+}
+
+// recentMessageKey - client_msg_id уникален в пределах чата: тот же ключ в другом чате - другое сообщение.
+type recentMessageKey struct {
+	chatID      string
+	clientMsgID string
+}
+
+func newRecentMessages() *recentMessages {
+	return &recentMessages{bySender: make(map[string]*senderRecentMessages)}
+}
+
+// lookup возвращает уже сохраненное сообщение с этим client_msg_id.
+func (r *recentMessages) lookup(senderID, chatID, clientMsgID string) (protocol.StoredMessage, bool) {
+	if clientMsgID == "" {
+		return protocol.StoredMessage{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sender, ok := r.bySender[senderID]
+	if !ok {
+		return protocol.StoredMessage{}, false
+	}
+	msg, ok := sender.messages[recentMessageKey{chatID: chatID, clientMsgID: clientMsgID}]
+	return msg, ok
+}
+
+// remember запоминает сохраненное сообщение; самое старое забывается, когда их больше recentMessagesPerSender.
+func (r *recentMessages) remember(senderID, clientMsgID string, msg protocol.StoredMessage) {
+	if clientMsgID == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sender, ok := r.bySender[senderID]
+	if !ok {
+		sender = &senderRecentMessages{messages: make(map[recentMessageKey]protocol.StoredMessage)}
+		r.bySender[senderID] = sender
+	}
+	key := recentMessageKey{chatID: msg.ChatID, clientMsgID: clientMsgID}
+	if _, exists := sender.messages[key]; !exists {
+		sender.order = append(sender.order, key)
+	}
+	sender.messages[key] = msg
+	if len(sender.order) > recentMessagesPerSender {
+		delete(sender.messages, sender.order[0])
+		sender.order = sender.order[1:]
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+// RegistrationPolicy - правила для логина, пароля и отображаемого имени новых пользователей.
+// Длины логина и имени считаются в символах, длина пароля - в байтах (bcrypt учитывает только первые 72).
+type RegistrationPolicy struct {
+	UsernameMinLength int    `json:"username_min_length"`
+	UsernameMaxLength int    `json:"username_max_length"`
+	UsernamePattern   string `json:"username_pattern"` // Регулярное выражение для всего логина
+
+	PasswordMinLength     int  `json:"password_min_length"`
+	PasswordMaxLength     int  `json:"password_max_length"`
+	PasswordRequireLetter bool `json:"password_require_letter"`
+	PasswordRequireDigit  bool `json:"password_require_digit"`
+	PasswordRequireMixed  bool `json:"password_require_mixed_case"`
+	PasswordRequireSymbol bool `json:"password_require_symbol"`
+
+	DisplayNameMinLength int `json:"display_name_min_length"`
+	DisplayNameMaxLength int `json:"display_name_max_length"`
+
+	// Зарезервированные имена сравниваются после NormalizeName и запрещены
+	// и как логин, и как отображаемое имя.
+	ReservedNames []string `json:"reserved_names"`
+
+	usernameRe *regexp.Regexp
+	reserved   map[string]bool
+}
+
+// bcryptMaxPasswordLength - bcrypt молча отбрасывает байты пароля после 72-го.
+const bcryptMaxPasswordLength = 72
+
+// DefaultRegistrationPolicy возвращает политику по умолчанию.
+func DefaultRegistrationPolicy() *RegistrationPolicy {
+	p := &RegistrationPolicy{
+		UsernameMinLength:     3,
+		UsernameMaxLength:     32,
+		UsernamePattern:       `^[A-Za-z0-9_.-]+$`,
+		PasswordMinLength:     8,
+		PasswordMaxLength:     bcryptMaxPasswordLength,
+		PasswordRequireLetter: true,
+		PasswordRequireDigit:  true,
+		DisplayNameMinLength:  1,
+		DisplayNameMaxLength:  64,
+		ReservedNames: []string{
+			"admin", "administrator", "root", "system", "server",
+			"moderator", "support", "global_broadcast",
+		},
+	}
+	if err := p.compile(); err != nil {
+		panic(err) // Политика по умолчанию задана в коде и обязана быть корректной
+	}
+	return p
+}
+
+// LoadRegistrationPolicy читает политику из JSON-файла. Отсутствующие в файле поля
+// берутся из DefaultRegistrationPolicy.
+func LoadRegistrationPolicy(path string) (*RegistrationPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registration policy '%s': %w", path, err)
+	}
+	p := DefaultRegistrationPolicy()
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("failed to parse registration policy '%s': %w", path, err)
+	}
+	if err := p.compile(); err != nil {
+		return nil, fmt.Errorf("invalid registration policy '%s': %w", path, err)
+	}
+	return p, nil
+}
+
+// compile подготавливает регулярное выражение и множество зарезервированных имен.
+func (p *RegistrationPolicy) compile() error {
+	p.usernameRe = nil
+	if p.UsernamePattern != "" {
+		re, err := regexp.Compile(p.UsernamePattern)
+		if err != nil {
+			return fmt.Errorf("invalid username_pattern: %w", err)
+		}
+		p.usernameRe = re
+	}
+	if p.PasswordMaxLength <= 0 || p.PasswordMaxLength > bcryptMaxPasswordLength {
+		p.PasswordMaxLength = bcryptMaxPasswordLength
+	}
+	p.reserved = make(map[string]bool, len(p.ReservedNames))
+	for _, name := range p.ReservedNames {
+		p.reserved[NormalizeName(name)] = true
+	}
+	return nil
+}
+
+// ValidationError содержит ошибки по отдельным полям запроса.
+type ValidationError struct {
+	Fields []protocol.FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		messages = append(messages, fmt.Sprintf("%s: %s", f.Field, f.Message))
+	}
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+// Validate проверяет данные регистрации. Возвращает nil или *ValidationError.
+func (p *RegistrationPolicy) Validate(username, password, displayName string) error {
+	var fields []protocol.FieldError
+	fields = append(fields, p.validateUsername(username)...)
+	fields = append(fields, p.validatePassword(password)...)
+	fields = append(fields, p.validateDisplayName(displayName)...)
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// ValidatePassword проверяет только пароль (например, при его смене).
+func (p *RegistrationPolicy) ValidatePassword(password string) error {
+	if fields := p.validatePassword(password); len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+func (p *RegistrationPolicy) validateUsername(username string) []protocol.FieldError {
+	const field = protocol.FieldUsername
+	length := utf8.RuneCountInString(username)
+	switch {
+	case length == 0:
+		return []protocol.FieldError{{Field: field, Code: protocol.FieldErrRequired, Message: "username is required"}}
+	case length < p.UsernameMinLength:
+		return []protocol.FieldError{{Field: field, Code: protocol.FieldErrTooShort, Message: fmt.Sprintf("username must be at least %d characters", p.UsernameMinLength)}}
+	case p.UsernameMaxLength > 0 && length > p.UsernameMaxLength:
+		return []protocol.FieldError{{Field: field, Code: protocol.FieldErrTooLong, Message: fmt.Sprintf("username must be at most %d characters", p.UsernameMaxLength)}}
+	case p.usernameRe != nil && !p.usernameRe.MatchString(username):
+		return []protocol.FieldError{{Field: field, Code: protocol.FieldErrInvalidCharacters, Message: "username contains characters that are not allowed"}}
+	case p.reserved[NormalizeName(username)]:
+		return []protocol.FieldError{{Field: field, Code: protocol.FieldErrReserved, Message: "this username is reserved"}}
+	}
+	return nil
+}
+
+func (p *RegistrationPolicy) validatePassword(password string) []protocol.FieldError {
+	const field = protocol.FieldPassword
+	switch {
+	case password == "":
+		return []protocol.FieldError{{Field: field, Code: protocol.FieldErrRequired, Message: "password is required"}}
+	case len(password) < p.PasswordMinLength:
+		return []protocol.FieldError{{Field: field, Code: protocol.FieldErrTooShort, Message: fmt.Sprintf("password must be at least %d characters", p.PasswordMinLength)}}
+	case len(password) > p.PasswordMaxLength:
+		return []protocol.FieldError{{Field: field, Code: protocol.FieldErrTooLong, Message: fmt.Sprintf("password must be at most %d bytes", p.PasswordMaxLength)}}
+	}
+
+	var hasLetter, hasDigit, hasUpper, hasLower, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+			hasUpper = hasUpper || unicode.IsUpper(r)
+			hasLower = hasLower || unicode.IsLower(r)
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			hasSymbol = true
+		}
+	}
+
+	var missing []string
+	if p.PasswordRequireLetter && !hasLetter {
+		missing = append(missing, "a letter")
+	}
+	if p.PasswordRequireDigit && !hasDigit {
+		missing = append(missing, "a digit")
+	}
+	if p.PasswordRequireMixed && !(hasUpper && hasLower) {
+		missing = append(missing, "upper and lower case letters")
+	}
+	if p.PasswordRequireSymbol && !hasSymbol {
+		missing = append(missing, "a symbol")
+	}
+	if len(missing) > 0 {
+		return []protocol.FieldError{{Field: field, Code: protocol.FieldErrTooWeak, Message: "password must contain " + strings.Join(missing, ", ")}}
+	}
+	return nil
+}
+
+func (p *RegistrationPolicy) validateDisplayName(displayName string) []protocol.FieldError {
+	const field = protocol.FieldDisplayName
+	length := utf8.RuneCountInString(displayName)
+	switch {
+	case strings.TrimSpace(displayName) == "":
+		return []protocol.FieldError{{Field: field, Code: protocol.FieldErrRequired, Message: "display name is required"}}
+	case length < p.DisplayNameMinLength:
+		return []protocol.FieldError{{Field: field, Code: protocol.FieldErrTooShort, Message: fmt.Sprintf("display name must be at least %d characters", p.DisplayNameMinLength)}}
+	case p.DisplayNameMaxLength > 0 && length > p.DisplayNameMaxLength:
+		return []protocol.FieldError{{Field: field, Code: protocol.FieldErrTooLong, Message: fmt.Sprintf("display name must be at most %d characters", p.DisplayNameMaxLength)}}
+	case strings.TrimSpace(displayName) != displayName:
+		return []protocol.FieldError{{Field: field, Code: protocol.FieldErrInvalidCharacters, Message: "display name must not start or end with whitespace"}}
+	case !utf8.ValidString(displayName):
+		return []protocol.FieldError{{Field: field, Code: protocol.FieldErrInvalidCharacters, Message: "display name is not valid UTF-8"}}
+	case p.reserved[NormalizeName(displayName)]:
+		return []protocol.FieldError{{Field: field, Code: protocol.FieldErrReserved, Message: "this display name is reserved"}}
+	}
+	for _, r := range displayName {
+		// Управляющие и форматирующие символы (в т.ч. смена направления текста) ломают вывод в консоли.
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return []protocol.FieldError{{Field: field, Code: protocol.FieldErrInvalidCharacters, Message: "display name contains control characters"}}
+		}
+	}
+	return nil
+}
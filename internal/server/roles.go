@@ -0,0 +1,194 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/vladimirruppel/messengor/internal/protocol"
+)
+
+// Role - роль пользователя. Определяет набор прав по умолчанию.
+type Role string
+
+const (
+	RoleUser      Role = protocol.RoleUser
+	RoleModerator Role = protocol.RoleModerator
+	RoleAdmin     Role = protocol.RoleAdmin
+)
+
+// Permission - отдельное право, проверяемое перед обработкой сообщения клиента.
+type Permission string
+
+const (
+	PermListUsers     Permission = protocol.PermListUsers
+	PermSendGlobal    Permission = protocol.PermSendGlobal
+	PermSendPrivate   Permission = protocol.PermSendPrivate
+	PermReadHistory   Permission = protocol.PermReadHistory
+	PermManageAccount Permission = protocol.PermManageAccount
+	PermKickUsers     Permission = protocol.PermKickUsers
+	PermManageRoles   Permission = protocol.PermManageRoles
+	PermManageInvites Permission = protocol.PermManageInvites
+)
+
+var (
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrUnknownRole      = errors.New("unknown role")
+	ErrLastAdmin        = errors.New("cannot remove the last admin")
+)
+
+// rolePermissions - права, которые получает пользователь при назначении роли.
+var rolePermissions = map[Role][]Permission{
+	RoleUser: {
+		PermListUsers, PermSendGlobal, PermSendPrivate, PermReadHistory, PermManageAccount,
+	},
+	RoleModerator: {
+		PermListUsers, PermSendGlobal, PermSendPrivate, PermReadHistory, PermManageAccount,
+		PermKickUsers,
+	},
+	RoleAdmin: {
+		PermListUsers, PermSendGlobal, PermSendPrivate, PermReadHistory, PermManageAccount,
+		PermKickUsers, PermManageRoles, PermManageInvites,
+	},
+}
+
+// roleRank упорядочивает роли: модератор не может выгнать модератора или администратора.
+var roleRank = map[Role]int{RoleUser: 0, RoleModerator: 1, RoleAdmin: 2}
+
+// ParseRole проверяет, что строка - известная роль.
+func ParseRole(value string) (Role, error) {
+	role := Role(value)
+	if _, ok := rolePermissions[role]; !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownRole, value)
+	}
+	return role, nil
+}
+
+// RolePermissions возвращает копию набора прав роли по умолчанию.
+func RolePermissions(role Role) []Permission {
+	return append([]Permission(nil), rolePermissions[role]...)
+}
+
+// EffectiveRole возвращает роль пользователя; у пользователей, созданных до появления ролей, это RoleUser.
+func (u *User) EffectiveRole() Role {
+	if u.Role == "" {
+		return RoleUser
+	}
+	return u.Role
+}
+
+// EffectivePermissions возвращает права роли пользователя вместе с сохраненным набором прав.
+// Права роли добавляются всегда, чтобы права, появившиеся в новых версиях сервера,
+// получали и пользователи, чей набор был сохранен раньше.
+func (u *User) EffectivePermissions() []Permission {
+	perms := RolePermissions(u.EffectiveRole())
+	for _, p := range u.Permissions {
+		if !containsPermission(perms, p) {
+			perms = append(perms, p)
+		}
+	}
+	return perms
+}
+
+func containsPermission(perms []Permission, perm Permission) bool {
+	for _, p := range perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission сообщает, есть ли у пользователя право perm.
+func (u *User) HasPermission(perm Permission) bool {
+	return containsPermission(u.EffectivePermissions(), perm)
+}
+
+// Outranks сообщает, выше ли роль пользователя роли other.
+func (u *User) Outranks(other *User) bool {
+	return roleRank[u.EffectiveRole()] > roleRank[other.EffectiveRole()]
+}
+
+// permissionStrings переводит права в строки для протокола.
+func permissionStrings(perms []Permission) []string {
+	out := make([]string, len(perms))
+	for i, p := range perms {
+		out[i] = string(p)
+	}
+	return out
+}
+
+// SetUserRole назначает пользователю роль и соответствующий ей набор прав.
+// Последнего администратора понизить нельзя, чтобы сервер не остался без управления.
+func SetUserRole(users UserStore, userID string, role Role) (*User, error) {
+	if _, ok := rolePermissions[role]; !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownRole, role)
+	}
+	user, err := users.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if role != RoleAdmin {
+		if err := ensureNotLastAdmin(users, user); err != nil {
+			return nil, err
+		}
+	}
+
+	var updated *User
+	if err := updateUser(users, userID, "user role", func(u *User) error {
+		u.Role = role
+		u.Permissions = RolePermissions(role)
+		updated = u.clone()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	log.Printf("User %s (ID: %s) now has role %s", updated.Username, updated.ID, role)
+	return updated, nil
+}
+
+// BootstrapAdmin назначает администратором существующего пользователя по логину.
+// Используется флагом сервера -bootstrap-admin.
+func BootstrapAdmin(users UserStore, username string) error {
+	user, err := users.GetByUsername(username)
+	if err != nil {
+		return fmt.Errorf("bootstrap admin %q: %w", username, err)
+	}
+	if user.EffectiveRole() == RoleAdmin {
+		return nil
+	}
+	_, err = SetUserRole(users, user.ID, RoleAdmin)
+	return err
+}
+
+// countAdmins считает активных администраторов.
+func countAdmins(users UserStore) (int, error) {
+	all, err := users.List()
+	if err != nil {
+		return 0, err
+	}
+	admins := 0
+	for _, u := range all {
+		if u.EffectiveRole() == RoleAdmin && !u.Deactivated {
+			admins++
+		}
+	}
+	return admins, nil
+}
+
+// ensureNotLastAdmin не дает деактивировать или удалить последнего администратора.
+func ensureNotLastAdmin(users UserStore, user *User) error {
+	if user.EffectiveRole() != RoleAdmin {
+		return nil
+	}
+	admins, err := countAdmins(users)
+	if err != nil {
+		return err
+	}
+	if admins <= 1 {
+		return ErrLastAdmin
+	}
+	return nil
+}
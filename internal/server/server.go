@@ -1,19 +1,26 @@
 package server
 
 import (
-	"encoding/json"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/vladimirruppel/messengor/internal/protocol"
 )
 
+// Сколько времени после верного пароля ждем второй фактор.
+const secondFactorTimeout = 5 * time.Minute
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	// Кодировка выбирается подпротоколом; клиент без подпротокола получает JSON.
+	Subprotocols: protocol.Subprotocols,
 	CheckOrigin: func(r *http.Request) bool {
 		// TODO: Разрешаем все источники - пока что
 		return true
@@ -23,6 +30,12 @@ var upgrader = websocket.Upgrader{
 func HandleWebSocketConnections(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	log.Println("Received HTTP request on /ws, attempting to upgrade...")
 
+	// Боты и скрипты предъявляют API-токен при upgrade и минуют AUTH_LOOP.
+	if secret, ok := apiTokenFromRequest(r); ok {
+		handleAPITokenConnection(hub, w, r, secret)
+		return
+	}
+
 	var conn, err = upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Failed to upgrade connection: %v\n", err)
@@ -33,9 +46,6 @@ func HandleWebSocketConnections(hub *Hub, w http.ResponseWriter, r *http.Request
 
 	log.Println("WebSocket connection established successfully!")
 
-	var authenticatedUser *User // Сюда запишем данные пользователя после успеха
-	var sessionToken string
-
 	// Установим дедлайн на первую аутентификационную операцию
 	if err := conn.SetReadDeadline(time.Now().Add(60 * time.Second)); err != nil {
 		log.Printf("Auth: Error setting read deadline for client %p: %v", conn, err)
@@ -43,106 +53,66 @@ func HandleWebSocketConnections(hub *Hub, w http.ResponseWriter, r *http.Request
 		return
 	}
 
-AUTH_LOOP:
-	for {
-		messageType, p, err := conn.ReadMessage()
+	codec := protocol.CodecForSubprotocol(conn.Subprotocol())
+	proto, first, ok := helloHandshake(hub, conn)
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	flow := &authFlow{hub: hub, conn: conn, proto: proto, remoteIP: remoteIPFromRequest(r)}
+	for flow.user == nil {
+		var messageType int
+		var p []byte
+		var err error
+		if first != nil {
+			// Первое сообщение клиента без HELLO уже прочитано при рукопожатии.
+			messageType, p = first.messageType, first.data
+			first = nil
+		} else {
+			messageType, p, err = conn.ReadMessage()
+		}
 		if err != nil {
 			log.Printf("Auth: Read error from client %p before authentication: %v", conn, err)
 			conn.Close() // Закрываем соединение, если ошибка до аутентификации
 			return       // Выходим из HandleWebSocketConnections
 		}
 
-		if messageType != websocket.TextMessage {
-			log.Printf("Auth: Received non-text message from client %p before auth.", conn)
-			sendErrorMessage(conn, "INVALID_MESSAGE_TYPE", "Expected text message for authentication.")
+		if messageType != codec.FrameType() {
+			log.Printf("Auth: Received unexpected frame type from client %p before auth.", conn)
+			sendErrorMessage(conn, "", protocol.ErrCodeInvalidMessageType, "Unexpected frame type for the negotiated encoding.")
 			continue // Ждем следующего сообщения
 		}
 
-		var receivedMsg protocol.WebSocketMessage
-		if err := json.Unmarshal(p, &receivedMsg); err != nil {
-			log.Printf("Auth: Failed to unmarshal WebSocket message from client %p: %v. Raw: %s", conn, err, string(p))
-			sendErrorMessage(conn, "INVALID_JSON", "Could not parse JSON message.")
+		receivedMsg, err := codec.Decode(p)
+		if err != nil {
+			log.Printf("Auth: Failed to decode WebSocket message from client %p: %v. Raw: %q", conn, err, p)
+			sendErrorMessage(conn, "", protocol.ErrCodeInvalidJSON, "Could not decode message.")
 			continue
 		}
 
 		log.Printf("Auth: Received from client %p: Type=%s", conn, receivedMsg.Type)
+		flow.dispatch(receivedMsg)
+		if flow.user != nil {
+			break // Успешная аутентификация
+		}
 
-		switch receivedMsg.Type {
-		case protocol.MsgTypeRegisterRequest:
-			var reqPayload protocol.RegisterRequestPayload
-			if err := json.Unmarshal(receivedMsg.Payload, &reqPayload); err != nil {
-				log.Printf("Failed to unmarshal RegisterRequest payload: %v\n", err)
-				sendErrorMessage(conn, "INVALID_PAYLOAD", "Could not parse register request payload.")
-				continue
-			}
-
-			log.Printf("Processing RegisterRequest for username: %s\n", reqPayload.Username)
-			user, err := RegisterNewUser(reqPayload.Username, reqPayload.Password, reqPayload.DisplayName)
-
-			var respPayload protocol.RegisterResponsePayload
-			if err != nil {
-				log.Printf("Registration failed for %s: %v\n", reqPayload.Username, err)
-				respPayload = protocol.RegisterResponsePayload{
-					Success:      false,
-					ErrorMessage: err.Error(), // Используем сообщение из ошибки хранилища
-				}
-			} else {
-				log.Printf("Registration successful for %s, UserID: %s\n", reqPayload.Username, user.ID)
-				respPayload = protocol.RegisterResponsePayload{
-					Success: true,
-					UserID:  user.ID,
-				}
-			}
-			sendWebSocketResponse(conn, protocol.MsgTypeRegisterResponse, respPayload)
-
-		case protocol.MsgTypeLoginRequest:
-			var reqPayload protocol.LoginRequestPayload
-			if err := json.Unmarshal(receivedMsg.Payload, &reqPayload); err != nil {
-				log.Printf("Auth: Failed to unmarshal LoginRequest payload: %v\n", err)
-				sendErrorMessage(conn, "INVALID_PAYLOAD", "Could not parse login request payload.")
-				continue
-			}
-
-			user, authErr := AuthenticateUser(reqPayload.Username, reqPayload.Password)
-			var respPayload protocol.LoginResponsePayload
-			if authErr != nil {
-				respPayload = protocol.LoginResponsePayload{Success: false, ErrorMessage: authErr.Error()}
-				sendWebSocketResponse(conn, protocol.MsgTypeLoginResponse, respPayload)
-				log.Printf("Authentication failed for %s. Closing connection.", reqPayload.Username)
-				continue
-			} else {
-				authenticatedUser = user
-				sessionToken = uuid.NewString()
-				respPayload = protocol.LoginResponsePayload{
-					Success:      true,
-					UserID:       user.ID,
-					DisplayName:  user.DisplayName,
-					SessionToken: sessionToken,
-				}
-				sendWebSocketResponse(conn, protocol.MsgTypeLoginResponse, respPayload)
-				log.Printf("Client %s (ID: %s) authenticated successfully. Token: %s", user.DisplayName, user.ID, sessionToken)
-				break AUTH_LOOP // Успешная аутентификация, выходим из цикла AUTH_LOOP
-			}
-
-		default:
-			log.Printf("Auth: Received unexpected message type %s from client %p before authentication.", receivedMsg.Type, conn)
-			sendErrorMessage(conn, "UNEXPECTED_MESSAGE_TYPE", "Expected LoginRequest or RegisterRequest.")
+		if maxAttempts := hub.authLimiter.MaxAttemptsPerConn(); maxAttempts > 0 && flow.attempts >= maxAttempts {
+			log.Printf("Auth: Client %p from %s reached %d authentication attempts. Closing connection.", conn, flow.remoteIP, flow.attempts)
+			sendErrorMessage(conn, receivedMsg.RequestID, protocol.ErrCodeTooManyAttempts, "Too many authentication attempts on this connection.")
+			closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too many authentication attempts")
+			conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeWait))
+			return
 		}
 
-		// Сбрасываем дедлайн после каждого успешно обработанного сообщения в цикле аутентификации
+		// Сбрасываем дедлайн после каждого обработанного сообщения в цикле аутентификации
 		if err := conn.SetReadDeadline(time.Now().Add(60 * time.Second)); err != nil {
 			log.Printf("Auth: Error resetting read deadline for client %p: %v", conn, err)
 			conn.Close()
 			return
 		}
 	}
-
-	// Если мы вышли из цикла AUTH_LOOP без authenticatedUser, значит что-то пошло не так
-	if authenticatedUser == nil {
-		log.Printf("Client %p did not authenticate. Closing connection.", conn)
-		conn.Close() // Закрываем, если аутентификация так и не прошла
-		return
-	}
+	authenticatedUser := flow.user
 
 	// Убираем дедлайн на чтение, так как readPump будет использовать свой механизм с Pong
 	if err := conn.SetReadDeadline(time.Time{}); err != nil { // time.Time{} - нулевое время, отключает дедлайн
@@ -153,13 +123,34 @@ AUTH_LOOP:
 	client := &Client{
 		hub:             hub,
 		conn:            conn,
-		send:            make(chan []byte, 256), // Буфер на 256 сообщений
+		send:            make(chan outgoingMessage, 256), // Буфер на 256 сообщений
+		proto:           proto,
+		codec:           codec,
 		UserID:          authenticatedUser.ID,
 		DisplayName:     authenticatedUser.DisplayName,
+		SessionToken:    flow.sessionToken,
 		IsAuthenticated: true,
+		connectedAt:     time.Now(),
 	}
+	serveClient(client)
+}
 
-	client.hub.register <- client
+// serveClient регистрирует аутентифицированного клиента в хабе и обслуживает его до отключения.
+// Если хаб отклонил соединение по лимиту, оно закрывается здесь, до запуска readPump и writePump.
+func serveClient(client *Client) {
+	client.done = make(chan struct{})
+	if err := client.hub.Register(client); err != nil {
+		log.Printf("Closing connection of %s (ID: %s): %v", client.DisplayName, client.UserID, err)
+		// Сессия, выданная этому соединению, больше не нужна (у соединений по API-токену ее нет).
+		if client.SessionToken != "" {
+			if err := client.hub.sessions.Revoke(client.SessionToken); err != nil && !errors.Is(err, ErrSessionNotFound) {
+				log.Printf("Failed to revoke session of rejected connection: %v", err)
+			}
+		}
+		closeMessage := websocket.FormatCloseMessage(protocol.CloseCodeConnectionLimit, err.Error())
+		client.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeWait))
+		return
+	}
 
 	go client.writePump()
 	client.readPump()
@@ -167,27 +158,99 @@ AUTH_LOOP:
 	log.Printf("HandleWebSocketConnections finished for client %s (ID: %s)", client.DisplayName, client.UserID)
 }
 
-// Вспомогательная функция для отправки ответов клиенту
-func sendWebSocketResponse(conn *websocket.Conn, msgType string, payloadData interface{}) {
-	payloadBytes, err := json.Marshal(payloadData)
+// apiTokenFromRequest извлекает API-токен из заголовка "Authorization: Bearer <token>"
+// или из параметра запроса access_token.
+func apiTokenFromRequest(r *http.Request) (string, bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, found := strings.Cut(header, " ")
+		if found && strings.EqualFold(scheme, protocol.APITokenAuthScheme) && strings.TrimSpace(token) != "" {
+			return strings.TrimSpace(token), true
+		}
+	}
+	if token := r.URL.Query().Get(protocol.APITokenQueryParam); token != "" {
+		return token, true
+	}
+	return "", false
+}
+
+// handleAPITokenConnection проверяет API-токен до upgrade. При неверном токене клиент получает
+// обычный HTTP-ответ с ошибкой, при верном - сразу регистрируется в хабе как аутентифицированный.
+func handleAPITokenConnection(hub *Hub, w http.ResponseWriter, r *http.Request, secret string) {
+	remoteIP := remoteIPFromRequest(r)
+	if wait := hub.authLimiter.Check("", remoteIP); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+		http.Error(w, "too many failed attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	token, err := hub.apiTokens.Authenticate(secret)
 	if err != nil {
-		log.Printf("Error marshalling payload for type %s: %v\n", msgType, err)
-		// Не отправляем ничего клиенту, если не можем сериализовать наш собственный ответ
+		log.Printf("Auth: Invalid api token presented from %s: %v", remoteIP, err)
+		hub.authLimiter.Failure("", remoteIP)
+		w.Header().Set("WWW-Authenticate", protocol.APITokenAuthScheme)
+		http.Error(w, "invalid api token", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := hub.users.GetByID(token.UserID)
+	if err == nil && user.Deactivated {
+		err = ErrUserDeactivated
+	}
+	if err != nil {
+		log.Printf("Auth: Api token %s of user %s cannot be used: %v", token.ID, token.UserID, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade connection: %v\n", err)
 		return
 	}
+	defer conn.Close()
 
-	wsMsg := protocol.WebSocketMessage{
-		Type:    msgType,
-		Payload: payloadBytes,
+	// Токен действует только в пределах текущих прав пользователя.
+	var effective []Permission
+	for _, scope := range token.Scopes {
+		if user.HasPermission(scope) {
+			effective = append(effective, scope)
+		}
 	}
+	sendWebSocketResponse(conn, "", protocol.MsgTypeLoginResponse, protocol.LoginResponsePayload{
+		Success:     true,
+		UserID:      user.ID,
+		DisplayName: user.DisplayName,
+		Role:        string(user.EffectiveRole()),
+		Permissions: permissionStrings(effective),
+	})
+	log.Printf("Client %s (ID: %s) authenticated with api token %s (%s).", user.DisplayName, user.ID, token.ID, token.Name)
+
+	serveClient(&Client{
+		hub:             hub,
+		conn:            conn,
+		send:            make(chan outgoingMessage, 256),
+		proto:           apiTokenProtocol(),
+		codec:           protocol.CodecForSubprotocol(conn.Subprotocol()),
+		UserID:          user.ID,
+		DisplayName:     user.DisplayName,
+		IsAuthenticated: true,
+		apiTokenID:      token.ID,
+		scopes:          append([]Permission{}, token.Scopes...),
+		connectedAt:     time.Now(),
+	})
+}
 
-	messageBytes, err := json.Marshal(wsMsg)
+// Вспомогательная функция для отправки ответов клиенту
+func sendWebSocketResponse(conn *websocket.Conn, requestID, msgType string, payloadData interface{}) {
+	codec := protocol.CodecForSubprotocol(conn.Subprotocol())
+	messageBytes, err := codec.Encode(msgType, requestID, payloadData)
 	if err != nil {
-		log.Printf("Error marshalling WebSocket message for type %s: %v\n", msgType, err)
+		log.Printf("Error encoding message for type %s: %v\n", msgType, err)
+		// Не отправляем ничего клиенту, если не можем сериализовать наш собственный ответ
 		return
 	}
 
-	if err := conn.WriteMessage(websocket.TextMessage, messageBytes); err != nil {
+	if err := conn.WriteMessage(codec.FrameType(), messageBytes); err != nil {
 		log.Printf("Error sending %s to client: %v\n", msgType, err)
 	} else {
 		log.Printf("Sent to client: Type=%s\n", msgType)
@@ -195,11 +258,37 @@ func sendWebSocketResponse(conn *websocket.Conn, msgType string, payloadData int
 }
 
 // Вспомогательная функция для отправки сообщений об ошибках клиенту
-func sendErrorMessage(conn *websocket.Conn, errorCode string, errorMessage string) {
+func sendErrorMessage(conn *websocket.Conn, requestID, errorCode, errorMessage string) {
 	payload := protocol.ErrorPayload{
 		ErrorCode:    errorCode,
 		ErrorMessage: errorMessage,
 	}
 	log.Printf("Sending error to client: Code=%s, Message=%s\n", errorCode, errorMessage)
-	sendWebSocketResponse(conn, protocol.MsgTypeErrorNotify, payload) // Используем новый тип
+	sendWebSocketResponse(conn, requestID, protocol.MsgTypeErrorNotify, payload)
+}
+
+// remoteIPFromRequest возвращает IP-адрес клиента без порта.
+func remoteIPFromRequest(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// registerErrorResponse превращает ошибку регистрации в ответ с ошибками по полям.
+func registerErrorResponse(err error) protocol.RegisterResponsePayload {
+	code, message := errorResponse(err)
+	resp := protocol.RegisterResponsePayload{Success: false, ErrorCode: code, ErrorMessage: message}
+
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		resp.FieldErrors = validationErr.Fields
+	case errors.Is(err, ErrUsernameTaken):
+		resp.FieldErrors = []protocol.FieldError{{Field: protocol.FieldUsername, Code: protocol.FieldErrTaken, Message: err.Error()}}
+	case errors.Is(err, ErrDisplayNameTaken):
+		resp.FieldErrors = []protocol.FieldError{{Field: protocol.FieldDisplayName, Code: protocol.FieldErrTaken, Message: err.Error()}}
+	}
+	return resp
 }
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Session представляет сессию пользователя, которую можно возобновить по токену
+// без повторной отправки пароля.
+type Session struct {
+	TokenHash  string    `json:"token_hash"` // SHA-256 от токена; сам токен на сервере не хранится
+	UserID     string    `json:"user_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+const (
+	// Максимальное время жизни сессии с момента входа.
+	sessionTTL = 30 * 24 * time.Hour
+
+	// Сессия считается заброшенной, если ею не пользовались дольше этого времени.
+	sessionIdleTimeout = 7 * 24 * time.Hour
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionExpired  = errors.New("session expired")
+)
+
+// SessionStore хранит сессии в памяти и сохраняет их в JSON-файл после каждого изменения.
+type SessionStore struct {
+	path     string
+	mu       sync.Mutex
+	sessions map[string]*Session // Ключ - хеш токена сессии
+}
+
+// NewSessionStore загружает сессии из файла path, отбрасывая истекшие.
+// Пустой path - хранилище только в памяти.
+func NewSessionStore(path string) (*SessionStore, error) {
+	s := &SessionStore{path: path, sessions: make(map[string]*Session)}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil // Сохраненных сессий еще нет
+		}
+		return nil, fmt.Errorf("failed to read session data file '%s': %w", path, err)
+	}
+	if len(data) == 0 {
+		return s, nil
+	}
+
+	if err := json.Unmarshal(data, &s.sessions); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal session data from '%s': %w", path, err)
+	}
+
+	now := time.Now().UTC()
+	for key, session := range s.sessions {
+		if session.isExpired(now) {
+			delete(s.sessions, key)
+		}
+	}
+
+	log.Printf("Successfully loaded %d active sessions from '%s'.", len(s.sessions), path)
+	return s, nil
+}
+
+// hashSessionToken возвращает ключ, под которым сессия хранится в SessionStore.
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// isExpired проверяет, истекла ли сессия по сроку жизни или по неактивности.
+func (s *Session) isExpired(now time.Time) bool {
+	return now.After(s.ExpiresAt) || now.Sub(s.LastUsedAt) > sessionIdleTimeout
+}
+
+// save сохраняет сессии в JSON-файл. Вызывается при захваченном s.mu.
+func (s *SessionStore) save() error {
+	if s.path == "" {
+		return nil // Хранилище только в памяти
+	}
+	data, err := json.MarshalIndent(s.sessions, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal session store: %w", err)
+	}
+	if err := writeFileAtomic(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write session data to file '%s': %w", s.path, err)
+	}
+	return nil
+}
+
+// Create создает новую сессию для пользователя и возвращает ее токен.
+func (s *SessionStore) Create(userID string) (string, *Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token := uuid.NewString()
+	now := time.Now().UTC()
+	session := &Session{
+		TokenHash:  hashSessionToken(token),
+		UserID:     userID,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(sessionTTL),
+	}
+
+	s.sessions[session.TokenHash] = session
+	if err := s.save(); err != nil {
+		delete(s.sessions, session.TokenHash)
+		return "", nil, fmt.Errorf("failed to save new session: %w", err)
+	}
+	return token, session, nil
+}
+
+// Resume проверяет токен и, если сессия действительна, продлевает ее активность.
+func (s *SessionStore) Resume(token string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := hashSessionToken(token)
+	session, exists := s.sessions[key]
+	if !exists {
+		return nil, ErrSessionNotFound
+	}
+
+	now := time.Now().UTC()
+	if session.isExpired(now) {
+		delete(s.sessions, key)
+		if err := s.save(); err != nil {
+			log.Printf("Error saving sessions after expiring session of user %s: %v", session.UserID, err)
+		}
+		return nil, ErrSessionExpired
+	}
+
+	session.LastUsedAt = now
+	if err := s.save(); err != nil {
+		// Сессия остается действительной в памяти, теряется лишь отметка активности.
+		log.Printf("Error saving sessions after resuming session of user %s: %v", session.UserID, err)
+	}
+	resumed := *session
+	return &resumed, nil
+}
+
+// Revoke удаляет сессию с указанным токеном, после чего ее нельзя возобновить.
+func (s *SessionStore) Revoke(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := hashSessionToken(token)
+	if _, exists := s.sessions[key]; !exists {
+		return ErrSessionNotFound
+	}
+	delete(s.sessions, key)
+	if err := s.save(); err != nil {
+		return fmt.Errorf("failed to save sessions after revocation: %w", err)
+	}
+	return nil
+}
+
+// RevokeUser удаляет все сессии пользователя и возвращает их количество.
+func (s *SessionStore) RevokeUser(userID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revoked := 0
+	for key, session := range s.sessions {
+		if session.UserID == userID {
+			delete(s.sessions, key)
+			revoked++
+		}
+	}
+	if revoked == 0 {
+		return 0, nil
+	}
+	if err := s.save(); err != nil {
+		return revoked, fmt.Errorf("failed to save sessions after revocation: %w", err)
+	}
+	return revoked, nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NameUniqueness задает, какие имена считаются совпадающими.
+type NameUniqueness int
+
+const (
+	// UniqueNormalized - имена совпадают после приведения к NFC и свертки регистра ("Alice" == "alice").
+	UniqueNormalized NameUniqueness = iota
+	// UniqueExact - совпадают только побайтово равные имена.
+	UniqueExact
+	// NotUnique - совпадения разрешены. Для логинов не применяется: они всегда уникальны хотя бы точно.
+	NotUnique
+)
+
+// UniquenessRules - правила уникальности логинов и отображаемых имен.
+type UniquenessRules struct {
+	Username    NameUniqueness
+	DisplayName NameUniqueness
+}
+
+// DefaultUniquenessRules запрещает логины и отображаемые имена, отличающиеся только регистром.
+var DefaultUniquenessRules = UniquenessRules{Username: UniqueNormalized, DisplayName: UniqueNormalized}
+
+// ParseNameUniqueness разбирает значение флага: "normalized", "exact" или "none".
+func ParseNameUniqueness(value string) (NameUniqueness, error) {
+	switch value {
+	case "normalized":
+		return UniqueNormalized, nil
+	case "exact":
+		return UniqueExact, nil
+	case "none":
+		return NotUnique, nil
+	}
+	return 0, fmt.Errorf("unknown uniqueness rule %q (expected normalized, exact or none)", value)
+}
+
+// NormalizeName приводит имя к каноническому виду для сравнения: NFC и свертка регистра.
+func NormalizeName(name string) string {
+	// Свертка регистра может нарушить нормализацию, поэтому NFC применяется и после нее.
+	return norm.NFC.String(cases.Fold().String(norm.NFC.String(name)))
+}
+
+// nameKey возвращает ключ индекса для имени по заданному правилу.
+func nameKey(name string, rule NameUniqueness) string {
+	if rule == UniqueExact {
+		return name
+	}
+	return NormalizeName(name)
+}
+
+// NameCollision описывает группу существующих пользователей, имена которых
+// совпадают по текущим правилам уникальности.
+type NameCollision struct {
+	Field   string // "username" или "display_name"
+	Key     string // Общий ключ после нормализации
+	UserIDs []string
+	Names   []string
+}
+
+// FindNameCollisions проверяет существующих пользователей на совпадения по правилам rules.
+// Используется при миграции на новые правила: такие аккаунты продолжают работать,
+// но новые совпадения с ними уже не допускаются.
+func FindNameCollisions(users []*User, rules UniquenessRules) []NameCollision {
+	var collisions []NameCollision
+	collisions = append(collisions, findFieldCollisions(users, "username", rules.Username, func(u *User) string { return u.Username })...)
+	if rules.DisplayName != NotUnique {
+		collisions = append(collisions, findFieldCollisions(users, "display_name", rules.DisplayName, func(u *User) string { return u.DisplayName })...)
+	}
+	return collisions
+}
+
+func findFieldCollisions(users []*User, field string, rule NameUniqueness, value func(*User) string) []NameCollision {
+	groups := make(map[string][]*User)
+	for _, u := range users {
+		key := nameKey(value(u), rule)
+		groups[key] = append(groups[key], u)
+	}
+
+	var collisions []NameCollision
+	for key, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		c := NameCollision{Field: field, Key: key}
+		for _, u := range group {
+			c.UserIDs = append(c.UserIDs, u.ID)
+			c.Names = append(c.Names, value(u))
+		}
+		collisions = append(collisions, c)
+	}
+	sort.Slice(collisions, func(i, j int) bool { return collisions[i].Key < collisions[j].Key })
+	return collisions
+}
+
+// String форматирует коллизию для отчета в логе.
+func (c NameCollision) String() string {
+	return fmt.Sprintf("%s %q is shared by %d users: %s (IDs: %s)",
+		c.Field, c.Key, len(c.UserIDs), strings.Join(c.Names, ", "), strings.Join(c.UserIDs, ", "))
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+// User представляет пользователя в системе.
+type User struct {
+	ID           string    `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"`
+	DisplayName  string    `json:"display_name"`
+	CreatedAt    time.Time `json:"created_at"`
+	Deactivated  bool      `json:"deactivated,omitempty"` // Вход запрещен, история сохраняется
+
+	Role        Role         `json:"role,omitempty"`        // Пусто у пользователей, созданных до появления ролей (RoleUser)
+	Permissions []Permission `json:"permissions,omitempty"` // Сохраненный набор прав; права роли добавляются к нему всегда
+
+	InviteCode string `json:"invite_code,omitempty"` // Код приглашения, по которому создан аккаунт
+
+	// Не сообщать собеседникам о прочтении их сообщений; отчеты о доставке отправляются всегда.
+	ReadReceiptsDisabled bool `json:"read_receipts_disabled,omitempty"`
+
+	// Двухфакторная аутентификация (TOTP). Секрет подключения хранится в TOTPPendingSecret,
+	// пока пользователь не подтвердит его первым кодом.
+	TOTPEnabled        bool     `json:"totp_enabled,omitempty"`
+	TOTPSecret         string   `json:"totp_secret,omitempty"`
+	TOTPPendingSecret  string   `json:"totp_pending_secret,omitempty"`
+	TOTPLastStep       int64    `json:"totp_last_step,omitempty"`       // Последний принятый шаг; защищает от повторного использования кода
+	RecoveryCodeHashes []string `json:"recovery_code_hashes,omitempty"` // SHA-256 от неиспользованных кодов восстановления
+}
+
+// Ошибки, специфичные для хранилища/аутентификации
+var (
+	ErrUserNotFound     = errors.New("user not found")
+	ErrUsernameTaken    = errors.New("username is already taken")
+	ErrDisplayNameTaken = errors.New("display name is already taken")
+	ErrInvalidPassword  = errors.New("invalid password")
+	// Возвращается при входе вместо ErrUserNotFound и ErrInvalidPassword, чтобы по ответу
+	// нельзя было узнать, существует ли логин.
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrPasswordHashing    = errors.New("failed to hash password")
+	ErrUserDeactivated    = errors.New("account is deactivated")
+
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnabled     = errors.New("two-factor authentication is not enabled")
+	ErrTOTPNotPending     = errors.New("two-factor enrollment has not been started")
+	ErrInvalidTOTPCode    = errors.New("invalid two-factor code")
+)
+
+// UserStore - хранилище пользователей.
+// Реализации возвращают копии, поэтому изменения пользователя нужно сохранять через Update.
+type UserStore interface {
+	// Create добавляет нового пользователя. ErrUsernameTaken или ErrDisplayNameTaken,
+	// если имя уже занято по правилам уникальности хранилища.
+	Create(user *User) error
+	// GetByUsername ищет пользователя по логину с учетом правил уникальности
+	// (например, без учета регистра). ErrUserNotFound, если его нет.
+	GetByUsername(username string) (*User, error)
+	// GetByID ищет пользователя по ID. ErrUserNotFound, если его нет.
+	GetByID(id string) (*User, error)
+	// Update атомарно изменяет пользователя: fn получает копию текущей записи под блокировкой
+	// хранилища, и изменения сохраняются, если fn вернула nil. Ошибка fn возвращается как есть.
+	// Так параллельные изменения разных полей (пароль и настройки) не затирают друг друга.
+	// ID менять нельзя, обращаться из fn к хранилищу тоже. ErrUserNotFound, если пользователя нет.
+	Update(id string, fn func(*User) error) error
+	// Delete удаляет пользователя по ID.
+	Delete(id string) error
+	// List возвращает всех пользователей.
+	List() ([]*User, error)
+}
+
+// clone возвращает копию пользователя, чтобы вызывающий код не менял данные хранилища напрямую.
+func (u *User) clone() *User {
+	c := *u
+	if u.Permissions != nil {
+		c.Permissions = append([]Permission(nil), u.Permissions...)
+	}
+	if u.RecoveryCodeHashes != nil {
+		c.RecoveryCodeHashes = append([]string(nil), u.RecoveryCodeHashes...)
+	}
+	return &c
+}
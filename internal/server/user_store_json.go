@@ -0,0 +1,325 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Журнал изменений лежит рядом с основным файлом: users_data.json.journal.
+	userJournalSuffix = ".journal"
+
+	// После стольких записей в журнале состояние сбрасывается в основной файл, а журнал очищается.
+	userJournalCompactThreshold = 100
+
+	// Сколько предыдущих версий основного файла хранить (users_data.json.bak.1 - самая свежая).
+	userStoreBackups = 5
+
+	userJournalOpPut    = "put"
+	userJournalOpDelete = "delete"
+)
+
+// userJournalEntry - одна строка журнала. Записи содержат полное состояние пользователя,
+// поэтому их повторное применение к уже сохраненному снимку ничего не меняет.
+type userJournalEntry struct {
+	Op   string    `json:"op"`
+	User *User     `json:"user,omitempty"` // Для put
+	ID   string    `json:"id,omitempty"`   // Для delete
+	At   time.Time `json:"at"`
+}
+
+// JSONFileUserStore хранит пользователей в памяти, а на диске - в виде снимка
+// (JSON-объект, где ключ - username) и журнала изменений, который дописывается
+// с fsync на каждое изменение. При запуске журнал воспроизводится поверх снимка.
+type JSONFileUserStore struct {
+	path        string
+	journalPath string
+
+	mu             sync.Mutex // Сериализует изменения вместе с записью журнала
+	mem            *MemoryUserStore
+	journal        *os.File
+	journalSize    int64 // Размер журнала после последней целой записи
+	journalEntries int
+}
+
+// NewJSONFileUserStore загружает пользователей из снимка path и журнала path.journal.
+// Правила rules применяются к новым пользователям и изменениям имен.
+// Поврежденный снимок или журнал - ошибка: сервер не должен стартовать с пустым
+// хранилищем и затирать аккаунты при следующей регистрации.
+func NewJSONFileUserStore(path string, rules UniquenessRules) (*JSONFileUserStore, error) {
+	s := &JSONFileUserStore{
+		path:        path,
+		journalPath: path + userJournalSuffix,
+		mem:         NewMemoryUserStore(rules),
+	}
+
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	replayed, err := s.replayJournal()
+	if err != nil {
+		return nil, err
+	}
+
+	journal, err := os.OpenFile(s.journalPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open user journal '%s': %w", s.journalPath, err)
+	}
+	s.journal = journal
+
+	if replayed {
+		// Переносим воспроизведенные изменения в снимок; заодно отрезается
+		// недописанная при сбое последняя строка журнала.
+		if err := s.compact(); err != nil {
+			journal.Close()
+			return nil, err
+		}
+	}
+
+	users, _ := s.mem.List()
+	log.Printf("Successfully loaded %d users from '%s'.", len(users), path)
+	return s, nil
+}
+
+// loadSnapshot читает основной файл. Отсутствующий файл означает пустое хранилище.
+func (s *JSONFileUserStore) loadSnapshot() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("User data file '%s' not found. A new one will be created on first registration.", s.path)
+			return nil
+		}
+		return fmt.Errorf("failed to read user data file '%s': %w", s.path, err)
+	}
+
+	users := make(map[string]*User)
+	if err := json.Unmarshal(data, &users); err != nil {
+		return fmt.Errorf("user data file '%s' is corrupt (%v); restore it from a backup (%s.bak.N) or fix it manually", s.path, err, s.path)
+	}
+	for username, u := range users {
+		if u == nil || u.ID == "" || u.Username != username {
+			return fmt.Errorf("user data file '%s' is corrupt: invalid entry %q; restore it from a backup (%s.bak.N) or fix it manually", s.path, username, s.path)
+		}
+		// Коллизии, допустимые по старым правилам уникальности, сохраняются как есть.
+		s.mem.put(u)
+	}
+	return nil
+}
+
+// replayJournal применяет записи журнала к загруженному снимку.
+// Возвращает true, если журнал не пуст. Недописанная последняя строка
+// (сбой во время записи) отбрасывается, испорченная строка в середине - ошибка.
+func (s *JSONFileUserStore) replayJournal() (bool, error) {
+	data, err := os.ReadFile(s.journalPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read user journal '%s': %w", s.journalPath, err)
+	}
+	if len(data) == 0 {
+		return false, nil
+	}
+
+	lines := bytes.Split(data, []byte{'\n'})
+	applied := 0
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var entry userJournalEntry
+		err := json.Unmarshal(line, &entry)
+		if err == nil {
+			err = s.applyJournalEntry(entry)
+		}
+		if err != nil {
+			if i == len(lines)-1 {
+				// Последняя строка без перевода строки - запись прервалась при сбое.
+				log.Printf("Warning: Discarding incomplete last entry of user journal '%s': %v", s.journalPath, err)
+				break
+			}
+			return false, fmt.Errorf("user journal '%s' is corrupt at line %d: %v", s.journalPath, i+1, err)
+		}
+		applied++
+	}
+
+	log.Printf("Replayed %d entries from user journal '%s'.", applied, s.journalPath)
+	return true, nil
+}
+
+// applyJournalEntry применяет одну запись журнала к хранилищу в памяти.
+func (s *JSONFileUserStore) applyJournalEntry(entry userJournalEntry) error {
+	switch entry.Op {
+	case userJournalOpPut:
+		if entry.User == nil || entry.User.ID == "" {
+			return errors.New("put entry without user")
+		}
+		s.mem.put(entry.User)
+	case userJournalOpDelete:
+		if entry.ID == "" {
+			return errors.New("delete entry without id")
+		}
+		s.mem.remove(entry.ID)
+	default:
+		return fmt.Errorf("unknown journal operation %q", entry.Op)
+	}
+	return nil
+}
+
+// appendJournal дописывает запись в журнал и дожидается ее записи на диск.
+// Вызывается при захваченном s.mu.
+func (s *JSONFileUserStore) appendJournal(entry userJournalEntry) error {
+	entry.At = time.Now().UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	if _, err := s.journal.Write(line); err != nil {
+		s.journal.Truncate(s.journalSize) // Убираем частично записанную строку
+		return fmt.Errorf("failed to write user journal '%s': %w", s.journalPath, err)
+	}
+	if err := s.journal.Sync(); err != nil {
+		s.journal.Truncate(s.journalSize)
+		return fmt.Errorf("failed to sync user journal '%s': %w", s.journalPath, err)
+	}
+	s.journalSize += int64(len(line))
+	s.journalEntries++
+
+	if s.journalEntries >= userJournalCompactThreshold {
+		if err := s.compact(); err != nil {
+			// Изменение уже надежно сохранено в журнале, снимок обновится при следующей попытке.
+			log.Printf("Warning: Failed to compact user journal: %v", err)
+		}
+	}
+	return nil
+}
+
+// compact сохраняет текущее состояние в основной файл и очищает журнал.
+// Вызывается при захваченном s.mu (или до того, как хранилище стало доступно).
+func (s *JSONFileUserStore) compact() error {
+	data, err := json.MarshalIndent(s.mem.snapshot(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal user store: %w", err)
+	}
+	if err := s.rotateBackups(); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data, 0600); err != nil {
+		return err
+	}
+
+	// Крах между заменой снимка и очисткой журнала безопасен: записи журнала идемпотентны.
+	if err := s.journal.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate user journal '%s': %w", s.journalPath, err)
+	}
+	if err := s.journal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync user journal '%s': %w", s.journalPath, err)
+	}
+	s.journalSize = 0
+	s.journalEntries = 0
+	return nil
+}
+
+// rotateBackups сдвигает резервные копии (bak.1 -> bak.2 ...) и копирует текущий
+// снимок в bak.1. Снимок копируется, а не переименовывается, чтобы основной файл
+// существовал в любой момент.
+func (s *JSONFileUserStore) rotateBackups() error {
+	current, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // Копировать нечего
+		}
+		return fmt.Errorf("failed to read '%s' for backup: %w", s.path, err)
+	}
+
+	for i := userStoreBackups - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.bak.%d", s.path, i)
+		to := fmt.Sprintf("%s.bak.%d", s.path, i+1)
+		if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate backup '%s': %w", from, err)
+		}
+	}
+	return writeFileAtomic(s.path+".bak.1", current, 0600)
+}
+
+// Close закрывает файл журнала.
+func (s *JSONFileUserStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.journal.Close()
+}
+
+func (s *JSONFileUserStore) Create(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.mem.Create(user); err != nil {
+		return err
+	}
+	if err := s.appendJournal(userJournalEntry{Op: userJournalOpPut, User: user}); err != nil {
+		s.mem.remove(user.ID) // Откатываем добавление в память
+		return err
+	}
+	return nil
+}
+
+func (s *JSONFileUserStore) GetByUsername(username string) (*User, error) {
+	return s.mem.GetByUsername(username)
+}
+
+func (s *JSONFileUserStore) GetByID(id string) (*User, error) {
+	return s.mem.GetByID(id)
+}
+
+func (s *JSONFileUserStore) Update(id string, fn func(*User) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, err := s.mem.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if err := s.mem.Update(id, fn); err != nil {
+		return err
+	}
+	// s.mu сериализует изменения, поэтому прочитанная запись - результат именно этого Update
+	user, err := s.mem.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if err := s.appendJournal(userJournalEntry{Op: userJournalOpPut, User: user}); err != nil {
+		s.mem.put(previous)
+		return err
+	}
+	return nil
+}
+
+func (s *JSONFileUserStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, err := s.mem.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if err := s.mem.Delete(id); err != nil {
+		return err
+	}
+	if err := s.appendJournal(userJournalEntry{Op: userJournalOpDelete, ID: id}); err != nil {
+		s.mem.put(previous)
+		return err
+	}
+	return nil
+}
+
+func (s *JSONFileUserStore) List() ([]*User, error) {
+	return s.mem.List()
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"sync"
+)
+
+// MemoryUserStore хранит пользователей только в памяти. Используется в тестах
+// и как основа для файловых реализаций.
+type MemoryUserStore struct {
+	mu    sync.RWMutex
+	rules UniquenessRules
+
+	byID map[string]*User
+	// Вторичные индексы: ключ имени (см. nameKey) -> ID пользователей.
+	// Больше одного ID бывает только у коллизий, существовавших до смены правил.
+	byUsername    map[string][]string
+	byDisplayName map[string][]string
+}
+
+// NewMemoryUserStore создает пустое хранилище в памяти с заданными правилами уникальности.
+func NewMemoryUserStore(rules UniquenessRules) *MemoryUserStore {
+	if rules.Username == NotUnique {
+		rules.Username = UniqueExact // Логин - ключ для входа, совпадать он не может
+	}
+	return &MemoryUserStore{
+		rules:         rules,
+		byID:          make(map[string]*User),
+		byUsername:    make(map[string][]string),
+		byDisplayName: make(map[string][]string),
+	}
+}
+
+func (s *MemoryUserStore) Create(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.byID[user.ID]; exists {
+		return ErrUsernameTaken
+	}
+	if err := s.checkUniqueLocked(user, nil); err != nil {
+		return err
+	}
+	s.insertLocked(user.clone())
+	return nil
+}
+
+func (s *MemoryUserStore) GetByUsername(username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := s.byUsername[nameKey(username, s.rules.Username)]
+	if len(ids) == 1 {
+		return s.byID[ids[0]].clone(), nil
+	}
+	// Старые коллизии ("Alice" и "alice") различаются только точным совпадением.
+	for _, id := range ids {
+		if u := s.byID[id]; u.Username == username {
+			return u.clone(), nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (s *MemoryUserStore) GetByID(id string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, exists := s.byID[id]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	return user.clone(), nil
+}
+
+func (s *MemoryUserStore) Update(id string, fn func(*User) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, exists := s.byID[id]
+	if !exists {
+		return ErrUserNotFound
+	}
+	user := existing.clone()
+	if err := fn(user); err != nil {
+		return err
+	}
+	user.ID = id
+	if err := s.checkUniqueLocked(user, existing); err != nil {
+		return err
+	}
+	s.removeLocked(existing)
+	s.insertLocked(user)
+	return nil
+}
+
+func (s *MemoryUserStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, exists := s.byID[id]
+	if !exists {
+		return ErrUserNotFound
+	}
+	s.removeLocked(existing)
+	return nil
+}
+
+func (s *MemoryUserStore) List() ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]*User, 0, len(s.byID))
+	for _, u := range s.byID {
+		users = append(users, u.clone())
+	}
+	return users, nil
+}
+
+// checkUniqueLocked проверяет, что логин и отображаемое имя не заняты другим пользователем.
+// При обновлении existing - текущая запись: имя, ключ которого не меняется, не проверяется,
+// чтобы старые коллизии, существовавшие до смены правил, не мешали менять остальные поля.
+func (s *MemoryUserStore) checkUniqueLocked(user, existing *User) error {
+	usernameKey := nameKey(user.Username, s.rules.Username)
+	if existing == nil || usernameKey != nameKey(existing.Username, s.rules.Username) {
+		for _, id := range s.byUsername[usernameKey] {
+			if id != user.ID {
+				return ErrUsernameTaken
+			}
+		}
+	}
+	displayKey := nameKey(user.DisplayName, s.rules.DisplayName)
+	if s.rules.DisplayName != NotUnique && (existing == nil || displayKey != nameKey(existing.DisplayName, s.rules.DisplayName)) {
+		for _, id := range s.byDisplayName[displayKey] {
+			if id != user.ID {
+				return ErrDisplayNameTaken
+			}
+		}
+	}
+	return nil
+}
+
+// insertLocked добавляет пользователя в основную карту и индексы.
+func (s *MemoryUserStore) insertLocked(user *User) {
+	s.byID[user.ID] = user
+	usernameKey := nameKey(user.Username, s.rules.Username)
+	s.byUsername[usernameKey] = append(s.byUsername[usernameKey], user.ID)
+	displayKey := nameKey(user.DisplayName, s.rules.DisplayName)
+	s.byDisplayName[displayKey] = append(s.byDisplayName[displayKey], user.ID)
+}
+
+// removeLocked удаляет пользователя из основной карты и индексов.
+func (s *MemoryUserStore) removeLocked(user *User) {
+	delete(s.byID, user.ID)
+	removeIndexedID(s.byUsername, nameKey(user.Username, s.rules.Username), user.ID)
+	removeIndexedID(s.byDisplayName, nameKey(user.DisplayName, s.rules.DisplayName), user.ID)
+}
+
+func removeIndexedID(index map[string][]string, key, id string) {
+	ids := index[key]
+	for i, existing := range ids {
+		if existing == id {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(index, key)
+	} else {
+		index[key] = ids
+	}
+}
+
+// put добавляет или заменяет пользователя без проверок уникальности.
+// Используется при загрузке снимка и воспроизведении журнала, где уже
+// существующие коллизии имен нужно сохранить, а не отвергнуть.
+func (s *MemoryUserStore) put(user *User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, exists := s.byID[user.ID]; exists {
+		s.removeLocked(existing)
+	}
+	// Точный дубль логина вытесняется: в снимке логин - ключ, двух таких быть не может.
+	for _, id := range s.byUsername[nameKey(user.Username, s.rules.Username)] {
+		if other := s.byID[id]; other.Username == user.Username {
+			s.removeLocked(other)
+			break
+		}
+	}
+	s.insertLocked(user.clone())
+}
+
+// remove удаляет пользователя по ID, если он есть. Используется при воспроизведении журнала.
+func (s *MemoryUserStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, exists := s.byID[id]; exists {
+		s.removeLocked(existing)
+	}
+}
+
+// snapshot возвращает содержимое хранилища в формате файла users_data.json (ключ - username).
+func (s *MemoryUserStore) snapshot() map[string]*User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make(map[string]*User, len(s.byID))
+	for _, u := range s.byID {
+		users[u.Username] = u.clone()
+	}
+	return users
+}
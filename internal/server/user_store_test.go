@@ -0,0 +1,424 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// userStoreFactory создает хранилище с правилами rules, в котором уже есть пользователи seed.
+// seed добавляется так же, как при загрузке с диска: без проверки уникальности, поэтому в нем
+// могут быть коллизии, существовавшие до смены правил.
+type userStoreFactory func(t *testing.T, rules UniquenessRules, seed ...*User) UserStore
+
+func newMemoryStoreForTest(t *testing.T, rules UniquenessRules, seed ...*User) UserStore {
+	s := NewMemoryUserStore(rules)
+	for _, u := range seed {
+		s.put(u)
+	}
+	return s
+}
+
+func newJSONStoreForTest(t *testing.T, rules UniquenessRules, seed ...*User) UserStore {
+	path := filepath.Join(t.TempDir(), "users_data.json")
+	if len(seed) > 0 {
+		writeUserSnapshot(t, path, seed...)
+	}
+	s, err := NewJSONFileUserStore(path, rules)
+	if err != nil {
+		t.Fatalf("NewJSONFileUserStore: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// writeUserSnapshot записывает снимок в формате users_data.json (ключ - username).
+func writeUserSnapshot(t *testing.T, path string, users ...*User) {
+	t.Helper()
+	snapshot := make(map[string]*User, len(users))
+	for _, u := range users {
+		snapshot[u.Username] = u
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatalf("marshal snapshot: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("write snapshot: %v", err)
+	}
+}
+
+func testUser(id, username, displayName string) *User {
+	return &User{ID: id, Username: username, DisplayName: displayName, PasswordHash: "hash-" + id, CreatedAt: time.Unix(1700000000, 0).UTC()}
+}
+
+func TestUserStoreContract(t *testing.T) {
+	stores := []struct {
+		name string
+		new  userStoreFactory
+	}{
+		{name: "memory", new: newMemoryStoreForTest},
+		{name: "json", new: newJSONStoreForTest},
+	}
+	for _, store := range stores {
+		t.Run(store.name, func(t *testing.T) { testUserStoreContract(t, store.new) })
+	}
+}
+
+func testUserStoreContract(t *testing.T, newStore userStoreFactory) {
+	t.Run("create_and_get", func(t *testing.T) {
+		s := newStore(t, DefaultUniquenessRules)
+		if err := s.Create(testUser("1", "Alice", "Alice A.")); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		byID, err := s.GetByID("1")
+		if err != nil || byID.Username != "Alice" {
+			t.Fatalf("GetByID = %+v, %v", byID, err)
+		}
+		// По умолчанию логин ищется без учета регистра
+		byName, err := s.GetByUsername("alice")
+		if err != nil || byName.ID != "1" {
+			t.Fatalf("GetByUsername(alice) = %+v, %v", byName, err)
+		}
+		if _, err := s.GetByID("missing"); !errors.Is(err, ErrUserNotFound) {
+			t.Fatalf("GetByID(missing) error = %v, want ErrUserNotFound", err)
+		}
+		if _, err := s.GetByUsername("bob"); !errors.Is(err, ErrUserNotFound) {
+			t.Fatalf("GetByUsername(bob) error = %v, want ErrUserNotFound", err)
+		}
+	})
+
+	t.Run("returns_copies", func(t *testing.T) {
+		s := newStore(t, DefaultUniquenessRules)
+		if err := s.Create(testUser("1", "alice", "Alice")); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		u, _ := s.GetByID("1")
+		u.DisplayName = "changed"
+		u.Permissions = append(u.Permissions, PermKickUsers)
+		again, _ := s.GetByID("1")
+		if again.DisplayName != "Alice" || len(again.Permissions) != 0 {
+			t.Fatalf("store changed without Update: %+v", again)
+		}
+	})
+
+	t.Run("uniqueness", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			rules   UniquenessRules
+			second  *User
+			wantErr error
+		}{
+			{name: "same_id", rules: DefaultUniquenessRules, second: testUser("1", "bob", "Bob"), wantErr: ErrUsernameTaken},
+			{name: "username_case", rules: DefaultUniquenessRules, second: testUser("2", "ALICE", "Bob"), wantErr: ErrUsernameTaken},
+			{name: "username_case_exact", rules: UniquenessRules{Username: UniqueExact, DisplayName: UniqueExact}, second: testUser("2", "ALICE", "Bob")},
+			{name: "username_exact", rules: UniquenessRules{Username: UniqueExact, DisplayName: UniqueExact}, second: testUser("2", "alice", "Bob"), wantErr: ErrUsernameTaken},
+			{name: "display_name_case", rules: DefaultUniquenessRules, second: testUser("2", "bob", "ALICE"), wantErr: ErrDisplayNameTaken},
+			{name: "display_name_not_unique", rules: UniquenessRules{Username: UniqueNormalized, DisplayName: NotUnique}, second: testUser("2", "bob", "Alice")},
+			// Для логинов NotUnique не применяется: хранилище проверяет хотя бы точное совпадение
+			{name: "username_not_unique", rules: UniquenessRules{Username: NotUnique, DisplayName: NotUnique}, second: testUser("2", "alice", "Bob"), wantErr: ErrUsernameTaken},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				s := newStore(t, tt.rules)
+				if err := s.Create(testUser("1", "alice", "Alice")); err != nil {
+					t.Fatalf("Create first: %v", err)
+				}
+				err := s.Create(tt.second)
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Create second error = %v, want %v", err, tt.wantErr)
+				}
+				users, _ := s.List()
+				want := 2
+				if tt.wantErr != nil {
+					want = 1
+				}
+				if len(users) != want {
+					t.Fatalf("List returned %d users, want %d", len(users), want)
+				}
+			})
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		s := newStore(t, DefaultUniquenessRules)
+		for _, u := range []*User{testUser("1", "alice", "Alice"), testUser("2", "bob", "Bob")} {
+			if err := s.Create(u); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+		}
+
+		u, _ := s.GetByID("1")
+		u.Username = "Alicia"
+		u.TOTPEnabled = true
+		if err := setUser(s, u); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if _, err := s.GetByUsername("alice"); !errors.Is(err, ErrUserNotFound) {
+			t.Fatalf("old username still found: %v", err)
+		}
+		if got, err := s.GetByUsername("alicia"); err != nil || !got.TOTPEnabled {
+			t.Fatalf("GetByUsername(alicia) = %+v, %v", got, err)
+		}
+		// Старое имя освободилось
+		if err := s.Create(testUser("3", "alice", "Someone")); err != nil {
+			t.Fatalf("Create with freed username: %v", err)
+		}
+
+		u.DisplayName = "BOB"
+		if err := setUser(s, u); !errors.Is(err, ErrDisplayNameTaken) {
+			t.Fatalf("Update to taken display name error = %v, want ErrDisplayNameTaken", err)
+		}
+		u.DisplayName = "Alice"
+		u.Username = "Bob"
+		if err := setUser(s, u); !errors.Is(err, ErrUsernameTaken) {
+			t.Fatalf("Update to taken username error = %v, want ErrUsernameTaken", err)
+		}
+		if got, _ := s.GetByID("1"); got.Username != "Alicia" {
+			t.Fatalf("failed Update changed the user: %+v", got)
+		}
+		if err := setUser(s, testUser("missing", "carol", "Carol")); !errors.Is(err, ErrUserNotFound) {
+			t.Fatalf("Update(missing) error = %v, want ErrUserNotFound", err)
+		}
+	})
+
+	t.Run("update_legacy_collision", func(t *testing.T) {
+		// "Alice" и "alice" созданы по правилам exact, затем правила стали normalized
+		s := newStore(t, DefaultUniquenessRules, testUser("1", "Alice", "Alice"), testUser("2", "alice", "alice"), testUser("3", "carol", "Carol"))
+		for _, username := range []string{"Alice", "alice"} {
+			u, err := s.GetByUsername(username)
+			if err != nil {
+				t.Fatalf("GetByUsername(%s): %v", username, err)
+			}
+			u.PasswordHash = "new-hash"
+			u.Deactivated = true
+			if err := setUser(s, u); err != nil {
+				t.Fatalf("Update of %s without renaming: %v", username, err)
+			}
+		}
+		// Смена регистра не меняет ключ имени, поэтому коллизия не мешает
+		u, _ := s.GetByID("2")
+		u.DisplayName = "ALICE"
+		if err := setUser(s, u); err != nil {
+			t.Fatalf("Update changing only the case of a colliding name: %v", err)
+		}
+		u.DisplayName = "CAROL"
+		if err := setUser(s, u); !errors.Is(err, ErrDisplayNameTaken) {
+			t.Fatalf("Update to a name taken by another user error = %v, want ErrDisplayNameTaken", err)
+		}
+	})
+
+	t.Run("update_fn", func(t *testing.T) {
+		s := newStore(t, DefaultUniquenessRules)
+		if err := s.Create(testUser("1", "alice", "Alice")); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		errStop := errors.New("stop")
+		err := s.Update("1", func(u *User) error {
+			u.DisplayName = "changed"
+			return errStop
+		})
+		if !errors.Is(err, errStop) {
+			t.Fatalf("Update error = %v, want the error returned by fn", err)
+		}
+		if got, _ := s.GetByID("1"); got.DisplayName != "Alice" {
+			t.Fatalf("Update saved changes after fn failed: %+v", got)
+		}
+		// ID записи fn поменять не может
+		if err := s.Update("1", func(u *User) error { u.ID = "2"; return nil }); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if got := userIDs(t, s); got != "1" {
+			t.Fatalf("List after changing ID in fn = %s, want 1", got)
+		}
+	})
+
+	t.Run("concurrent_updates", func(t *testing.T) {
+		// Изменения разных полей, начатые одновременно, не затирают друг друга
+		s := newStore(t, DefaultUniquenessRules)
+		if err := s.Create(testUser("1", "alice", "Alice")); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		const n = 50
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				s.Update("1", func(u *User) error { u.TOTPLastStep++; return nil })
+			}()
+			go func() {
+				defer wg.Done()
+				s.Update("1", func(u *User) error {
+					u.RecoveryCodeHashes = append(u.RecoveryCodeHashes, "h")
+					return nil
+				})
+			}()
+		}
+		wg.Wait()
+		got, _ := s.GetByID("1")
+		if got.TOTPLastStep != n || len(got.RecoveryCodeHashes) != n {
+			t.Fatalf("after %d concurrent updates of each field: step %d, %d hashes", n, got.TOTPLastStep, len(got.RecoveryCodeHashes))
+		}
+	})
+
+	t.Run("delete_and_list", func(t *testing.T) {
+		s := newStore(t, DefaultUniquenessRules)
+		for _, u := range []*User{testUser("1", "alice", "Alice"), testUser("2", "bob", "Bob"), testUser("3", "carol", "Carol")} {
+			if err := s.Create(u); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+		}
+		if err := s.Delete("2"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if err := s.Delete("2"); !errors.Is(err, ErrUserNotFound) {
+			t.Fatalf("second Delete error = %v, want ErrUserNotFound", err)
+		}
+		if _, err := s.GetByUsername("bob"); !errors.Is(err, ErrUserNotFound) {
+			t.Fatalf("deleted user still found: %v", err)
+		}
+		if got := userIDs(t, s); got != "1,3" {
+			t.Fatalf("List = %s, want 1,3", got)
+		}
+		if err := s.Create(testUser("4", "Bob", "Bob")); err != nil {
+			t.Fatalf("Create with name of deleted user: %v", err)
+		}
+	})
+}
+
+// setUser заменяет запись пользователя с ID u.ID копией u.
+func setUser(s UserStore, u *User) error {
+	return s.Update(u.ID, func(cur *User) error {
+		*cur = *u.clone()
+		return nil
+	})
+}
+
+// userIDs возвращает отсортированные ID всех пользователей хранилища через запятую.
+func userIDs(t *testing.T, s UserStore) string {
+	t.Helper()
+	users, err := s.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	ids := make([]string, 0, len(users))
+	for _, u := range users {
+		ids = append(ids, u.ID)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func TestJSONFileUserStoreReplaysJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users_data.json")
+	s, err := NewJSONFileUserStore(path, DefaultUniquenessRules)
+	if err != nil {
+		t.Fatalf("NewJSONFileUserStore: %v", err)
+	}
+	for _, u := range []*User{testUser("1", "alice", "Alice"), testUser("2", "bob", "Bob"), testUser("3", "carol", "Carol")} {
+		if err := s.Create(u); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	u, _ := s.GetByID("1")
+	u.Role = RoleAdmin
+	if err := setUser(s, u); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := s.Delete("2"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	s.Close()
+
+	// Изменения пока только в журнале: снимок создается при сжатии журнала
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("snapshot exists before compaction: %v", err)
+	}
+	// Сбой во время записи оставляет недописанную последнюю строку
+	journal, err := os.OpenFile(path+userJournalSuffix, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	journal.WriteString(`{"op":"put","user":{"id":"4","username":"da`)
+	journal.Close()
+
+	reopened, err := NewJSONFileUserStore(path, DefaultUniquenessRules)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	if got := userIDs(t, reopened); got != "1,3" {
+		t.Fatalf("users after replay = %s, want 1,3", got)
+	}
+	if got, _ := reopened.GetByID("1"); got.Role != RoleAdmin {
+		t.Fatalf("replayed user role = %q, want %q", got.Role, RoleAdmin)
+	}
+
+	// Воспроизведенный журнал перенесен в снимок и очищен
+	if info, err := os.Stat(path + userJournalSuffix); err != nil || info.Size() != 0 {
+		t.Fatalf("journal after replay: %v, %v", info, err)
+	}
+	snapshot, err := NewJSONFileUserStore(path, DefaultUniquenessRules)
+	if err != nil {
+		t.Fatalf("reopen from snapshot: %v", err)
+	}
+	defer snapshot.Close()
+	if got := userIDs(t, snapshot); got != "1,3" {
+		t.Fatalf("users from snapshot = %s, want 1,3", got)
+	}
+}
+
+func TestJSONFileUserStoreRefusesCorruptFiles(t *testing.T) {
+	validEntry := `{"op":"put","user":{"id":"1","username":"alice","display_name":"Alice"},"at":"2024-01-01T00:00:00Z"}`
+	tests := []struct {
+		name     string
+		snapshot string
+		journal  string
+		wantErr  string
+	}{
+		{name: "snapshot_not_json", snapshot: `{"alice": {"id": "1", "username": "alice"`, wantErr: "is corrupt"},
+		{name: "snapshot_not_object", snapshot: `[]`, wantErr: "is corrupt"},
+		{name: "snapshot_key_mismatch", snapshot: `{"alice": {"id": "1", "username": "bob"}}`, wantErr: "invalid entry"},
+		{name: "snapshot_entry_without_id", snapshot: `{"alice": {"username": "alice"}}`, wantErr: "invalid entry"},
+		{name: "snapshot_null_entry", snapshot: `{"alice": null}`, wantErr: "invalid entry"},
+		{name: "journal_corrupt_line", journal: "not json\n" + validEntry + "\n", wantErr: "corrupt at line 1"},
+		{name: "journal_unknown_op", journal: `{"op":"drop","id":"1"}` + "\n" + validEntry + "\n", wantErr: "corrupt at line 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users_data.json")
+			if tt.snapshot != "" {
+				if err := os.WriteFile(path, []byte(tt.snapshot), 0600); err != nil {
+					t.Fatalf("write snapshot: %v", err)
+				}
+			}
+			if tt.journal != "" {
+				if err := os.WriteFile(path+userJournalSuffix, []byte(tt.journal), 0600); err != nil {
+					t.Fatalf("write journal: %v", err)
+				}
+			}
+
+			s, err := NewJSONFileUserStore(path, DefaultUniquenessRules)
+			if err == nil {
+				s.Close()
+				t.Fatal("NewJSONFileUserStore succeeded on corrupt data")
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to mention %q", err, tt.wantErr)
+			}
+			// Поврежденный снимок не перезаписывается
+			if tt.snapshot != "" {
+				if data, _ := os.ReadFile(path); string(data) != tt.snapshot {
+					t.Fatalf("snapshot was modified: %s", data)
+				}
+			}
+		})
+	}
+}